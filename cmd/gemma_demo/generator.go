@@ -4,9 +4,11 @@ import (
 	"flag"
 	hfd "github.com/gomlx/gemma/download/huggingface"
 	"github.com/gomlx/gemma/samplers"
+	"github.com/gomlx/gemma/transformers"
 	"github.com/gomlx/gomlx/backends"
 	_ "github.com/gomlx/gomlx/backends/xla"
 	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gopjrt/dtypes"
 	"github.com/janpfeifer/must"
 	"os"
 	"path"
@@ -16,10 +18,29 @@ var (
 	flagDataDir            = flag.String("data", "~/work/gemma", "Directory to cache downloaded and generated dataset files.")
 	flagModelID            = flag.String("model", "google/gemma-2-2b-it", "HuggingFace Gemma model id")
 	flagMaxGeneratedTokens = flag.Int("max_tokens", 1024, "Maximum number of tokens to generate.")
+	flagCacheLength        = flag.Int("cache_length", 2048, "Length of the attention cache: it limits the prompt plus generated tokens.")
+	flagCacheInt8          = flag.Bool("cache_int8", false, "Quantize the attention cache to int8, using ~half the memory.")
+	flagWeightsInt8        = flag.Bool("weights_int8", false, "Quantize the model weights to int8, using ~half the memory.")
+	flagWeightsQ4          = flag.Int("weights_q4", 0, "If > 0, quantize the model linear layers to 4 bits, with groups of the given size "+
+		"(e.g.: 32). It can be combined with -weights_int8, which then quantizes the embedding table.")
 )
 
 func BuildSampler() *samplers.Sampler {
 	ctx := context.New()
 	vocab := must.M1(hfd.Download(ctx, *flagModelID, os.Getenv("HF_TOKEN"), path.Join(*flagDataDir, "huggingface")))
-	return must.M1(samplers.New(backends.New(), ctx, vocab, *flagMaxGeneratedTokens))
+	if *flagWeightsQ4 > 0 || *flagWeightsInt8 {
+		config := must.M1(transformers.NewConfigFromContext(ctx.In("model")))
+		if *flagWeightsQ4 > 0 {
+			must.M(transformers.QuantizeWeightsQ4(ctx.In("model"), config, *flagWeightsQ4, false))
+		}
+		if *flagWeightsInt8 {
+			must.M(transformers.QuantizeWeightsInt8(ctx.In("model"), config))
+		}
+	}
+	sampler := must.M1(samplers.New(backends.New(), ctx, vocab, *flagMaxGeneratedTokens))
+	must.M(sampler.SetCacheLength(*flagCacheLength))
+	if *flagCacheInt8 {
+		must.M(sampler.SetCacheDType(dtypes.Int8))
+	}
+	return sampler
 }
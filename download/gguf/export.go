@@ -0,0 +1,337 @@
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/gomlx/gemma/sentencepiece"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/data"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// exportTypes maps the model dtypes supported by Export to the GGML type of the weights and the llama.cpp
+// "general.file_type" of the file.
+var exportTypes = map[dtypes.DType]struct {
+	ggmlType GGMLType
+	fileType uint32
+}{
+	dtypes.Float32:  {GGMLTypeF32, 0},
+	dtypes.Float16:  {GGMLTypeF16, 1},
+	dtypes.BFloat16: {GGMLTypeBF16, 32},
+}
+
+// metadataEntry is a metadata key and value, written in order. See writeFile for the supported value types.
+type metadataEntry struct {
+	key   string
+	value any
+}
+
+// Export writes the Gemma model in ctx (under the "model" scope) and its tokenizer to filePath in the GGUF format,
+// with the metadata (architecture, number of heads, context length, etc.) llama.cpp based tools need to run it.
+//
+// The model must be in the HuggingFace layout: convert models loaded from Kaggle checkpoints first with
+// transformers.ConvertToHuggingFaceLayout. Weights are written in the model dtype, and quantized weights (see
+// transformers.QuantizeWeightsInt8 and transformers.QuantizeWeightsQ4) are dequantized: use llama.cpp's tools to
+// quantize the file. The normalization scales are written in float32, with 1 added, as llama.cpp expects.
+//
+// LoRA adapters are not exported: merge them first with transformers.MergeLoRA.
+func Export(ctx *context.Context, vocab *sentencepiece.Tokenizer, filePath string) error {
+	filePath = data.ReplaceTildeInDir(filePath)
+	modelCtx := ctx.In("model")
+	config, err := transformers.NewConfigFromContext(modelCtx)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", filePath)
+	}
+	if !config.HuggingFaceVersion {
+		return errors.Errorf("Export(%q): model is not in the HuggingFace layout, convert it first with "+
+			"transformers.ConvertToHuggingFaceLayout", filePath)
+	}
+	exportType, found := exportTypes[config.DType]
+	if !found {
+		return errors.Errorf("Export(%q): model dtype %s not supported, only bfloat16, float16 and float32",
+			filePath, config.DType)
+	}
+	metadata, err := modelMetadata(config, exportType.fileType)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", filePath)
+	}
+	if vocab.Info.VocabularySize != config.VocabularySize {
+		return errors.Errorf("Export(%q): tokenizer has %d tokens, but the model vocabulary size is %d",
+			filePath, vocab.Info.VocabularySize, config.VocabularySize)
+	}
+	vocabMetadata, err := tokenizerMetadata(vocab)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", filePath)
+	}
+	metadata = append(metadata, vocabMetadata...)
+
+	modelVariables, err := transformers.ListModelVariables(modelCtx)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", filePath)
+	}
+	var infos []*TensorInfo
+	variables := make(map[*TensorInfo][]string)
+	for _, modelVar := range modelVariables {
+		scopeAndName := append(slices.Clone(modelVar.Scope), modelVar.Name)
+		ggufName := convertScopeAndNameToGGUF(scopeAndName)
+		if ggufName == "" {
+			return errors.Errorf("Export(%q): variable %q has no corresponding GGUF tensor", filePath, modelVar.Path())
+		}
+		info := &TensorInfo{Name: ggufName, Type: exportType.ggmlType}
+		if modelVar.Name == "scale" {
+			info.Type = GGMLTypeF32
+		}
+		infos = append(infos, info)
+		variables[info] = scopeAndName
+	}
+	slices.SortFunc(infos, func(a, b *TensorInfo) int { return strings.Compare(a.Name, b.Name) })
+
+	// The dimensions of the quantized weights are only known once dequantized, so they are dequantized twice:
+	// once here and once when writing them, to avoid holding all the dequantized weights in memory.
+	tensorValue := func(info *TensorInfo) (*tensors.Tensor, error) {
+		scopeAndName := variables[info]
+		name, scope := scopeAndName[len(scopeAndName)-1], scopeAndName[:len(scopeAndName)-1]
+		scopedCtx := modelCtx
+		for _, p := range scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		dtype := config.DType
+		if info.Type == GGMLTypeF32 {
+			dtype = dtypes.Float32
+		}
+		value, err := transformers.DequantizeWeights(scopedCtx, name, dtype)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "tensor %q", info.Name)
+		}
+		return value, nil
+	}
+	for _, info := range infos {
+		value, err := tensorValue(info)
+		if err != nil {
+			return errors.WithMessagef(err, "Export(%q)", filePath)
+		}
+		info.Dimensions = value.Shape().Dimensions
+	}
+	err = writeFile(filePath, metadata, infos, func(info *TensorInfo) ([]byte, error) {
+		value, err := tensorValue(info)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(info.Name, "norm.weight") {
+			scales := tensors.CopyFlatData[float32](value)
+			buf := make([]byte, 4*len(scales))
+			for ii, scale := range scales {
+				binary.LittleEndian.PutUint32(buf[4*ii:], math.Float32bits(scale+1))
+			}
+			return buf, nil
+		}
+		var buf []byte
+		value.ConstBytes(func(b []byte) { buf = slices.Clone(b) })
+		return buf, nil
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", filePath)
+	}
+	return nil
+}
+
+// modelMetadata returns the general and architecture metadata of the model, as used by llama.cpp.
+func modelMetadata(config *transformers.Config, fileType uint32) ([]metadataEntry, error) {
+	architecture := "gemma2"
+	if config.Type == transformers.Gemma_2B || config.Type == transformers.Gemma_7B {
+		architecture = "gemma"
+	}
+	if config.QueryPreAttentionNorm != transformers.QueryNormTypeByOneOverSqrtHeadDim &&
+		config.QueryPreAttentionNorm != transformers.QueryNormTypeByOneOverSqrtEmbedDimDivNumHeads {
+		return nil, errors.Errorf("query pre-attention normalization %s not supported by llama.cpp",
+			config.QueryPreAttentionNorm)
+	}
+	metadata := []metadataEntry{
+		{"general.architecture", architecture},
+		{"general.name", config.Type.String()},
+		{"general.file_type", fileType},
+		{architecture + ".context_length", uint32(config.MaxSequenceLength)},
+		{architecture + ".embedding_length", uint32(config.EmbedDim)},
+		{architecture + ".block_count", uint32(config.NumLayers)},
+		{architecture + ".feed_forward_length", uint32(config.HiddenDim)},
+		{architecture + ".attention.head_count", uint32(config.NumHeads)},
+		{architecture + ".attention.head_count_kv", uint32(config.NumKVHeads)},
+		{architecture + ".attention.key_length", uint32(config.HeadDim)},
+		{architecture + ".attention.value_length", uint32(config.HeadDim)},
+		{architecture + ".attention.layer_norm_rms_epsilon", float32(transformers.RMSNormEpsilon)},
+	}
+	if architecture == "gemma2" {
+		metadata = append(metadata,
+			metadataEntry{architecture + ".attention.sliding_window", uint32(config.SlidingWindowSize)},
+			metadataEntry{architecture + ".attn_logit_softcapping", float32(config.AttentionLogitsSoftCap)},
+			metadataEntry{architecture + ".final_logit_softcapping", float32(config.FinalLogitSoftCap)})
+	}
+	return metadata, nil
+}
+
+// convertScopeAndNameToGGUF converts the scope and name of a model variable in the HuggingFace layout to the name
+// of the GGUF tensor. It is the inverse of convertGGUFNameToScopeAndName, and it returns "" for unknown variables.
+func convertScopeAndNameToGGUF(scopeAndName []string) string {
+	switch {
+	case slices.Equal(scopeAndName, []string{"embedder", "input_embedding"}):
+		return "token_embd.weight"
+	case slices.Equal(scopeAndName, []string{"final_norm", "scale"}):
+		return "output_norm.weight"
+	case len(scopeAndName) < 2 || !strings.HasPrefix(scopeAndName[0], "layer_"):
+		return ""
+	}
+	layerNumber, err := strconv.Atoi(strings.TrimPrefix(scopeAndName[0], "layer_"))
+	if err != nil {
+		return ""
+	}
+	for ggufName, layerTensor := range ggufLayerTensors {
+		if slices.Equal(layerTensor, scopeAndName[1:]) {
+			return "blk." + strconv.Itoa(layerNumber) + "." + ggufName + ".weight"
+		}
+	}
+	return ""
+}
+
+// writeFile writes a GGUF (version 3) file with the given metadata and tensors, whose Offset is set.
+// The data of each tensor, in its GGML type, is returned by tensorData, called once per tensor in order.
+//
+// Metadata values can be string, uint32, int32, uint64, float32, bool, or slices of string, float32 or int32.
+func writeFile(filePath string, metadata []metadataEntry, infos []*TensorInfo, tensorData func(info *TensorInfo) ([]byte, error)) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create GGUF file %q", filePath)
+	}
+	w := &headerWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	w.write(uint32(Magic))
+	w.write(uint32(3))
+	w.write(uint64(len(infos)))
+	w.write(uint64(len(metadata)))
+	for _, entry := range metadata {
+		w.string(entry.key)
+		w.value(entry.value)
+		if w.err != nil {
+			_ = f.Close()
+			return errors.WithMessagef(w.err, "metadata key %q", entry.key)
+		}
+	}
+	var offset uint64
+	for _, info := range infos {
+		size, err := info.Type.DataSize(info.Size())
+		if err != nil {
+			_ = f.Close()
+			return errors.WithMessagef(err, "tensor %q", info.Name)
+		}
+		info.Offset = offset
+		offset += (uint64(size) + DefaultAlignment - 1) / DefaultAlignment * DefaultAlignment
+		w.string(info.Name)
+		w.write(uint32(len(info.Dimensions)))
+		for _, dim := range slices.Backward(info.Dimensions) {
+			w.write(uint64(dim))
+		}
+		w.write(uint32(info.Type))
+		w.write(info.Offset)
+	}
+	w.align()
+	for _, info := range infos {
+		buf, err := tensorData(info)
+		if size, _ := info.Type.DataSize(info.Size()); err == nil && len(buf) != size {
+			err = errors.Errorf("tensor %q has %d bytes of data, expected %d", info.Name, len(buf), size)
+		}
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		w.write(buf)
+		w.align()
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err != nil {
+		_ = f.Close()
+		return errors.Wrapf(w.err, "failed to write GGUF file %q", filePath)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write GGUF file %q", filePath)
+	}
+	return nil
+}
+
+// headerWriter writes little-endian values, keeping the first error and the number of bytes written.
+type headerWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (h *headerWriter) write(value any) {
+	if h.err != nil {
+		return
+	}
+	if h.err = binary.Write(h.w, binary.LittleEndian, value); h.err == nil {
+		h.n += int64(binary.Size(value))
+	}
+}
+
+func (h *headerWriter) string(s string) {
+	h.write(uint64(len(s)))
+	h.write([]byte(s))
+}
+
+// align writes zeros up to the next multiple of DefaultAlignment.
+func (h *headerWriter) align() {
+	h.write(make([]byte, (DefaultAlignment-h.n%DefaultAlignment)%DefaultAlignment))
+}
+
+// value writes the type and the value of a metadata entry.
+func (h *headerWriter) value(value any) {
+	switch v := value.(type) {
+	case string:
+		h.write(uint32(valueTypeString))
+		h.string(v)
+	case uint32:
+		h.write(uint32(valueTypeUint32))
+		h.write(v)
+	case int32:
+		h.write(uint32(valueTypeInt32))
+		h.write(v)
+	case uint64:
+		h.write(uint32(valueTypeUint64))
+		h.write(v)
+	case float32:
+		h.write(uint32(valueTypeFloat32))
+		h.write(v)
+	case bool:
+		h.write(uint32(valueTypeBool))
+		h.write(v)
+	case []string:
+		h.write(uint32(valueTypeArray))
+		h.write(uint32(valueTypeString))
+		h.write(uint64(len(v)))
+		for _, s := range v {
+			h.string(s)
+		}
+	case []float32:
+		h.write(uint32(valueTypeArray))
+		h.write(uint32(valueTypeFloat32))
+		h.write(uint64(len(v)))
+		h.write(v)
+	case []int32:
+		h.write(uint32(valueTypeArray))
+		h.write(uint32(valueTypeInt32))
+		h.write(uint64(len(v)))
+		h.write(v)
+	default:
+		if h.err == nil {
+			h.err = errors.Errorf("metadata value type %T not supported", value)
+		}
+	}
+}
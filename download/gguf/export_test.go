@@ -0,0 +1,169 @@
+package gguf
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestConvertScopeAndNameToGGUF(t *testing.T) {
+	for _, name := range []string{
+		"token_embd.weight",
+		"output_norm.weight",
+		"blk.3.attn_norm.weight",
+		"blk.3.post_ffw_norm.weight",
+		"blk.3.attn_k.weight",
+		"blk.12.ffn_gate.weight",
+		"blk.12.ffn_down.weight",
+	} {
+		require.Equal(t, name, convertScopeAndNameToGGUF(convertGGUFNameToScopeAndName(name)))
+	}
+	require.Equal(t, "", convertScopeAndNameToGGUF([]string{"layer_1", "attn", "q_einsum", "w"}))
+	require.Equal(t, "", convertScopeAndNameToGGUF([]string{"unknown", "w"}))
+}
+
+// bf16Values converts the values to bfloat16.
+func bf16Values(values ...float32) []bfloat16.BFloat16 {
+	converted := make([]bfloat16.BFloat16, len(values))
+	for ii, v := range values {
+		converted[ii] = bfloat16.FromFloat32(v)
+	}
+	return converted
+}
+
+func TestExport(t *testing.T) {
+	// The vocabulary size must match the HuggingFace's version of the model, so the test tokenizer is padded.
+	metadata := testVocabulary()
+	tokens := metadata[2].value.([]string)
+	for len(tokens) < 256000 {
+		tokens = append(tokens, fmt.Sprintf("token_%d", len(tokens)))
+	}
+	metadata[2].value = tokens
+	metadata[3].value = make([]float32, len(tokens))
+	metadata[4].value = append(metadata[4].value.([]int32), make([]int32, len(tokens)-len(metadata[4].value.([]int32)))...)
+	f, err := Open(writeTestFile(t, metadata, nil))
+	require.NoError(t, err)
+	vocab, err := f.NewTokenizer()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// A Gemma2-2B shaped model (the number of layers is what identifies it) with tiny variables.
+	ctx := context.New()
+	modelCtx := ctx.In("model")
+	embeddingValues := make([]bfloat16.BFloat16, len(tokens)*2)
+	for ii := range embeddingValues {
+		embeddingValues[ii] = bfloat16.FromFloat32(float32(ii % 7))
+	}
+	modelCtx.In("embedder").VariableWithValue("input_embedding",
+		tensors.FromFlatDataAndDimensions(embeddingValues, len(tokens), 2))
+	modelCtx.In("final_norm").VariableWithValue("scale", bf16Values(0.5, -0.5))
+	const numLayers = 26
+	for layerIdx := range numLayers {
+		layerCtx := modelCtx.In(fmt.Sprintf("layer_%d", layerIdx))
+		for _, normName := range []string{"pre_attention_norm", "post_attention_norm", "pre_ffw_norm", "post_ffw_norm"} {
+			layerCtx.In(normName).VariableWithValue("scale", bf16Values(0, 1))
+		}
+		attnCtx := layerCtx.In("attn").In("hf")
+		for _, name := range []string{"q_proj", "k_proj", "v_proj"} {
+			attnCtx.VariableWithValue(name, [][]bfloat16.BFloat16{bf16Values(1, 2)})
+		}
+		attnCtx.VariableWithValue("o_proj", [][]bfloat16.BFloat16{bf16Values(1), bf16Values(2)})
+		mlpCtx := layerCtx.In("mlp").In("hf")
+		mlpCtx.VariableWithValue("gating_proj", [][]bfloat16.BFloat16{bf16Values(1, 2), bf16Values(3, 4), bf16Values(5, 6)})
+		mlpCtx.VariableWithValue("up_proj", [][]bfloat16.BFloat16{bf16Values(1, 2), bf16Values(3, 4), bf16Values(5, 6)})
+		mlpCtx.VariableWithValue("down_proj", [][]bfloat16.BFloat16{bf16Values(1, 2, 3), bf16Values(float32(layerIdx), 5, 6)})
+	}
+
+	filePath := path.Join(t.TempDir(), "exported.gguf")
+	require.NoError(t, Export(ctx, vocab, filePath))
+
+	// Check the metadata.
+	f, err = Open(filePath)
+	require.NoError(t, err)
+	architecture, _ := f.String("general.architecture")
+	require.Equal(t, "gemma2", architecture)
+	blockCount, _ := f.Int("gemma2.block_count")
+	require.Equal(t, numLayers, blockCount)
+	headCountKV, _ := f.Int("gemma2.attention.head_count_kv")
+	require.Equal(t, 4, headCountKV)
+	bosID, _ := f.Int("tokenizer.ggml.bos_token_id")
+	require.Equal(t, 2, bosID)
+	require.Equal(t, false, f.Metadata["tokenizer.ggml.add_space_prefix"])
+	require.Len(t, f.Tensors, 2+numLayers*(4+4+3))
+	exportedVocab, err := f.NewTokenizer()
+	require.NoError(t, err)
+	require.Equal(t, vocab.EncodeAsIDs("hello hello!"), exportedVocab.EncodeAsIDs("hello hello!"))
+	require.NoError(t, f.Close())
+
+	// Load it back.
+	loadedCtx := context.New()
+	_, err = Load(loadedCtx, filePath, false)
+	require.NoError(t, err)
+	for v := range modelCtx.IterVariablesInScope() {
+		loaded := loadedCtx.GetVariableByScopeAndName(v.Scope(), v.Name())
+		require.NotNilf(t, loaded, "variable %q in scope %q not loaded", v.Name(), v.Scope())
+		require.Truef(t, v.Value().Equal(loaded.Value()), "variable %q in scope %q: exported %s, loaded %s",
+			v.Name(), v.Scope(), v.Value(), loaded.Value())
+	}
+
+	// Validation: the variables have the names, but not the shapes, of Gemma2-2B.
+	_, err = LoadWithOptions(context.New(), filePath, false, &mmap.Options{Validate: true})
+	require.ErrorContains(t, err, "0 missing, 0 unexpected and 288 mis-shaped variables")
+	require.ErrorContains(t, err, "mis-shaped: final_norm/scale (BFloat16)[2304]: found (BFloat16)[2]")
+	_, err = LoadWithOptions(context.New(), filePath, false, &mmap.Options{Validate: true, Layers: []int{0}})
+	require.ErrorContains(t, err, "Options.Validate can't be used with Options.Layers")
+
+	// LoRA adapters must be merged first.
+	loraCtx := modelCtx.In("layer_0").In("attn").In(transformers.LoRAScope).In("q_proj")
+	loraCtx.VariableWithValue("a", [][]float32{{1}})
+	require.ErrorContains(t, Export(ctx, vocab, filePath), "MergeLoRA")
+	loraCtx.DeleteVariable(loraCtx.Scope(), "a")
+
+	// Kaggle layout must be converted first.
+	config, err := transformers.NewConfigFromContext(modelCtx)
+	require.NoError(t, err)
+	config.NumHeads, config.NumKVHeads, config.HeadDim, config.EmbedDim = 1, 1, 1, 2 // Dimensions of the test model.
+	require.NoError(t, transformers.ConvertToKaggleLayout(modelCtx, config))
+	require.ErrorContains(t, Export(ctx, vocab, filePath), "ConvertToHuggingFaceLayout")
+}
+
+func TestWriteFile(t *testing.T) {
+	// The file written must match, byte for byte, the one written by the independent encoder of the tests.
+	metadata := testVocabulary()
+	tensorsList := []testTensor{
+		{name: "a", dimensions: []int{2, 3}, ggmlType: GGMLTypeF32, data: bytes.Repeat([]byte{1}, 24)},
+		{name: "b", dimensions: []int{5}, ggmlType: GGMLTypeF16, data: bytes.Repeat([]byte{2}, 10)},
+		{name: "c", dimensions: []int{1, 32}, ggmlType: GGMLTypeQ4_0, data: bytes.Repeat([]byte{3}, 18)},
+	}
+	want, err := os.ReadFile(writeTestFile(t, metadata, tensorsList))
+	require.NoError(t, err)
+
+	var entries []metadataEntry
+	for _, m := range metadata {
+		entries = append(entries, metadataEntry{m.key, m.value})
+	}
+	var infos []*TensorInfo
+	for _, tensor := range tensorsList {
+		infos = append(infos, &TensorInfo{Name: tensor.name, Dimensions: tensor.dimensions, Type: tensor.ggmlType})
+	}
+	filePath := path.Join(t.TempDir(), "model.gguf")
+	require.NoError(t, writeFile(filePath, entries, infos, func(info *TensorInfo) ([]byte, error) {
+		return tensorsList[slices.Index(infos, info)].data, nil
+	}))
+	got, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// Tensor data of the wrong size.
+	err = writeFile(filePath, entries, infos, func(info *TensorInfo) ([]byte, error) { return nil, nil })
+	require.ErrorContains(t, err, "bytes of data")
+}
@@ -0,0 +1,283 @@
+package gguf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/pkg/errors"
+	"github.com/x448/float16"
+	"math"
+)
+
+// GGMLType is the type of the data of a tensor in a GGUF file: a float type, or one of the ggml block
+// quantization formats.
+type GGMLType uint32
+
+// GGMLType values, as defined by ggml. Only the types listed in ggmlTypes are supported.
+const (
+	GGMLTypeF32  GGMLType = 0
+	GGMLTypeF16  GGMLType = 1
+	GGMLTypeQ4_0 GGMLType = 2
+	GGMLTypeQ4_1 GGMLType = 3
+	GGMLTypeQ5_0 GGMLType = 6
+	GGMLTypeQ5_1 GGMLType = 7
+	GGMLTypeQ8_0 GGMLType = 8
+	GGMLTypeQ8_1 GGMLType = 9
+	GGMLTypeQ2_K GGMLType = 10
+	GGMLTypeQ3_K GGMLType = 11
+	GGMLTypeQ4_K GGMLType = 12
+	GGMLTypeQ5_K GGMLType = 13
+	GGMLTypeQ6_K GGMLType = 14
+	GGMLTypeQ8_K GGMLType = 15
+	GGMLTypeBF16 GGMLType = 30
+)
+
+// ggmlTypeInfo describes how a GGMLType is stored: in blocks of blockSize values, each taking blockBytes.
+type ggmlTypeInfo struct {
+	name                  string
+	blockSize, blockBytes int
+
+	// dequantize one block of data to values (blockSize of them).
+	dequantize func(block []byte, values []float32)
+}
+
+// qkBlockSize is the number of values in the blocks of the "K" quantization formats (super-blocks).
+const qkBlockSize = 256
+
+// ggmlTypes lists the supported types.
+var ggmlTypes = map[GGMLType]ggmlTypeInfo{
+	GGMLTypeF32: {"F32", 1, 4, func(block []byte, values []float32) {
+		values[0] = math.Float32frombits(binary.LittleEndian.Uint32(block))
+	}},
+	GGMLTypeF16: {"F16", 1, 2, func(block []byte, values []float32) {
+		values[0] = fp16(block)
+	}},
+	GGMLTypeBF16: {"BF16", 1, 2, func(block []byte, values []float32) {
+		values[0] = bfloat16.FromBits(binary.LittleEndian.Uint16(block)).Float32()
+	}},
+	GGMLTypeQ4_0: {"Q4_0", 32, 18, dequantizeQ4_0},
+	GGMLTypeQ4_1: {"Q4_1", 32, 20, dequantizeQ4_1},
+	GGMLTypeQ5_0: {"Q5_0", 32, 22, dequantizeQ5_0},
+	GGMLTypeQ5_1: {"Q5_1", 32, 24, dequantizeQ5_1},
+	GGMLTypeQ8_0: {"Q8_0", 32, 34, dequantizeQ8_0},
+	GGMLTypeQ4_K: {"Q4_K", qkBlockSize, 144, dequantizeQ4_K},
+	GGMLTypeQ5_K: {"Q5_K", qkBlockSize, 176, dequantizeQ5_K},
+	GGMLTypeQ6_K: {"Q6_K", qkBlockSize, 210, dequantizeQ6_K},
+}
+
+// String implements fmt.Stringer.
+func (t GGMLType) String() string {
+	if info, found := ggmlTypes[t]; found {
+		return info.name
+	}
+	return fmt.Sprintf("GGMLType(%d)", uint32(t))
+}
+
+// info returns the description of the type, or an error if it is not supported.
+func (t GGMLType) info() (ggmlTypeInfo, error) {
+	info, found := ggmlTypes[t]
+	if !found {
+		return info, errors.Errorf("ggml type %s not supported", t)
+	}
+	return info, nil
+}
+
+// DataSize returns the number of bytes used to store numElements values of the type.
+func (t GGMLType) DataSize(numElements int) (int, error) {
+	info, err := t.info()
+	if err != nil {
+		return 0, err
+	}
+	if numElements%info.blockSize != 0 {
+		return 0, errors.Errorf("%d elements is not a multiple of the block size %d of ggml type %s",
+			numElements, info.blockSize, t)
+	}
+	return numElements / info.blockSize * info.blockBytes, nil
+}
+
+// Dequantize converts the data of values of the type to float32, writing them to values.
+func (t GGMLType) Dequantize(data []byte, values []float32) error {
+	return t.dequantizeBlocks(data, len(values), func(offset int, block []float32) {
+		copy(values[offset:], block)
+	})
+}
+
+// dequantizeToBFloat16 converts the data of values of the type to bfloat16, writing them to values. It works one
+// block at a time, so it doesn't need the memory of the float32 values.
+func (t GGMLType) dequantizeToBFloat16(data []byte, values []bfloat16.BFloat16) error {
+	return t.dequantizeBlocks(data, len(values), func(offset int, block []float32) {
+		for ii, v := range block {
+			values[offset+ii] = bfloat16.FromFloat32(v)
+		}
+	})
+}
+
+// dequantizeBlocks dequantizes the data of numValues values of the type, one block at a time, calling blockFn with
+// the offset of the block and its values.
+func (t GGMLType) dequantizeBlocks(data []byte, numValues int, blockFn func(offset int, block []float32)) error {
+	size, err := t.DataSize(numValues)
+	if err != nil {
+		return err
+	}
+	if len(data) != size {
+		return errors.Errorf("%d bytes of data, but %d values of ggml type %s take %d bytes", len(data), numValues, t, size)
+	}
+	info, _ := t.info()
+	block := make([]float32, info.blockSize)
+	for blockIdx := range numValues / info.blockSize {
+		info.dequantize(data[blockIdx*info.blockBytes:(blockIdx+1)*info.blockBytes], block)
+		blockFn(blockIdx*info.blockSize, block)
+	}
+	return nil
+}
+
+// fp16 decodes a little-endian float16.
+func fp16(b []byte) float32 {
+	return float16.Frombits(binary.LittleEndian.Uint16(b)).Float32()
+}
+
+// dequantizeQ4_0: d (fp16), 16 bytes with 32 4-bit values: the lower bits hold the first 16 values, the upper bits
+// the last 16. value = (q - 8) * d.
+func dequantizeQ4_0(block []byte, values []float32) {
+	d := fp16(block)
+	qs := block[2:]
+	for j := range 16 {
+		values[j] = float32(int(qs[j]&0xF)-8) * d
+		values[j+16] = float32(int(qs[j]>>4)-8) * d
+	}
+}
+
+// unpackQ4_0 returns the 4-bit values (0 to 15) and the scale of a Q4_0 block, without dequantizing them.
+func unpackQ4_0(block []byte, quantized []uint8) (scale float32) {
+	qs := block[2:]
+	for j := range 16 {
+		quantized[j] = qs[j] & 0xF
+		quantized[j+16] = qs[j] >> 4
+	}
+	return fp16(block)
+}
+
+// dequantizeQ4_1: d (fp16), m (fp16), and 32 4-bit values stored as in Q4_0. value = q * d + m.
+func dequantizeQ4_1(block []byte, values []float32) {
+	d, m := fp16(block), fp16(block[2:])
+	qs := block[4:]
+	for j := range 16 {
+		values[j] = float32(qs[j]&0xF)*d + m
+		values[j+16] = float32(qs[j]>>4)*d + m
+	}
+}
+
+// dequantizeQ5_0: d (fp16), 32 high bits (uint32), and the lower 4 bits of the 32 values stored as in Q4_0.
+// value = (q - 16) * d.
+func dequantizeQ5_0(block []byte, values []float32) {
+	d := fp16(block)
+	qh := binary.LittleEndian.Uint32(block[2:])
+	qs := block[6:]
+	for j := range 16 {
+		high0 := uint8((qh>>j)<<4) & 0x10
+		high1 := uint8(qh>>(j+12)) & 0x10
+		values[j] = float32(int(qs[j]&0xF|high0)-16) * d
+		values[j+16] = float32(int(qs[j]>>4|high1)-16) * d
+	}
+}
+
+// dequantizeQ5_1: d (fp16), m (fp16), and 32 5-bit values stored as in Q5_0. value = q * d + m.
+func dequantizeQ5_1(block []byte, values []float32) {
+	d, m := fp16(block), fp16(block[2:])
+	qh := binary.LittleEndian.Uint32(block[4:])
+	qs := block[8:]
+	for j := range 16 {
+		high0 := uint8((qh>>j)<<4) & 0x10
+		high1 := uint8(qh>>(j+12)) & 0x10
+		values[j] = float32(qs[j]&0xF|high0)*d + m
+		values[j+16] = float32(qs[j]>>4|high1)*d + m
+	}
+}
+
+// dequantizeQ8_0: d (fp16) and 32 int8 values. value = q * d.
+func dequantizeQ8_0(block []byte, values []float32) {
+	d := fp16(block)
+	for j, q := range block[2:] {
+		values[j] = float32(int8(q)) * d
+	}
+}
+
+// scaleMinK4 returns the 6-bit scale and min of the sub-block j of the Q4_K and Q5_K formats, packed in 12 bytes.
+func scaleMinK4(j int, scales []byte) (scale, m uint8) {
+	if j < 4 {
+		return scales[j] & 63, scales[j+4] & 63
+	}
+	return (scales[j+4] & 0xF) | ((scales[j-4] >> 6) << 4), (scales[j+4] >> 4) | ((scales[j] >> 6) << 4)
+}
+
+// dequantizeQ4_K: d (fp16), dmin (fp16), 8 pairs of 6-bit scales and mins (12 bytes), and 256 4-bit values, in
+// 8 sub-blocks of 32 values. value = q * d * scale - dmin * min.
+func dequantizeQ4_K(block []byte, values []float32) {
+	d, dMin := fp16(block), fp16(block[2:])
+	scales := block[4:16]
+	qs := block[16:]
+	for j := 0; j < qkBlockSize/64; j++ {
+		scale1, min1 := scaleMinK4(2*j, scales)
+		scale2, min2 := scaleMinK4(2*j+1, scales)
+		d1, m1 := d*float32(scale1), dMin*float32(min1)
+		d2, m2 := d*float32(scale2), dMin*float32(min2)
+		q := qs[32*j : 32*(j+1)]
+		y := values[64*j : 64*(j+1)]
+		for l := range 32 {
+			y[l] = d1*float32(q[l]&0xF) - m1
+			y[l+32] = d2*float32(q[l]>>4) - m2
+		}
+	}
+}
+
+// dequantizeQ5_K: as Q4_K, with the fifth bit of each value stored in 32 bytes (qh) before the lower 4 bits.
+func dequantizeQ5_K(block []byte, values []float32) {
+	d, dMin := fp16(block), fp16(block[2:])
+	scales := block[4:16]
+	qh := block[16:48]
+	qs := block[48:]
+	for j := 0; j < qkBlockSize/64; j++ {
+		scale1, min1 := scaleMinK4(2*j, scales)
+		scale2, min2 := scaleMinK4(2*j+1, scales)
+		d1, m1 := d*float32(scale1), dMin*float32(min1)
+		d2, m2 := d*float32(scale2), dMin*float32(min2)
+		bit1, bit2 := uint8(1)<<(2*j), uint8(2)<<(2*j)
+		q := qs[32*j : 32*(j+1)]
+		y := values[64*j : 64*(j+1)]
+		for l := range 32 {
+			high1, high2 := float32(0), float32(0)
+			if qh[l]&bit1 != 0 {
+				high1 = 16
+			}
+			if qh[l]&bit2 != 0 {
+				high2 = 16
+			}
+			y[l] = d1*(float32(q[l]&0xF)+high1) - m1
+			y[l+32] = d2*(float32(q[l]>>4)+high2) - m2
+		}
+	}
+}
+
+// dequantizeQ6_K: the lower 4 bits (128 bytes), the upper 2 bits (64 bytes) of 256 6-bit values, 16 int8 scales
+// (one per 16 values) and d (fp16). value = d * scale * (q - 32).
+func dequantizeQ6_K(block []byte, values []float32) {
+	ql, qh := block[:128], block[128:192]
+	scales := block[192:208]
+	d := fp16(block[208:])
+	for n := 0; n < qkBlockSize/128; n++ {
+		ql, qh := ql[64*n:], qh[32*n:]
+		sc := scales[8*n:]
+		y := values[128*n:]
+		for l := range 32 {
+			is := l / 16
+			q1 := int(ql[l]&0xF|((qh[l]>>0)&3)<<4) - 32
+			q2 := int(ql[l+32]&0xF|((qh[l]>>2)&3)<<4) - 32
+			q3 := int(ql[l]>>4|((qh[l]>>4)&3)<<4) - 32
+			q4 := int(ql[l+32]>>4|((qh[l]>>6)&3)<<4) - 32
+			y[l] = d * float32(int8(sc[is])) * float32(q1)
+			y[l+32] = d * float32(int8(sc[is+2])) * float32(q2)
+			y[l+64] = d * float32(int8(sc[is+4])) * float32(q3)
+			y[l+96] = d * float32(int8(sc[is+6])) * float32(q4)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// Package gguf loads Gemma models distributed in the GGUF format (used by llama.cpp), often already quantized.
+//
+// It parses the GGUF container, maps the Gemma tensor names into the scopes used by the transformers package (in
+// the HuggingFace layout), dequantizes the common quantization formats (or keeps them quantized, when the format
+// is supported by the transformers package), and reconstructs the sentencepiece tokenizer from the GGUF metadata.
+//
+// Example:
+//
+//	ctx := context.New()
+//	vocab, err := gguf.Load(ctx, "~/models/gemma-2-2b-it-Q4_K_M.gguf", false)
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/gomlx/gomlx/ml/data"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"slices"
+)
+
+// Magic is the first 4 bytes of a GGUF file: "GGUF" in little-endian.
+const Magic = 0x46554747
+
+// DefaultAlignment of the tensors data, if not given by the "general.alignment" metadata key.
+const DefaultAlignment = 32
+
+// GGUF metadata value types.
+const (
+	valueTypeUint8 = iota
+	valueTypeInt8
+	valueTypeUint16
+	valueTypeInt16
+	valueTypeUint32
+	valueTypeInt32
+	valueTypeFloat32
+	valueTypeBool
+	valueTypeString
+	valueTypeArray
+	valueTypeUint64
+	valueTypeInt64
+	valueTypeFloat64
+)
+
+// File is an open GGUF file: its metadata and the description of its tensors are read when it is opened, and the
+// tensors are read on demand with ReadTensor.
+type File struct {
+	// Version of the GGUF format: 2 and 3 are supported.
+	Version uint32
+
+	// Metadata maps keys to their values, which can be any of uint8, int8, uint16, int16, uint32, int32, uint64,
+	// int64, float32, float64, bool, string or slices of those.
+	Metadata map[string]any
+
+	// Tensors in the order they are listed in the file.
+	Tensors []*TensorInfo
+
+	file       *os.File
+	dataOffset int64
+}
+
+// TensorInfo describes one tensor of a GGUF file.
+type TensorInfo struct {
+	Name string
+
+	// Dimensions of the tensor in row-major order (the reverse of the order GGUF stores them), so the
+	// last axis is the contiguous one.
+	Dimensions []int
+
+	// Type of the tensor data, possibly quantized.
+	Type GGMLType
+
+	// Offset of the tensor data, relative to the start of the data section.
+	Offset uint64
+}
+
+// Size returns the number of elements of the tensor.
+func (info *TensorInfo) Size() int {
+	size := 1
+	for _, dim := range info.Dimensions {
+		size *= dim
+	}
+	return size
+}
+
+// Open a GGUF file and reads its metadata and description of tensors. The file must be closed with File.Close.
+func Open(filePath string) (*File, error) {
+	filePath = data.ReplaceTildeInDir(filePath)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open GGUF file %q", filePath)
+	}
+	gf := &File{file: f}
+	if err = gf.readHeader(); err != nil {
+		_ = f.Close()
+		return nil, errors.WithMessagef(err, "reading GGUF file %q", filePath)
+	}
+	return gf, nil
+}
+
+// Close the underlying file.
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+// countingReader counts the bytes read, to find where the tensors data starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// headerReader reads the little-endian values of a GGUF header, keeping the first error.
+type headerReader struct {
+	r   *countingReader
+	err error
+}
+
+func (h *headerReader) read(value any) {
+	if h.err != nil {
+		return
+	}
+	if err := binary.Read(h.r, binary.LittleEndian, value); err != nil {
+		h.err = errors.Wrap(err, "failed to read GGUF header")
+	}
+}
+
+func (h *headerReader) uint32() (v uint32) { h.read(&v); return }
+func (h *headerReader) uint64() (v uint64) { h.read(&v); return }
+
+// maxStringLength sanity checks the length of the strings, to fail early on corrupted files.
+const maxStringLength = 1 << 30
+
+func (h *headerReader) string() string {
+	length := h.uint64()
+	if h.err != nil {
+		return ""
+	}
+	if length > maxStringLength {
+		h.err = errors.Errorf("invalid string length %d in GGUF header", length)
+		return ""
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(h.r, buf); err != nil {
+		h.err = errors.Wrap(err, "failed to read GGUF header")
+	}
+	return string(buf)
+}
+
+// value reads a metadata value of the given type.
+func (h *headerReader) value(valueType uint32) any {
+	switch valueType {
+	case valueTypeUint8:
+		var v uint8
+		h.read(&v)
+		return v
+	case valueTypeInt8:
+		var v int8
+		h.read(&v)
+		return v
+	case valueTypeUint16:
+		var v uint16
+		h.read(&v)
+		return v
+	case valueTypeInt16:
+		var v int16
+		h.read(&v)
+		return v
+	case valueTypeUint32:
+		return h.uint32()
+	case valueTypeInt32:
+		var v int32
+		h.read(&v)
+		return v
+	case valueTypeFloat32:
+		var v float32
+		h.read(&v)
+		return v
+	case valueTypeBool:
+		var v uint8
+		h.read(&v)
+		return v != 0
+	case valueTypeString:
+		return h.string()
+	case valueTypeUint64:
+		return h.uint64()
+	case valueTypeInt64:
+		var v int64
+		h.read(&v)
+		return v
+	case valueTypeFloat64:
+		var v float64
+		h.read(&v)
+		return v
+	case valueTypeArray:
+		return h.array()
+	}
+	if h.err == nil {
+		h.err = errors.Errorf("unknown GGUF metadata value type %d", valueType)
+	}
+	return nil
+}
+
+// array reads a metadata array, returning a typed slice.
+func (h *headerReader) array() any {
+	elementType := h.uint32()
+	length := h.uint64()
+	if h.err != nil {
+		return nil
+	}
+	if length > maxStringLength {
+		h.err = errors.Errorf("invalid array length %d in GGUF header", length)
+		return nil
+	}
+	switch elementType {
+	case valueTypeUint8:
+		return readArray[uint8](h, length)
+	case valueTypeInt8:
+		return readArray[int8](h, length)
+	case valueTypeUint16:
+		return readArray[uint16](h, length)
+	case valueTypeInt16:
+		return readArray[int16](h, length)
+	case valueTypeUint32:
+		return readArray[uint32](h, length)
+	case valueTypeInt32:
+		return readArray[int32](h, length)
+	case valueTypeFloat32:
+		return readArray[float32](h, length)
+	case valueTypeUint64:
+		return readArray[uint64](h, length)
+	case valueTypeInt64:
+		return readArray[int64](h, length)
+	case valueTypeFloat64:
+		return readArray[float64](h, length)
+	case valueTypeBool:
+		values := readArray[uint8](h, length)
+		bools := make([]bool, len(values))
+		for ii, v := range values {
+			bools[ii] = v != 0
+		}
+		return bools
+	case valueTypeString:
+		values := make([]string, length)
+		for ii := range values {
+			values[ii] = h.string()
+		}
+		return values
+	}
+	values := make([]any, length)
+	for ii := range values {
+		values[ii] = h.value(elementType)
+	}
+	return values
+}
+
+// readArray reads an array of fixed size values.
+func readArray[T any](h *headerReader, length uint64) []T {
+	values := make([]T, length)
+	h.read(values)
+	return values
+}
+
+// readHeader reads the metadata and tensors description.
+func (f *File) readHeader() error {
+	h := &headerReader{r: &countingReader{r: bufio.NewReaderSize(f.file, 1<<20)}}
+	magic := h.uint32()
+	f.Version = h.uint32()
+	if h.err != nil {
+		return h.err
+	}
+	if magic != Magic {
+		return errors.Errorf("invalid magic number 0x%08x, not a GGUF file", magic)
+	}
+	if f.Version != 2 && f.Version != 3 {
+		return errors.Errorf("GGUF version %d not supported, only versions 2 and 3", f.Version)
+	}
+	numTensors := h.uint64()
+	numMetadata := h.uint64()
+	f.Metadata = make(map[string]any)
+	for range numMetadata {
+		key := h.string()
+		f.Metadata[key] = h.value(h.uint32())
+		if h.err != nil {
+			return errors.WithMessagef(h.err, "metadata key %q", key)
+		}
+	}
+	for range numTensors {
+		info := &TensorInfo{Name: h.string()}
+		numDims := h.uint32()
+		if h.err == nil && numDims > 8 {
+			return errors.Errorf("tensor %q has invalid rank %d", info.Name, numDims)
+		}
+		for range numDims {
+			info.Dimensions = append(info.Dimensions, int(h.uint64()))
+		}
+		slices.Reverse(info.Dimensions)
+		info.Type = GGMLType(h.uint32())
+		info.Offset = h.uint64()
+		if h.err != nil {
+			return errors.WithMessagef(h.err, "tensor %q", info.Name)
+		}
+		f.Tensors = append(f.Tensors, info)
+	}
+
+	alignment := int64(DefaultAlignment)
+	if v, found := f.Metadata["general.alignment"]; found {
+		a, ok := v.(uint32)
+		if !ok || a == 0 {
+			return errors.Errorf("invalid general.alignment=%v", v)
+		}
+		alignment = int64(a)
+	}
+	f.dataOffset = (h.r.n + alignment - 1) / alignment * alignment
+	return nil
+}
+
+// String returns the metadata value of the key, if it is a string.
+func (f *File) String(key string) (string, bool) {
+	v, ok := f.Metadata[key].(string)
+	return v, ok
+}
+
+// Int returns the metadata value of the key, if it is an integer of any type.
+func (f *File) Int(key string) (int, bool) {
+	switch v := f.Metadata[key].(type) {
+	case uint8:
+		return int(v), true
+	case int8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case int64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+// ReadTensorData returns the raw (possibly quantized) data of the tensor.
+func (f *File) ReadTensorData(info *TensorInfo) ([]byte, error) {
+	size, err := info.Type.DataSize(info.Size())
+	if err != nil {
+		return nil, errors.WithMessagef(err, "tensor %q", info.Name)
+	}
+	buf := make([]byte, size)
+	if _, err = f.file.ReadAt(buf, f.dataOffset+int64(info.Offset)); err != nil {
+		return nil, errors.Wrapf(err, "failed to read data of tensor %q", info.Name)
+	}
+	return buf, nil
+}
@@ -0,0 +1,327 @@
+package gguf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/stretchr/testify/require"
+	"github.com/x448/float16"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+// testTensor is a tensor to write in a test GGUF file, with dimensions in row-major order.
+type testTensor struct {
+	name       string
+	dimensions []int
+	ggmlType   GGMLType
+	data       []byte
+}
+
+// testMetadata is a metadata entry to write in a test GGUF file.
+type testMetadata struct {
+	key   string
+	value any
+}
+
+// writeTestFile writes a GGUF (version 3) file with the given metadata and tensors.
+func writeTestFile(t *testing.T, metadata []testMetadata, tensorsList []testTensor) string {
+	var buf bytes.Buffer
+	write := func(v any) { require.NoError(t, binary.Write(&buf, binary.LittleEndian, v)) }
+	writeString := func(s string) {
+		write(uint64(len(s)))
+		buf.WriteString(s)
+	}
+	write(uint32(Magic))
+	write(uint32(3))
+	write(uint64(len(tensorsList)))
+	write(uint64(len(metadata)))
+	for _, m := range metadata {
+		writeString(m.key)
+		switch v := m.value.(type) {
+		case string:
+			write(uint32(valueTypeString))
+			writeString(v)
+		case uint32:
+			write(uint32(valueTypeUint32))
+			write(v)
+		case bool:
+			write(uint32(valueTypeBool))
+			write(v)
+		case []string:
+			write(uint32(valueTypeArray))
+			write(uint32(valueTypeString))
+			write(uint64(len(v)))
+			for _, s := range v {
+				writeString(s)
+			}
+		case []float32:
+			write(uint32(valueTypeArray))
+			write(uint32(valueTypeFloat32))
+			write(uint64(len(v)))
+			write(v)
+		case []int32:
+			write(uint32(valueTypeArray))
+			write(uint32(valueTypeInt32))
+			write(uint64(len(v)))
+			write(v)
+		default:
+			t.Fatalf("unsupported metadata type %T", v)
+		}
+	}
+	var offset uint64
+	for _, tensor := range tensorsList {
+		writeString(tensor.name)
+		write(uint32(len(tensor.dimensions)))
+		dims := slices.Clone(tensor.dimensions)
+		slices.Reverse(dims)
+		for _, dim := range dims {
+			write(uint64(dim))
+		}
+		write(uint32(tensor.ggmlType))
+		write(offset)
+		offset += uint64(len(tensor.data)+DefaultAlignment-1) / DefaultAlignment * DefaultAlignment
+	}
+	for _, tensor := range slices.Insert(tensorsList, 0, testTensor{}) {
+		// Pad to the alignment before each tensor (and before the data section).
+		buf.Write(tensor.data)
+		buf.Write(make([]byte, (DefaultAlignment-buf.Len()%DefaultAlignment)%DefaultAlignment))
+	}
+	filePath := path.Join(t.TempDir(), "model.gguf")
+	require.NoError(t, os.WriteFile(filePath, buf.Bytes(), 0644))
+	return filePath
+}
+
+// f32Data encodes float32 values as a GGML F32 tensor.
+func f32Data(values ...float32) []byte {
+	data := make([]byte, 4*len(values))
+	for ii, v := range values {
+		binary.LittleEndian.PutUint32(data[4*ii:], math.Float32bits(v))
+	}
+	return data
+}
+
+// q4_0Block encodes a Q4_0 block with the scale d and the quantized values q (from 0 to 15).
+func q4_0Block(d float32, q []uint8) []byte {
+	block := binary.LittleEndian.AppendUint16(nil, float16.Fromfloat32(d).Bits())
+	for j := range 16 {
+		block = append(block, q[j]|q[j+16]<<4)
+	}
+	return block
+}
+
+func TestDequantize(t *testing.T) {
+	// Q8_0: value = q * d.
+	block := binary.LittleEndian.AppendUint16(nil, float16.Fromfloat32(0.5).Bits())
+	for j := range 32 {
+		block = append(block, uint8(int8(j-16)))
+	}
+	values := make([]float32, 32)
+	require.NoError(t, GGMLTypeQ8_0.Dequantize(block, values))
+	for j, v := range values {
+		require.Equal(t, float32(j-16)*0.5, v)
+	}
+
+	// Q4_0: value = (q - 8) * d.
+	q := make([]uint8, 32)
+	for j := range q {
+		q[j] = uint8(j % 16)
+	}
+	require.NoError(t, GGMLTypeQ4_0.Dequantize(q4_0Block(2, q), values))
+	for j, v := range values {
+		require.Equal(t, float32(j%16-8)*2, v)
+	}
+	quantized := make([]uint8, 32)
+	require.Equal(t, float32(2), unpackQ4_0(q4_0Block(2, q), quantized))
+	require.Equal(t, q, quantized)
+
+	// Q4_K: with d=1, dmin=0.5, all scales=2 and mins=1: value = 2*q - 0.5.
+	block = binary.LittleEndian.AppendUint16(nil, float16.Fromfloat32(1).Bits())
+	block = binary.LittleEndian.AppendUint16(block, float16.Fromfloat32(0.5).Bits())
+	block = append(block, 2, 2, 2, 2, 1, 1, 1, 1, 0x12, 0x12, 0x12, 0x12)
+	for j := range 128 {
+		block = append(block, uint8(j%16)|uint8(15-j%16)<<4)
+	}
+	values = make([]float32, 256)
+	require.NoError(t, GGMLTypeQ4_K.Dequantize(block, values))
+	for j, v := range values {
+		// Each group of 64 values holds 32 lower nibbles followed by 32 upper nibbles.
+		l := j % 32
+		want := float32(l % 16)
+		if j%64 >= 32 {
+			want = float32(15 - l%16)
+		}
+		require.Equalf(t, 2*want-0.5, v, "value #%d", j)
+	}
+
+	// Invalid data sizes.
+	require.Error(t, GGMLTypeQ4_K.Dequantize(block[:100], values))
+	require.Error(t, GGMLType(1000).Dequantize(block, values))
+}
+
+// testVocabulary returns the tokenizer metadata of a small Gemma-like vocabulary.
+func testVocabulary() []testMetadata {
+	tokens := []string{"<pad>", "<eos>", "<bos>", "<unk>"}
+	tokenTypes := []int32{3, 3, 3, 2}
+	for b := range 256 {
+		tokens = append(tokens, fmt.Sprintf("<0x%02X>", b))
+		tokenTypes = append(tokenTypes, tokenTypeByte)
+	}
+	// The last piece is never used: go-sentencepiece sizes its merge buffer with the longest piece, so it must
+	// be longer than any pair of symbols in the tests.
+	for _, piece := range []string{"▁", "h", "e", "l", "o", "he", "ll", "hell", "hello", "▁hello", "▁unused▁long▁piece"} {
+		tokens = append(tokens, piece)
+		tokenTypes = append(tokenTypes, tokenTypeNormal)
+	}
+	scores := make([]float32, len(tokens))
+	for ii := range scores {
+		scores[ii] = -float32(ii)
+	}
+	return []testMetadata{
+		{"general.architecture", "gemma2"},
+		{"tokenizer.ggml.model", "llama"},
+		{"tokenizer.ggml.tokens", tokens},
+		{"tokenizer.ggml.scores", scores},
+		{"tokenizer.ggml.token_type", tokenTypes},
+		{"tokenizer.ggml.add_space_prefix", false},
+	}
+}
+
+func TestNewTokenizer(t *testing.T) {
+	f, err := Open(writeTestFile(t, testVocabulary(), nil))
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	require.Equal(t, uint32(3), f.Version)
+	architecture, ok := f.String("general.architecture")
+	require.True(t, ok)
+	require.Equal(t, "gemma2", architecture)
+
+	vocab, err := f.NewTokenizer()
+	require.NoError(t, err)
+	require.Equal(t, 0, vocab.PadID())
+	require.Equal(t, 1, vocab.EndOfSentenceID())
+	require.Equal(t, 2, vocab.BeginningOfSentenceID())
+	require.Equal(t, 3, vocab.UnknownID())
+	ids := vocab.EncodeAsIDs("hello hello!")
+	helloID, spaceHelloID := 4+256+8, 4+256+9
+	require.Equal(t, []int{helloID, spaceHelloID, 4 + '!'}, ids)
+	require.Equal(t, "hello hello!", vocab.DecodeIDs(ids))
+
+	// Not a sentencepiece tokenizer.
+	f.Metadata["tokenizer.ggml.model"] = "gpt2"
+	_, err = f.NewTokenizer()
+	require.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	// Embedding dimension 32, with only some of the tensors: Load doesn't check the model is complete.
+	q := make([]uint8, 64*32)
+	for j := range q {
+		q[j] = uint8(j % 16)
+	}
+	var qProjData []byte
+	for blockIdx := range 64 {
+		qProjData = append(qProjData, q4_0Block(float32(blockIdx%4+1)/2, q[blockIdx*32:])...)
+	}
+	embedding := make([]float32, 3*32)
+	for ii := range embedding {
+		embedding[ii] = float32(ii)
+	}
+	tensorsList := []testTensor{
+		{"token_embd.weight", []int{3, 32}, GGMLTypeF32, f32Data(embedding...)},
+		{"output_norm.weight", []int{2}, GGMLTypeF32, f32Data(1, 1.5)},
+		{"blk.1.attn_norm.weight", []int{2}, GGMLTypeF32, f32Data(2, 0.5)},
+		{"blk.1.attn_q.weight", []int{64, 32}, GGMLTypeQ4_0, qProjData},
+		{"rope_freqs.weight", []int{2}, GGMLTypeF32, f32Data(1, 2)},
+	}
+	filePath := writeTestFile(t, testVocabulary(), tensorsList)
+
+	for _, keepQuantized := range []bool{false, true} {
+		ctx := context.New()
+		vocab, err := Load(ctx, filePath, keepQuantized)
+		require.NoError(t, err)
+		require.Equal(t, 2, vocab.BeginningOfSentenceID())
+
+		modelCtx := ctx.In("model")
+		embeddingVar := modelCtx.In("embedder").GetVariable("input_embedding")
+		require.NotNil(t, embeddingVar)
+		require.Equal(t, dtypes.BFloat16, embeddingVar.Shape().DType)
+		require.Equal(t, []int{3, 32}, embeddingVar.Shape().Dimensions)
+
+		// Norm scales have 1 subtracted.
+		require.Equal(t, []bfloat16.BFloat16{bfloat16.FromFloat32(0), bfloat16.FromFloat32(0.5)},
+			modelCtx.In("final_norm").GetVariable("scale").Value().Value())
+		require.Equal(t, []bfloat16.BFloat16{bfloat16.FromFloat32(1), bfloat16.FromFloat32(-0.5)},
+			modelCtx.In("layer_1").In("pre_attention_norm").GetVariable("scale").Value().Value())
+		require.Nil(t, ctx.GetVariableByScopeAndName("/", "rope_freqs"))
+
+		attnCtx := modelCtx.In("layer_1").In("attn").In("hf")
+		qProj, err := transformers.DequantizeWeights(attnCtx, "q_proj", dtypes.Float32)
+		require.NoError(t, err)
+		require.NotNil(t, qProj)
+		qProjValues := qProj.Value().([][]float32)
+		require.Len(t, qProjValues, 64)
+		for row := range 64 {
+			// One Q4_0 block per row.
+			for col := range 32 {
+				require.Equal(t, float32(row%4+1)/2*float32(col%16-8), qProjValues[row][col])
+			}
+		}
+		require.Equal(t, keepQuantized, attnCtx.GetVariable("q_proj") == nil)
+	}
+
+	// Only layer 0 (so nothing from layer 1), with skipped tensors and progress reported.
+	var skipped []mmap.SkippedTensor
+	var lastProgress mmap.Progress
+	ctx := context.New()
+	_, err := LoadWithOptions(ctx, filePath, false, &mmap.Options{
+		Layers:   []int{0},
+		Progress: func(progress mmap.Progress) { lastProgress = progress },
+		Skipped:  func(tensor mmap.SkippedTensor) { skipped = append(skipped, tensor) },
+	})
+	require.NoError(t, err)
+	require.Nil(t, ctx.In("model").In("layer_1").In("pre_attention_norm").GetVariable("scale"))
+	require.NotNil(t, ctx.In("model").In("embedder").GetVariable("input_embedding"))
+	require.Len(t, skipped, 3)
+	reasons := make(map[string]mmap.SkipReason)
+	for _, tensor := range skipped {
+		reasons[tensor.Name] = tensor.Reason
+	}
+	require.Equal(t, map[string]mmap.SkipReason{
+		"blk.1.attn_norm.weight": mmap.SkipLayer,
+		"blk.1.attn_q.weight":    mmap.SkipLayer,
+		"rope_freqs.weight":      mmap.SkipUnmapped,
+	}, reasons)
+	require.Equal(t, 2, lastProgress.TensorsLoaded)
+	require.Equal(t, lastProgress.TotalBytes, lastProgress.BytesLoaded)
+	require.Equal(t, int64((3*32+2)*4), lastProgress.TotalBytes)
+
+	// Checksums verified against the manifest in the same directory.
+	verifyOpts := &mmap.Options{VerifyChecksums: true, CheckFinite: true}
+	_, err = LoadWithOptions(context.New(), filePath, false, verifyOpts)
+	require.ErrorContains(t, err, mmap.ManifestFileName)
+	dir, fileName := path.Split(filePath)
+	manifest, err := mmap.NewManifest(dir, []string{fileName})
+	require.NoError(t, err)
+	require.NoError(t, manifest.Write(dir))
+	_, err = LoadWithOptions(context.New(), filePath, false, verifyOpts)
+	require.NoError(t, err)
+	delete(manifest, fileName)
+	require.NoError(t, manifest.Write(dir))
+	_, err = LoadWithOptions(context.New(), filePath, false, verifyOpts)
+	require.ErrorContains(t, err, "not listed")
+
+	// Unsupported architecture.
+	metadata := testVocabulary()
+	metadata[0].value = "llama"
+	_, err = Load(context.New(), writeTestFile(t, metadata, nil), false)
+	require.ErrorContains(t, err, "architecture")
+}
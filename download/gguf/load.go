@@ -0,0 +1,214 @@
+package gguf
+
+import (
+	"fmt"
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gemma/sentencepiece"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gomlx/types/xslices"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/pkg/errors"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SupportedArchitectures are the values of the "general.architecture" metadata that Load accepts.
+var SupportedArchitectures = []string{"gemma", "gemma2"}
+
+// Load the Gemma model in the GGUF file filePath into ctx (under the "model" scope, in the HuggingFace layout,
+// see transformers.Config.HuggingFaceVersion), and returns the tokenizer reconstructed from its metadata.
+//
+// Weights are dequantized to bfloat16, the dtype used by the model, except if keepQuantized is true: then the
+// linear projections quantized with Q4_0 are kept quantized, in the format used by transformers.QuantizeWeightsQ4
+// (with groups of 32 values), which is lossless. The other quantization formats have no equivalent in the
+// transformers package, and they are always dequantized.
+//
+// llama.cpp stores the Gemma normalization scales with 1 added, which is subtracted back when loading.
+//
+// See LoadWithOptions to transfer the weights to the device as they are loaded, to load only some of the layers, or
+// to report the progress.
+func Load(ctx *context.Context, filePath string, keepQuantized bool) (vocab *sentencepiece.Tokenizer, err error) {
+	return LoadWithOptions(ctx, filePath, keepQuantized, nil)
+}
+
+// LoadWithOptions is like Load, but configured by opts (it can be nil), see mmap.Options. Weights kept quantized
+// are always loaded to local tensors.
+//
+// With opts.VerifyChecksums, the file is verified against the mmap.ManifestFileName in its directory. With
+// opts.Validate, the variables loaded are checked against those the model requests, see transformers.ValidateModel.
+func LoadWithOptions(ctx *context.Context, filePath string, keepQuantized bool, opts *mmap.Options) (vocab *sentencepiece.Tokenizer, err error) {
+	validate := opts != nil && opts.Validate
+	if validate && opts.Layers != nil {
+		return nil, errors.Errorf("GGUF file %q: Options.Validate can't be used with Options.Layers, the other "+
+			"layers are not loaded", filePath)
+	}
+	dir, fileName := path.Split(filePath)
+	manifest, err := opts.ChecksumsManifest(dir)
+	if err == nil && manifest != nil {
+		err = manifest.VerifyFile(dir, fileName)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "GGUF file %q", filePath)
+	}
+	f, err := Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	architecture, _ := f.String("general.architecture")
+	if !slices.Contains(SupportedArchitectures, architecture) {
+		return nil, errors.Errorf("GGUF file %q has architecture %q, only %q are supported",
+			filePath, architecture, SupportedArchitectures)
+	}
+	vocab, err = f.NewTokenizer()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "GGUF file %q", filePath)
+	}
+	var tasks []mmap.Task
+	for _, info := range f.Tensors {
+		if task, ok := f.loadTensorTask(ctx, info, keepQuantized, opts); ok {
+			tasks = append(tasks, task)
+		}
+	}
+	if err = opts.Run(tasks); err != nil {
+		return nil, errors.WithMessagef(err, "GGUF file %q", filePath)
+	}
+	if validate {
+		if err = transformers.ValidateModel(ctx.In("model")); err != nil {
+			return nil, errors.WithMessagef(err, "GGUF file %q", filePath)
+		}
+	}
+	return vocab, nil
+}
+
+// loadTensorTask returns the task that creates the variable (under the "model" scope) corresponding to the GGUF
+// tensor. Tensors not used by the model, or in layers not selected by opts, are reported as skipped, and it
+// returns false.
+func (f *File) loadTensorTask(ctx *context.Context, info *TensorInfo, keepQuantized bool, opts *mmap.Options) (task mmap.Task, ok bool) {
+	scopeAndName := convertGGUFNameToScopeAndName(info.Name)
+	shape := shapes.Make(dtypes.BFloat16, info.Dimensions...)
+	if len(scopeAndName) == 0 {
+		opts.Skip(info.Name, shape, mmap.SkipUnmapped)
+		return
+	}
+	if opts.SkipScope(scopeAndName) {
+		opts.Skip(info.Name, shape, mmap.SkipLayer)
+		return
+	}
+	ctxTmp := ctx.In("model")
+	name, scope := xslices.Pop(scopeAndName)
+	for _, p := range scope {
+		ctxTmp = ctxTmp.In(p)
+	}
+	task.Name = info.Name
+	dataSize, _ := info.Type.DataSize(info.Size())
+	task.Bytes = int64(dataSize)
+	task.Set = func(tensor *tensors.Tensor) error {
+		ctxTmp.VariableWithValue(name, tensor)
+		return nil
+	}
+
+	switch {
+	case name == "scale":
+		// Normalization scales: small, so they are dequantized to float32 first, to subtract 1 before rounding.
+		task.Read = func() (*tensors.Tensor, error) {
+			data, err := f.ReadTensorData(info)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]float32, info.Size())
+			if err = info.Type.Dequantize(data, values); err != nil {
+				return nil, err
+			}
+			scales := make([]bfloat16.BFloat16, len(values))
+			for ii, v := range values {
+				scales[ii] = bfloat16.FromFloat32(v - 1)
+			}
+			return opts.Transfer(tensors.FromFlatDataAndDimensions(scales, info.Dimensions...))
+		}
+
+	case keepQuantized && info.Type == GGMLTypeQ4_0 && name != "input_embedding":
+		// The quantized values are unpacked by Read, and Set creates the variables of the quantized weights.
+		var quantized []uint8
+		var scales []float32
+		task.Read = func() (*tensors.Tensor, error) {
+			data, err := f.ReadTensorData(info)
+			if err != nil {
+				return nil, err
+			}
+			info4, _ := info.Type.info()
+			quantized = make([]uint8, info.Size())
+			scales = make([]float32, info.Size()/info4.blockSize)
+			for blockIdx := range scales {
+				scales[blockIdx] = unpackQ4_0(data[blockIdx*info4.blockBytes:], quantized[blockIdx*info4.blockSize:])
+			}
+			return nil, nil
+		}
+		task.Set = func(_ *tensors.Tensor) error {
+			return transformers.SetQuantizedWeightsQ4(ctxTmp, name, info.Dimensions, quantized, scales, nil)
+		}
+
+	default:
+		task.Read = func() (*tensors.Tensor, error) {
+			data, err := f.ReadTensorData(info)
+			if err != nil {
+				return nil, err
+			}
+			tensor := tensors.FromShape(shape)
+			tensors.MutableFlatData(tensor, func(flat []bfloat16.BFloat16) {
+				err = info.Type.dequantizeToBFloat16(data, flat)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return opts.Transfer(tensor)
+		}
+	}
+	return task, true
+}
+
+// ggufLayerTensors maps the names of the tensors of a layer ("blk.<N>.<name>.weight") to their scope and name,
+// relative to the layer scope.
+var ggufLayerTensors = map[string][]string{
+	"attn_norm":           {"pre_attention_norm", "scale"},
+	"post_attention_norm": {"post_attention_norm", "scale"},
+	"ffn_norm":            {"pre_ffw_norm", "scale"},
+	"post_ffw_norm":       {"post_ffw_norm", "scale"},
+	"attn_q":              {"attn", "hf", "q_proj"},
+	"attn_k":              {"attn", "hf", "k_proj"},
+	"attn_v":              {"attn", "hf", "v_proj"},
+	"attn_output":         {"attn", "hf", "o_proj"},
+	"ffn_gate":            {"mlp", "hf", "gating_proj"},
+	"ffn_up":              {"mlp", "hf", "up_proj"},
+	"ffn_down":            {"mlp", "hf", "down_proj"},
+}
+
+// convertGGUFNameToScopeAndName converts the name of a tensor in a GGUF file (e.g.: "blk.3.attn_q.weight") to the
+// scope and name of the model variable (e.g.: "layer_3/attn/hf/q_proj"). It returns nil for unknown tensors.
+func convertGGUFNameToScopeAndName(name string) []string {
+	switch name {
+	case "token_embd.weight":
+		return []string{"embedder", "input_embedding"}
+	case "output_norm.weight":
+		return []string{"final_norm", "scale"}
+	}
+	parts := strings.Split(name, ".")
+	if len(parts) != 4 || parts[0] != "blk" || parts[3] != "weight" {
+		return nil
+	}
+	layerNumber, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil
+	}
+	layerTensor, found := ggufLayerTensors[parts[2]]
+	if !found {
+		return nil
+	}
+	return append([]string{fmt.Sprintf("layer_%d", layerNumber)}, layerTensor...)
+}
@@ -0,0 +1,210 @@
+package gguf
+
+import (
+	"github.com/gomlx/gemma/sentencepiece"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// Token types in the "tokenizer.ggml.token_type" metadata: they match the sentencepiece piece types, except for
+// tokenTypeUndefined.
+const (
+	tokenTypeUndefined = 0
+	tokenTypeNormal    = 1
+	tokenTypeByte      = 6
+)
+
+// Field numbers of the sentencepiece model proto used (see sentencepiece_model.proto).
+const (
+	modelPiecesField         = 1
+	modelTrainerSpecField    = 2
+	modelNormalizerSpecField = 3
+
+	pieceTextField  = 1
+	pieceScoreField = 2
+	pieceTypeField  = 3
+
+	trainerModelTypeField    = 3
+	trainerByteFallbackField = 35
+	trainerModelTypeBPE      = 2
+
+	normalizerNameField                   = 1
+	normalizerAddDummyPrefixField         = 3
+	normalizerRemoveExtraWhitespacesField = 4
+	normalizerEscapeWhitespacesField      = 5
+)
+
+// NewTokenizer reconstructs the sentencepiece tokenizer from the "tokenizer.ggml.*" metadata of the file.
+//
+// Only sentencepiece tokenizers ("tokenizer.ggml.model" = "llama"), as used by Gemma, are supported.
+func (f *File) NewTokenizer() (*sentencepiece.Tokenizer, error) {
+	modelProto, err := f.tokenizerModelProto()
+	if err != nil {
+		return nil, err
+	}
+	return sentencepiece.NewFromBytes(modelProto)
+}
+
+// tokenizerModelProto returns the serialized sentencepiece model proto equivalent to the tokenizer metadata.
+func (f *File) tokenizerModelProto() ([]byte, error) {
+	if model, _ := f.String("tokenizer.ggml.model"); model != "llama" {
+		return nil, errors.Errorf("GGUF tokenizer model %q not supported, only sentencepiece (\"llama\")", model)
+	}
+	if addSpacePrefix, _ := f.Metadata["tokenizer.ggml.add_space_prefix"].(bool); addSpacePrefix {
+		return nil, errors.New("GGUF tokenizer with tokenizer.ggml.add_space_prefix=true not supported")
+	}
+	tokens, ok := f.Metadata["tokenizer.ggml.tokens"].([]string)
+	if !ok || len(tokens) == 0 {
+		return nil, errors.New("GGUF file has no tokenizer.ggml.tokens")
+	}
+	scores, _ := f.Metadata["tokenizer.ggml.scores"].([]float32)
+	tokenTypes, _ := f.Metadata["tokenizer.ggml.token_type"].([]int32)
+	if (scores != nil && len(scores) != len(tokens)) || (tokenTypes != nil && len(tokenTypes) != len(tokens)) {
+		return nil, errors.Errorf("GGUF tokenizer has %d tokens, but %d scores and %d token types",
+			len(tokens), len(scores), len(tokenTypes))
+	}
+
+	var modelProto []byte
+	byteFallback := false
+	for ii, token := range tokens {
+		tokenType := int32(tokenTypeNormal)
+		if tokenTypes != nil && tokenTypes[ii] != tokenTypeUndefined {
+			tokenType = tokenTypes[ii]
+		}
+		byteFallback = byteFallback || tokenType == tokenTypeByte
+		var score float32
+		if scores != nil {
+			score = scores[ii]
+		}
+		var piece []byte
+		piece = protowire.AppendTag(piece, pieceTextField, protowire.BytesType)
+		piece = protowire.AppendString(piece, token)
+		piece = protowire.AppendTag(piece, pieceScoreField, protowire.Fixed32Type)
+		piece = protowire.AppendFixed32(piece, math.Float32bits(score))
+		piece = protowire.AppendTag(piece, pieceTypeField, protowire.VarintType)
+		piece = protowire.AppendVarint(piece, uint64(tokenType))
+		modelProto = protowire.AppendTag(modelProto, modelPiecesField, protowire.BytesType)
+		modelProto = protowire.AppendBytes(modelProto, piece)
+	}
+
+	var trainerSpec []byte
+	trainerSpec = protowire.AppendTag(trainerSpec, trainerModelTypeField, protowire.VarintType)
+	trainerSpec = protowire.AppendVarint(trainerSpec, trainerModelTypeBPE)
+	trainerSpec = protowire.AppendTag(trainerSpec, trainerByteFallbackField, protowire.VarintType)
+	trainerSpec = protowire.AppendVarint(trainerSpec, protowire.EncodeBool(byteFallback))
+	modelProto = protowire.AppendTag(modelProto, modelTrainerSpecField, protowire.BytesType)
+	modelProto = protowire.AppendBytes(modelProto, trainerSpec)
+
+	var normalizerSpec []byte
+	normalizerSpec = protowire.AppendTag(normalizerSpec, normalizerNameField, protowire.BytesType)
+	normalizerSpec = protowire.AppendString(normalizerSpec, "identity")
+	for _, field := range []protowire.Number{normalizerAddDummyPrefixField, normalizerRemoveExtraWhitespacesField} {
+		normalizerSpec = protowire.AppendTag(normalizerSpec, field, protowire.VarintType)
+		normalizerSpec = protowire.AppendVarint(normalizerSpec, protowire.EncodeBool(false))
+	}
+	normalizerSpec = protowire.AppendTag(normalizerSpec, normalizerEscapeWhitespacesField, protowire.VarintType)
+	normalizerSpec = protowire.AppendVarint(normalizerSpec, protowire.EncodeBool(true))
+	modelProto = protowire.AppendTag(modelProto, modelNormalizerSpecField, protowire.BytesType)
+	modelProto = protowire.AppendBytes(modelProto, normalizerSpec)
+	return modelProto, nil
+}
+
+// tokenizerMetadata returns the "tokenizer.ggml.*" metadata equivalent to the sentencepiece model proto of vocab.
+// It is the inverse of File.tokenizerModelProto.
+func tokenizerMetadata(vocab *sentencepiece.Tokenizer) ([]metadataEntry, error) {
+	if len(vocab.ModelProto) == 0 {
+		return nil, errors.New("tokenizer has no sentencepiece model proto")
+	}
+	var tokens []string
+	var scores []float32
+	var tokenTypes []int32
+	addDummyPrefix := true // Default value of the normalizer_spec.add_dummy_prefix field.
+	err := protoFields(vocab.ModelProto, func(field protowire.Number, value []byte, _ uint64) error {
+		switch field {
+		case modelPiecesField:
+			token, score, tokenType := "", float32(0), int32(tokenTypeNormal)
+			err := protoFields(value, func(field protowire.Number, value []byte, number uint64) error {
+				switch field {
+				case pieceTextField:
+					token = string(value)
+				case pieceScoreField:
+					score = math.Float32frombits(uint32(number))
+				case pieceTypeField:
+					tokenType = int32(number)
+				}
+				return nil
+			})
+			tokens, scores, tokenTypes = append(tokens, token), append(scores, score), append(tokenTypes, tokenType)
+			return err
+		case modelNormalizerSpecField:
+			return protoFields(value, func(field protowire.Number, _ []byte, number uint64) error {
+				if field == normalizerAddDummyPrefixField {
+					addDummyPrefix = number != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	metadata := []metadataEntry{
+		{"tokenizer.ggml.model", "llama"},
+		{"tokenizer.ggml.tokens", tokens},
+		{"tokenizer.ggml.scores", scores},
+		{"tokenizer.ggml.token_type", tokenTypes},
+		{"tokenizer.ggml.add_space_prefix", addDummyPrefix},
+		{"tokenizer.ggml.add_bos_token", true},
+		{"tokenizer.ggml.add_eos_token", false},
+	}
+	for _, special := range []struct {
+		key string
+		id  int
+	}{
+		{"tokenizer.ggml.bos_token_id", vocab.BeginningOfSentenceID()},
+		{"tokenizer.ggml.eos_token_id", vocab.EndOfSentenceID()},
+		{"tokenizer.ggml.unknown_token_id", vocab.UnknownID()},
+		{"tokenizer.ggml.padding_token_id", vocab.PadID()},
+	} {
+		if special.id >= 0 {
+			metadata = append(metadata, metadataEntry{special.key, uint32(special.id)})
+		}
+	}
+	return metadata, nil
+}
+
+// protoFields calls fn for each field of the serialized proto message b, with its value: the bytes of
+// length-delimited fields, or the number of varint and fixed32 fields.
+func protoFields(b []byte, fn func(field protowire.Number, value []byte, number uint64) error) error {
+	for len(b) > 0 {
+		field, fieldType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid sentencepiece model proto")
+		}
+		b = b[n:]
+		var value []byte
+		var number uint64
+		switch fieldType {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			number, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			number = uint64(v)
+		default:
+			n = protowire.ConsumeFieldValue(field, fieldType, b)
+		}
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "invalid sentencepiece model proto")
+		}
+		b = b[n:]
+		if err := fn(field, value, number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package huggingface
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomlx/gemma/safetensors"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/data"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ConfigFileName is the name of the model configuration file in a HuggingFace model directory.
+	ConfigFileName = "config.json"
+
+	// DefaultMaxShardBytes is the default maximum size of each ".safetensors" shard written by Export, the same
+	// used by HuggingFace's transformers library.
+	DefaultMaxShardBytes = 5 << 30
+)
+
+// Gemma special tokens ids, written to the ConfigFileName.
+const (
+	padTokenID = 0
+	eosTokenID = 1
+	bosTokenID = 2
+)
+
+// hfConfig is the subset of the HuggingFace ConfigFileName written by Export.
+type hfConfig struct {
+	Architectures         []string `json:"architectures"`
+	ModelType             string   `json:"model_type"`
+	VocabSize             int      `json:"vocab_size"`
+	HiddenSize            int      `json:"hidden_size"`
+	IntermediateSize      int      `json:"intermediate_size"`
+	NumHiddenLayers       int      `json:"num_hidden_layers"`
+	NumAttentionHeads     int      `json:"num_attention_heads"`
+	NumKeyValueHeads      int      `json:"num_key_value_heads"`
+	HeadDim               int      `json:"head_dim"`
+	HiddenActivation      string   `json:"hidden_activation"`
+	MaxPositionEmbeddings int      `json:"max_position_embeddings"`
+	RMSNormEps            float64  `json:"rms_norm_eps"`
+	RopeTheta             float64  `json:"rope_theta"`
+	QueryPreAttnScalar    int      `json:"query_pre_attn_scalar,omitempty"`
+	SlidingWindow         int      `json:"sliding_window,omitempty"`
+	FinalLogitSoftcapping float64  `json:"final_logit_softcapping,omitempty"`
+	AttnLogitSoftcapping  float64  `json:"attn_logit_softcapping,omitempty"`
+	PadTokenID            int      `json:"pad_token_id"`
+	EOSTokenID            int      `json:"eos_token_id"`
+	BOSTokenID            int      `json:"bos_token_id"`
+	TorchDType            string   `json:"torch_dtype"`
+}
+
+// torchDTypes maps the dtypes supported by Export to their PyTorch names.
+var torchDTypes = map[dtypes.DType]string{
+	dtypes.BFloat16: "bfloat16",
+	dtypes.Float16:  "float16",
+	dtypes.Float32:  "float32",
+}
+
+// Export writes the Gemma model in ctx (under the "model" scope, as created by Download or LoadFromDir, or by the
+// kaggle package) to dir in HuggingFace format: the weights sharded in ".safetensors" files of at most
+// maxShardBytes (if <= 0 it uses DefaultMaxShardBytes), the WeightsIndexFileName and the ConfigFileName.
+// The tokenizer is not written: copy the TokenizerFileName of the original model to dir.
+//
+// Variables in the Kaggle layout (e.g.: "qkv_einsum", "kv_einsum" and "gating_einsum") are split and transposed
+// into the corresponding HuggingFace "*_proj" tensors. Quantized weights (see transformers.QuantizeWeightsInt8 and
+// transformers.QuantizeWeightsQ4) are dequantized to the model dtype, since the format has no quantization support.
+//
+// The embedding table of the Kaggle checkpoints is truncated to transformers.HuggingFaceVocabularySize rows, the
+// vocabulary size of the HuggingFace checkpoints, dropping its padding. So the exported model is recognized as
+// being in the HuggingFace layout when loaded back (see transformers.NewConfigFromContext).
+//
+// LoRA adapters are not exported: merge them first with transformers.MergeLoRA, or export them separately.
+func Export(ctx *context.Context, dir string, maxShardBytes int64) error {
+	dir = data.ReplaceTildeInDir(dir)
+	if maxShardBytes <= 0 {
+		maxShardBytes = DefaultMaxShardBytes
+	}
+	modelCtx := ctx.In("model")
+	config, err := transformers.NewConfigFromContext(modelCtx)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", dir)
+	}
+	configJSON, err := newHuggingFaceConfig(config)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", dir)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Export(%q): failed to create directory", dir)
+	}
+
+	modelVariables, err := transformers.ListModelVariables(modelCtx)
+	if err != nil {
+		return errors.WithMessagef(err, "Export(%q)", dir)
+	}
+
+	// Convert and write the tensors, one shard at a time.
+	var shard []safetensors.NamedTensor
+	var shardBytes, totalBytes int64
+	var shardFiles []string
+	index := weightsIndex{WeightMap: make(map[string]string)}
+	flushShard := func() error {
+		if len(shard) == 0 {
+			return nil
+		}
+		// Shards are renamed at the end, once the number of shards is known.
+		fileName := fmt.Sprintf("model-%05d.safetensors", len(shardFiles)+1)
+		err := safetensors.WriteFile(path.Join(dir, fileName), shard, map[string]string{"format": "pt"})
+		if err != nil {
+			return err
+		}
+		for _, namedTensor := range shard {
+			index.WeightMap[namedTensor.Name] = fileName
+		}
+		shardFiles = append(shardFiles, fileName)
+		shard, shardBytes = nil, 0
+		return nil
+	}
+	for _, modelVar := range modelVariables {
+		layouts := convertScopeAndNameToHuggingFace(append(modelVar.Scope, modelVar.Name), config.TransposeGatingEinsum)
+		if layouts == nil {
+			return errors.Errorf("Export(%q): variable %q has no corresponding HuggingFace tensor", dir, modelVar.Path())
+		}
+		name := modelVar.Name
+		scopedCtx := modelCtx
+		for _, p := range modelVar.Scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		value, err := transformers.DequantizeWeights(scopedCtx, name, config.DType)
+		if err != nil {
+			return errors.WithMessagef(err, "Export(%q)", dir)
+		}
+		if name == "input_embedding" && config.VocabularySize > transformers.HuggingFaceVocabularySize {
+			layouts[0].rows = transformers.HuggingFaceVocabularySize
+		}
+		for _, layout := range layouts {
+			tensor, err := convertLayout(value, layout)
+			if err != nil {
+				return errors.WithMessagef(err, "Export(%q): converting variable %q in scope %q to %q",
+					dir, name, scopedCtx.Scope(), layout.name)
+			}
+			size := int64(tensor.Shape().Memory())
+			if shardBytes > 0 && shardBytes+size > maxShardBytes {
+				if err = flushShard(); err != nil {
+					return errors.WithMessagef(err, "Export(%q)", dir)
+				}
+			}
+			shard = append(shard, safetensors.NamedTensor{Name: layout.name, Tensor: tensor})
+			shardBytes += size
+			totalBytes += size
+		}
+	}
+	if err = flushShard(); err != nil {
+		return errors.WithMessagef(err, "Export(%q)", dir)
+	}
+
+	// Rename shards to HuggingFace's convention, "model-<i>-of-<n>.safetensors".
+	finalNames := make(map[string]string, len(shardFiles))
+	for ii, fileName := range shardFiles {
+		finalNames[fileName] = fmt.Sprintf("model-%05d-of-%05d.safetensors", ii+1, len(shardFiles))
+		if err = os.Rename(path.Join(dir, fileName), path.Join(dir, finalNames[fileName])); err != nil {
+			return errors.Wrapf(err, "Export(%q): failed to rename shard %q", dir, fileName)
+		}
+	}
+	for tensorName, fileName := range index.WeightMap {
+		index.WeightMap[tensorName] = finalNames[fileName]
+	}
+	index.Metadata = &weightsIndexMetadata{TotalSize: totalBytes}
+	if err = writeJSON(path.Join(dir, WeightsIndexFileName), index); err != nil {
+		return errors.WithMessagef(err, "Export(%q)", dir)
+	}
+	if err = writeJSON(path.Join(dir, ConfigFileName), configJSON); err != nil {
+		return errors.WithMessagef(err, "Export(%q)", dir)
+	}
+	return nil
+}
+
+// writeJSON writes value as indented JSON to filePath.
+func writeJSON(filePath string, value any) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %q", filePath)
+	}
+	if err = os.WriteFile(filePath, append(contents, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %q", filePath)
+	}
+	return nil
+}
+
+// newHuggingFaceConfig returns the HuggingFace configuration matching the model config.
+func newHuggingFaceConfig(config *transformers.Config) (*hfConfig, error) {
+	torchDType, found := torchDTypes[config.DType]
+	if !found {
+		return nil, errors.Errorf("model dtype %s not supported, only bfloat16, float16 and float32", config.DType)
+	}
+	c := &hfConfig{
+		Architectures:         []string{"Gemma2ForCausalLM"},
+		ModelType:             "gemma2",
+		VocabSize:             min(config.VocabularySize, transformers.HuggingFaceVocabularySize),
+		HiddenSize:            config.EmbedDim,
+		IntermediateSize:      config.HiddenDim,
+		NumHiddenLayers:       config.NumLayers,
+		NumAttentionHeads:     config.NumHeads,
+		NumKeyValueHeads:      config.NumKVHeads,
+		HeadDim:               config.HeadDim,
+		HiddenActivation:      "gelu_pytorch_tanh",
+		MaxPositionEmbeddings: config.MaxSequenceLength,
+		RMSNormEps:            transformers.RMSNormEpsilon,
+		RopeTheta:             transformers.RoPEDefaultMaxWaveLength,
+		SlidingWindow:         config.SlidingWindowSize,
+		FinalLogitSoftcapping: config.FinalLogitSoftCap,
+		AttnLogitSoftcapping:  config.AttentionLogitsSoftCap,
+		PadTokenID:            padTokenID,
+		EOSTokenID:            eosTokenID,
+		BOSTokenID:            bosTokenID,
+		TorchDType:            torchDType,
+	}
+	if config.Type == transformers.Gemma_2B || config.Type == transformers.Gemma_7B {
+		c.Architectures = []string{"GemmaForCausalLM"}
+		c.ModelType = "gemma"
+	}
+
+	// HuggingFace scales the queries by 1/sqrt(query_pre_attn_scalar).
+	switch config.QueryPreAttentionNorm {
+	case transformers.QueryNormTypeByOneOverSqrtHeadDim:
+		c.QueryPreAttnScalar = config.HeadDim
+	case transformers.QueryNormTypeByOneOverSqrtEmbedDimDivNumHeads:
+		c.QueryPreAttnScalar = config.EmbedDim / config.NumHeads
+	default:
+		return nil, errors.Errorf("query pre-attention normalization %s not supported by HuggingFace's Gemma",
+			config.QueryPreAttentionNorm)
+	}
+	return c, nil
+}
+
+// tensorLayout describes how a HuggingFace tensor is derived from the value of a model variable.
+type tensorLayout struct {
+	// name of the HuggingFace tensor.
+	name string
+
+	// slice is the index on the first axis of the variable from which the tensor is taken, for variables that
+	// combine more than one projection. It is -1 if the whole variable is used.
+	slice int
+
+	// rows, if > 0, is the number of leading rows of the first axis of the variable kept in the tensor: it is
+	// used to drop the padding of the embedding table.
+	rows int
+
+	// permutation of the axes of the (sliced) variable. If nil, the axes are not permuted.
+	permutation []int
+
+	// rowAxes is the number of leading axes (after the permutation) merged into the rows of a matrix, with the
+	// remaining axes merged into its columns. If 0, the tensor is not reshaped.
+	rowAxes int
+}
+
+// huggingFaceNormNames maps the names of the normalization scopes of a layer to their HuggingFace names.
+var huggingFaceNormNames = map[string]string{
+	"pre_attention_norm":  "input_layernorm",
+	"post_attention_norm": "post_attention_layernorm",
+	"pre_ffw_norm":        "pre_feedforward_layernorm",
+	"post_ffw_norm":       "post_feedforward_layernorm",
+}
+
+// convertScopeAndNameToHuggingFace is the inverse of convertHuggingFaceNameToScopeAndName: it returns the layout of
+// the HuggingFace tensors derived from the model variable with the given scope and name (relative to the model scope).
+//
+// Variables of the Kaggle layout are converted to the HuggingFace projections, shaped [outputDim, inputDim].
+// It returns nil if the variable has no corresponding HuggingFace tensor.
+func convertScopeAndNameToHuggingFace(scopeAndName []string, transposeGatingEinsum bool) []tensorLayout {
+	whole := func(name string) []tensorLayout {
+		return []tensorLayout{{name: name, slice: -1}}
+	}
+	switch strings.Join(scopeAndName, context.ScopeSeparator) {
+	case "embedder/input_embedding":
+		return whole("model.embed_tokens.weight")
+	case "final_norm/scale":
+		return whole("model.norm.weight")
+	}
+
+	layerNumberStr, found := strings.CutPrefix(scopeAndName[0], "layer_")
+	if !found || len(scopeAndName) < 3 {
+		return nil
+	}
+	layerNumber, err := strconv.Atoi(layerNumberStr)
+	if err != nil {
+		return nil
+	}
+	prefix := fmt.Sprintf("model.layers.%d.", layerNumber)
+	layerScopeAndName := strings.Join(scopeAndName[1:], context.ScopeSeparator)
+	if normName, found := huggingFaceNormNames[scopeAndName[1]]; found && len(scopeAndName) == 3 && scopeAndName[2] == "scale" {
+		return whole(prefix + normName + ".weight")
+	}
+
+	// Layout of the query, key and value projections, from [N, D, H] to [N*H, D].
+	projection := func(name string, slice int) tensorLayout {
+		return tensorLayout{name: prefix + "self_attn." + name + ".weight", slice: slice, permutation: []int{0, 2, 1}, rowAxes: 2}
+	}
+	switch layerScopeAndName {
+	case "attn/hf/q_proj", "attn/hf/k_proj", "attn/hf/v_proj", "attn/hf/o_proj":
+		return whole(prefix + "self_attn." + scopeAndName[3] + ".weight")
+	case "mlp/hf/gating_proj":
+		return whole(prefix + "mlp.gate_proj.weight")
+	case "mlp/hf/up_proj", "mlp/hf/down_proj":
+		return whole(prefix + "mlp." + scopeAndName[3] + ".weight")
+	case "attn/q_einsum/w": // [N, D, H]
+		return []tensorLayout{projection("q_proj", -1)}
+	case "attn/kv_einsum/w": // [2, K, D, H]
+		return []tensorLayout{projection("k_proj", 0), projection("v_proj", 1)}
+	case "attn/qkv_einsum/w": // [3, N, D, H]
+		return []tensorLayout{projection("q_proj", 0), projection("k_proj", 1), projection("v_proj", 2)}
+	case "attn/attn_vec_einsum/w": // [N, H, D] -> [D, N*H]
+		return []tensorLayout{{name: prefix + "self_attn.o_proj.weight", slice: -1, permutation: []int{2, 0, 1}, rowAxes: 1}}
+	case "mlp/gating_einsum": // [2, D, F] or, if transposeGatingEinsum, [2, F, D] -> [F, D]
+		var permutation []int
+		if !transposeGatingEinsum {
+			permutation = []int{1, 0}
+		}
+		return []tensorLayout{
+			{name: prefix + "mlp.gate_proj.weight", slice: 0, permutation: permutation},
+			{name: prefix + "mlp.up_proj.weight", slice: 1, permutation: permutation},
+		}
+	case "mlp/linear": // [F, D] -> [D, F]
+		return []tensorLayout{{name: prefix + "mlp.down_proj.weight", slice: -1, permutation: []int{1, 0}}}
+	}
+	return nil
+}
+
+// convertLayout returns a new tensor with the value of t converted to the given layout.
+// It works on the raw bytes of the tensor, so it preserves its dtype.
+func convertLayout(t *tensors.Tensor, layout tensorLayout) (*tensors.Tensor, error) {
+	dtype := t.DType()
+	if layout.slice >= 0 {
+		dims := t.Shape().Dimensions
+		if len(dims) == 0 || layout.slice >= dims[0] {
+			return nil, errors.Errorf("cannot take slice #%d of the first axis of a tensor shaped %s", layout.slice, t.Shape())
+		}
+		sliced := tensors.FromShape(shapes.Make(dtype, dims[1:]...))
+		copyBytes(sliced, t, layout.slice*int(sliced.Shape().Memory()))
+		t = sliced
+	}
+	if layout.rows > 0 {
+		dims := slices.Clone(t.Shape().Dimensions)
+		if len(dims) == 0 || layout.rows > dims[0] {
+			return nil, errors.Errorf("cannot take %d rows of the first axis of a tensor shaped %s", layout.rows, t.Shape())
+		}
+		dims[0] = layout.rows
+		truncated := tensors.FromShape(shapes.Make(dtype, dims...))
+		copyBytes(truncated, t, 0)
+		t = truncated
+	}
+	if layout.permutation != nil {
+		var err error
+		t, err = transformers.TransposeTensor(t, layout.permutation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if layout.rowAxes == 0 {
+		return t, nil
+	}
+	dims := t.Shape().Dimensions
+	if layout.rowAxes > len(dims) {
+		return nil, errors.Errorf("tensor shaped %s has an unexpected rank", t.Shape())
+	}
+	rows, cols := 1, 1
+	for axis, dim := range dims {
+		if axis < layout.rowAxes {
+			rows *= dim
+		} else {
+			cols *= dim
+		}
+	}
+	output := tensors.FromShape(shapes.Make(dtype, rows, cols))
+	copyBytes(output, t, 0)
+	return output, nil
+}
+
+// copyBytes copies to output the bytes of input starting at offset, as many as the output holds.
+func copyBytes(output, input *tensors.Tensor, offset int) {
+	input.ConstBytes(func(inputBytes []byte) {
+		output.MutableBytes(func(outputBytes []byte) {
+			copy(outputBytes, inputBytes[offset:])
+		})
+	})
+}
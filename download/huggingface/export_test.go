@@ -0,0 +1,163 @@
+package huggingface
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomlx/gemma/safetensors"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestConvertScopeAndNameToHuggingFace(t *testing.T) {
+	// Variables in the HuggingFace layout are the inverse of convertHuggingFaceNameToScopeAndName.
+	for _, name := range []string{
+		"model.embed_tokens.weight",
+		"model.norm.weight",
+		"model.layers.3.input_layernorm.weight",
+		"model.layers.3.post_feedforward_layernorm.weight",
+		"model.layers.3.self_attn.k_proj.weight",
+		"model.layers.3.mlp.gate_proj.weight",
+		"model.layers.3.mlp.down_proj.weight",
+	} {
+		layouts := convertScopeAndNameToHuggingFace(convertHuggingFaceNameToScopeAndName(name), false)
+		require.Equal(t, []tensorLayout{{name: name, slice: -1}}, layouts)
+	}
+
+	// Kaggle layout.
+	layouts := convertScopeAndNameToHuggingFace([]string{"layer_1", "attn", "qkv_einsum", "w"}, false)
+	require.Len(t, layouts, 3)
+	require.Equal(t, "model.layers.1.self_attn.v_proj.weight", layouts[2].name)
+	require.Equal(t, 2, layouts[2].slice)
+	layouts = convertScopeAndNameToHuggingFace([]string{"layer_1", "mlp", "gating_einsum"}, true)
+	require.Equal(t, []tensorLayout{
+		{name: "model.layers.1.mlp.gate_proj.weight", slice: 0},
+		{name: "model.layers.1.mlp.up_proj.weight", slice: 1},
+	}, layouts)
+
+	require.Nil(t, convertScopeAndNameToHuggingFace([]string{"layer_1", "attn", "lora", "q_proj", "a"}, false))
+	require.Nil(t, convertScopeAndNameToHuggingFace([]string{"unknown", "w"}, false))
+}
+
+func TestConvertLayout(t *testing.T) {
+	// q_einsum shaped [N=2, D=3, H=2] to q_proj shaped [N*H, D].
+	qEinsum := tensors.FromValue([][][]float32{
+		{{0, 1}, {2, 3}, {4, 5}},
+		{{10, 11}, {12, 13}, {14, 15}},
+	})
+	layouts := convertScopeAndNameToHuggingFace([]string{"layer_0", "attn", "q_einsum", "w"}, false)
+	qProj, err := convertLayout(qEinsum, layouts[0])
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{0, 2, 4}, {1, 3, 5}, {10, 12, 14}, {11, 13, 15}}, qProj.Value())
+
+	// kv_einsum shaped [2, K=1, D=2, H=2]: the value projection is the second slice.
+	kvEinsum := tensors.FromValue([][][][]float32{{{{0, 1}, {2, 3}}}, {{{4, 5}, {6, 7}}}})
+	layouts = convertScopeAndNameToHuggingFace([]string{"layer_0", "attn", "kv_einsum", "w"}, false)
+	vProj, err := convertLayout(kvEinsum, layouts[1])
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{4, 6}, {5, 7}}, vProj.Value())
+
+	// attn_vec_einsum shaped [N=2, H=1, D=3] to o_proj shaped [D, N*H].
+	attnVec := tensors.FromValue([][][]float32{{{0, 1, 2}}, {{3, 4, 5}}})
+	layouts = convertScopeAndNameToHuggingFace([]string{"layer_0", "attn", "attn_vec_einsum", "w"}, false)
+	oProj, err := convertLayout(attnVec, layouts[0])
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{0, 3}, {1, 4}, {2, 5}}, oProj.Value())
+
+	// Wrong rank.
+	_, err = convertLayout(tensors.FromValue([]float32{1, 2}), layouts[0])
+	require.Error(t, err)
+}
+
+// newKaggleTestModel returns a Gemma2-2B shaped model (the number of layers is what identifies it) with the given
+// embedding table and tiny variables in the Kaggle layout: D=2, F=3, N=K=H=1.
+func newKaggleTestModel(embedding *tensors.Tensor) *context.Context {
+	ctx := context.New()
+	modelCtx := ctx.In("model")
+	modelCtx.In("embedder").VariableWithValue("input_embedding", embedding)
+	modelCtx.In("final_norm").VariableWithValue("scale", []float32{1, 1})
+	for layerIdx := range testNumLayers {
+		layerCtx := modelCtx.In(fmt.Sprintf("layer_%d", layerIdx))
+		for _, normName := range []string{"pre_attention_norm", "post_attention_norm", "pre_ffw_norm", "post_ffw_norm"} {
+			layerCtx.In(normName).VariableWithValue("scale", []float32{0, 0})
+		}
+		layerCtx.In("attn").In("q_einsum").VariableWithValue("w", [][][]float32{{{1}, {2}}}) // [N=1, D=2, H=1]
+		layerCtx.In("attn").In("kv_einsum").VariableWithValue("w", [][][][]float32{{{{1}, {2}}}, {{{3}, {4}}}})
+		layerCtx.In("attn").In("attn_vec_einsum").VariableWithValue("w", [][][]float32{{{1, 2}}}) // [N=1, H=1, D=2]
+		layerCtx.In("mlp").VariableWithValue("gating_einsum", [][][]float32{{{1, 2, 3}, {4, 5, 6}}, {{7, 8, 9}, {10, 11, 12}}})
+		layerCtx.In("mlp").VariableWithValue("linear", [][]float32{{1, 2}, {3, 4}, {5, 6}})
+	}
+	return ctx
+}
+
+const testNumLayers = 26
+
+func TestExport(t *testing.T) {
+	ctx := newKaggleTestModel(tensors.FromValue([][]float32{{1, 2}, {3, 4}, {5, 6}}))
+	dir := t.TempDir()
+	require.NoError(t, Export(ctx, dir, 512))
+	require.NoError(t, os.WriteFile(path.Join(dir, TokenizerFileName), nil, 0644))
+	files, err := listWeightsFiles(dir)
+	require.NoError(t, err)
+	require.Greater(t, len(files), 1)
+	require.True(t, strings.HasSuffix(files[0], fmt.Sprintf("-of-%05d.safetensors", len(files))))
+
+	tensorsByName := make(map[string]*tensors.Tensor)
+	for _, fileName := range files {
+		_, fileTensors, err := safetensors.ReadFile(path.Join(dir, fileName))
+		require.NoError(t, err)
+		for name, tensor := range fileTensors {
+			tensorsByName[name] = tensor
+		}
+	}
+	require.Len(t, tensorsByName, 2+testNumLayers*(4+4+3))
+	for name := range tensorsByName {
+		require.NotNilf(t, convertHuggingFaceNameToScopeAndName(name), "unknown tensor %q exported", name)
+	}
+	require.Equal(t, [][]float32{{1, 2}}, tensorsByName["model.layers.5.self_attn.k_proj.weight"].Value())
+	require.Equal(t, [][]float32{{7, 10}, {8, 11}, {9, 12}}, tensorsByName["model.layers.5.mlp.up_proj.weight"].Value())
+	require.Equal(t, [][]float32{{1, 3, 5}, {2, 4, 6}}, tensorsByName["model.layers.5.mlp.down_proj.weight"].Value())
+
+	configBytes, err := os.ReadFile(path.Join(dir, ConfigFileName))
+	require.NoError(t, err)
+	var config map[string]any
+	require.NoError(t, json.Unmarshal(configBytes, &config))
+	require.Equal(t, "gemma2", config["model_type"])
+	require.Equal(t, float64(testNumLayers), config["num_hidden_layers"])
+	require.Equal(t, float64(3), config["vocab_size"])
+	require.Equal(t, "float32", config["torch_dtype"])
+
+	// LoRA adapters must be merged first.
+	ctx.In("model").In("layer_0").In("attn").In(transformers.LoRAScope).In("q_proj").VariableWithValue("a", [][]float32{{1}})
+	require.ErrorContains(t, Export(ctx, t.TempDir(), 0), "MergeLoRA")
+
+	// Round-trip of a model with the padded Kaggle embedding table: it must be loaded back as a model in the
+	// HuggingFace layout, with the HuggingFace vocabulary size.
+	ctx = newKaggleTestModel(tensors.FromShape(shapes.Make(dtypes.BFloat16, transformers.KaggleVocabularySize, 2)))
+	dir = t.TempDir()
+	require.NoError(t, Export(ctx, dir, 0))
+	configBytes, err = os.ReadFile(path.Join(dir, ConfigFileName))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(configBytes, &config))
+	require.Equal(t, float64(transformers.HuggingFaceVocabularySize), config["vocab_size"])
+	require.Equal(t, "bfloat16", config["torch_dtype"])
+	writeTestTokenizer(t, dir)
+	loadedCtx := context.New()
+	_, err = LoadFromDir(loadedCtx, dir)
+	require.NoError(t, err)
+	modelCtx := loadedCtx.In("model")
+	loadedConfig, err := transformers.NewConfigFromContext(modelCtx)
+	require.NoError(t, err)
+	require.True(t, loadedConfig.HuggingFaceVersion)
+	require.Equal(t, transformers.HuggingFaceVocabularySize, loadedConfig.VocabularySize)
+	loadedConfig.EmbedDim, loadedConfig.HiddenDim = 2, 3
+	loadedConfig.NumHeads, loadedConfig.NumKVHeads, loadedConfig.HeadDim = 1, 1, 1
+	require.NoError(t, transformers.ValidateVariables(modelCtx, loadedConfig))
+}
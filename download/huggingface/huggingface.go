@@ -11,12 +11,18 @@
 package huggingface
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/gomlx/gemma/download/mmap"
 	"github.com/gomlx/gemma/sentencepiece"
 	"github.com/gomlx/gomlx/ml/context"
 	"github.com/gomlx/gomlx/ml/data"
 	gomlxhf "github.com/gomlx/gomlx/ml/data/huggingface"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
 	"github.com/gomlx/gomlx/types/xslices"
+	"github.com/pkg/errors"
+	"net/http"
 	"path"
 	"strconv"
 	"strings"
@@ -28,9 +34,20 @@ import (
 // The hfAuthToken is a HuggingFace token -- read-only access -- that needs to be created once in HuggingFace site.
 //
 // It loads the weights into the given context and creates a sentencepiece tokenizer (vocab) that is returned.
+// See DownloadWithOptions to transfer the weights directly to the device, or to load only some of the layers.
 //
 // An error is returned if something fails.
 func Download(ctx *context.Context, hfID, hfAuthToken, cacheDir string) (vocab *sentencepiece.Tokenizer, err error) {
+	return DownloadWithOptions(ctx, hfID, hfAuthToken, cacheDir, nil)
+}
+
+// DownloadWithOptions is like Download, but the downloaded files are loaded as configured by opts (it can be nil),
+// see LoadFromDirWithOptions.
+//
+// With opts.VerifyChecksums, the SHA-256 of the files stored in git LFS (the ".safetensors" files) are fetched from
+// HuggingFace into the mmap.ManifestFileName of the model directory (if not there yet), and the files are verified
+// against them.
+func DownloadWithOptions(ctx *context.Context, hfID, hfAuthToken, cacheDir string, opts *mmap.Options) (vocab *sentencepiece.Tokenizer, err error) {
 	cacheDir = data.ReplaceTildeInDir(cacheDir)
 	var hfm *gomlxhf.Model
 	hfm, err = gomlxhf.New(hfID, hfAuthToken, cacheDir)
@@ -41,30 +58,89 @@ func Download(ctx *context.Context, hfID, hfAuthToken, cacheDir string) (vocab *
 	if err != nil {
 		return
 	}
+	if opts != nil && opts.VerifyChecksums && !data.FileExists(path.Join(hfm.BaseDir, mmap.ManifestFileName)) {
+		if err = downloadChecksumsManifest(hfID, hfAuthToken, hfm.BaseDir); err != nil {
+			return
+		}
+	}
+	return LoadFromDirWithOptions(ctx, hfm.BaseDir, opts)
+}
+
+// modelsAPIURL is the URL of the HuggingFace API with the information about the models.
+var modelsAPIURL = "https://huggingface.co/api/models/"
 
-	vocab, err = sentencepiece.NewFromPath(path.Join(hfm.BaseDir, "tokenizer.model"))
+// lfsInfo is the subset of the model information (requested with the "blobs" parameter) with the SHA-256 of the
+// files stored in git LFS.
+type lfsInfo struct {
+	Siblings []struct {
+		Name string `json:"rfilename"`
+		LFS  *struct {
+			SHA256 string `json:"sha256"`
+		} `json:"lfs,omitempty"`
+	} `json:"siblings"`
+}
+
+// downloadChecksumsManifest writes the mmap.ManifestFileName of dir with the SHA-256 of the files of model hfID that
+// are stored in git LFS, as published by HuggingFace.
+func downloadChecksumsManifest(hfID, hfAuthToken, dir string) error {
+	url := modelsAPIURL + hfID + "?blobs=true"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return
+		return errors.Wrapf(err, "failed to create request for %q", url)
 	}
-
-	for entry, err2 := range hfm.EnumerateTensors() {
-		if err2 != nil {
-			err = err2
-			return
-		}
-		scopeAndName := convertHuggingFaceNameToScopeAndName(entry.Name)
-		if len(scopeAndName) == 0 {
-			fmt.Printf("Skipping: %s -> %s\n", entry.Name, entry.Tensor.Shape())
-		} else {
-			ctxTmp := ctx.In("model")
-			name, scope := xslices.Pop(scopeAndName)
-			for _, p := range scope {
-				ctxTmp = ctxTmp.In(p)
-			}
-			ctxTmp.VariableWithValue(name, entry.Tensor)
+	if hfAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+hfAuthToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download the checksums of the files from %q", url)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to download the checksums of the files from %q: %s", url, resp.Status)
+	}
+	var info lfsInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return errors.Wrapf(err, "failed to parse the checksums of the files downloaded from %q", url)
+	}
+	manifest := make(mmap.Manifest)
+	for _, sibling := range info.Siblings {
+		if sibling.LFS != nil && sibling.LFS.SHA256 != "" {
+			manifest[sibling.Name] = strings.ToLower(sibling.LFS.SHA256)
 		}
 	}
-	return
+	if len(manifest) == 0 {
+		return errors.Errorf("no checksums of files stored in git LFS found in %q", url)
+	}
+	return manifest.Write(dir)
+}
+
+// uploadTensorTask returns the task (without its Read function) that creates the variable (under the "model"
+// scope) corresponding to the HuggingFace tensor name.
+// Tensors not used by the model, or in layers not selected by opts, are reported as skipped, and it returns false.
+func uploadTensorTask(ctx *context.Context, tensorName string, shape shapes.Shape, opts *mmap.Options) (task mmap.Task, ok bool) {
+	scopeAndName := convertHuggingFaceNameToScopeAndName(tensorName)
+	if len(scopeAndName) == 0 {
+		opts.Skip(tensorName, shape, mmap.SkipUnmapped)
+		return
+	}
+	if opts.SkipScope(scopeAndName) {
+		opts.Skip(tensorName, shape, mmap.SkipLayer)
+		return
+	}
+	ctxTmp := ctx.In("model")
+	name, scope := xslices.Pop(scopeAndName)
+	for _, p := range scope {
+		ctxTmp = ctxTmp.In(p)
+	}
+	task = mmap.Task{
+		Name: tensorName,
+		Set: func(tensor *tensors.Tensor) error {
+			ctxTmp.VariableWithValue(name, tensor)
+			return nil
+		},
+	}
+	return task, true
 }
 
 func convertHuggingFaceNameToScopeAndName(name string) []string {
@@ -88,28 +164,28 @@ func convertHuggingFaceNameToScopeAndName(name string) []string {
 		layerScope := fmt.Sprintf("layer_%d", layerNumber)
 		switch parts[3] {
 		case "input_layernorm":
-			return append([]string{layerScope, "pre_attention_norm", "scale"})
+			return []string{layerScope, "pre_attention_norm", "scale"}
 		case "post_attention_layernorm":
-			return append([]string{layerScope, "post_attention_norm", "scale"})
+			return []string{layerScope, "post_attention_norm", "scale"}
 		case "post_feedforward_layernorm":
-			return append([]string{layerScope, "post_ffw_norm", "scale"})
+			return []string{layerScope, "post_ffw_norm", "scale"}
 		case "pre_feedforward_layernorm":
-			return append([]string{layerScope, "pre_ffw_norm", "scale"})
+			return []string{layerScope, "pre_ffw_norm", "scale"}
 		case "mlp":
 			// For the MLP (the GatedFeedForwardNetwork), the weights in HuggingFace are transposed/split differently,
 			// so they take new variable names not matching those in Kaggle version.
 			switch parts[4] {
 			case "down_proj":
-				return append([]string{layerScope, "mlp", "hf", "down_proj"})
+				return []string{layerScope, "mlp", "hf", "down_proj"}
 			case "gate_proj":
-				return append([]string{layerScope, "mlp", "hf", "gating_proj"})
+				return []string{layerScope, "mlp", "hf", "gating_proj"}
 			case "up_proj":
-				return append([]string{layerScope, "mlp", "hf", "up_proj"})
+				return []string{layerScope, "mlp", "hf", "up_proj"}
 			default:
 				return nil
 			}
 		case "self_attn":
-			return append([]string{layerScope, "attn", "hf", parts[4]})
+			return []string{layerScope, "attn", "hf", parts[4]}
 		default:
 			return nil
 		}
@@ -0,0 +1,191 @@
+package huggingface
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gemma/safetensors"
+	"github.com/gomlx/gemma/sentencepiece"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/data"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// TokenizerFileName is the name of the sentencepiece tokenizer file in a HuggingFace model directory.
+	TokenizerFileName = "tokenizer.model"
+
+	// WeightsFileName is the name of the weights file of a HuggingFace model stored in a single file.
+	WeightsFileName = "model.safetensors"
+
+	// WeightsIndexFileName is the name of the index file of a HuggingFace model with its weights sharded in
+	// multiple files: it maps each tensor name to the file that holds it.
+	WeightsIndexFileName = "model.safetensors.index.json"
+)
+
+// weightsIndex is the subset of the WeightsIndexFileName used.
+type weightsIndex struct {
+	Metadata  *weightsIndexMetadata `json:"metadata,omitempty"`
+	WeightMap map[string]string     `json:"weight_map"`
+}
+
+// weightsIndexMetadata is the metadata of the WeightsIndexFileName.
+type weightsIndexMetadata struct {
+	TotalSize int64 `json:"total_size"`
+}
+
+// LoadFromDir loads the Gemma model stored in HuggingFace format in the local directory dir: it doesn't access
+// the network nor requires a token, so it can be used in air-gapped machines, with the files copied from a
+// HuggingFace model repository.
+//
+// The directory must have the TokenizerFileName and either WeightsFileName or WeightsIndexFileName along with all
+// the ".safetensors" shards listed in it. Other files are ignored.
+//
+// It loads the weights into the given context and creates a sentencepiece tokenizer (vocab) that is returned.
+// See LoadFromDirWithOptions to transfer the weights directly to the device, or to load only some of the layers.
+func LoadFromDir(ctx *context.Context, dir string) (vocab *sentencepiece.Tokenizer, err error) {
+	return LoadFromDirWithOptions(ctx, dir, nil)
+}
+
+// LoadFromDirWithOptions is like LoadFromDir, but configured by opts (it can be nil): the ".safetensors" files are
+// memory-mapped, and each tensor is either copied to a local tensor, or, if opts.Backend is set, transferred
+// directly to the device without a copy in the Go heap. See mmap.Options.
+//
+// With opts.VerifyChecksums, the ".safetensors" files are verified against the mmap.ManifestFileName in dir, which
+// DownloadWithOptions creates from the HuggingFace's LFS hashes, and mmap.NewManifest can generate.
+//
+// With opts.Validate, the variables loaded are checked against those the model requests, see
+// transformers.ValidateModel.
+func LoadFromDirWithOptions(ctx *context.Context, dir string, opts *mmap.Options) (vocab *sentencepiece.Tokenizer, err error) {
+	dir = data.ReplaceTildeInDir(dir)
+	validate := opts != nil && opts.Validate
+	if validate && opts.Layers != nil {
+		return nil, errors.Errorf("LoadFromDir(%q): Options.Validate can't be used with Options.Layers, the other "+
+			"layers are not loaded", dir)
+	}
+	weightsFiles, err := listWeightsFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	vocab, err = sentencepiece.NewFromPath(path.Join(dir, TokenizerFileName))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "LoadFromDir(%q)", dir)
+	}
+	manifest, err := opts.ChecksumsManifest(dir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "LoadFromDir(%q)", dir)
+	}
+	var tasks []mmap.Task
+	for _, fileName := range weightsFiles {
+		f, fileTasks, err := weightsFileTasks(ctx, dir, fileName, manifest, opts)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "LoadFromDir(%q)", dir)
+		}
+		defer func() { _ = f.Close() }()
+		tasks = append(tasks, fileTasks...)
+	}
+	if err = opts.Run(tasks); err != nil {
+		return nil, errors.WithMessagef(err, "LoadFromDir(%q)", dir)
+	}
+	if validate {
+		if err = transformers.ValidateModel(ctx.In("model")); err != nil {
+			return nil, errors.WithMessagef(err, "LoadFromDir(%q)", dir)
+		}
+	}
+	return vocab, nil
+}
+
+// weightsFileTasks memory-maps the ".safetensors" file fileName of dir, and returns the tasks that create the
+// variables (under the "model" scope) of its tensors, in the order of their names. The returned file must be
+// closed once the tasks are run.
+//
+// If manifest is not nil, the file is first verified against it.
+func weightsFileTasks(ctx *context.Context, dir, fileName string, manifest mmap.Manifest, opts *mmap.Options) (*mmap.File, []mmap.Task, error) {
+	filePath := path.Join(dir, fileName)
+	f, err := mmap.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	contents := f.Bytes()
+	if manifest != nil {
+		if err = manifest.Verify(fileName, contents); err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+	}
+	header, err := safetensors.ReadHeader(bytes.NewReader(contents))
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, errors.WithMessagef(err, "reading %q", filePath)
+	}
+	infos := slices.Clone(header.Tensors)
+	slices.SortFunc(infos, func(a, b *safetensors.TensorInfo) int { return strings.Compare(a.Name, b.Name) })
+	var tasks []mmap.Task
+	for _, info := range infos {
+		start := header.DataOffset + info.Offset
+		if start+info.Size > int64(len(contents)) {
+			_ = f.Close()
+			return nil, nil, errors.Errorf("file %q is truncated: tensor %q requires bytes up to %d, but file has %d bytes",
+				filePath, info.Name, start+info.Size, len(contents))
+		}
+		task, ok := uploadTensorTask(ctx, info.Name, info.Shape, opts)
+		if !ok {
+			continue
+		}
+		task.Bytes = info.Size
+		task.Read = func() (*tensors.Tensor, error) {
+			return opts.NewTensor(info.Shape, contents[start:start+info.Size])
+		}
+		tasks = append(tasks, task)
+	}
+	return f, tasks, nil
+}
+
+// listWeightsFiles returns the ".safetensors" files of the model in dir, checking that all the required files
+// exist. If some are missing, the error lists all of them.
+func listWeightsFiles(dir string) ([]string, error) {
+	var weightsFiles, missing []string
+	if !data.FileExists(path.Join(dir, TokenizerFileName)) {
+		missing = append(missing, TokenizerFileName)
+	}
+	indexPath := path.Join(dir, WeightsIndexFileName)
+	switch {
+	case data.FileExists(indexPath):
+		indexBytes, err := os.ReadFile(indexPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "LoadFromDir(%q): failed to read %q", dir, WeightsIndexFileName)
+		}
+		var index weightsIndex
+		if err = json.Unmarshal(indexBytes, &index); err != nil {
+			return nil, errors.Wrapf(err, "LoadFromDir(%q): failed to parse %q", dir, WeightsIndexFileName)
+		}
+		for _, fileName := range index.WeightMap {
+			if !slices.Contains(weightsFiles, fileName) {
+				weightsFiles = append(weightsFiles, fileName)
+			}
+		}
+		if len(weightsFiles) == 0 {
+			return nil, errors.Errorf("LoadFromDir(%q): %q lists no weights files", dir, WeightsIndexFileName)
+		}
+		slices.Sort(weightsFiles)
+		for _, fileName := range weightsFiles {
+			if !data.FileExists(path.Join(dir, fileName)) {
+				missing = append(missing, fileName)
+			}
+		}
+	case data.FileExists(path.Join(dir, WeightsFileName)):
+		weightsFiles = []string{WeightsFileName}
+	default:
+		missing = append(missing, WeightsFileName+" (or "+WeightsIndexFileName+" and its shards)")
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("LoadFromDir(%q): missing files: %s", dir, strings.Join(missing, ", "))
+	}
+	return weightsFiles, nil
+}
@@ -0,0 +1,124 @@
+package huggingface
+
+import (
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gemma/safetensors"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListWeightsFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadFromDir(nil, dir)
+	require.ErrorContains(t, err, "missing files: tokenizer.model, model.safetensors")
+
+	// Single weights file.
+	require.NoError(t, os.WriteFile(path.Join(dir, TokenizerFileName), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, WeightsFileName), nil, 0644))
+	files, err := listWeightsFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{WeightsFileName}, files)
+
+	// Sharded weights: the index takes precedence, and the missing shards are listed.
+	index := `{"metadata": {"total_size": 10}, "weight_map": {
+		"model.embed_tokens.weight": "model-00001-of-00003.safetensors",
+		"model.norm.weight": "model-00003-of-00003.safetensors",
+		"model.layers.0.mlp.up_proj.weight": "model-00002-of-00003.safetensors",
+		"model.layers.1.mlp.up_proj.weight": "model-00002-of-00003.safetensors"}}`
+	require.NoError(t, os.WriteFile(path.Join(dir, WeightsIndexFileName), []byte(index), 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "model-00002-of-00003.safetensors"), nil, 0644))
+	_, err = listWeightsFiles(dir)
+	require.ErrorContains(t, err, "missing files: model-00001-of-00003.safetensors, model-00003-of-00003.safetensors")
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "model-00001-of-00003.safetensors"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "model-00003-of-00003.safetensors"), nil, 0644))
+	files, err = listWeightsFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"model-00001-of-00003.safetensors", "model-00002-of-00003.safetensors",
+		"model-00003-of-00003.safetensors"}, files)
+}
+
+func TestLoadFromDirWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTokenizer(t, dir)
+	err := safetensors.WriteFile(path.Join(dir, WeightsFileName), []safetensors.NamedTensor{
+		{Name: "model.embed_tokens.weight", Tensor: tensors.FromValue([][]float32{{1, 2}, {3, 4}})},
+		{Name: "model.norm.weight", Tensor: tensors.FromValue([]float32{5, 6})},
+		{Name: "model.layers.0.input_layernorm.weight", Tensor: tensors.FromValue([]float32{7, 8})},
+		{Name: "model.layers.1.input_layernorm.weight", Tensor: tensors.FromValue([]float32{9, 10})},
+		{Name: "lm_head.weight", Tensor: tensors.FromValue([]float32{11})},
+	}, nil)
+	require.NoError(t, err)
+
+	ctx := context.New()
+	_, err = LoadFromDirWithOptions(ctx, dir, &mmap.Options{Layers: []int{1}})
+	require.NoError(t, err)
+	modelCtx := ctx.In("model")
+	require.Equal(t, [][]float32{{1, 2}, {3, 4}}, modelCtx.In("embedder").GetVariable("input_embedding").Value().Value())
+	require.Equal(t, []float32{5, 6}, modelCtx.In("final_norm").GetVariable("scale").Value().Value())
+	require.Nil(t, modelCtx.In("layer_0").In("pre_attention_norm").GetVariable("scale"))
+	require.Equal(t, []float32{9, 10}, modelCtx.In("layer_1").In("pre_attention_norm").GetVariable("scale").Value().Value())
+
+	// Validation: it can't be combined with Layers, and the variables don't match any Gemma model.
+	_, err = LoadFromDirWithOptions(context.New(), dir, &mmap.Options{Validate: true, Layers: []int{1}})
+	require.ErrorContains(t, err, "Options.Validate can't be used with Options.Layers")
+	_, err = LoadFromDirWithOptions(context.New(), dir, &mmap.Options{Validate: true})
+	require.ErrorContains(t, err, "failed to validate the model variables")
+
+	// Checksums.
+	verifyOpts := &mmap.Options{VerifyChecksums: true}
+	_, err = LoadFromDirWithOptions(context.New(), dir, verifyOpts)
+	require.ErrorContains(t, err, mmap.ManifestFileName)
+	manifest, err := mmap.NewManifest(dir, []string{WeightsFileName})
+	require.NoError(t, err)
+	require.NoError(t, manifest.Write(dir))
+	_, err = LoadFromDirWithOptions(context.New(), dir, verifyOpts)
+	require.NoError(t, err)
+
+	// Truncated file.
+	contents, err := os.ReadFile(path.Join(dir, WeightsFileName))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, WeightsFileName), contents[:len(contents)-4], 0644))
+	_, err = LoadFromDir(context.New(), dir)
+	require.ErrorContains(t, err, "truncated")
+	_, err = LoadFromDirWithOptions(context.New(), dir, verifyOpts)
+	require.ErrorContains(t, err, "corrupted")
+}
+
+func TestDownloadChecksumsManifest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/google/gemma-2-2b-it" || r.URL.Query().Get("blobs") != "true" ||
+			r.Header.Get("Authorization") != "Bearer token" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id": "google/gemma-2-2b-it", "siblings": [
+			{"rfilename": "config.json", "size": 10},
+			{"rfilename": "model-00001-of-00002.safetensors", "lfs": {"sha256": "AB01", "size": 100}},
+			{"rfilename": "tokenizer.model", "lfs": {"sha256": "cd23", "size": 10}}]}`))
+	}))
+	defer server.Close()
+	defer func(url string) { modelsAPIURL = url }(modelsAPIURL)
+	modelsAPIURL = server.URL + "/"
+
+	dir := t.TempDir()
+	require.NoError(t, downloadChecksumsManifest("google/gemma-2-2b-it", "token", dir))
+	contents, err := os.ReadFile(path.Join(dir, mmap.ManifestFileName))
+	require.NoError(t, err)
+	require.Equal(t, "ab01  model-00001-of-00002.safetensors\ncd23  tokenizer.model\n", string(contents))
+	require.Error(t, downloadChecksumsManifest("google/gemma-2-2b-it", "wrong token", dir))
+}
+
+// writeTestTokenizer writes to dir a minimal sentencepiece model proto supported: an "<unk>" piece,
+// trainer_spec.model_type = BPE and normalizer_spec.{add_dummy_prefix,remove_extra_whitespaces} = false.
+func writeTestTokenizer(t *testing.T, dir string) {
+	modelProto := append([]byte{0x0a, 0x09, 0x0a, 0x05}, "<unk>"...)
+	modelProto = append(modelProto, 0x18, 0x02, 0x12, 0x02, 0x18, 0x02, 0x1a, 0x04, 0x18, 0x00, 0x20, 0x00)
+	require.NoError(t, os.WriteFile(path.Join(dir, TokenizerFileName), modelProto, 0644))
+}
@@ -0,0 +1,192 @@
+package huggingface
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomlx/gemma/safetensors"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gemma/trees"
+	"github.com/gomlx/gomlx/ml/data"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/pkg/errors"
+	"github.com/x448/float16"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PEFTConfigFileName is the name of the configuration file of an adapter saved by HuggingFace's PEFT library.
+	PEFTConfigFileName = "adapter_config.json"
+
+	// PEFTWeightsFileName is the name of the weights file of an adapter saved by HuggingFace's PEFT library.
+	PEFTWeightsFileName = "adapter_model.safetensors"
+)
+
+// peftConfig is the subset of PEFT's adapter_config.json used.
+type peftConfig struct {
+	PEFTType  string  `json:"peft_type"`
+	Rank      int     `json:"r"`
+	Alpha     float64 `json:"lora_alpha"`
+	Dropout   float64 `json:"lora_dropout"`
+	UseRSLoRA bool    `json:"use_rslora"`
+	UseDoRA   bool    `json:"use_dora"`
+}
+
+// LoadPEFTAdapter loads a LoRA adapter saved by HuggingFace's PEFT library in adapterDir (the files
+// "adapter_config.json" and "adapter_model.safetensors") for a Gemma model.
+//
+// The returned adapter can be served along with others with transformers.SetLoRAAdapters (or with
+// samplers.Sampler.SetLoRAAdapters).
+func LoadPEFTAdapter(name, adapterDir string) (*transformers.LoRAAdapter, error) {
+	adapterDir = data.ReplaceTildeInDir(adapterDir)
+	configPath := path.Join(adapterDir, PEFTConfigFileName)
+	configBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read PEFT adapter configuration from %q", configPath)
+	}
+	var config peftConfig
+	if err = json.Unmarshal(configBytes, &config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse PEFT adapter configuration from %q", configPath)
+	}
+	if config.PEFTType != "" && config.PEFTType != "LORA" {
+		return nil, errors.Errorf("PEFT adapter in %q has type %q, only \"LORA\" is supported", adapterDir, config.PEFTType)
+	}
+	if config.UseRSLoRA || config.UseDoRA {
+		return nil, errors.Errorf("PEFT adapter in %q uses rsLoRA or DoRA, which are not supported", adapterDir)
+	}
+	if config.Rank <= 0 {
+		return nil, errors.Errorf("PEFT adapter in %q has invalid rank r=%d", adapterDir, config.Rank)
+	}
+
+	weightsPath := path.Join(adapterDir, PEFTWeightsFileName)
+	_, tensorsByName, err := safetensors.ReadFile(weightsPath)
+	if err != nil {
+		return nil, err
+	}
+	adapter := &transformers.LoRAAdapter{
+		Name: name,
+		Config: &transformers.LoRAConfig{
+			Rank:    config.Rank,
+			Alpha:   config.Alpha,
+			Dropout: config.Dropout,
+		},
+		Weights: trees.New[*tensors.Tensor](),
+	}
+	for tensorName, tensor := range tensorsByName {
+		treePath, target, isA := convertPEFTName(tensorName)
+		if treePath == nil {
+			return nil, errors.Errorf("PEFT adapter %q: unknown tensor %q", weightsPath, tensorName)
+		}
+		if !slices.Contains(adapter.Config.Targets, target) {
+			adapter.Config.Targets = append(adapter.Config.Targets, target)
+		}
+
+		// PEFT stores A shaped [rank, inputDim] and B shaped [outputDim, rank]: they are transposed to
+		// A shaped [inputDim, rank] and B shaped [rank, outputDim].
+		if tensor.Shape().Rank() != 2 {
+			return nil, errors.Errorf("PEFT adapter %q: tensor %q shaped %s, expected rank 2", weightsPath, tensorName, tensor.Shape())
+		}
+		tensor, err = transposeToFloat32(tensor)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "PEFT adapter %q: tensor %q", weightsPath, tensorName)
+		}
+		rankAxis := 1
+		if !isA {
+			rankAxis = 0
+		}
+		if tensor.Shape().Dim(rankAxis) != config.Rank {
+			return nil, errors.Errorf("PEFT adapter %q: tensor %q shaped %s (after transposing), expected rank %d",
+				weightsPath, tensorName, tensor.Shape(), config.Rank)
+		}
+		if err = adapter.Weights.Set(treePath, tensor); err != nil {
+			return nil, errors.WithMessagef(err, "PEFT adapter %q: tensor %q", weightsPath, tensorName)
+		}
+	}
+	if len(adapter.Config.Targets) == 0 {
+		return nil, errors.Errorf("PEFT adapter %q has no LoRA weights", weightsPath)
+	}
+	return adapter, nil
+}
+
+// convertPEFTName converts the name of a PEFT LoRA tensor (e.g.:
+// "base_model.model.model.layers.0.self_attn.q_proj.lora_A.weight") to the path of the corresponding variable
+// (e.g.: "layer_0/attn/lora/q_proj/a"). It also returns the projection adapted and whether it is the A weights.
+//
+// It returns a nil path if the name is not recognized.
+func convertPEFTName(name string) (treePath trees.Path, target transformers.LoRATarget, isA bool) {
+	idx := strings.Index(name, "layers.")
+	if idx < 0 {
+		return
+	}
+	parts := strings.Split(name[idx:], ".")
+	if len(parts) < 5 || (len(parts) == 6 && parts[5] != "weight") || len(parts) > 6 {
+		return
+	}
+	layerIdx, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	var layerScope string
+	switch parts[2] {
+	case "self_attn":
+		layerScope = "attn"
+	case "mlp":
+		layerScope = "mlp"
+	default:
+		return
+	}
+	target = transformers.LoRATarget(parts[3])
+	if !slices.Contains(transformers.LoRAAllTargets, target) {
+		return
+	}
+	var weightsName string
+	switch parts[4] {
+	case "lora_A":
+		weightsName, isA = "a", true
+	case "lora_B":
+		weightsName = "b"
+	default:
+		return
+	}
+	treePath = trees.Path{fmt.Sprintf("layer_%d", layerIdx), layerScope, transformers.LoRAScope, string(target), weightsName}
+	return
+}
+
+// transposeToFloat32 transposes a matrix, converting it to float32.
+func transposeToFloat32(t *tensors.Tensor) (*tensors.Tensor, error) {
+	rows, cols := t.Shape().Dim(0), t.Shape().Dim(1)
+	values := make([]float32, rows*cols)
+	switch t.DType() {
+	case dtypes.Float32:
+		tensors.ConstFlatData(t, func(flat []float32) { copy(values, flat) })
+	case dtypes.BFloat16:
+		tensors.ConstFlatData(t, func(flat []bfloat16.BFloat16) {
+			for ii, v := range flat {
+				values[ii] = v.Float32()
+			}
+		})
+	case dtypes.Float16:
+		tensors.ConstFlatData(t, func(flat []float16.Float16) {
+			for ii, v := range flat {
+				values[ii] = v.Float32()
+			}
+		})
+	default:
+		return nil, errors.Errorf("dtype %s not supported, only float32, bfloat16 and float16", t.DType())
+	}
+	transposed := tensors.FromShape(shapes.Make(dtypes.Float32, cols, rows))
+	tensors.MutableFlatData(transposed, func(flat []float32) {
+		for row := range rows {
+			for col := range cols {
+				flat[col*rows+row] = values[row*cols+col]
+			}
+		}
+	})
+	return transposed, nil
+}
@@ -0,0 +1,63 @@
+package huggingface
+
+import (
+	"github.com/gomlx/gemma/safetensors"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gemma/trees"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestConvertPEFTName(t *testing.T) {
+	treePath, target, isA := convertPEFTName("base_model.model.model.layers.3.self_attn.q_proj.lora_A.weight")
+	require.Equal(t, trees.Path{"layer_3", "attn", "lora", "q_proj", "a"}, treePath)
+	require.Equal(t, transformers.LoRATargetQuery, target)
+	require.True(t, isA)
+
+	treePath, target, isA = convertPEFTName("base_model.model.model.layers.0.mlp.down_proj.lora_B.weight")
+	require.Equal(t, trees.Path{"layer_0", "mlp", "lora", "down_proj", "b"}, treePath)
+	require.Equal(t, transformers.LoRATargetDown, target)
+	require.False(t, isA)
+
+	for _, name := range []string{
+		"base_model.model.model.embed_tokens.weight",
+		"base_model.model.model.layers.0.self_attn.q_proj.weight",
+		"base_model.model.model.layers.0.self_attn.x_proj.lora_A.weight",
+		"base_model.model.model.layers.x.self_attn.q_proj.lora_A.weight",
+	} {
+		treePath, _, _ = convertPEFTName(name)
+		require.Nil(t, treePath, "name %q", name)
+	}
+}
+
+func TestLoadPEFTAdapter(t *testing.T) {
+	dir := t.TempDir()
+	config := `{"peft_type": "LORA", "r": 2, "lora_alpha": 4, "target_modules": ["v_proj"]}`
+	require.NoError(t, os.WriteFile(path.Join(dir, PEFTConfigFileName), []byte(config), 0644))
+	require.NoError(t, safetensors.WriteFile(path.Join(dir, PEFTWeightsFileName), []safetensors.NamedTensor{
+		{Name: "base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight", Tensor: tensors.FromValue([][]float32{{1, 2, 3}, {4, 5, 6}})},
+		{Name: "base_model.model.model.layers.0.self_attn.v_proj.lora_B.weight", Tensor: tensors.FromValue([][]float32{{1, 2}})},
+	}, map[string]string{"format": "pt"}))
+
+	adapter, err := LoadPEFTAdapter("test", dir)
+	require.NoError(t, err)
+	require.Equal(t, "test", adapter.Name)
+	require.Equal(t, 2, adapter.Config.Rank)
+	require.Equal(t, 2.0, adapter.Config.Scale())
+	require.Equal(t, []transformers.LoRATarget{transformers.LoRATargetValue}, adapter.Config.Targets)
+	a, err := adapter.Weights.Get("layer_0", "attn", "lora", "v_proj", "a")
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1, 4}, {2, 5}, {3, 6}}, a.Value())
+	b, err := adapter.Weights.Get("layer_0", "attn", "lora", "v_proj", "b")
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1}, {2}}, b.Value())
+
+	// Rank mismatch.
+	config = `{"peft_type": "LORA", "r": 3, "lora_alpha": 4}`
+	require.NoError(t, os.WriteFile(path.Join(dir, PEFTConfigFileName), []byte(config), 0644))
+	_, err = LoadPEFTAdapter("test", dir)
+	require.Error(t, err)
+}
@@ -78,16 +78,11 @@ func fromJsonTreeMetaData(jsonTree any) (tree *trees.Tree[*Metadata], err error)
 	for key, value := range mapAny {
 		switch key {
 		case KeyUseZarr3:
-			// Check for Zarr3: not supported.
-			zarr3, ok := value.(bool)
-			if !ok {
+			// Both Zarr versions 2 and 3 are supported: the version used by each array is detected when reading it.
+			if _, ok := value.(bool); !ok {
 				err = errors.Errorf("metadata json value for key %q is not a bool, got %T instead", key, value)
 				return
 			}
-			if zarr3 {
-				err = errors.Errorf("%q set to true, but Zarr3 is not supported by this library", key)
-				return
-			}
 		case KeyTreeMetadata:
 			entries, ok := value.(map[string]any)
 			if !ok {
@@ -0,0 +1,542 @@
+package kaggle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gomlx/gomlx/ml/data"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"slices"
+)
+
+// This file implements a read-only key-value store over an "Orbax Consistent Distributed Backend Tree" (OCDBT)
+// directory, as written by TensorStore (and used by Orbax to save the Kaggle checkpoints).
+//
+// An OCDBT store is a B+tree: the manifest (OCDBTManifestFileName) points to the root node of the latest version of
+// the tree, and the nodes and the values (unless they are small enough to be stored inline in the nodes) are stored
+// in data files, under the "d/" subdirectory. See the format description in
+// https://google.github.io/tensorstore/kvstore/ocdbt/index.html.
+
+const (
+	ocdbtManifestMagic  = 0x0cdb3a2a
+	ocdbtBtreeNodeMagic = 0x0cdb20de
+
+	ocdbtMaxFormatVersion = 1
+
+	ocdbtCompressionNone = 0
+	ocdbtCompressionZstd = 1
+
+	ocdbtManifestKindSingle = 0
+
+	ocdbtValueInline   = 0
+	ocdbtValueIndirect = 1
+
+	// ocdbtMaxHeight is a sanity limit to the height of the B+tree, to protect against corrupted (cyclic) trees.
+	ocdbtMaxHeight = 32
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ocdbtDataFile identifies one data file of an OCDBT store, relative to its directory.
+type ocdbtDataFile struct {
+	basePath, relativePath string
+}
+
+// ocdbtReference is the location of a B+tree node or of a value stored in a data file.
+type ocdbtReference struct {
+	file           *ocdbtDataFile
+	offset, length uint64
+}
+
+// ocdbtValue is either stored inline or referenced in a data file.
+type ocdbtValue struct {
+	inline   []byte
+	indirect *ocdbtReference
+}
+
+// ocdbtStore is a read-only OCDBT key-value store: all its keys are indexed when it is opened.
+type ocdbtStore struct {
+	dir    string
+	values map[string]ocdbtValue
+}
+
+// openOCDBT opens the OCDBT store in dir, reading its manifest and indexing all the keys of the latest version.
+func openOCDBT(dir string) (*ocdbtStore, error) {
+	dir = data.ReplaceTildeInDir(dir)
+	store := &ocdbtStore{dir: dir, values: make(map[string]ocdbtValue)}
+	manifestPath := path.Join(dir, OCDBTManifestFileName)
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read OCDBT manifest %q", manifestPath)
+	}
+	root, rootHeight, err := parseOCDBTManifest(manifest)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse OCDBT manifest %q", manifestPath)
+	}
+	if root == nil {
+		// Empty tree.
+		return store, nil
+	}
+	if err = store.indexNode(root, rootHeight, nil); err != nil {
+		return nil, errors.WithMessagef(err, "reading OCDBT store in %q", dir)
+	}
+	return store, nil
+}
+
+// Keys returns the sorted list of keys in the store.
+func (s *ocdbtStore) Keys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Has returns whether the key is present in the store.
+func (s *ocdbtStore) Has(key string) bool {
+	_, found := s.values[key]
+	return found
+}
+
+// Get returns the value of the key. It returns an error wrapping os.ErrNotExist if the key is not present.
+func (s *ocdbtStore) Get(key string) ([]byte, error) {
+	value, found := s.values[key]
+	if !found {
+		return nil, errors.Wrapf(os.ErrNotExist, "key %q not found in OCDBT store %q", key, s.dir)
+	}
+	if value.indirect == nil {
+		return value.inline, nil
+	}
+	return s.read(value.indirect)
+}
+
+// read the referenced bytes from its data file.
+func (s *ocdbtStore) read(ref *ocdbtReference) ([]byte, error) {
+	filePath, err := s.dataFilePath(ref.file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open OCDBT data file %q", filePath)
+	}
+	defer func() { _ = f.Close() }()
+	buf := make([]byte, ref.length)
+	if _, err = f.ReadAt(buf, int64(ref.offset)); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %d bytes at offset %d from OCDBT data file %q", ref.length, ref.offset, filePath)
+	}
+	return buf, nil
+}
+
+// dataFilePath returns the path of the data file: data files are stored under the "d/" subdirectory of their base
+// path, but for robustness the relative path is also tried directly.
+func (s *ocdbtStore) dataFilePath(file *ocdbtDataFile) (string, error) {
+	candidates := []string{
+		path.Join(s.dir, file.basePath, "d", file.relativePath),
+		path.Join(s.dir, file.basePath, file.relativePath),
+	}
+	for _, candidate := range candidates {
+		if data.FileExists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", errors.Errorf("OCDBT data file %q (base path %q) not found in %q", file.relativePath, file.basePath, s.dir)
+}
+
+// indexNode reads the B+tree node (and recursively its children) and indexes its keys, prefixed by keyPrefix.
+func (s *ocdbtStore) indexNode(ref *ocdbtReference, height int, keyPrefix []byte) error {
+	if height > ocdbtMaxHeight {
+		return errors.Errorf("OCDBT B+tree height %d is larger than the maximum %d, the store is likely corrupted", height, ocdbtMaxHeight)
+	}
+	encoded, err := s.read(ref)
+	if err != nil {
+		return err
+	}
+	node, err := parseOCDBTNode(encoded)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to parse OCDBT B+tree node in %q at offset %d", ref.file.relativePath, ref.offset)
+	}
+	if node.height != height {
+		return errors.Errorf("OCDBT B+tree node in %q at offset %d has height %d, expected %d",
+			ref.file.relativePath, ref.offset, node.height, height)
+	}
+	for _, entry := range node.entries {
+		key := slices.Concat(keyPrefix, entry.key)
+		if node.height == 0 {
+			s.values[string(key)] = entry.value
+			continue
+		}
+		childPrefix := key[:len(keyPrefix)+entry.subtreeCommonPrefixLength]
+		if err = s.indexNode(entry.child, height-1, childPrefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeOCDBTEnvelope validates the header (magic, length and version) and the footer (CRC-32C checksum) of an
+// encoded OCDBT manifest or B+tree node, and returns its uncompressed body.
+//
+// The header is: magic (uint32 big-endian), length of the whole encoded data (uint64 little-endian),
+// version (varint) and compression format (varint). The footer is the CRC-32C of everything before it
+// (uint32 little-endian).
+func decodeOCDBTEnvelope(encoded []byte, magic uint32) ([]byte, error) {
+	const minLength = 4 + 8 + 1 + 1 + 4
+	if len(encoded) < minLength {
+		return nil, errors.Errorf("encoded OCDBT data has %d bytes, less than the minimum of %d", len(encoded), minLength)
+	}
+	if got := binary.BigEndian.Uint32(encoded); got != magic {
+		return nil, errors.Errorf("invalid OCDBT magic value 0x%08x, expected 0x%08x", got, magic)
+	}
+	if length := binary.LittleEndian.Uint64(encoded[4:]); length != uint64(len(encoded)) {
+		return nil, errors.Errorf("encoded OCDBT data length is %d, but its header says %d", len(encoded), length)
+	}
+	footerPos := len(encoded) - 4
+	if want, got := binary.LittleEndian.Uint32(encoded[footerPos:]), crc32.Checksum(encoded[:footerPos], crc32cTable); want != got {
+		return nil, errors.Errorf("OCDBT data checksum mismatch: got 0x%08x, expected 0x%08x", got, want)
+	}
+	r := &ocdbtReader{data: encoded[12:footerPos]}
+	version := r.uvarint()
+	compression := r.uvarint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if version > ocdbtMaxFormatVersion {
+		return nil, errors.Errorf("OCDBT format version %d not supported, at most %d", version, ocdbtMaxFormatVersion)
+	}
+	body := r.data[r.pos:]
+	switch compression {
+	case ocdbtCompressionNone:
+		return body, nil
+	case ocdbtCompressionZstd:
+		return zstdDecompress(body)
+	default:
+		return nil, errors.Errorf("OCDBT compression format %d not supported", compression)
+	}
+}
+
+// zstdDecompress decompresses zstd compressed data.
+func zstdDecompress(compressed []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create zstd decoder")
+	}
+	defer decoder.Close()
+	decompressed, err := io.ReadAll(decoder)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress zstd data")
+	}
+	return decompressed, nil
+}
+
+// parseOCDBTManifest parses a manifest, and returns the reference to the root node of the latest version of the
+// B+tree and its height. It returns a nil root if the tree is empty.
+//
+// Only manifests of kind "single" (with the version tree inline) are supported.
+func parseOCDBTManifest(encoded []byte) (root *ocdbtReference, rootHeight int, err error) {
+	body, err := decodeOCDBTEnvelope(encoded, ocdbtManifestMagic)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := &ocdbtReader{data: body}
+
+	// Config.
+	_ = r.bytes(16) // UUID.
+	manifestKind := r.uvarint()
+	_ = r.uvarint() // max_inline_value_bytes
+	_ = r.uvarint() // max_decoded_node_bytes
+	_ = r.byte()    // version_tree_arity_log2
+	if compression := r.uvarint(); compression == ocdbtCompressionZstd {
+		_ = r.uvarint() // zstd compression level.
+	}
+	if r.err != nil {
+		return nil, 0, errors.WithMessage(r.err, "reading OCDBT manifest config")
+	}
+	if manifestKind != ocdbtManifestKindSingle {
+		return nil, 0, errors.Errorf("OCDBT manifest kind %d not supported, only \"single\" (%d) manifests are",
+			manifestKind, ocdbtManifestKindSingle)
+	}
+
+	// Versions stored inline in the manifest, in columns: the latest is the last one.
+	files := r.dataFileTable()
+	numVersions := r.count()
+	if r.err != nil {
+		return nil, 0, errors.WithMessage(r.err, "reading OCDBT manifest versions")
+	}
+	if numVersions == 0 {
+		return nil, 0, errors.New("OCDBT manifest has no versions")
+	}
+	_ = r.uvarints(numVersions) // generation_number
+	heights := r.bytes(uint64(numVersions))
+	fileIds := r.uvarints(numVersions)
+	offsets := r.uvarints(numVersions)
+	lengths := r.uvarints(numVersions)
+	if r.err != nil {
+		return nil, 0, errors.WithMessage(r.err, "reading OCDBT manifest versions")
+	}
+	last := numVersions - 1
+	rootHeight = int(heights[last])
+	if lengths[last] == 0 {
+		return nil, rootHeight, nil
+	}
+	if fileIds[last] >= uint64(len(files)) {
+		return nil, 0, errors.Errorf("OCDBT manifest root references data file #%d, but there are only %d", fileIds[last], len(files))
+	}
+	root = &ocdbtReference{file: files[fileIds[last]], offset: offsets[last], length: lengths[last]}
+	return root, rootHeight, nil
+}
+
+// ocdbtNodeEntry is an entry of a B+tree node: for leaf nodes (height 0) it holds a value, for interior nodes it
+// holds the reference to a child node.
+type ocdbtNodeEntry struct {
+	key   []byte
+	value ocdbtValue
+
+	child                     *ocdbtReference
+	subtreeCommonPrefixLength int
+}
+
+// ocdbtNode is a parsed B+tree node.
+type ocdbtNode struct {
+	height  int
+	entries []ocdbtNodeEntry
+}
+
+// parseOCDBTNode parses an encoded B+tree node.
+//
+// Keys are prefix-compressed: each key is stored as the length of the prefix shared with the previous key, and the
+// remaining suffix. The other fields are stored in columns, one for each field of the entries.
+func parseOCDBTNode(encoded []byte) (*ocdbtNode, error) {
+	body, err := decodeOCDBTEnvelope(encoded, ocdbtBtreeNodeMagic)
+	if err != nil {
+		return nil, err
+	}
+	r := &ocdbtReader{data: body}
+	node := &ocdbtNode{height: int(r.byte())}
+	files := r.dataFileTable()
+	numEntries := r.count()
+	if r.err != nil {
+		return nil, r.err
+	}
+	node.entries = make([]ocdbtNodeEntry, numEntries)
+
+	// Keys.
+	prefixLengths := r.uvarints(max(numEntries-1, 0))
+	suffixLengths := r.uvarints(numEntries)
+	var subtreePrefixLengths []uint64
+	if node.height > 0 {
+		subtreePrefixLengths = r.uvarints(numEntries)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	var previousKey []byte
+	for ii := range node.entries {
+		var prefixLength uint64
+		if ii > 0 {
+			prefixLength = prefixLengths[ii-1]
+			if prefixLength > uint64(len(previousKey)) {
+				return nil, errors.Errorf("OCDBT node key #%d shares %d bytes with the previous key, which has only %d bytes",
+					ii, prefixLength, len(previousKey))
+			}
+		}
+		key := slices.Concat(previousKey[:prefixLength], r.bytes(suffixLengths[ii]))
+		if r.err != nil {
+			return nil, r.err
+		}
+		node.entries[ii].key = key
+		if node.height > 0 {
+			if subtreePrefixLengths[ii] > uint64(len(key)) {
+				return nil, errors.Errorf("OCDBT node key #%d has subtree common prefix length %d larger than the key (%d bytes)",
+					ii, subtreePrefixLengths[ii], len(key))
+			}
+			node.entries[ii].subtreeCommonPrefixLength = int(subtreePrefixLengths[ii])
+		}
+		previousKey = key
+	}
+
+	if node.height > 0 {
+		// Interior node: references to the child nodes, followed by their statistics (not used).
+		references := r.references(files, numEntries)
+		if r.err != nil {
+			return nil, r.err
+		}
+		for ii := range node.entries {
+			node.entries[ii].child = references[ii]
+		}
+		return node, nil
+	}
+
+	// Leaf node: values lengths and kinds, followed by the inline values and by the references to indirect values.
+	valueLengths := r.uvarints(numEntries)
+	valueKinds := r.uvarints(numEntries)
+	if r.err != nil {
+		return nil, r.err
+	}
+	numIndirect := 0
+	for ii := range node.entries {
+		switch valueKinds[ii] {
+		case ocdbtValueInline:
+			node.entries[ii].value.inline = r.bytes(valueLengths[ii])
+		case ocdbtValueIndirect:
+			numIndirect++
+		default:
+			return nil, errors.Errorf("OCDBT node entry #%d has unknown value kind %d", ii, valueKinds[ii])
+		}
+	}
+	fileIds := r.uvarints(numIndirect)
+	offsets := r.uvarints(numIndirect)
+	if r.err != nil {
+		return nil, r.err
+	}
+	indirectIdx := 0
+	for ii := range node.entries {
+		if valueKinds[ii] != ocdbtValueIndirect {
+			continue
+		}
+		if fileIds[indirectIdx] >= uint64(len(files)) {
+			return nil, errors.Errorf("OCDBT node entry #%d references data file #%d, but there are only %d",
+				ii, fileIds[indirectIdx], len(files))
+		}
+		node.entries[ii].value.indirect = &ocdbtReference{
+			file:   files[fileIds[indirectIdx]],
+			offset: offsets[indirectIdx],
+			length: valueLengths[ii],
+		}
+		indirectIdx++
+	}
+	return node, nil
+}
+
+// ocdbtReader decodes the fields of OCDBT encoded data. The first error is kept in err, and after that all reads
+// return zero values.
+type ocdbtReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *ocdbtReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = errors.Errorf(format, args...)
+	}
+}
+
+func (r *ocdbtReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail("invalid or truncated varint at position %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return value
+}
+
+// count reads a varint used as a number of elements, checking it is not larger than the remaining data, to
+// protect against large allocations with corrupted data.
+func (r *ocdbtReader) count() int {
+	value := r.uvarint()
+	if value > uint64(len(r.data)-r.pos) {
+		r.fail("count %d at position %d is larger than the remaining data", value, r.pos)
+		return 0
+	}
+	return int(value)
+}
+
+func (r *ocdbtReader) uvarints(n int) []uint64 {
+	values := make([]uint64, n)
+	for ii := range values {
+		values[ii] = r.uvarint()
+	}
+	return values
+}
+
+func (r *ocdbtReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *ocdbtReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail("reading %d bytes at position %d, but only %d bytes remain", n, r.pos, len(r.data)-r.pos)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// dataFileTable reads the table of data files referenced by a manifest or node.
+//
+// The paths (base path concatenated with the relative path) are prefix-compressed: the length of the prefix
+// shared with the previous path, the length of the remaining suffix and the length of the base path, stored in
+// columns, followed by the suffixes.
+func (r *ocdbtReader) dataFileTable() []*ocdbtDataFile {
+	numFiles := r.count()
+	prefixLengths := r.uvarints(max(numFiles-1, 0))
+	suffixLengths := r.uvarints(numFiles)
+	basePathLengths := r.uvarints(numFiles)
+	if r.err != nil {
+		return nil
+	}
+	files := make([]*ocdbtDataFile, numFiles)
+	var previousPath []byte
+	for ii := range files {
+		var prefixLength uint64
+		if ii > 0 {
+			prefixLength = prefixLengths[ii-1]
+		}
+		if prefixLength > uint64(len(previousPath)) {
+			r.fail("data file #%d shares %d bytes with the previous path, which has only %d bytes", ii, prefixLength, len(previousPath))
+			return nil
+		}
+		fullPath := slices.Concat(previousPath[:prefixLength], r.bytes(suffixLengths[ii]))
+		if r.err != nil {
+			return nil
+		}
+		if basePathLengths[ii] > uint64(len(fullPath)) {
+			r.fail("data file #%d has base path length %d larger than its path (%d bytes)", ii, basePathLengths[ii], len(fullPath))
+			return nil
+		}
+		files[ii] = &ocdbtDataFile{
+			basePath:     string(fullPath[:basePathLengths[ii]]),
+			relativePath: string(fullPath[basePathLengths[ii]:]),
+		}
+		previousPath = fullPath
+	}
+	return files
+}
+
+// references reads n references to data stored in the given data files: the data file indices, offsets and lengths,
+// stored in columns.
+func (r *ocdbtReader) references(files []*ocdbtDataFile, n int) []*ocdbtReference {
+	fileIds := r.uvarints(n)
+	offsets := r.uvarints(n)
+	lengths := r.uvarints(n)
+	if r.err != nil {
+		return nil
+	}
+	references := make([]*ocdbtReference, n)
+	for ii := range references {
+		if fileIds[ii] >= uint64(len(files)) {
+			r.fail("reference #%d to data file #%d, but there are only %d", ii, fileIds[ii], len(files))
+			return nil
+		}
+		references[ii] = &ocdbtReference{file: files[fileIds[ii]], offset: offsets[ii], length: lengths[ii]}
+	}
+	return references
+}
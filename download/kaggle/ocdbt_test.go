@@ -0,0 +1,218 @@
+package kaggle
+
+import (
+	"encoding/binary"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+)
+
+// encodeOCDBTEnvelope encodes the body with the header and footer of an OCDBT manifest or node.
+func encodeOCDBTEnvelope(t *testing.T, magic uint32, body []byte, compress bool) []byte {
+	compression := uint64(ocdbtCompressionNone)
+	if compress {
+		compression = ocdbtCompressionZstd
+		encoder, err := zstd.NewWriter(nil)
+		require.NoError(t, err)
+		body = encoder.EncodeAll(body, nil)
+	}
+	encoded := binary.BigEndian.AppendUint32(nil, magic)
+	encoded = binary.LittleEndian.AppendUint64(encoded, 0) // Length, set below.
+	encoded = binary.AppendUvarint(encoded, 0)             // Version.
+	encoded = binary.AppendUvarint(encoded, compression)
+	encoded = append(encoded, body...)
+	binary.LittleEndian.PutUint64(encoded[4:], uint64(len(encoded)+4))
+	return binary.LittleEndian.AppendUint32(encoded, crc32.Checksum(encoded, crc32cTable))
+}
+
+func appendUvarints(buf []byte, values ...uint64) []byte {
+	for _, v := range values {
+		buf = binary.AppendUvarint(buf, v)
+	}
+	return buf
+}
+
+// encodeTestDataFileTable encodes a data files table with the given relative paths (and empty base paths),
+// without prefix compression.
+func encodeTestDataFileTable(relativePaths ...string) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(relativePaths)))
+	for range len(relativePaths) - 1 {
+		buf = binary.AppendUvarint(buf, 0) // Prefix lengths.
+	}
+	for _, p := range relativePaths {
+		buf = binary.AppendUvarint(buf, uint64(len(p))) // Suffix lengths.
+	}
+	for range relativePaths {
+		buf = binary.AppendUvarint(buf, 0) // Base path lengths.
+	}
+	for _, p := range relativePaths {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// testOCDBTValue is a value of a test OCDBT leaf node: either inline, or stored in data file #0 at the offset.
+type testOCDBTValue struct {
+	inline   []byte
+	offset   uint64
+	length   uint64
+	indirect bool
+}
+
+// encodeTestLeafNode encodes a leaf node, with keys prefix-compressed.
+func encodeTestLeafNode(t *testing.T, keys []string, values []testOCDBTValue) []byte {
+	body := []byte{0} // Height.
+	body = append(body, encodeTestDataFileTable("data_0")...)
+	body = binary.AppendUvarint(body, uint64(len(keys)))
+	for ii := 1; ii < len(keys); ii++ {
+		prefix := 0
+		for prefix < len(keys[ii]) && prefix < len(keys[ii-1]) && keys[ii][prefix] == keys[ii-1][prefix] {
+			prefix++
+		}
+		body = binary.AppendUvarint(body, uint64(prefix))
+	}
+	var suffixes []byte
+	var previous string
+	for _, key := range keys {
+		prefix := 0
+		for prefix < len(key) && prefix < len(previous) && key[prefix] == previous[prefix] {
+			prefix++
+		}
+		body = binary.AppendUvarint(body, uint64(len(key)-prefix))
+		suffixes = append(suffixes, key[prefix:]...)
+		previous = key
+	}
+	body = append(body, suffixes...)
+	for _, v := range values {
+		if v.indirect {
+			body = binary.AppendUvarint(body, v.length)
+		} else {
+			body = binary.AppendUvarint(body, uint64(len(v.inline)))
+		}
+	}
+	for _, v := range values {
+		if v.indirect {
+			body = binary.AppendUvarint(body, ocdbtValueIndirect)
+		} else {
+			body = binary.AppendUvarint(body, ocdbtValueInline)
+		}
+	}
+	for _, v := range values {
+		if !v.indirect {
+			body = append(body, v.inline...)
+		}
+	}
+	var offsets []uint64
+	for _, v := range values {
+		if v.indirect {
+			body = binary.AppendUvarint(body, 0) // Data file id.
+			offsets = append(offsets, v.offset)
+		}
+	}
+	body = appendUvarints(body, offsets...)
+	return encodeOCDBTEnvelope(t, ocdbtBtreeNodeMagic, body, true)
+}
+
+// writeTestOCDBT writes an OCDBT store to dir with the given keys and values, in two leaf nodes under an interior
+// node. Values larger than 8 bytes are stored indirectly.
+func writeTestOCDBT(t *testing.T, dir string, keys []string, values [][]byte) {
+	// Data file with the values stored indirectly, followed by the leaf nodes and the root node.
+	var dataFile []byte
+	leafValues := make([]testOCDBTValue, len(keys))
+	for ii, value := range values {
+		if len(value) > 8 {
+			leafValues[ii] = testOCDBTValue{indirect: true, offset: uint64(len(dataFile)), length: uint64(len(value))}
+			dataFile = append(dataFile, value...)
+		} else {
+			leafValues[ii] = testOCDBTValue{inline: value}
+		}
+	}
+	split := len(keys) / 2
+	var leafOffsets, leafLengths []uint64
+	for _, part := range [][2]int{{0, split}, {split, len(keys)}} {
+		// Keys of the second leaf are relative to the subtree common prefix (the first byte of its first key).
+		leafKeys := keys[part[0]:part[1]]
+		if part[0] > 0 {
+			leafKeys = make([]string, 0, part[1]-part[0])
+			for _, key := range keys[part[0]:part[1]] {
+				leafKeys = append(leafKeys, key[1:])
+			}
+		}
+		leaf := encodeTestLeafNode(t, leafKeys, leafValues[part[0]:part[1]])
+		leafOffsets = append(leafOffsets, uint64(len(dataFile)))
+		leafLengths = append(leafLengths, uint64(len(leaf)))
+		dataFile = append(dataFile, leaf...)
+	}
+
+	// Interior (root) node: the keys are the first keys of each child.
+	root := []byte{1} // Height.
+	root = append(root, encodeTestDataFileTable("data_0")...)
+	root = binary.AppendUvarint(root, 2)
+	root = appendUvarints(root, 0)                                              // Prefix length.
+	root = appendUvarints(root, uint64(len(keys[0])), uint64(len(keys[split]))) // Suffix lengths.
+	root = appendUvarints(root, 0, 1)                                           // Subtree common prefix lengths.
+	root = append(root, keys[0]+keys[split]...)
+	root = appendUvarints(root, 0, 0)             // Data file ids.
+	root = appendUvarints(root, leafOffsets...)   // Offsets.
+	root = appendUvarints(root, leafLengths...)   // Lengths.
+	root = appendUvarints(root, 1, 1, 0, 0, 0, 0) // Statistics.
+	encodedRoot := encodeOCDBTEnvelope(t, ocdbtBtreeNodeMagic, root, false)
+	rootOffset := uint64(len(dataFile))
+	dataFile = append(dataFile, encodedRoot...)
+	require.NoError(t, os.MkdirAll(path.Join(dir, "d"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "d", "data_0"), dataFile, 0644))
+
+	// Manifest.
+	manifest := make([]byte, 16)             // UUID.
+	manifest = appendUvarints(manifest, 0)   // Manifest kind.
+	manifest = appendUvarints(manifest, 8)   // max_inline_value_bytes.
+	manifest = appendUvarints(manifest, 1e6) // max_decoded_node_bytes.
+	manifest = append(manifest, 4)           // version_tree_arity_log2.
+	manifest = appendUvarints(manifest, ocdbtCompressionZstd, 0)
+	manifest = append(manifest, encodeTestDataFileTable("data_0")...)
+	manifest = appendUvarints(manifest, 1) // Number of versions.
+	manifest = appendUvarints(manifest, 1) // Generation number.
+	manifest = append(manifest, 1)         // Root height.
+	manifest = appendUvarints(manifest, 0, rootOffset, uint64(len(encodedRoot)))
+	manifest = appendUvarints(manifest, uint64(len(keys)), 0, 0)
+	manifest = binary.LittleEndian.AppendUint64(manifest, 0) // Commit time.
+	require.NoError(t, os.WriteFile(path.Join(dir, OCDBTManifestFileName),
+		encodeOCDBTEnvelope(t, ocdbtManifestMagic, manifest, false), 0644))
+}
+
+func TestOCDBT(t *testing.T) {
+	dir := t.TempDir()
+	keys := []string{"a/.zarray", "a/0.0", "b/c/0", "b/zarr.json"}
+	values := [][]byte{[]byte("small"), []byte("a value stored indirectly"), []byte("another indirect value"), []byte("{}")}
+	writeTestOCDBT(t, dir, keys, values)
+
+	store, err := openOCDBT(dir)
+	require.NoError(t, err)
+	require.Equal(t, keys, store.Keys())
+	for ii, key := range keys {
+		require.True(t, store.Has(key))
+		value, err := store.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[ii], value)
+	}
+	require.False(t, store.Has("c"))
+	_, err = store.Get("c")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDecodeOCDBTEnvelope(t *testing.T) {
+	encoded := encodeOCDBTEnvelope(t, ocdbtManifestMagic, []byte("body"), true)
+	body, err := decodeOCDBTEnvelope(encoded, ocdbtManifestMagic)
+	require.NoError(t, err)
+	require.Equal(t, []byte("body"), body)
+
+	_, err = decodeOCDBTEnvelope(encoded, ocdbtBtreeNodeMagic)
+	require.ErrorContains(t, err, "magic")
+
+	encoded[len(encoded)-5] ^= 0xFF
+	_, err = decodeOCDBTEnvelope(encoded, ocdbtManifestMagic)
+	require.ErrorContains(t, err, "checksum")
+}
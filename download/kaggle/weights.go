@@ -1,9 +1,15 @@
 // Package kaggle loads Gemma weights into tensors along with the matching metadata, after they
-// have been downloaded from kaggle and converted using the included cmd/convert_checkpoint.py.
+// have been downloaded from kaggle.
+//
+// The weights are read after they have been converted using the included cmd/convert_checkpoint.py (which requires
+// Python and Jax). Experimentally, they can also be read directly from the original Orbax checkpoint (OCDBT + Zarr
+// format), see ReadOCDBTWeightsToTree.
 package kaggle
 
 import (
 	"github.com/dustin/go-humanize"
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gemma/transformers"
 	"github.com/gomlx/gemma/trees"
 	"github.com/gomlx/gomlx/ml/context"
 	"github.com/gomlx/gomlx/ml/data"
@@ -14,7 +20,6 @@ import (
 	"github.com/janpfeifer/must"
 	"github.com/pkg/errors"
 	"github.com/vmihailenco/msgpack"
-	"io"
 	"io/fs"
 	"os"
 	"path"
@@ -30,33 +35,159 @@ const (
 	OCDBTManifestFileName = "manifest.ocdbt"
 )
 
-// ReadConvertedWeights from checkpointDir (under the "raw/" subdirectory).
-// It will read the weights and shape converted by the `convert_checkpoint.py` script
-// (see github.com/gomlx/gemma repository, under cmd/convert_checkpoint.py) and set them
-// in the given context, under its current scope.
+// ReadConvertedWeights from checkpointDir and set them in the given context, under the "model" scope.
+//
+// It reads the weights and shape converted by the `convert_checkpoint.py` script (see github.com/gomlx/gemma
+// repository, under cmd/convert_checkpoint.py), from the "raw/" subdirectory of checkpointDir. To read the
+// original Orbax checkpoint instead, see the experimental ReadOCDBTWeightsToTreeWithOptions.
+//
+// See ReadConvertedWeightsWithOptions to transfer the weights directly to the device, or to load only some of the
+// layers.
 func ReadConvertedWeights(ctx *context.Context, checkpointDir string) error {
-	weights, err := ReadConvertedWeightsToTree(checkpointDir)
+	return ReadConvertedWeightsWithOptions(ctx, checkpointDir, nil)
+}
+
+// ReadConvertedWeightsWithOptions is like ReadConvertedWeights, but configured by opts (it can be nil), see
+// ReadWeightsToTreeWithOptions. With opts.Validate, the variables loaded are checked against those the model
+// requests, see transformers.ValidateModel.
+func ReadConvertedWeightsWithOptions(ctx *context.Context, checkpointDir string, opts *mmap.Options) error {
+	validate := opts != nil && opts.Validate
+	if validate && opts.Layers != nil {
+		return errors.Errorf("ReadConvertedWeights(%q): Options.Validate can't be used with Options.Layers, the "+
+			"other layers are not loaded", checkpointDir)
+	}
+	weights, err := ReadWeightsToTreeWithOptions(checkpointDir, opts)
 	if err != nil {
 		return err
 	}
 	UploadWeightsToContext(ctx.In("model"), weights)
+	if validate {
+		if err = transformers.ValidateModel(ctx.In("model")); err != nil {
+			return errors.WithMessagef(err, "ReadConvertedWeights(%q)", checkpointDir)
+		}
+	}
 	return nil
 }
 
+// ReadWeightsToTree from checkpointDir: the weights converted by the `convert_checkpoint.py` script, see
+// ReadConvertedWeightsToTree.
+//
+// It returns a tree of tensors, with the path matching those of the original Jax checkpoint.
+func ReadWeightsToTree(checkpointDir string) (tree *trees.Tree[*tensors.Tensor], err error) {
+	return ReadWeightsToTreeWithOptions(checkpointDir, nil)
+}
+
+// ReadWeightsToTreeWithOptions is like ReadWeightsToTree, but configured by opts (it can be nil): the converted
+// ".raw" files are memory-mapped, and if opts.Backend is set each tensor is transferred directly to the device,
+// without a copy in the Go heap. See mmap.Options.
+//
+// With opts.VerifyChecksums, the files are verified against the mmap.ManifestFileName generated by WriteManifest
+// (WriteConvertedWeights generates it for the weights it writes).
+func ReadWeightsToTreeWithOptions(checkpointDir string, opts *mmap.Options) (tree *trees.Tree[*tensors.Tensor], err error) {
+	return readConvertedWeightsToTree(data.ReplaceTildeInDir(checkpointDir), opts)
+}
+
+// skipTreePath returns whether the weights in the tree path (starting with "transformer") are in a layer not
+// selected by opts.
+func skipTreePath(opts *mmap.Options, treePath []string) bool {
+	return len(treePath) > 1 && opts.SkipScope(treePath[1:])
+}
+
+// ReadOCDBTWeightsToTree reads the weights of the original Orbax checkpoint in checkpointDir, as downloaded from
+// Kaggle, without requiring Python: the parameters listed in the metadata file (see ReadMetadata) are read from the
+// OCDBT key-value store (see OCDBTManifestFileName), where each one is stored as a Zarr array (versions 2 or 3).
+//
+// It returns a tree of tensors, with the path matching those of the original Jax checkpoint.
+//
+// Only the features of the formats used by the Kaggle checkpoints are supported: single-file manifests, zstd
+// compression, and Zarr arrays with regular chunks.
+//
+// Experimental: the reader follows the TensorStore format description, but it hasn't yet been tested against
+// checkpoints written by Orbax/TensorStore. So it is opt-in: ReadConvertedWeights and ReadWeightsToTree only read
+// the converted weights.
+func ReadOCDBTWeightsToTree(checkpointDir string) (tree *trees.Tree[*tensors.Tensor], err error) {
+	return ReadOCDBTWeightsToTreeWithOptions(checkpointDir, nil)
+}
+
+// ReadOCDBTWeightsToTreeWithOptions is like ReadOCDBTWeightsToTree, but configured by opts (it can be nil). The
+// Orbax checkpoint is compressed, so its tensors are always decoded to the Go heap, but they are released once
+// transferred to the device (if opts.Backend is set). See mmap.Options.
+//
+// With opts.VerifyChecksums, the files are verified against the mmap.ManifestFileName generated by WriteManifest.
+func ReadOCDBTWeightsToTreeWithOptions(checkpointDir string, opts *mmap.Options) (tree *trees.Tree[*tensors.Tensor], err error) {
+	checkpointDir = data.ReplaceTildeInDir(checkpointDir)
+	metadata, err := ReadMetadata(checkpointDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "ReadOCDBTWeightsToTree(%q)", checkpointDir)
+	}
+	manifest, err := opts.ChecksumsManifest(checkpointDir)
+	if err == nil && manifest != nil {
+		// The checkpoint files are not memory-mapped, so they are all verified upfront.
+		err = manifest.VerifyFiles(checkpointDir)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "ReadOCDBTWeightsToTree(%q)", checkpointDir)
+	}
+	store, err := openOCDBT(checkpointDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "ReadOCDBTWeightsToTree(%q)", checkpointDir)
+	}
+	tree = trees.New[*tensors.Tensor]()
+	var tasks []mmap.Task
+	for treePath, meta := range metadata.OrderedLeaves() {
+		if meta.SkipDeserialize {
+			continue
+		}
+		name := strings.Join(treePath, ".")
+		if skipTreePath(opts, treePath) {
+			opts.Skip(name, shapes.Shape{}, mmap.SkipLayer)
+			continue
+		}
+		tasks = append(tasks, mmap.Task{
+			Name: name,
+			Read: func() (*tensors.Tensor, error) {
+				tensor, err := readZarrArray(store, name)
+				if err != nil {
+					return nil, err
+				}
+				return opts.Transfer(tensor)
+			},
+			Set: func(tensor *tensors.Tensor) error { return tree.Set(treePath, tensor) },
+		})
+	}
+	if err = opts.Run(tasks); err != nil {
+		return nil, errors.WithMessagef(err, "ReadOCDBTWeightsToTree(%q)", checkpointDir)
+	}
+	return tree, nil
+}
+
 // ReadConvertedWeightsToTree from checkpointDir (under the "raw/" subdirectory).
 // It will read the weights and shape converted by the `convert_checkpoint.py` script
 // (see github.com/gomlx/gemma repository, under cmd/convert_checkpoint.py)
 //
 // It returns a tree of tensors, with the path matching those of the original Jax checkpoint.
 func ReadConvertedWeightsToTree(checkpointDir string) (tree *trees.Tree[*tensors.Tensor], err error) {
+	return readConvertedWeightsToTree(checkpointDir, nil)
+}
+
+func readConvertedWeightsToTree(checkpointDir string, opts *mmap.Options) (tree *trees.Tree[*tensors.Tensor], err error) {
 	rawDir := path.Join(checkpointDir, "raw")
 	if !data.FileExists(rawDir) {
 		err = errors.Errorf(
 			"ReadConvertedWeights(%q), the given directory doesn't have a subdirectory 'raw/' with the converted files",
 			checkpointDir)
+		if isOCDBT(checkpointDir) {
+			err = errors.WithMessage(err, "convert the Orbax checkpoint with cmd/convert_checkpoint.py, or read it "+
+				"with the experimental ReadOCDBTWeightsToTree")
+		}
 		return
 	}
+	manifest, err := opts.ChecksumsManifest(rawDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "ReadConvertedWeights(%q)", checkpointDir)
+	}
 	tree = trees.New[*tensors.Tensor]()
+	var tasks []mmap.Task
 	err = fs.WalkDir(os.DirFS(rawDir), ".", func(filePath string, entry fs.DirEntry, err error) error {
 		if err != nil {
 			return errors.Wrapf(err, "failed to traverse %q", rawDir)
@@ -109,33 +240,128 @@ func ReadConvertedWeightsToTree(checkpointDir string) (tree *trees.Tree[*tensors
 
 		treePath := strings.Split(base, "/")
 		//fmt.Printf("%q -> %s\n", treePath, shape)
+		if skipTreePath(opts, treePath) {
+			opts.Skip(base, shape, mmap.SkipLayer)
+			return nil
+		}
+		tasks = append(tasks, mmap.Task{
+			Name:  base,
+			Bytes: info.Size(),
+			Read: func() (*tensors.Tensor, error) {
+				f, err := mmap.Open(rawFilePath)
+				if err != nil {
+					return nil, errors.WithMessage(err, "failed to read raw data")
+				}
+				defer func() { _ = f.Close() }()
+				if manifest != nil {
+					if err = manifest.Verify(filePath, f.Bytes()); err != nil {
+						return nil, err
+					}
+				}
+				tensor, err := opts.NewTensor(shape, f.Bytes())
+				if err != nil {
+					return nil, errors.WithMessagef(err, "failed to read raw data from %q", rawFilePath)
+				}
+				return tensor, nil
+			},
+			Set: func(tensor *tensors.Tensor) error {
+				err := tree.Set(treePath, tensor)
+				if err != nil {
+					return errors.WithMessagef(err, "failed to set variable with %s", humanize.Bytes(uint64(shape.Memory())))
+				}
+				return nil
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = opts.Run(tasks); err != nil {
+		return nil, errors.WithMessagef(err, "ReadConvertedWeights(%q)", checkpointDir)
+	}
+	return
+}
 
-		tensor := tensors.FromShape(shape)
-		f, err := os.Open(rawFilePath)
-		if err != nil {
-			return errors.Wrapf(err, "failed to open raw data from %q", rawFilePath)
+// WriteConvertedWeights writes the weights of the model in the given context (under the "model" scope) to
+// checkpointDir (under the "raw/" subdirectory), in the same format generated by the `convert_checkpoint.py` script.
+//
+// It is the inverse of ReadConvertedWeights, and can be used to save the weights of a fine-tuned model.
+func WriteConvertedWeights(ctx *context.Context, checkpointDir string) error {
+	checkpointDir = data.ReplaceTildeInDir(checkpointDir)
+	ctx = ctx.In("model")
+	baseScope := ctx.Scope() + context.ScopeSeparator
+	rawDir := path.Join(checkpointDir, "raw", "transformer")
+	count := 0
+	for v := range ctx.IterVariablesInScope() {
+		scopeParts := strings.Split(strings.TrimPrefix(v.Scope()+context.ScopeSeparator, baseScope), context.ScopeSeparator)
+		basePath := path.Join(append(append([]string{rawDir}, scopeParts...), v.Name())...)
+		if err := os.MkdirAll(path.Dir(basePath), 0755); err != nil {
+			return errors.Wrapf(err, "failed to create directory for %q", basePath)
+		}
+
+		shape := v.Shape()
+		shapeParts := append([]string{strings.ToLower(shape.DType.String())},
+			xslices.Map(shape.Dimensions, strconv.Itoa)...)
+		shapeFilePath := basePath + ".shape"
+		if err := os.WriteFile(shapeFilePath, []byte(strings.Join(shapeParts, ",")), 0644); err != nil {
+			return errors.Wrapf(err, "failed to write shape to %q", shapeFilePath)
 		}
-		var n int
-		tensor.MutableBytes(func(data []byte) {
-			n, err = io.ReadFull(f, data)
+
+		rawFilePath := basePath + ".raw"
+		var err error
+		v.Value().ConstBytes(func(data []byte) {
+			err = os.WriteFile(rawFilePath, data, 0644)
 		})
-		_ = f.Close()
 		if err != nil {
-			return errors.Wrapf(err, "failed to read raw data from %q", rawFilePath)
-		}
-		if n != int(shape.Memory()) {
-			return errors.Errorf("read %d bytes from %q, expected %d", n, rawFilePath, shape.Memory())
+			return errors.Wrapf(err, "failed to write raw data to %q", rawFilePath)
 		}
-		err = tree.Set(treePath, tensor)
+		count++
+	}
+	if count == 0 {
+		return errors.Errorf("WriteConvertedWeights(%q): no variables found in scope %q", checkpointDir, ctx.Scope())
+	}
+	return WriteManifest(checkpointDir)
+}
+
+// WriteManifest generates the mmap.ManifestFileName with the SHA-256 of the weights files in checkpointDir, used
+// to verify them when loading with mmap.Options.VerifyChecksums.
+//
+// For converted weights it lists the ".raw" files (and it is written in the "raw/" subdirectory), otherwise it
+// lists all the files of the original Orbax checkpoint. It should be run right after downloading or converting
+// the checkpoint, since it trusts the files as they are.
+func WriteManifest(checkpointDir string) error {
+	checkpointDir = data.ReplaceTildeInDir(checkpointDir)
+	dir := path.Join(checkpointDir, "raw")
+	converted := data.FileExists(dir)
+	if !converted {
+		dir = checkpointDir
+	}
+	var fileNames []string
+	err := fs.WalkDir(os.DirFS(dir), ".", func(filePath string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			return errors.WithMessagef(err, "failed to set variable with %s", humanize.Bytes(uint64(n)))
+			return errors.Wrapf(err, "failed to traverse %q", dir)
 		}
+		if entry.IsDir() || filePath == mmap.ManifestFileName || (converted && filepath.Ext(filePath) != ".raw") {
+			return nil
+		}
+		fileNames = append(fileNames, filePath)
 		return nil
 	})
+	if err == nil && len(fileNames) == 0 {
+		err = errors.Errorf("no weights files found in %q", dir)
+	}
+	var manifest mmap.Manifest
+	if err == nil {
+		manifest, err = mmap.NewManifest(dir, fileNames)
+	}
+	if err == nil {
+		err = manifest.Write(dir)
+	}
 	if err != nil {
-		return nil, err
+		return errors.WithMessagef(err, "WriteManifest(%q)", checkpointDir)
 	}
-	return
+	return nil
 }
 
 // PyReadAggregate of Python checkpoint. Not used by Gemma v2.
@@ -0,0 +1,67 @@
+package kaggle
+
+import (
+	"encoding/binary"
+	"github.com/gomlx/gemma/download/mmap"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadConvertedWeightsWithOptions(t *testing.T) {
+	ctx := context.New()
+	modelCtx := ctx.In("model")
+	modelCtx.In("embedder").VariableWithValue("input_embedding", [][]float32{{1, 2}, {3, 4}})
+	modelCtx.In("layer_0").In("attn").In("q_einsum").VariableWithValue("w", [][][]float32{{{5}, {6}}})
+	modelCtx.In("layer_1").In("attn").In("q_einsum").VariableWithValue("w", [][][]float32{{{7}, {8}}})
+	checkpointDir := t.TempDir()
+	require.NoError(t, WriteConvertedWeights(ctx, checkpointDir))
+
+	// All layers.
+	loadedCtx := context.New()
+	require.NoError(t, ReadConvertedWeights(loadedCtx, checkpointDir))
+	for v := range modelCtx.IterVariablesInScope() {
+		loaded := loadedCtx.GetVariableByScopeAndName(v.Scope(), v.Name())
+		require.NotNilf(t, loaded, "variable %q in scope %q not loaded", v.Name(), v.Scope())
+		require.Equal(t, v.Value().Value(), loaded.Value().Value())
+	}
+
+	// Only layer 1.
+	loadedCtx = context.New()
+	require.NoError(t, ReadConvertedWeightsWithOptions(loadedCtx, checkpointDir, &mmap.Options{Layers: []int{1}}))
+	loadedModelCtx := loadedCtx.In("model")
+	require.NotNil(t, loadedModelCtx.In("embedder").GetVariable("input_embedding"))
+	require.Nil(t, loadedModelCtx.In("layer_0").In("attn").In("q_einsum").GetVariable("w"))
+	require.Equal(t, [][][]float32{{{7}, {8}}},
+		loadedModelCtx.In("layer_1").In("attn").In("q_einsum").GetVariable("w").Value().Value())
+
+	// Validation: it can't be combined with Layers, and the variables don't match any Gemma model.
+	err := ReadConvertedWeightsWithOptions(context.New(), checkpointDir, &mmap.Options{Validate: true, Layers: []int{1}})
+	require.ErrorContains(t, err, "Options.Validate can't be used with Options.Layers")
+	err = ReadConvertedWeightsWithOptions(context.New(), checkpointDir, &mmap.Options{Validate: true})
+	require.ErrorContains(t, err, "failed to validate the model variables")
+
+	// Checksums: WriteConvertedWeights generates the manifest.
+	verifyOpts := &mmap.Options{VerifyChecksums: true, CheckFinite: true}
+	require.NoError(t, ReadConvertedWeightsWithOptions(context.New(), checkpointDir, verifyOpts))
+	rawFilePath := path.Join(checkpointDir, "raw", "transformer", "layer_1", "attn", "q_einsum", "w.raw")
+	contents, err := os.ReadFile(rawFilePath)
+	require.NoError(t, err)
+	contents[0] ^= 1
+	require.NoError(t, os.WriteFile(rawFilePath, contents, 0644))
+	require.ErrorContains(t, ReadConvertedWeightsWithOptions(context.New(), checkpointDir, verifyOpts), "corrupted")
+
+	// A NaN, with an updated manifest.
+	binary.LittleEndian.PutUint32(contents, math.Float32bits(float32(math.NaN())))
+	require.NoError(t, os.WriteFile(rawFilePath, contents, 0644))
+	require.NoError(t, WriteManifest(checkpointDir))
+	require.NoError(t, ReadConvertedWeightsWithOptions(context.New(), checkpointDir, &mmap.Options{VerifyChecksums: true}))
+	require.ErrorContains(t, ReadConvertedWeightsWithOptions(context.New(), checkpointDir, verifyOpts), "NaN")
+
+	// Missing manifest.
+	require.NoError(t, os.Remove(path.Join(checkpointDir, "raw", mmap.ManifestFileName)))
+	require.ErrorContains(t, ReadConvertedWeightsWithOptions(context.New(), checkpointDir, verifyOpts), mmap.ManifestFileName)
+}
@@ -0,0 +1,420 @@
+package kaggle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// This file implements reading of Zarr arrays (versions 2 and 3) stored in a key-value store, as saved by Orbax
+// (through TensorStore) for each parameter of the checkpoint. See https://zarr-specs.readthedocs.io/.
+
+const (
+	zarr2MetadataKey = ".zarray"
+	zarr3MetadataKey = "zarr.json"
+)
+
+// keyValueReader is a read-only key-value store, like ocdbtStore.
+type keyValueReader interface {
+	Has(key string) bool
+	Get(key string) ([]byte, error)
+}
+
+// zarrArray is the metadata of a Zarr array needed to read it, common to versions 2 and 3.
+type zarrArray struct {
+	shape      shapes.Shape
+	chunkShape []int
+
+	// chunkKey returns the key of the chunk with the given indices (in the chunks grid).
+	chunkKey func(chunkIndices []int) string
+
+	// decompress the data of a chunk.
+	decompress func(data []byte) ([]byte, error)
+}
+
+// readZarrArray reads the Zarr array under name (e.g.: "transformer.layer_0.attn.q_einsum.w") from the key-value
+// store. The version of Zarr is detected from the metadata keys present.
+func readZarrArray(kv keyValueReader, name string) (*tensors.Tensor, error) {
+	var array *zarrArray
+	var err error
+	switch {
+	case kv.Has(name + "/" + zarr3MetadataKey):
+		array, err = readZarr3Metadata(kv, name)
+	case kv.Has(name + "/" + zarr2MetadataKey):
+		array, err = readZarr2Metadata(kv, name)
+	default:
+		return nil, errors.Errorf("Zarr array %q not found: neither %q nor %q are present", name, zarr3MetadataKey, zarr2MetadataKey)
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "Zarr array %q", name)
+	}
+	tensor, err := array.read(kv)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "Zarr array %q", name)
+	}
+	return tensor, nil
+}
+
+// read all the chunks of the array and assemble them into a tensor. Missing chunks are filled with zeros.
+func (array *zarrArray) read(kv keyValueReader) (*tensors.Tensor, error) {
+	rank := array.shape.Rank()
+	if len(array.chunkShape) != rank {
+		return nil, errors.Errorf("chunk shape %v doesn't match the rank of shape %s", array.chunkShape, array.shape)
+	}
+	itemSize := int(array.shape.DType.Size())
+	chunkSize := itemSize
+	numChunks := make([]int, rank)
+	for axis, chunkDim := range array.chunkShape {
+		if chunkDim <= 0 {
+			return nil, errors.Errorf("invalid chunk shape %v", array.chunkShape)
+		}
+		chunkSize *= chunkDim
+		numChunks[axis] = (array.shape.Dimensions[axis] + chunkDim - 1) / chunkDim
+	}
+
+	tensor := tensors.FromShape(array.shape)
+	var err error
+	tensor.MutableBytes(func(output []byte) {
+		chunkIndices := make([]int, rank)
+		for {
+			var chunk []byte
+			key := array.chunkKey(chunkIndices)
+			if kv.Has(key) {
+				chunk, err = kv.Get(key)
+				if err == nil {
+					chunk, err = array.decompress(chunk)
+				}
+				if err != nil {
+					err = errors.WithMessagef(err, "chunk %q", key)
+					return
+				}
+				if len(chunk) != chunkSize {
+					err = errors.Errorf("chunk %q has %d bytes, expected %d for chunk shape %v", key, len(chunk), chunkSize, array.chunkShape)
+					return
+				}
+				copyChunk(output, chunk, array.shape.Dimensions, array.chunkShape, chunkIndices, itemSize)
+			}
+
+			// Next chunk, in row-major order.
+			axis := rank - 1
+			for ; axis >= 0; axis-- {
+				chunkIndices[axis]++
+				if chunkIndices[axis] < numChunks[axis] {
+					break
+				}
+				chunkIndices[axis] = 0
+			}
+			if axis < 0 {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tensor, nil
+}
+
+// copyChunk copies the part of the chunk (with the given indices in the chunks grid) that falls within the array
+// to the output. Both are in row-major order.
+func copyChunk(output, chunk []byte, dims, chunkShape, chunkIndices []int, itemSize int) {
+	rank := len(dims)
+	if rank == 0 {
+		copy(output, chunk)
+		return
+	}
+	// Size of the chunk that falls within the array, along each axis.
+	validDims := make([]int, rank)
+	for axis := range rank {
+		validDims[axis] = min(chunkShape[axis], dims[axis]-chunkIndices[axis]*chunkShape[axis])
+	}
+	// Copy one row (last axis) at a time.
+	rowBytes := validDims[rank-1] * itemSize
+	position := make([]int, rank-1) // Position within the chunk, excluding the last axis.
+	for {
+		chunkOffset, outputOffset := 0, 0
+		for axis := range rank {
+			within := 0
+			if axis < rank-1 {
+				within = position[axis]
+			}
+			chunkOffset = chunkOffset*chunkShape[axis] + within
+			outputOffset = outputOffset*dims[axis] + chunkIndices[axis]*chunkShape[axis] + within
+		}
+		copy(output[outputOffset*itemSize:outputOffset*itemSize+rowBytes], chunk[chunkOffset*itemSize:])
+
+		axis := rank - 2
+		for ; axis >= 0; axis-- {
+			position[axis]++
+			if position[axis] < validDims[axis] {
+				break
+			}
+			position[axis] = 0
+		}
+		if axis < 0 {
+			return
+		}
+	}
+}
+
+// zarrCompressor is the configuration of a Zarr version 2 compressor (the "compressor" field).
+type zarrCompressor struct {
+	ID string `json:"id"`
+}
+
+// zarrDecompressor returns the function to decompress chunks with the given compressor, or nil if not supported.
+// An empty id means no compression.
+func zarrDecompressor(id string) func(data []byte) ([]byte, error) {
+	switch id {
+	case "":
+		return func(data []byte) ([]byte, error) { return data, nil }
+	case "zstd":
+		return zstdDecompress
+	case "gzip":
+		return func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to decompress gzip data")
+			}
+			return readAllAndClose(r)
+		}
+	case "zlib":
+		return func(data []byte) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to decompress zlib data")
+			}
+			return readAllAndClose(r)
+		}
+	}
+	return nil
+}
+
+// readAllAndClose reads all the decompressed data from r.
+func readAllAndClose(r io.ReadCloser) ([]byte, error) {
+	decompressed, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress data")
+	}
+	return decompressed, nil
+}
+
+// zarr2Metadata is the subset of the ".zarray" metadata used.
+type zarr2Metadata struct {
+	ZarrFormat         int             `json:"zarr_format"`
+	Shape              []int           `json:"shape"`
+	Chunks             []int           `json:"chunks"`
+	DType              string          `json:"dtype"`
+	Compressor         *zarrCompressor `json:"compressor"`
+	Filters            []any           `json:"filters"`
+	Order              string          `json:"order"`
+	DimensionSeparator string          `json:"dimension_separator"`
+}
+
+// readZarr2Metadata reads the metadata of a Zarr version 2 array.
+func readZarr2Metadata(kv keyValueReader, name string) (*zarrArray, error) {
+	metadataBytes, err := kv.Get(name + "/" + zarr2MetadataKey)
+	if err != nil {
+		return nil, err
+	}
+	var metadata zarr2Metadata
+	if err = json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %q", zarr2MetadataKey)
+	}
+	if metadata.ZarrFormat != 2 {
+		return nil, errors.Errorf("%q has zarr_format %d, expected 2", zarr2MetadataKey, metadata.ZarrFormat)
+	}
+	if metadata.Order != "" && metadata.Order != "C" {
+		return nil, errors.Errorf("order %q not supported, only \"C\" (row-major)", metadata.Order)
+	}
+	if len(metadata.Filters) > 0 {
+		return nil, errors.Errorf("filters %v not supported", metadata.Filters)
+	}
+	dtype, err := zarr2DType(metadata.DType)
+	if err != nil {
+		return nil, err
+	}
+	var compressorID string
+	if metadata.Compressor != nil {
+		compressorID = metadata.Compressor.ID
+	}
+	decompress := zarrDecompressor(compressorID)
+	if decompress == nil {
+		return nil, errors.Errorf("compressor %q not supported", compressorID)
+	}
+	separator := metadata.DimensionSeparator
+	if separator == "" {
+		separator = "."
+	}
+	return &zarrArray{
+		shape:      shapes.Make(dtype, metadata.Shape...),
+		chunkShape: metadata.Chunks,
+		chunkKey: func(chunkIndices []int) string {
+			if len(chunkIndices) == 0 {
+				return name + "/0"
+			}
+			return name + "/" + joinInts(chunkIndices, separator)
+		},
+		decompress: decompress,
+	}, nil
+}
+
+// zarr2DType converts a Zarr version 2 dtype (a NumPy type string, like "<f4") to a dtypes.DType.
+func zarr2DType(zarrDType string) (dtypes.DType, error) {
+	if zarrDType == "bfloat16" {
+		// Extension used by TensorStore.
+		return dtypes.BFloat16, nil
+	}
+	if len(zarrDType) < 3 {
+		return dtypes.InvalidDType, errors.Errorf("dtype %q not supported", zarrDType)
+	}
+	byteOrder, kind, size := zarrDType[0], zarrDType[1], zarrDType[2:]
+	if byteOrder == '>' && size != "1" {
+		return dtypes.InvalidDType, errors.Errorf("big-endian dtype %q not supported", zarrDType)
+	}
+	numpyNames := map[string]dtypes.DType{
+		"b1": dtypes.Bool,
+		"i1": dtypes.Int8, "i2": dtypes.Int16, "i4": dtypes.Int32, "i8": dtypes.Int64,
+		"u1": dtypes.Uint8, "u2": dtypes.Uint16, "u4": dtypes.Uint32, "u8": dtypes.Uint64,
+		"f2": dtypes.Float16, "f4": dtypes.Float32, "f8": dtypes.Float64,
+	}
+	dtype, found := numpyNames[string(kind)+size]
+	if !found {
+		return dtypes.InvalidDType, errors.Errorf("dtype %q not supported", zarrDType)
+	}
+	return dtype, nil
+}
+
+// zarr3Metadata is the subset of the "zarr.json" metadata of an array used.
+type zarr3Metadata struct {
+	ZarrFormat int    `json:"zarr_format"`
+	NodeType   string `json:"node_type"`
+	Shape      []int  `json:"shape"`
+	DataType   string `json:"data_type"`
+	ChunkGrid  struct {
+		Name          string `json:"name"`
+		Configuration struct {
+			ChunkShape []int `json:"chunk_shape"`
+		} `json:"configuration"`
+	} `json:"chunk_grid"`
+	ChunkKeyEncoding struct {
+		Name          string `json:"name"`
+		Configuration struct {
+			Separator string `json:"separator"`
+		} `json:"configuration"`
+	} `json:"chunk_key_encoding"`
+	Codecs []struct {
+		Name          string `json:"name"`
+		Configuration struct {
+			Endian string `json:"endian"`
+		} `json:"configuration"`
+	} `json:"codecs"`
+}
+
+// zarr3DataTypes maps the Zarr version 3 data types to dtypes.DType.
+var zarr3DataTypes = map[string]dtypes.DType{
+	"bool":     dtypes.Bool,
+	"int8":     dtypes.Int8,
+	"int16":    dtypes.Int16,
+	"int32":    dtypes.Int32,
+	"int64":    dtypes.Int64,
+	"uint8":    dtypes.Uint8,
+	"uint16":   dtypes.Uint16,
+	"uint32":   dtypes.Uint32,
+	"uint64":   dtypes.Uint64,
+	"float16":  dtypes.Float16,
+	"bfloat16": dtypes.BFloat16,
+	"float32":  dtypes.Float32,
+	"float64":  dtypes.Float64,
+}
+
+// readZarr3Metadata reads the metadata of a Zarr version 3 array.
+//
+// Only the "bytes" (little-endian) codec optionally followed by one compression codec is supported: in particular
+// the "sharding_indexed" and "transpose" codecs are not.
+func readZarr3Metadata(kv keyValueReader, name string) (*zarrArray, error) {
+	metadataBytes, err := kv.Get(name + "/" + zarr3MetadataKey)
+	if err != nil {
+		return nil, err
+	}
+	var metadata zarr3Metadata
+	if err = json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %q", zarr3MetadataKey)
+	}
+	if metadata.ZarrFormat != 3 || metadata.NodeType != "array" {
+		return nil, errors.Errorf("%q has zarr_format %d and node_type %q, expected 3 and \"array\"",
+			zarr3MetadataKey, metadata.ZarrFormat, metadata.NodeType)
+	}
+	dtype, found := zarr3DataTypes[metadata.DataType]
+	if !found {
+		return nil, errors.Errorf("data_type %q not supported", metadata.DataType)
+	}
+	if metadata.ChunkGrid.Name != "regular" {
+		return nil, errors.Errorf("chunk_grid %q not supported, only \"regular\"", metadata.ChunkGrid.Name)
+	}
+
+	var chunkKey func(chunkIndices []int) string
+	separator := metadata.ChunkKeyEncoding.Configuration.Separator
+	switch metadata.ChunkKeyEncoding.Name {
+	case "default":
+		if separator == "" {
+			separator = "/"
+		}
+		chunkKey = func(chunkIndices []int) string {
+			if len(chunkIndices) == 0 {
+				return name + "/c"
+			}
+			return name + "/c" + separator + joinInts(chunkIndices, separator)
+		}
+	case "v2":
+		if separator == "" {
+			separator = "."
+		}
+		chunkKey = func(chunkIndices []int) string {
+			if len(chunkIndices) == 0 {
+				return name + "/0"
+			}
+			return name + "/" + joinInts(chunkIndices, separator)
+		}
+	default:
+		return nil, errors.Errorf("chunk_key_encoding %q not supported", metadata.ChunkKeyEncoding.Name)
+	}
+
+	decompress := zarrDecompressor("")
+	for ii, codec := range metadata.Codecs {
+		switch {
+		case ii == 0 && codec.Name == "bytes":
+			if codec.Configuration.Endian == "big" && dtype.Size() > 1 {
+				return nil, errors.New("big-endian \"bytes\" codec not supported")
+			}
+		case ii == 1 && zarrDecompressor(codec.Name) != nil:
+			decompress = zarrDecompressor(codec.Name)
+		default:
+			return nil, errors.Errorf("codec #%d %q not supported, only \"bytes\" followed by an optional compression codec", ii, codec.Name)
+		}
+	}
+	return &zarrArray{
+		shape:      shapes.Make(dtype, metadata.Shape...),
+		chunkShape: metadata.ChunkGrid.Configuration.ChunkShape,
+		chunkKey:   chunkKey,
+		decompress: decompress,
+	}, nil
+}
+
+// joinInts joins the integers with the separator.
+func joinInts(values []int, separator string) string {
+	parts := make([]string, len(values))
+	for ii, v := range values {
+		parts[ii] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, separator)
+}
@@ -0,0 +1,134 @@
+package kaggle
+
+import (
+	"encoding/binary"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+// mapKeyValue is an in-memory keyValueReader.
+type mapKeyValue map[string][]byte
+
+func (kv mapKeyValue) Has(key string) bool { _, found := kv[key]; return found }
+
+func (kv mapKeyValue) Get(key string) ([]byte, error) {
+	value, found := kv[key]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return value, nil
+}
+
+// encodeChunk2D returns the chunk (chunkRow, chunkCol) of the float32 matrix as little-endian bytes, padded with
+// zeros at the edges.
+func encodeChunk2D(values [][]float32, chunkRows, chunkCols, chunkRow, chunkCol int) []byte {
+	var chunk []byte
+	for row := chunkRow * chunkRows; row < (chunkRow+1)*chunkRows; row++ {
+		for col := chunkCol * chunkCols; col < (chunkCol+1)*chunkCols; col++ {
+			var v float32
+			if row < len(values) && col < len(values[row]) {
+				v = values[row][col]
+			}
+			chunk = binary.LittleEndian.AppendUint32(chunk, math.Float32bits(v))
+		}
+	}
+	return chunk
+}
+
+func TestReadZarrArray(t *testing.T) {
+	values := [][]float32{
+		{0, 1, 2, 3, 4},
+		{10, 11, 12, 13, 14},
+		{20, 21, 22, 23, 24},
+	}
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	// Zarr version 2: zstd compressed chunks, chunk (1, 2) is missing (filled with zeros).
+	kv := mapKeyValue{
+		"x/.zarray": []byte(`{"zarr_format": 2, "shape": [3, 5], "chunks": [2, 2], "dtype": "<f4",
+			"compressor": {"id": "zstd", "level": 1}, "filters": null, "order": "C", "fill_value": 0}`),
+	}
+	for chunkRow := range 2 {
+		for chunkCol := range 3 {
+			if chunkRow == 1 && chunkCol == 2 {
+				continue
+			}
+			kv[path.Join("x", joinInts([]int{chunkRow, chunkCol}, "."))] =
+				encoder.EncodeAll(encodeChunk2D(values, 2, 2, chunkRow, chunkCol), nil)
+		}
+	}
+	tensor, err := readZarrArray(kv, "x")
+	require.NoError(t, err)
+	want := [][]float32{
+		{0, 1, 2, 3, 4},
+		{10, 11, 12, 13, 14},
+		{20, 21, 22, 23, 0},
+	}
+	require.Equal(t, want, tensor.Value())
+
+	// Zarr version 3: uncompressed, with the default chunk key encoding.
+	kv = mapKeyValue{
+		"y/zarr.json": []byte(`{"zarr_format": 3, "node_type": "array", "shape": [3, 5], "data_type": "float32",
+			"chunk_grid": {"name": "regular", "configuration": {"chunk_shape": [3, 3]}},
+			"chunk_key_encoding": {"name": "default"},
+			"codecs": [{"name": "bytes", "configuration": {"endian": "little"}}], "fill_value": 0}`),
+		"y/c/0/0": encodeChunk2D(values, 3, 3, 0, 0),
+		"y/c/0/1": encodeChunk2D(values, 3, 3, 0, 1),
+	}
+	tensor, err = readZarrArray(kv, "y")
+	require.NoError(t, err)
+	require.Equal(t, values, tensor.Value())
+
+	// Scalar.
+	kv = mapKeyValue{
+		"s/.zarray": []byte(`{"zarr_format": 2, "shape": [], "chunks": [], "dtype": "<i4", "compressor": null}`),
+		"s/0":       binary.LittleEndian.AppendUint32(nil, 7),
+	}
+	tensor, err = readZarrArray(kv, "s")
+	require.NoError(t, err)
+	require.Equal(t, int32(7), tensor.Value())
+
+	// Not supported.
+	kv = mapKeyValue{
+		"z/.zarray": []byte(`{"zarr_format": 2, "shape": [2], "chunks": [2], "dtype": "<f4", "compressor": {"id": "blosc"}}`),
+	}
+	_, err = readZarrArray(kv, "z")
+	require.ErrorContains(t, err, "blosc")
+	_, err = readZarrArray(kv, "missing")
+	require.Error(t, err)
+}
+
+func TestReadOCDBTWeightsToTree(t *testing.T) {
+	dir := t.TempDir()
+	metadata := `{"use_zarr3": true, "tree_metadata": {
+		"('transformer', 'final_norm', 'scale')": {
+			"key_metadata": [{"key": "transformer", "key_type": 2}, {"key": "final_norm", "key_type": 2}, {"key": "scale", "key_type": 2}],
+			"value_metadata": {"value_type": "jax.Array", "skip_deserialize": false}}}}`
+	require.NoError(t, os.WriteFile(path.Join(dir, MetadataFileName), []byte(metadata), 0644))
+	var chunk []byte
+	for _, v := range []float32{1, 2, 3} {
+		chunk = binary.LittleEndian.AppendUint32(chunk, math.Float32bits(v))
+	}
+	writeTestOCDBT(t, dir,
+		[]string{"transformer.final_norm.scale/c/0", "transformer.final_norm.scale/zarr.json"},
+		[][]byte{chunk, []byte(`{"zarr_format": 3, "node_type": "array", "shape": [3], "data_type": "float32",
+			"chunk_grid": {"name": "regular", "configuration": {"chunk_shape": [3]}},
+			"chunk_key_encoding": {"name": "default", "configuration": {"separator": "/"}},
+			"codecs": [{"name": "bytes", "configuration": {"endian": "little"}}], "fill_value": 0}`)})
+
+	// The OCDBT reader is opt-in.
+	_, err := ReadWeightsToTree(dir)
+	require.ErrorContains(t, err, "ReadOCDBTWeightsToTree")
+
+	tree, err := ReadOCDBTWeightsToTree(dir)
+	require.NoError(t, err)
+	scale, err := tree.Get("transformer", "final_norm", "scale")
+	require.NoError(t, err)
+	require.Equal(t, []float32{1, 2, 3}, tensors.CopyFlatData[float32](scale))
+}
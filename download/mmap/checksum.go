@@ -0,0 +1,205 @@
+package mmap
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ManifestFileName is the name of the file with the SHA-256 checksums of the weights files of a model directory,
+// see Manifest.
+const ManifestFileName = "SHA256SUMS"
+
+// Manifest maps the names of the files of a model directory (relative to the directory, with "/" as separator) to
+// their SHA-256 checksums, in lowercase hexadecimal.
+//
+// It is stored in ManifestFileName, in the format of the `sha256sum` tool, so it can also be checked with
+// `sha256sum -c SHA256SUMS`.
+type Manifest map[string]string
+
+// NewManifest computes the checksums of the given files of dir.
+func NewManifest(dir string, fileNames []string) (Manifest, error) {
+	manifest := make(Manifest, len(fileNames))
+	for _, fileName := range fileNames {
+		checksum, err := fileChecksum(path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		manifest[fileName] = checksum
+	}
+	return manifest, nil
+}
+
+// fileChecksum returns the SHA-256 of the file in filePath, in lowercase hexadecimal.
+func fileChecksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open %q to compute its checksum", filePath)
+	}
+	defer func() { _ = f.Close() }()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", errors.Wrapf(err, "failed to read %q to compute its checksum", filePath)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReadManifest reads the ManifestFileName of dir.
+func ReadManifest(dir string) (Manifest, error) {
+	manifestPath := path.Join(dir, ManifestFileName)
+	contents, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read checksums manifest %q", manifestPath)
+	}
+	manifest := make(Manifest)
+	for lineNum, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		checksum, fileName, found := strings.Cut(line, " ")
+		// sha256sum marks files read in binary mode with a "*" before the name.
+		fileName = strings.TrimPrefix(strings.TrimPrefix(fileName, " "), "*")
+		if !found || fileName == "" || len(checksum) != 2*sha256.Size {
+			return nil, errors.Errorf("%q: invalid line %d: %q", manifestPath, lineNum+1, line)
+		}
+		if _, err := hex.DecodeString(checksum); err != nil {
+			return nil, errors.Errorf("%q: invalid checksum in line %d: %q", manifestPath, lineNum+1, line)
+		}
+		manifest[fileName] = strings.ToLower(checksum)
+	}
+	return manifest, nil
+}
+
+// Write the manifest to the ManifestFileName of dir, sorted by file name.
+func (m Manifest) Write(dir string) error {
+	fileNames := make([]string, 0, len(m))
+	for fileName := range m {
+		fileNames = append(fileNames, fileName)
+	}
+	slices.Sort(fileNames)
+	manifestPath := path.Join(dir, ManifestFileName)
+	f, err := os.Create(manifestPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create checksums manifest %q", manifestPath)
+	}
+	w := bufio.NewWriter(f)
+	for _, fileName := range fileNames {
+		_, _ = fmt.Fprintf(w, "%s  %s\n", m[fileName], fileName)
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write checksums manifest %q", manifestPath)
+	}
+	return nil
+}
+
+// ChecksumsManifest returns the Manifest of dir to verify the weights files with, if Options.VerifyChecksums is
+// set. Otherwise, it returns nil.
+func (o *Options) ChecksumsManifest(dir string) (Manifest, error) {
+	if o == nil || !o.VerifyChecksums {
+		return nil, nil
+	}
+	return ReadManifest(dir)
+}
+
+// Verify the contents of the file fileName against its checksum in the manifest. It fails if the file is not
+// listed.
+func (m Manifest) Verify(fileName string, contents []byte) error {
+	expected, found := m[fileName]
+	if !found {
+		return errors.Errorf("file %q is not listed in the checksums manifest", fileName)
+	}
+	sum := sha256.Sum256(contents)
+	if got := hex.EncodeToString(sum[:]); got != expected {
+		return errors.Errorf("file %q is corrupted (truncated or modified): its SHA-256 is %s, but %s was expected",
+			fileName, got, expected)
+	}
+	return nil
+}
+
+// VerifyFile verifies the file fileName of dir, reading it from disk, against its checksum in the manifest. It is
+// used for files that are not memory-mapped. It fails if the file is not listed.
+func (m Manifest) VerifyFile(dir, fileName string) error {
+	expected, found := m[fileName]
+	if !found {
+		return errors.Errorf("file %q is not listed in the checksums manifest", fileName)
+	}
+	got, err := fileChecksum(path.Join(dir, fileName))
+	if err != nil {
+		return err
+	}
+	if got != expected {
+		return errors.Errorf("file %q is corrupted (truncated or modified): its SHA-256 is %s, but %s was expected",
+			fileName, got, expected)
+	}
+	return nil
+}
+
+// VerifyFiles verifies all the files listed in the manifest, reading them from dir, see VerifyFile.
+func (m Manifest) VerifyFiles(dir string) error {
+	fileNames := make([]string, 0, len(m))
+	for fileName := range m {
+		fileNames = append(fileNames, fileName)
+	}
+	slices.Sort(fileNames)
+	for _, fileName := range fileNames {
+		if err := m.VerifyFile(dir, fileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFinite returns an error if the raw data of a tensor with the given shape has NaN or Inf values. Only
+// floating point dtypes are checked.
+func checkFinite(shape shapes.Shape, data []byte) error {
+	// Values are NaN or Inf if all the bits of the exponent are set.
+	var isNonFinite func(idx int) bool
+	switch shape.DType {
+	case dtypes.Float64:
+		isNonFinite = func(idx int) bool {
+			return binary.LittleEndian.Uint64(data[idx*8:])&0x7FF0_0000_0000_0000 == 0x7FF0_0000_0000_0000
+		}
+	case dtypes.Float32:
+		isNonFinite = func(idx int) bool {
+			return binary.LittleEndian.Uint32(data[idx*4:])&0x7F80_0000 == 0x7F80_0000
+		}
+	case dtypes.Float16:
+		isNonFinite = func(idx int) bool {
+			return binary.LittleEndian.Uint16(data[idx*2:])&0x7C00 == 0x7C00
+		}
+	case dtypes.BFloat16:
+		isNonFinite = func(idx int) bool {
+			return binary.LittleEndian.Uint16(data[idx*2:])&0x7F80 == 0x7F80
+		}
+	default:
+		return nil
+	}
+	count, first := 0, -1
+	for idx := range shape.Size() {
+		if isNonFinite(idx) {
+			if first < 0 {
+				first = idx
+			}
+			count++
+		}
+	}
+	if count > 0 {
+		return errors.Errorf("tensor shaped %s has %d NaN or Inf values (the first at flat index %d), the weights are corrupted",
+			shape, count, first)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package mmap
+
+import (
+	"encoding/binary"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/stretchr/testify/require"
+	"github.com/x448/float16"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(path.Join(dir, "raw"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "raw", "w.raw"), []byte("abc"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "b.raw"), nil, 0644))
+	manifest, err := NewManifest(dir, []string{"raw/w.raw", "b.raw"})
+	require.NoError(t, err)
+	require.NoError(t, manifest.Write(dir))
+
+	// Same format as `sha256sum`.
+	contents, err := os.ReadFile(path.Join(dir, ManifestFileName))
+	require.NoError(t, err)
+	require.Equal(t,
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  b.raw\n"+
+			"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad  raw/w.raw\n",
+		string(contents))
+	readManifest, err := ReadManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, manifest, readManifest)
+
+	require.NoError(t, manifest.Verify("raw/w.raw", []byte("abc")))
+	require.ErrorContains(t, manifest.Verify("raw/w.raw", []byte("abd")), "corrupted")
+	require.ErrorContains(t, manifest.Verify("other.raw", nil), "not listed")
+	require.NoError(t, manifest.VerifyFiles(dir))
+	require.NoError(t, os.WriteFile(path.Join(dir, "raw", "w.raw"), []byte("ab"), 0644))
+	require.ErrorContains(t, manifest.VerifyFiles(dir), "corrupted")
+	require.ErrorContains(t, manifest.VerifyFile(dir, "other.raw"), "not listed")
+
+	// Binary mode marker, and invalid lines.
+	require.NoError(t, os.WriteFile(path.Join(dir, ManifestFileName),
+		[]byte("E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855 *b.raw\n\n"), 0644))
+	readManifest, err = ReadManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, Manifest{"b.raw": manifest["b.raw"]}, readManifest)
+	require.NoError(t, os.WriteFile(path.Join(dir, ManifestFileName), []byte("1234  b.raw\n"), 0644))
+	_, err = ReadManifest(dir)
+	require.ErrorContains(t, err, "invalid line 1")
+
+	// Only read if VerifyChecksums is set.
+	var opts *Options
+	readManifest, err = opts.ChecksumsManifest(dir)
+	require.NoError(t, err)
+	require.Nil(t, readManifest)
+	opts = &Options{VerifyChecksums: true}
+	_, err = opts.ChecksumsManifest(t.TempDir())
+	require.ErrorContains(t, err, ManifestFileName)
+}
+
+func TestCheckFinite(t *testing.T) {
+	f32 := func(values ...float32) []byte {
+		data := make([]byte, 4*len(values))
+		for ii, v := range values {
+			binary.LittleEndian.PutUint32(data[4*ii:], math.Float32bits(v))
+		}
+		return data
+	}
+	inf := float32(math.Inf(1))
+	require.NoError(t, checkFinite(shapes.Make(dtypes.Float32, 3), f32(1, -math.MaxFloat32, 0)))
+	require.ErrorContains(t, checkFinite(shapes.Make(dtypes.Float32, 3), f32(1, -inf, float32(math.NaN()))),
+		"2 NaN or Inf values (the first at flat index 1)")
+
+	f64 := make([]byte, 16)
+	binary.LittleEndian.PutUint64(f64[8:], math.Float64bits(math.NaN()))
+	require.ErrorContains(t, checkFinite(shapes.Make(dtypes.Float64, 2), f64), "index 1")
+
+	f16 := make([]byte, 4)
+	binary.LittleEndian.PutUint16(f16, float16.Fromfloat32(65504).Bits())
+	require.NoError(t, checkFinite(shapes.Make(dtypes.Float16, 2), f16))
+	binary.LittleEndian.PutUint16(f16[2:], float16.Inf(-1).Bits())
+	require.Error(t, checkFinite(shapes.Make(dtypes.Float16, 2), f16))
+
+	bf16 := make([]byte, 4)
+	binary.LittleEndian.PutUint16(bf16, bfloat16.FromFloat32(3e38).Bits())
+	require.NoError(t, checkFinite(shapes.Make(dtypes.BFloat16, 2), bf16))
+	binary.LittleEndian.PutUint16(bf16[2:], bfloat16.FromFloat32(inf).Bits())
+	require.Error(t, checkFinite(shapes.Make(dtypes.BFloat16, 2), bf16))
+
+	// Integers are not checked.
+	require.NoError(t, checkFinite(shapes.Make(dtypes.Int32, 1), []byte{0xff, 0xff, 0xff, 0x7f}))
+
+	// Through NewTensor.
+	opts := &Options{CheckFinite: true}
+	_, err := opts.NewTensor(shapes.Make(dtypes.Float32, 2), f32(1, inf))
+	require.ErrorContains(t, err, "NaN or Inf")
+	tensor, err := opts.NewTensor(shapes.Make(dtypes.Float32, 2), f32(1, 2))
+	require.NoError(t, err)
+	_, err = opts.Transfer(tensor)
+	require.NoError(t, err)
+}
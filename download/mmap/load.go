@@ -0,0 +1,160 @@
+package mmap
+
+import (
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency is the number of tensors read concurrently, if Options.Concurrency is not set.
+const DefaultConcurrency = 4
+
+// Progress of the loading of the weights, reported to Options.Progress.
+type Progress struct {
+	// TensorsLoaded out of TotalTensors: skipped tensors are not counted.
+	TensorsLoaded, TotalTensors int
+
+	// BytesLoaded out of TotalBytes. TotalBytes is 0 if the size of the tensors is not known in advance (e.g.: for
+	// compressed checkpoints).
+	BytesLoaded, TotalBytes int64
+
+	// Elapsed time since the loading started.
+	Elapsed time.Duration
+
+	// ETA is the estimated time to finish the loading, extrapolated from the bytes (or, if TotalBytes is 0, the
+	// tensors) loaded so far.
+	ETA time.Duration
+}
+
+// SkipReason describes why a tensor of the weights files was not loaded.
+type SkipReason int
+
+const (
+	// SkipUnmapped is used for tensors with no corresponding model variable (e.g.: a separate output projection,
+	// tied to the embedding table in Gemma).
+	SkipUnmapped SkipReason = iota
+
+	// SkipLayer is used for tensors of layers not selected by Options.Layers.
+	SkipLayer
+)
+
+// String implements fmt.Stringer.
+func (r SkipReason) String() string {
+	switch r {
+	case SkipUnmapped:
+		return "unmapped"
+	case SkipLayer:
+		return "layer not selected"
+	}
+	return "unknown"
+}
+
+// SkippedTensor describes a tensor of the weights files that was not loaded, reported to Options.Skipped.
+type SkippedTensor struct {
+	// Name of the tensor in the weights files.
+	Name string
+
+	// Shape of the tensor, if known.
+	Shape shapes.Shape
+
+	Reason SkipReason
+}
+
+// Skip reports the skipped tensor to Options.Skipped, if set.
+func (o *Options) Skip(name string, shape shapes.Shape, reason SkipReason) {
+	if o != nil && o.Skipped != nil {
+		o.Skipped(SkippedTensor{Name: name, Shape: shape, Reason: reason})
+	}
+}
+
+// Task loads one tensor, see Options.Run.
+type Task struct {
+	// Name of the tensor, used in the errors.
+	Name string
+
+	// Bytes read by the task, used to report progress. It can be 0 if not known in advance.
+	Bytes int64
+
+	// Read the tensor: it is called concurrently with the Read of other tasks.
+	Read func() (*tensors.Tensor, error)
+
+	// Set is called with the tensor read, one task at a time, so it can be used to create variables in a context.
+	Set func(tensor *tensors.Tensor) error
+}
+
+// Run the tasks with a pool of Options.Concurrency workers, reporting the progress to Options.Progress after each
+// task is done. It stops at the first error, which is returned.
+func (o *Options) Run(tasks []Task) error {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	start := time.Now()
+	progress := Progress{TotalTensors: len(tasks)}
+	for _, task := range tasks {
+		progress.TotalBytes += task.Bytes
+	}
+
+	var mu sync.Mutex // Protects progress, firstErr and serializes the calls to Task.Set and Options.Progress.
+	var firstErr error
+	taskIndices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(opts.Concurrency, len(tasks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range taskIndices {
+				task := tasks[idx]
+				tensor, err := task.Read()
+				mu.Lock()
+				if err == nil && firstErr == nil {
+					err = task.Set(tensor)
+				}
+				if err != nil {
+					if firstErr == nil {
+						firstErr = errors.WithMessagef(err, "loading tensor %q", task.Name)
+					}
+					mu.Unlock()
+					continue
+				}
+				progress.TensorsLoaded++
+				progress.BytesLoaded += task.Bytes
+				progress.Elapsed = time.Since(start)
+				progress.ETA = progress.estimateRemaining()
+				if opts.Progress != nil && firstErr == nil {
+					opts.Progress(progress)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for idx := range tasks {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		taskIndices <- idx
+	}
+	close(taskIndices)
+	wg.Wait()
+	return firstErr
+}
+
+// estimateRemaining extrapolates the time to finish from the elapsed time.
+func (p *Progress) estimateRemaining() time.Duration {
+	done, total := float64(p.BytesLoaded), float64(p.TotalBytes)
+	if p.TotalBytes == 0 {
+		done, total = float64(p.TensorsLoaded), float64(p.TotalTensors)
+	}
+	if done == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * (total - done) / done)
+}
@@ -0,0 +1,110 @@
+package mmap
+
+import (
+	"fmt"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	const numTasks = 20
+	newTasks := func(values map[string]int32, failAt int) []Task {
+		tasks := make([]Task, numTasks)
+		for ii := range tasks {
+			name := fmt.Sprintf("tensor_%d", ii)
+			tasks[ii] = Task{
+				Name:  name,
+				Bytes: 10,
+				Read: func() (*tensors.Tensor, error) {
+					if ii == failAt {
+						return nil, errors.New("read failed")
+					}
+					time.Sleep(time.Millisecond)
+					return tensors.FromValue(int32(ii)), nil
+				},
+				Set: func(tensor *tensors.Tensor) error {
+					values[name] = tensor.Value().(int32) // Not protected: Set must be called one at a time.
+					return nil
+				},
+			}
+		}
+		return tasks
+	}
+
+	// All tasks loaded, with the progress reported after each one.
+	values := make(map[string]int32)
+	var progressCalls int
+	var lastProgress Progress
+	var concurrent, maxConcurrent atomic.Int32
+	tasks := newTasks(values, -1)
+	for ii := range tasks {
+		read := tasks[ii].Read
+		tasks[ii].Read = func() (*tensors.Tensor, error) {
+			n := concurrent.Add(1)
+			defer concurrent.Add(-1)
+			for {
+				m := maxConcurrent.Load()
+				if n <= m || maxConcurrent.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			return read()
+		}
+	}
+	opts := &Options{
+		Concurrency: 3,
+		Progress: func(progress Progress) {
+			progressCalls++
+			require.Equal(t, progressCalls, progress.TensorsLoaded)
+			lastProgress = progress
+		},
+	}
+	require.NoError(t, opts.Run(tasks))
+	require.Len(t, values, numTasks)
+	require.Equal(t, int32(7), values["tensor_7"])
+	require.Equal(t, numTasks, progressCalls)
+	require.Equal(t, numTasks, lastProgress.TotalTensors)
+	require.Equal(t, int64(numTasks*10), lastProgress.TotalBytes)
+	require.Equal(t, lastProgress.TotalBytes, lastProgress.BytesLoaded)
+	require.Equal(t, time.Duration(0), lastProgress.ETA)
+	require.Positive(t, lastProgress.Elapsed)
+	require.LessOrEqual(t, maxConcurrent.Load(), int32(3))
+
+	// Nil options and no tasks.
+	var nilOpts *Options
+	require.NoError(t, nilOpts.Run(nil))
+
+	// The first error is returned, and the following tasks are not started.
+	values = make(map[string]int32)
+	err := (&Options{Concurrency: 1}).Run(newTasks(values, 5))
+	require.ErrorContains(t, err, "tensor_5")
+	require.ErrorContains(t, err, "read failed")
+	require.Len(t, values, 5)
+}
+
+func TestEstimateRemaining(t *testing.T) {
+	p := Progress{BytesLoaded: 25, TotalBytes: 100, TensorsLoaded: 1, TotalTensors: 2, Elapsed: time.Second}
+	require.Equal(t, 3*time.Second, p.estimateRemaining())
+
+	// Without the size of the tensors, it is extrapolated from the number of tensors.
+	p.TotalBytes, p.BytesLoaded = 0, 0
+	require.Equal(t, time.Second, p.estimateRemaining())
+}
+
+func TestSkip(t *testing.T) {
+	var nilOpts *Options
+	nilOpts.Skip("unused", shapes.Make(dtypes.Float32), SkipUnmapped) // No-op.
+
+	var skipped []SkippedTensor
+	opts := &Options{Skipped: func(tensor SkippedTensor) { skipped = append(skipped, tensor) }}
+	opts.Skip("blk.3.attn_q.weight", shapes.Make(dtypes.Float32, 2, 3), SkipLayer)
+	require.Equal(t, []SkippedTensor{{"blk.3.attn_q.weight", shapes.Make(dtypes.Float32, 2, 3), SkipLayer}}, skipped)
+	require.Equal(t, "layer not selected", SkipLayer.String())
+	require.Equal(t, "unmapped", SkipUnmapped.String())
+}
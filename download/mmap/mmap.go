@@ -0,0 +1,163 @@
+// Package mmap loads model weights from memory-mapped files, so they can be transferred to the device directly
+// from the page cache, without first being copied to the Go heap.
+//
+// It is used by the huggingface, kaggle and gguf packages, configured with Options: to load 9B and 27B models in
+// machines with just enough RAM, set Options.Backend, and optionally restrict the layers loaded with
+// Options.Layers. The tensors are read by a pool of workers, and the progress and the skipped tensors are reported
+// with callbacks, usable by CLIs and servers alike.
+//
+// Example:
+//
+//	backend := backends.New()
+//	ctx := context.New()
+//	vocab, err := huggingface.LoadFromDirWithOptions(ctx, dir, &mmap.Options{Backend: backend})
+package mmap
+
+import (
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gomlx/backends"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/pkg/errors"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Options configure how the weights are loaded. A nil *Options loads all the layers into local tensors, reading
+// DefaultConcurrency tensors at a time.
+type Options struct {
+	// Backend, if set, makes each tensor be transferred directly from the memory-mapped file to the device, and
+	// no copy of the weights is kept in the Go heap. The variables then hold on-device tensors only.
+	//
+	// If nil, tensors are copied from the file to local (Go heap) storage, and they are transferred to the device
+	// when first used.
+	Backend backends.Backend
+
+	// Layers, if not nil, restricts the loading to the given transformer layers (numbered from 0). The weights
+	// outside the layers (the embedding table and the final normalization) are always loaded.
+	//
+	// Notice transformers.NewConfigFromContext infers the number of layers from the variables, so this is meant to
+	// inspect or process (e.g.: quantize) a model a few layers at a time.
+	Layers []int
+
+	// Concurrency is the number of tensors read concurrently. If <= 0, it uses DefaultConcurrency.
+	Concurrency int
+
+	// Progress, if set, is called after each tensor is loaded, one call at a time, e.g.: to display a progress bar.
+	Progress func(progress Progress)
+
+	// Skipped, if set, is called for each tensor of the weights files that is not loaded, see SkipReason.
+	Skipped func(tensor SkippedTensor)
+
+	// VerifyChecksums, if set, verifies the SHA-256 of each weights file read against the Manifest of the model
+	// directory, so a truncated or corrupted download fails to load. Loading fails if the manifest is missing, or
+	// doesn't list one of the files. It requires reading the files fully, which is slow for large models.
+	VerifyChecksums bool
+
+	// CheckFinite, if set, scans the floating point tensors loaded for NaN and Inf values, which are never present
+	// in valid weights, and fails the loading if any is found.
+	CheckFinite bool
+
+	// Validate, if set, asks the loaders of the models to check the variables loaded into the context against the
+	// exact variables the model requests, and to fail the loading with the list of missing, unexpected and mis-shaped
+	// variables: see the loaders of each format.
+	//
+	// It can't be used with Layers, since the variables of the other layers are missing.
+	Validate bool
+}
+
+// SkipScope returns whether the weights with the given scope and name (relative to the model scope, e.g.:
+// ["layer_3", "attn", "q_einsum", "w"]) are not to be loaded, because they belong to a layer not listed in
+// Options.Layers.
+func (o *Options) SkipScope(scopeAndName []string) bool {
+	if o == nil || o.Layers == nil || len(scopeAndName) == 0 {
+		return false
+	}
+	layerNumber, err := strconv.Atoi(strings.TrimPrefix(scopeAndName[0], "layer_"))
+	if err != nil || !strings.HasPrefix(scopeAndName[0], "layer_") {
+		return false
+	}
+	return !slices.Contains(o.Layers, layerNumber)
+}
+
+// NewTensor creates a tensor with the given shape and raw data, usually a slice of a memory-mapped File.
+//
+// If Options.Backend is set, the tensor is created directly on the device (device 0), and data is no longer
+// referenced once NewTensor returns. Otherwise, data is copied to a new local tensor.
+func (o *Options) NewTensor(shape shapes.Shape, data []byte) (t *tensors.Tensor, err error) {
+	if len(data) != int(shape.Memory()) {
+		return nil, errors.Errorf("shape %s requires %d bytes, but got %d bytes of data", shape, shape.Memory(), len(data))
+	}
+	if o != nil && o.CheckFinite {
+		if err = checkFinite(shape, data); err != nil {
+			return nil, err
+		}
+	}
+	if o == nil || o.Backend == nil {
+		t = tensors.FromShape(shape)
+		t.MutableBytes(func(tensorData []byte) { copy(tensorData, data) })
+		return t, nil
+	}
+
+	// The backend takes a flat slice of the dtype: data is viewed as such, if it is properly aligned.
+	goType := shape.DType.GoType()
+	var flat any
+	if len(data) > 0 && uintptr(unsafe.Pointer(unsafe.SliceData(data)))%uintptr(goType.Align()) == 0 {
+		flat = reflect.SliceAt(goType, unsafe.Pointer(unsafe.SliceData(data)), shape.Size()).Interface()
+	} else {
+		flatV := reflect.MakeSlice(reflect.SliceOf(goType), shape.Size(), shape.Size())
+		if shape.Size() > 0 {
+			copy(unsafe.Slice((*byte)(flatV.UnsafePointer()), len(data)), data)
+		}
+		flat = flatV.Interface()
+	}
+	err = exceptions.TryCatch[error](func() {
+		buffer := o.Backend.BufferFromFlatData(0, flat, shape)
+		t = tensors.FromBuffer(o.Backend, buffer)
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to transfer tensor shaped %s to the device", shape)
+	}
+	return t, nil
+}
+
+// Transfer the local tensor to the device, if Options.Backend is set, and release its local storage.
+// Otherwise, it returns the tensor unchanged.
+//
+// It is used for tensors that need decoding (e.g.: decompression or dequantization), so they can't be transferred
+// directly from a memory-mapped file. Like NewTensor, it checks the values if Options.CheckFinite is set.
+func (o *Options) Transfer(local *tensors.Tensor) (t *tensors.Tensor, err error) {
+	if o == nil {
+		return local, nil
+	}
+	if o.Backend == nil {
+		if o.CheckFinite {
+			local.ConstBytes(func(data []byte) {
+				err = checkFinite(local.Shape(), data)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		return local, nil
+	}
+	local.ConstBytes(func(data []byte) {
+		t, err = o.NewTensor(local.Shape(), data)
+	})
+	local.FinalizeAll()
+	return t, err
+}
+
+// File is a read-only memory-mapped file. In platforms without mmap support, the file is read to memory instead.
+type File struct {
+	data   []byte
+	mapped bool
+}
+
+// Bytes returns the contents of the file. They are only valid until the File is closed.
+func (f *File) Bytes() []byte {
+	return f.data
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package mmap
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+// Open reads the file in filePath to memory, since memory-mapping is not supported in this platform.
+func Open(filePath string) (*File, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", filePath)
+	}
+	return &File{data: data}, nil
+}
+
+// Close releases the contents of the file.
+func (f *File) Close() error {
+	f.data = nil
+	return nil
+}
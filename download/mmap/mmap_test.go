@@ -0,0 +1,48 @@
+package mmap
+
+import (
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "weights.raw")
+	contents := []byte{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0}
+	require.NoError(t, os.WriteFile(filePath, contents, 0644))
+	f, err := Open(filePath)
+	require.NoError(t, err)
+	require.Equal(t, contents, f.Bytes())
+
+	// Without a backend, tensors are copied: they remain valid after the file is closed.
+	var opts *Options
+	tensor, err := opts.NewTensor(shapes.Make(dtypes.Int32, 3), f.Bytes())
+	require.NoError(t, err)
+	_, err = opts.NewTensor(shapes.Make(dtypes.Int32, 2), f.Bytes())
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, []int32{1, 2, 3}, tensor.Value())
+
+	// Empty files.
+	require.NoError(t, os.WriteFile(filePath, nil, 0644))
+	f, err = Open(filePath)
+	require.NoError(t, err)
+	require.Empty(t, f.Bytes())
+	require.NoError(t, f.Close())
+
+	_, err = Open(path.Join(t.TempDir(), "missing.raw"))
+	require.Error(t, err)
+}
+
+func TestSkipScope(t *testing.T) {
+	var opts *Options
+	require.False(t, opts.SkipScope([]string{"layer_3", "attn", "q_einsum", "w"}))
+	opts = &Options{Layers: []int{0, 2}}
+	require.False(t, opts.SkipScope([]string{"layer_2", "attn", "q_einsum", "w"}))
+	require.True(t, opts.SkipScope([]string{"layer_3", "attn", "q_einsum", "w"}))
+	require.False(t, opts.SkipScope([]string{"embedder", "input_embedding"}))
+	require.False(t, opts.SkipScope([]string{"final_norm", "scale"}))
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package mmap
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"syscall"
+)
+
+// Open memory-maps the file in filePath, read-only. It must be closed with File.Close.
+func Open(filePath string) (*File, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", filePath)
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %q", filePath)
+	}
+	if info.Size() == 0 {
+		// Empty files can't be mapped.
+		return &File{}, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to memory-map %q", filePath)
+	}
+	return &File{data: data, mapped: true}, nil
+}
+
+// Close unmaps the file.
+func (f *File) Close() error {
+	if !f.mapped {
+		return nil
+	}
+	data := f.data
+	f.data, f.mapped = nil, false
+	return errors.Wrap(syscall.Munmap(data), "failed to unmap file")
+}
@@ -0,0 +1,245 @@
+// Package embeddings extracts text embeddings from a Gemma model, for retrieval, clustering or classification.
+//
+// The embeddings are the pooled hidden states of the model (see Pooling), taken after the final normalization
+// or from the output of any of the transformer layers (see Embedder.WithLayer).
+package embeddings
+
+import (
+	"fmt"
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gemma/samplers"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"slices"
+)
+
+// Pooling defines how the hidden states of the tokens of a text are combined into one embedding.
+type Pooling string
+
+const (
+	// PoolingMean takes the mean of the hidden states of the tokens of the text. The <bos> token is excluded (except
+	// for empty texts), since its hidden state is the same for every text.
+	PoolingMean Pooling = "mean"
+
+	// PoolingLastToken takes the hidden state of the last token of the text, the only one that attended to the
+	// whole text.
+	PoolingLastToken Pooling = "last_token"
+)
+
+// LayerFinal selects the hidden states after the last layer and the final normalization, the ones used to predict
+// the next token. See Embedder.WithLayer.
+const LayerFinal = -1
+
+// DefaultMaxLength is the default maximum number of tokens of a text, see Embedder.WithMaxLength.
+const DefaultMaxLength = 512
+
+// Embedder extracts text embeddings using a Gemma model.
+type Embedder struct {
+	Backend backends.Backend
+	Vocab   samplers.Vocabulary
+
+	// Context with the model weights, under the "model" scope.
+	Context *context.Context
+
+	// Config of the Gemma model, created from the weights.
+	Config *transformers.Config
+
+	pooling   Pooling
+	layer     int
+	normalize bool
+	maxLength int
+	exec      *context.Exec
+}
+
+// New creates an Embedder with the model weights in ctx (under the "model" scope, as loaded by the download
+// packages) and its vocabulary.
+//
+// By default, it uses PoolingMean over the final hidden states (LayerFinal), and the embeddings are L2-normalized.
+func New(backend backends.Backend, ctx *context.Context, vocab samplers.Vocabulary) (*Embedder, error) {
+	e := &Embedder{
+		Backend:   backend,
+		Vocab:     vocab,
+		Context:   ctx.Reuse(),
+		pooling:   PoolingMean,
+		layer:     LayerFinal,
+		normalize: true,
+		maxLength: DefaultMaxLength,
+	}
+	var err error
+	e.Config, err = transformers.NewConfigFromContext(e.Context.In("model"))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// WithPooling sets how the hidden states of the tokens are combined into one embedding. Default is PoolingMean.
+func (e *Embedder) WithPooling(pooling Pooling) (*Embedder, error) {
+	if pooling != PoolingMean && pooling != PoolingLastToken {
+		return nil, errors.Errorf("unknown pooling %q, valid values are %q and %q", pooling, PoolingMean, PoolingLastToken)
+	}
+	e.pooling = pooling
+	e.exec = nil
+	return e, nil
+}
+
+// WithLayer sets the layer whose output (hidden states) is used, from 0 to Config.NumLayers-1, or LayerFinal (the
+// default) for the hidden states after the final normalization.
+//
+// Intermediary layers often work better for some tasks, and they are cheaper to compute, since the following
+// layers are not executed.
+func (e *Embedder) WithLayer(layer int) (*Embedder, error) {
+	if layer != LayerFinal && (layer < 0 || layer >= e.Config.NumLayers) {
+		return nil, errors.Errorf("invalid layer %d, the model has %d layers (or use LayerFinal=%d)",
+			layer, e.Config.NumLayers, LayerFinal)
+	}
+	e.layer = layer
+	e.exec = nil
+	return e, nil
+}
+
+// WithNormalization sets whether the embeddings are L2-normalized (the default), so their dot-product is their
+// cosine similarity.
+func (e *Embedder) WithNormalization(normalize bool) *Embedder {
+	e.normalize = normalize
+	e.exec = nil
+	return e
+}
+
+// WithMaxLength sets the maximum number of tokens (including <bos>) of each text: longer texts are truncated.
+// Default is DefaultMaxLength.
+func (e *Embedder) WithMaxLength(maxLength int) (*Embedder, error) {
+	if maxLength < 2 || maxLength > e.Config.MaxSequenceLength {
+		return nil, errors.Errorf("invalid maxLength %d, it must be between 2 and %d (Config.MaxSequenceLength)",
+			maxLength, e.Config.MaxSequenceLength)
+	}
+	e.maxLength = maxLength
+	return e, nil
+}
+
+// Embed returns the embeddings of the texts, shaped float32[len(texts), Config.EmbedDim].
+func (e *Embedder) Embed(texts []string) (embeddings *tensors.Tensor, err error) {
+	if len(texts) == 0 {
+		return nil, errors.New("Embedder.Embed() requires at least one text")
+	}
+	tokens, positions, lengths := tokenize(e.Vocab, texts, e.maxLength)
+	if e.exec == nil {
+		e.exec = context.NewExec(e.Backend, e.Context, e.embedGraphFn())
+	}
+	err = exceptions.TryCatch[error](func() {
+		embeddings = e.exec.Call(tokens, positions, lengths)[0]
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "Embedder.Embed() failed")
+	}
+	return embeddings, nil
+}
+
+// EmbedAsSlices is like Embed, but returns the embeddings as Go slices, one per text.
+func (e *Embedder) EmbedAsSlices(texts []string) ([][]float32, error) {
+	embeddings, err := e.Embed(texts)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings.Value().([][]float32), nil
+}
+
+// embedGraphFn returns the graph building function for the current configuration of the Embedder.
+// It takes as inputs the tokens, positions and lengths (see tokenize), and returns the embeddings.
+func (e *Embedder) embedGraphFn() func(ctx *context.Context, tokens, positions, lengths *Node) *Node {
+	config, pooling, layer, normalize := e.Config, e.pooling, e.layer, e.normalize
+	return func(ctx *context.Context, tokens, positions, lengths *Node) *Node {
+		g := tokens.Graph()
+		ctx = ctx.In("model")
+		x := transformers.EmbedTokens(ctx.In("embedder"), config, tokens)
+		lastLayer := layer
+		if layer == LayerFinal {
+			lastLayer = config.NumLayers - 1
+		}
+		for layerIdx := range lastLayer + 1 {
+			x = transformers.Block(ctx.In(fmt.Sprintf("layer_%d", layerIdx)), config, layerIdx, x, positions, nil, nil)
+		}
+		if layer == LayerFinal {
+			x = transformers.RMSNorm(ctx.In("final_norm"), x)
+		}
+		x = ConvertDType(x, dtypes.Float32)
+
+		var pooled *Node
+		switch pooling {
+		case PoolingMean:
+			// Skips padding (position -1) and <bos> (position 0), except for empty texts, which only have <bos>.
+			isEmpty := ExpandAxes(Equal(lengths, OnesLike(lengths)), -1)
+			mask := Or(GreaterOrEqual(positions, OnesLike(positions)),
+				And(isEmpty, Equal(positions, ZerosLike(positions))))
+			pooled = MaskedReduceMean(x, BroadcastToShape(ExpandAxes(mask, -1), x.Shape()), 1)
+		case PoolingLastToken:
+			batchIndices := Iota(g, shapes.Make(dtypes.Int32, lengths.Shape().Dim(0)), 0)
+			indices := Concatenate([]*Node{
+				ExpandAxes(batchIndices, -1),
+				ExpandAxes(AddScalar(lengths, -1), -1),
+			}, -1)
+			pooled = Gather(x, indices)
+		default:
+			exceptions.Panicf("unknown pooling %q", pooling)
+		}
+		if normalize {
+			pooled = L2Normalize(pooled, -1)
+		}
+		return pooled
+	}
+}
+
+// tokenize the texts as [<bos>, <text tokens>...], truncated to maxLength tokens, and padded to a common length.
+//
+// It returns the tokens and positions (-1 for padding), both shaped int32[len(texts), paddedLength], and the number
+// of tokens of each text, shaped int32[len(texts)].
+//
+// The padded length is the length of the longest text rounded up to a power of 2 (capped at maxLength), to limit the
+// number of different shapes the model is compiled for.
+func tokenize(vocab samplers.Vocabulary, texts []string, maxLength int) (tokens, positions, lengths *tensors.Tensor) {
+	sequences := make([][]int, len(texts))
+	longest := 0
+	for ii, text := range texts {
+		sequence := slices.Concat([]int{vocab.BeginningOfSentenceID()}, vocab.EncodeAsIDs(text))
+		if len(sequence) > maxLength {
+			sequence = sequence[:maxLength]
+		}
+		sequences[ii] = sequence
+		longest = max(longest, len(sequence))
+	}
+	paddedLength := 1
+	for paddedLength < longest {
+		paddedLength *= 2
+	}
+	paddedLength = min(paddedLength, maxLength)
+
+	tokens = tensors.FromShape(shapes.Make(dtypes.Int32, len(texts), paddedLength))
+	positions = tensors.FromShape(shapes.Make(dtypes.Int32, len(texts), paddedLength))
+	lengths = tensors.FromShape(shapes.Make(dtypes.Int32, len(texts)))
+	tensors.MutableFlatData(tokens, func(flatTokens []int32) {
+		tensors.MutableFlatData(positions, func(flatPositions []int32) {
+			tensors.MutableFlatData(lengths, func(flatLengths []int32) {
+				for ii, sequence := range sequences {
+					flatLengths[ii] = int32(len(sequence))
+					row := ii * paddedLength
+					for jj := range paddedLength {
+						if jj < len(sequence) {
+							flatTokens[row+jj] = int32(sequence[jj])
+							flatPositions[row+jj] = int32(jj)
+						} else {
+							flatTokens[row+jj] = int32(vocab.PadID())
+							flatPositions[row+jj] = -1
+						}
+					}
+				}
+			})
+		})
+	})
+	return
+}
@@ -0,0 +1,42 @@
+package embeddings
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// fakeVocab tokenizes by splitting the text in words, each word is converted to its length plus 10.
+type fakeVocab struct{}
+
+func (fakeVocab) EncodeAsIDs(text string) []int {
+	var ids []int
+	for _, word := range strings.Fields(text) {
+		ids = append(ids, len(word)+10)
+	}
+	return ids
+}
+
+func (fakeVocab) DecodeIDs([]int) string     { return "" }
+func (fakeVocab) BeginningOfSentenceID() int { return 2 }
+func (fakeVocab) EndOfSentenceID() int       { return 1 }
+func (fakeVocab) UnknownID() int             { return 3 }
+func (fakeVocab) PadID() int                 { return 0 }
+
+func TestTokenize(t *testing.T) {
+	tokens, positions, lengths := tokenize(fakeVocab{}, []string{"a bb ccc", "", "dddd"}, 16)
+	require.Equal(t, [][]int32{{2, 11, 12, 13}, {2, 0, 0, 0}, {2, 14, 0, 0}}, tokens.Value())
+	require.Equal(t, [][]int32{{0, 1, 2, 3}, {0, -1, -1, -1}, {0, 1, -1, -1}}, positions.Value())
+	require.Equal(t, []int32{4, 1, 2}, lengths.Value())
+
+	// Padded to a power of 2.
+	tokens, _, lengths = tokenize(fakeVocab{}, []string{"a bb ccc dddd"}, 16)
+	require.Equal(t, [][]int32{{2, 11, 12, 13, 14, 0, 0, 0}}, tokens.Value())
+	require.Equal(t, []int32{5}, lengths.Value())
+
+	// Truncated to maxLength.
+	tokens, positions, lengths = tokenize(fakeVocab{}, []string{"a bb ccc dddd"}, 3)
+	require.Equal(t, [][]int32{{2, 11, 12}}, tokens.Value())
+	require.Equal(t, [][]int32{{0, 1, 2}}, positions.Value())
+	require.Equal(t, []int32{3}, lengths.Value())
+}
@@ -0,0 +1,102 @@
+package finetune
+
+import (
+	"github.com/gomlx/exceptions"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/context/initializers"
+	"github.com/gomlx/gomlx/ml/train/optimizers"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gopjrt/dtypes"
+	"strings"
+)
+
+// GradientAccumulationScope is the scope where the accumulated gradients are stored.
+const GradientAccumulationScope = "gradient_accumulation"
+
+// gradientAccumulation wraps an optimizer, accumulating the gradients of numSteps training steps (micro-batches),
+// and only applying the mean of the accumulated gradients with the wrapped optimizer every numSteps.
+//
+// It allows training with larger effective batch sizes than what fits in memory.
+type gradientAccumulation struct {
+	optimizer optimizers.Interface
+	numSteps  int
+}
+
+// Compile-time check that gradientAccumulation implements optimizers.Interface.
+var _ optimizers.Interface = (*gradientAccumulation)(nil)
+
+// UpdateGraph implements optimizers.Interface.
+//
+// It accumulates the gradients of the loss (in float32), and calls the wrapped optimizer with a surrogate loss
+// whose gradients are the mean accumulated gradients. All updates done by the wrapped optimizer (including to its
+// own state) are only kept every numSteps steps.
+func (o *gradientAccumulation) UpdateGraph(ctx *context.Context, g *Graph, loss *Node) {
+	accumulationCtx := ctx.In(GradientAccumulationScope).Checked(false)
+	globalStepVar := optimizers.GetGlobalStepVar(ctx)
+
+	// Find the gradients, in the same order as the trainable variables enumerated.
+	grads := ctx.BuildTrainableVariablesGradientsGraph(loss)
+	var trainableVars []*context.Variable
+	ctx.EnumerateVariables(func(v *context.Variable) {
+		if v.Trainable && v.InUseByGraph(g) {
+			trainableVars = append(trainableVars, v)
+		}
+	})
+	if len(trainableVars) != len(grads) {
+		exceptions.Panicf("gradient accumulation got gradients for %d variables, but there are %d trainable variables "+
+			"-- were new variables created in between ?", len(grads), len(trainableVars))
+	}
+
+	// Count the micro-steps.
+	countVar := accumulationCtx.VariableWithValue("count", int32(0)).SetTrainable(false)
+	count := AddScalar(countVar.ValueGraph(g), 1)
+	isApplyStep := Equal(count, Scalar(g, dtypes.Int32, o.numSteps))
+	countVar.SetValueGraph(Where(isApplyStep, ZerosLike(count), count))
+
+	// Accumulate gradients, and build a surrogate loss whose gradients are the mean accumulated gradients.
+	surrogateLoss := ScalarZero(g, dtypes.Float32)
+	for ii, v := range trainableVars {
+		accumulatorCtx := ctx.InAbsPath(accumulationCtx.Scope() + v.Scope()).Checked(false)
+		accumulatorVar := accumulatorCtx.WithInitializer(initializers.Zero).
+			VariableWithShape(v.Name(), shapes.Make(dtypes.Float32, v.Shape().Dimensions...)).SetTrainable(false)
+		accumulated := Add(accumulatorVar.ValueGraph(g), ConvertDType(grads[ii], dtypes.Float32))
+		accumulatorVar.SetValueGraph(Where(isApplyStep, ZerosLike(accumulated), accumulated))
+		meanGrad := StopGradient(DivScalar(accumulated, float64(o.numSteps)))
+		surrogateLoss = Add(surrogateLoss, ReduceAllSum(Mul(meanGrad, ConvertDType(v.ValueGraph(g), dtypes.Float32))))
+	}
+
+	// Record the current value of the variables, so the updates of the wrapped optimizer can be reverted.
+	previousValues := make(map[*context.Variable]*Node)
+	ctx.EnumerateVariables(func(v *context.Variable) {
+		if v.InUseByGraph(g) {
+			previousValues[v] = v.ValueGraph(g)
+		}
+	})
+
+	o.optimizer.UpdateGraph(ctx, g, surrogateLoss)
+
+	// Only keep the updates of the optimizer on the apply steps. The global step is always kept, since it counts
+	// the micro-steps.
+	accumulationScopePrefix := accumulationCtx.Scope() + context.ScopeSeparator
+	ctx.EnumerateVariables(func(v *context.Variable) {
+		if !v.InUseByGraph(g) || v == globalStepVar || strings.HasPrefix(v.Scope(), accumulationScopePrefix) {
+			return
+		}
+		previous, found := previousValues[v]
+		if !found {
+			previous = v.ParamNode(g) // Variable first used by the optimizer.
+		}
+		updated := v.ValueGraph(g)
+		if updated == previous {
+			return
+		}
+		v.SetValueGraph(Where(isApplyStep, updated, previous))
+	})
+}
+
+// Clear implements optimizers.Interface.
+func (o *gradientAccumulation) Clear(ctx *context.Context) {
+	ctx.In(GradientAccumulationScope).DeleteVariablesInScope()
+	o.optimizer.Clear(ctx)
+}
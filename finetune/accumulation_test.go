@@ -0,0 +1,78 @@
+package finetune
+
+import (
+	"github.com/gomlx/gemma/internal/testutil"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/train/optimizers"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// linearRegressionStep returns a context with the weights of a linear regression (initialized to [1, -1]), and
+// the training step that updates them with the optimizer, given the inputs x shaped [batchSize, 2] and the
+// labels y shaped [batchSize]. It returns the mean squared error.
+func linearRegressionStep(backend backends.Backend, optimizer optimizers.Interface) (*context.Context, *context.Exec) {
+	ctx := context.New()
+	ctx.In(ModelScope).VariableWithValue("w", []float32{1, -1})
+	exec := context.NewExec(backend, ctx, func(ctx *context.Context, x, y *Node) *Node {
+		w := ctx.In(ModelScope).GetVariable("w").ValueGraph(x.Graph())
+		predictions := ReduceSum(Mul(x, ExpandAxes(w, 0)), -1)
+		loss := ReduceAllMean(Square(Sub(predictions, y)))
+		optimizer.UpdateGraph(ctx, x.Graph(), loss)
+		return loss
+	})
+	return ctx, exec
+}
+
+func TestGradientAccumulation(t *testing.T) {
+	backend := testutil.Backend(t)
+	x := [][]float32{{1, 2}, {3, -1}, {0, 1}, {2, 2}}
+	y := []float32{1, 0, 2, -1}
+	newAdam := func() optimizers.Interface { return optimizers.Adam().LearningRate(0.1).Done() }
+
+	// Reference: one step on the whole batch.
+	wantCtx, wantStep := linearRegressionStep(backend, newAdam())
+	wantStep.Call(x, y)
+
+	// Two accumulated micro-batches of 2 examples.
+	ctx, step := linearRegressionStep(backend, &gradientAccumulation{optimizer: newAdam(), numSteps: 2})
+	step.Call(x[:2], y[:2])
+
+	// Nothing changes until the gradients are applied, but the step counters.
+	require.Equal(t, []float32{1, -1}, ctx.In(ModelScope).GetVariable("w").Value().Value())
+	adamCtx := ctx.InAbsPath("/" + optimizers.AdamDefaultScope)
+	require.Equal(t, int64(0), adamCtx.GetVariable(optimizers.GlobalStepVariableName).Value().Value())
+	for _, name := range []string{"w_1st_moment", "w_2nd_moment"} {
+		require.Equal(t, []float32{0, 0}, adamCtx.In(ModelScope).GetVariable(name).Value().Value(), name)
+	}
+	require.Equal(t, int64(1), optimizers.GetGlobalStep(ctx))
+	require.Equal(t, int32(1), ctx.In(GradientAccumulationScope).GetVariable("count").Value().Value())
+
+	// The mean of the gradients of the micro-batches is the gradient of the whole batch: the weights and the
+	// optimizer state match the reference.
+	step.Call(x[2:], y[2:])
+	require.Equal(t, int64(2), optimizers.GetGlobalStep(ctx))
+	require.Equal(t, int32(0), ctx.In(GradientAccumulationScope).GetVariable("count").Value().Value())
+	require.Equal(t, []float32{0, 0},
+		ctx.InAbsPath("/"+GradientAccumulationScope+"/"+ModelScope).GetVariable("w").Value().Value())
+	var numCompared int
+	for want := range wantCtx.IterVariables() {
+		if want.Scope() == context.RootScope && want.Name() == optimizers.GlobalStepVariableName {
+			continue
+		}
+		got := ctx.InAbsPath(want.Scope()).GetVariable(want.Name())
+		require.NotNil(t, got, want.ScopeAndName())
+		if want.Value().DType() == dtypes.Float32 {
+			require.InDeltaSlice(t, tensors.CopyFlatData[float32](want.Value()), tensors.CopyFlatData[float32](got.Value()),
+				1e-5, want.ScopeAndName())
+		} else {
+			require.Equal(t, want.Value().Value(), got.Value().Value(), want.ScopeAndName())
+		}
+		numCompared++
+	}
+	require.Equal(t, 5, numCompared) // The weights, the 2 moments and the step of Adam, and the learning rate.
+}
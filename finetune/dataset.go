@@ -0,0 +1,175 @@
+package finetune
+
+import (
+	"github.com/gomlx/gemma/samplers"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"io"
+	"math/rand/v2"
+	"slices"
+)
+
+// Example for supervised fine-tuning: the model is trained to generate the Completion, given the Prompt.
+type Example struct {
+	Prompt, Completion string
+}
+
+// Dataset of Example objects, yielding batches of tokenized examples. It implements train.Dataset.
+//
+// Each example is tokenized as [<bos>, <prompt tokens>..., <completion tokens>..., <eos>], truncated to MaxLength+1
+// tokens, and padded with the <pad> token.
+//
+// It yields as inputs the tokens and their positions (-1 for padding, so they are never attended to), both shaped
+// int32[batchSize, maxLength], and as labels the next tokens (int32[batchSize, maxLength]) and a mask
+// (bool[batchSize, maxLength]) selecting the completion tokens, the only ones on which the loss is computed.
+//
+// The last batch is padded with empty examples (fully masked), so all batches have the same shape.
+type Dataset struct {
+	name                 string
+	vocab                samplers.Vocabulary
+	examples             []Example
+	batchSize, maxLength int
+	infinite             bool
+	rng                  *rand.Rand
+	order                []int
+	next                 int
+}
+
+// NewDataset creates a Dataset with the given examples, that yields batches of batchSize examples, each
+// with maxLength tokens. See Dataset for details.
+func NewDataset(name string, vocab samplers.Vocabulary, examples []Example, batchSize, maxLength int) *Dataset {
+	ds := &Dataset{
+		name:      name,
+		vocab:     vocab,
+		examples:  examples,
+		batchSize: batchSize,
+		maxLength: maxLength,
+		order:     make([]int, len(examples)),
+	}
+	ds.Reset()
+	return ds
+}
+
+// Infinite sets the dataset to loop over the examples indefinitely, instead of returning io.EOF after
+// the last batch. Typically used for training with train.Loop.RunSteps.
+func (ds *Dataset) Infinite(infinite bool) *Dataset {
+	ds.infinite = infinite
+	return ds
+}
+
+// Shuffle the examples at every epoch, using the given seed.
+func (ds *Dataset) Shuffle(seed uint64) *Dataset {
+	ds.rng = rand.New(rand.NewPCG(seed, seed))
+	ds.Reset()
+	return ds
+}
+
+// Name implements train.Dataset.
+func (ds *Dataset) Name() string {
+	return ds.name
+}
+
+// Reset implements train.Dataset, and restarts the dataset from the beginning (reshuffling it if Shuffle was set).
+func (ds *Dataset) Reset() {
+	for ii := range ds.order {
+		ds.order[ii] = ii
+	}
+	if ds.rng != nil {
+		ds.rng.Shuffle(len(ds.order), func(i, j int) { ds.order[i], ds.order[j] = ds.order[j], ds.order[i] })
+	}
+	ds.next = 0
+}
+
+// Yield implements train.Dataset.
+func (ds *Dataset) Yield() (spec any, inputs []*tensors.Tensor, labels []*tensors.Tensor, err error) {
+	batchIndices, err := ds.nextBatch()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	batch := make([]*Example, len(batchIndices))
+	for ii, exampleIdx := range batchIndices {
+		if exampleIdx >= 0 {
+			batch[ii] = &ds.examples[exampleIdx]
+		}
+	}
+	tokens, positions, targets, mask := tokenizeBatch(ds.vocab, batch, ds.maxLength)
+	return nil, []*tensors.Tensor{tokens, positions}, []*tensors.Tensor{targets, mask}, nil
+}
+
+// nextBatch returns the indices of the examples of the next batch, with -1 for the padding examples of the last
+// batch. It returns io.EOF at the end of the dataset, if it is not infinite.
+func (ds *Dataset) nextBatch() ([]int, error) {
+	if ds.next >= len(ds.order) {
+		if !ds.infinite || len(ds.order) == 0 {
+			return nil, io.EOF
+		}
+		ds.Reset()
+	}
+	batchIndices := make([]int, ds.batchSize)
+	for ii := range batchIndices {
+		batchIndices[ii] = -1
+		if ds.next < len(ds.order) {
+			batchIndices[ii] = ds.order[ds.next]
+			ds.next++
+		}
+	}
+	return batchIndices, nil
+}
+
+// tokenizeBatch tokenizes the examples (nil examples are padding) into the tokens, positions, targets and mask
+// tensors described in Dataset, each shaped [len(examples), maxLength].
+func tokenizeBatch(vocab samplers.Vocabulary, examples []*Example, maxLength int) (tokens, positions, targets, mask *tensors.Tensor) {
+	batchSize := len(examples)
+	tokens = tensors.FromShape(shapes.Make(dtypes.Int32, batchSize, maxLength))
+	positions = tensors.FromShape(shapes.Make(dtypes.Int32, batchSize, maxLength))
+	targets = tensors.FromShape(shapes.Make(dtypes.Int32, batchSize, maxLength))
+	mask = tensors.FromShape(shapes.Make(dtypes.Bool, batchSize, maxLength))
+	tensors.MutableFlatData(tokens, func(flatTokens []int32) {
+		tensors.MutableFlatData(positions, func(flatPositions []int32) {
+			tensors.MutableFlatData(targets, func(flatTargets []int32) {
+				tensors.MutableFlatData(mask, func(flatMask []bool) {
+					for exampleIdx, example := range examples {
+						var sequence []int
+						var isCompletion []bool
+						if example != nil {
+							sequence, isCompletion = tokenizeExample(vocab, *example, maxLength+1)
+						}
+						row := exampleIdx * maxLength
+						for ii := range maxLength {
+							if ii+1 < len(sequence) {
+								flatTokens[row+ii] = int32(sequence[ii])
+								flatPositions[row+ii] = int32(ii)
+								flatTargets[row+ii] = int32(sequence[ii+1])
+								flatMask[row+ii] = isCompletion[ii+1]
+							} else {
+								flatTokens[row+ii] = int32(vocab.PadID())
+								flatPositions[row+ii] = -1
+								flatTargets[row+ii] = int32(vocab.PadID())
+							}
+						}
+					}
+				})
+			})
+		})
+	})
+	return
+}
+
+// tokenizeExample returns the tokens of the example, truncated to maxTokens, and whether each token is part of
+// the completion (including the final <eos>).
+func tokenizeExample(vocab samplers.Vocabulary, example Example, maxTokens int) (tokens []int, isCompletion []bool) {
+	promptTokens := vocab.EncodeAsIDs(example.Prompt)
+	completionTokens := vocab.EncodeAsIDs(example.Completion)
+	tokens = slices.Concat([]int{vocab.BeginningOfSentenceID()}, promptTokens, completionTokens,
+		[]int{vocab.EndOfSentenceID()})
+	isCompletion = make([]bool, len(tokens))
+	for ii := 1 + len(promptTokens); ii < len(tokens); ii++ {
+		isCompletion[ii] = true
+	}
+	if len(tokens) > maxTokens {
+		tokens = tokens[:maxTokens]
+		isCompletion = isCompletion[:maxTokens]
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package finetune
+
+import (
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeVocab tokenizes by splitting the text in words, each word is converted to its length plus 10.
+type fakeVocab struct{}
+
+func (fakeVocab) EncodeAsIDs(text string) []int {
+	var ids []int
+	for _, word := range strings.Fields(text) {
+		ids = append(ids, len(word)+10)
+	}
+	return ids
+}
+
+func (fakeVocab) DecodeIDs([]int) string     { return "" }
+func (fakeVocab) BeginningOfSentenceID() int { return 2 }
+func (fakeVocab) EndOfSentenceID() int       { return 1 }
+func (fakeVocab) UnknownID() int             { return 3 }
+func (fakeVocab) PadID() int                 { return 0 }
+
+func TestTokenizeExample(t *testing.T) {
+	tokens, isCompletion := tokenizeExample(fakeVocab{}, Example{Prompt: "a bb", Completion: "ccc"}, 10)
+	require.Equal(t, []int{2, 11, 12, 13, 1}, tokens)
+	require.Equal(t, []bool{false, false, false, true, true}, isCompletion)
+
+	tokens, isCompletion = tokenizeExample(fakeVocab{}, Example{Prompt: "a bb", Completion: "ccc"}, 4)
+	require.Equal(t, []int{2, 11, 12, 13}, tokens)
+	require.Equal(t, []bool{false, false, false, true}, isCompletion)
+}
+
+func TestDataset(t *testing.T) {
+	examples := []Example{
+		{Prompt: "a", Completion: "bb"},
+		{Prompt: "a bb ccc", Completion: "dddd eeeee"},
+		{Prompt: "", Completion: "a"},
+	}
+	ds := NewDataset("test", fakeVocab{}, examples, 2, 4)
+
+	_, inputs, labels, err := ds.Yield()
+	require.NoError(t, err)
+	require.Equal(t, [][]int32{{2, 11, 12, 0}, {2, 11, 12, 13}}, inputs[0].Value())
+	require.Equal(t, [][]int32{{0, 1, 2, -1}, {0, 1, 2, 3}}, inputs[1].Value())
+	require.Equal(t, [][]int32{{11, 12, 1, 0}, {11, 12, 13, 14}}, labels[0].Value())
+	require.Equal(t, [][]bool{{false, true, true, false}, {false, false, false, true}}, labels[1].Value())
+
+	// Last batch is padded with an empty example.
+	_, inputs, labels, err = ds.Yield()
+	require.NoError(t, err)
+	require.Equal(t, [][]int32{{2, 11, 0, 0}, {0, 0, 0, 0}}, inputs[0].Value())
+	require.Equal(t, [][]int32{{0, 1, -1, -1}, {-1, -1, -1, -1}}, inputs[1].Value())
+	require.Equal(t, [][]bool{{true, true, false, false}, {false, false, false, false}}, labels[1].Value())
+
+	_, _, _, err = ds.Yield()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Infinite and shuffled: it loops over the examples.
+	ds.Infinite(true).Shuffle(42)
+	seen := make(map[int32]bool)
+	for range 4 {
+		_, inputs, _, err = ds.Yield()
+		require.NoError(t, err)
+		for _, token := range tensors.CopyFlatData[int32](inputs[0]) {
+			seen[token] = true
+		}
+	}
+	require.True(t, seen[13], "the longest example should have been yielded")
+}
@@ -0,0 +1,99 @@
+package finetune
+
+import (
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/train"
+	"github.com/gomlx/gomlx/ml/train/optimizers"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+)
+
+// TeacherScope is the scope of the teacher model weights in the context, used for knowledge distillation
+// (see NewDistillation).
+const TeacherScope = "teacher"
+
+// NewDistillation creates a Trainer for knowledge distillation: the Gemma model with the weights in ctx under
+// ModelScope (the student) is trained to match the output distribution of the larger Gemma model with the weights
+// under TeacherScope (the teacher), on the same batches of a Dataset. The teacher weights are frozen, and they are
+// not saved in the checkpoints.
+//
+// The teacher weights can be loaded with, for instance:
+//
+//	weights, err := kaggle.ReadConvertedWeightsToTree(teacherDir)
+//	if err != nil { ... }
+//	kaggle.UploadWeightsToContext(ctx.In(finetune.TeacherScope), weights)
+//
+// Both models must share the same tokenizer. See DistillationLoss for the temperature and alpha arguments, and New
+// for the other arguments.
+func NewDistillation(backend backends.Backend, ctx *context.Context, temperature, alpha float64,
+	optimizer optimizers.Interface, gradientAccumulationSteps int) (*Trainer, error) {
+	if temperature <= 0 {
+		return nil, errors.Errorf("NewDistillation() requires temperature > 0, got %g", temperature)
+	}
+	if alpha < 0 || alpha > 1 {
+		return nil, errors.Errorf("NewDistillation() requires alpha in [0, 1], got %g", alpha)
+	}
+	config, err := transformers.NewConfigFromContext(ctx.In(ModelScope))
+	if err != nil {
+		return nil, err
+	}
+	teacherConfig, err := transformers.NewConfigFromContext(ctx.In(TeacherScope))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "NewDistillation() failed to read the teacher model under scope %q", TeacherScope)
+	}
+	// The teacher weights are frozen, and so not saved in the checkpoints, see Trainer.WithCheckpoints.
+	for v := range ctx.In(TeacherScope).IterVariablesInScope() {
+		v.SetTrainable(false)
+	}
+	return newTrainer(backend, ctx, config, DistillationModelFn(config, teacherConfig),
+		DistillationLoss(temperature, alpha), optimizer, gradientAccumulationSteps)
+}
+
+// DistillationModelFn returns the train.ModelFn for knowledge distillation: it takes as inputs the tokens and their
+// positions (as yielded by Dataset), and returns the logits of the student model (under ModelScope) and of the
+// teacher model (under TeacherScope), both shaped [batchSize, sequenceLength, vocabularySize].
+//
+// No gradients flow through the teacher model.
+func DistillationModelFn(config, teacherConfig *transformers.Config) train.ModelFn {
+	return func(ctx *context.Context, _ any, inputs []*Node) []*Node {
+		tokens, positions := inputs[0], inputs[1]
+		logits := transformers.Gemma(ctx.In(ModelScope).Reuse(), config, tokens, positions, nil)
+		teacherLogits := transformers.Gemma(ctx.In(TeacherScope).Reuse(), teacherConfig, tokens, positions, nil)
+		return []*Node{logits, StopGradient(teacherLogits)}
+	}
+}
+
+// DistillationLoss returns the knowledge distillation loss function:
+//
+//	alpha * temperature^2 * KL(teacher || student) + (1 - alpha) * CausalLMLoss
+//
+// Where the KL divergence is computed between the teacher and student distributions softened by the temperature
+// (higher values expose more of the teacher's "dark knowledge" about the unlikely tokens), and it is scaled by
+// temperature^2 to keep its gradients' magnitude independent of the temperature. Both terms are averaged over the
+// targets selected by the mask.
+//
+// The labels are the same as CausalLMLoss, and the predictions are the student and teacher logits returned by
+// DistillationModelFn. If the models have vocabularies of different sizes (e.g.: the Kaggle and HuggingFace
+// versions differ only by unused padding tokens), the KL divergence is computed on the common tokens.
+func DistillationLoss(temperature, alpha float64) train.LossFn {
+	return func(labels, predictions []*Node) *Node {
+		mask := labels[1]
+		logits, teacherLogits := predictions[0], predictions[1]
+		loss := MulScalar(CausalLMLoss(labels, predictions[:1]), 1-alpha)
+		if alpha == 0 {
+			return loss
+		}
+
+		vocabSize := min(logits.Shape().Dim(-1), teacherLogits.Shape().Dim(-1))
+		logits = Slice(ConvertDType(logits, dtypes.Float32), AxisRange(), AxisRange(), AxisRange(0, vocabSize))
+		teacherLogits = Slice(ConvertDType(teacherLogits, dtypes.Float32), AxisRange(), AxisRange(), AxisRange(0, vocabSize))
+		logProbs := LogSoftmax(DivScalar(logits, temperature), -1)
+		teacherLogProbs := LogSoftmax(DivScalar(teacherLogits, temperature), -1)
+		kl := ReduceSum(Mul(Exp(teacherLogProbs), Sub(teacherLogProbs, logProbs)), -1)
+		kl = MaskedReduceMean(kl, mask)
+		return Add(loss, MulScalar(kl, alpha*temperature*temperature))
+	}
+}
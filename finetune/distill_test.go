@@ -0,0 +1,84 @@
+package finetune
+
+import (
+	"github.com/gomlx/gemma/internal/testutil"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNewDistillationArguments(t *testing.T) {
+	for _, tc := range []struct {
+		temperature, alpha float64
+		wantErr            string
+	}{
+		{0, 0.5, "temperature > 0"},
+		{-1, 0.5, "temperature > 0"},
+		{1, -0.1, "alpha in [0, 1]"},
+		{1, 1.1, "alpha in [0, 1]"},
+		{1, 0.5, "embedding table"}, // Valid arguments, but there are no models in the context.
+	} {
+		_, err := NewDistillation(nil, context.New(), tc.temperature, tc.alpha, nil, 1)
+		require.ErrorContainsf(t, err, tc.wantErr, "temperature=%g, alpha=%g", tc.temperature, tc.alpha)
+	}
+}
+
+func TestDistillationLoss(t *testing.T) {
+	backend := testutil.Backend(t)
+	distillationLoss := func(temperature, alpha float64, logits, teacherLogits [][][]float32) float64 {
+		loss := ExecOnce(backend, func(logits, teacherLogits, targets, mask *Node) *Node {
+			return DistillationLoss(temperature, alpha)([]*Node{targets, mask}, []*Node{logits, teacherLogits})
+		}, logits, teacherLogits, [][]int32{{1}}, [][]bool{{true}})
+		return float64(loss.Value().(float32))
+	}
+
+	// The student vocabulary is padded with one more token: the KL divergence is computed only on the common
+	// tokens, so the distributions match whatever the logit of the padding token.
+	require.InDelta(t, 0.0, distillationLoss(1, 1, [][][]float32{{{0, 1, 5}}}, [][][]float32{{{0, 1}}}), 1e-6)
+
+	// KL(teacher || student) between softmax(0.5, 0) and softmax(0, 0.5), scaled by temperature^2.
+	const temperature = 2.0
+	p := 1 / (1 + math.Exp(-0.5))
+	kl := (2*p - 1) * 0.5
+	require.InDelta(t, temperature*temperature*kl,
+		distillationLoss(temperature, 1, [][][]float32{{{0, 1, -3}}}, [][][]float32{{{1, 0}}}), 1e-5)
+
+	// With alpha=0, it is the causal language model loss over the whole student vocabulary.
+	logSumExp := math.Log(1 + math.E + math.Exp(-3))
+	require.InDelta(t, logSumExp-1,
+		distillationLoss(temperature, 0, [][][]float32{{{0, 1, -3}}}, [][][]float32{{{1, 0}}}), 1e-5)
+}
+
+func TestCheckpointsExcludeFrozenWeights(t *testing.T) {
+	ctx := context.New()
+	ctx.In(ModelScope).VariableWithValue("trained", []float32{1, 2})
+	ctx.In(ModelScope).VariableWithValue("frozen", []float32{3}).SetTrainable(false)
+	ctx.In(TeacherScope).VariableWithValue("w", []float32{4}).SetTrainable(false)
+	copyReferenceWeights(ctx)
+	trainer := &Trainer{Context: ctx, frozenVars: frozenVariables(ctx, ModelScope, TeacherScope, ReferenceScope)}
+	require.Len(t, trainer.frozenVars, 4)
+
+	dir := t.TempDir()
+	handler, err := trainer.newCheckpointHandler(dir, 1)
+	require.NoError(t, err)
+	require.NoError(t, handler.Save())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var metadata string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			contents, err := os.ReadFile(path.Join(dir, entry.Name()))
+			require.NoError(t, err)
+			metadata = string(contents)
+		}
+	}
+	require.Contains(t, metadata, "/model/trained")
+	require.NotContains(t, metadata, "/model/frozen")
+	require.NotContains(t, metadata, "/teacher/")
+	require.NotContains(t, metadata, "/reference/")
+}
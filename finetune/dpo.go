@@ -0,0 +1,191 @@
+package finetune
+
+import (
+	"github.com/gomlx/gemma/samplers"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/train"
+	"github.com/gomlx/gomlx/ml/train/optimizers"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/pkg/errors"
+)
+
+// ReferenceScope is the scope of the frozen copy of the model weights used as the reference model by
+// Direct Preference Optimization, when not using LoRA (see NewDPO).
+const ReferenceScope = "reference"
+
+// PreferenceExample for Direct Preference Optimization: given the Prompt, the Chosen completion is preferred over
+// the Rejected one.
+type PreferenceExample struct {
+	Prompt, Chosen, Rejected string
+}
+
+// PreferenceDataset of PreferenceExample objects, yielding batches of tokenized examples. It implements train.Dataset.
+//
+// Each batch of batchSize preference examples holds 2*batchSize sequences, tokenized as in Dataset: first the
+// prompts with the chosen completions, and then the prompts with the rejected completions, in the same order.
+//
+// It yields as inputs the tokens, positions, targets and mask (see Dataset), all shaped [2*batchSize, maxLength],
+// and as labels the targets and mask again.
+type PreferenceDataset struct {
+	*Dataset
+	rejected []Example
+}
+
+// NewPreferenceDataset creates a PreferenceDataset with the given examples, that yields batches of batchSize
+// preference examples (so 2*batchSize sequences), each sequence with maxLength tokens.
+func NewPreferenceDataset(name string, vocab samplers.Vocabulary, examples []PreferenceExample, batchSize, maxLength int) *PreferenceDataset {
+	chosen := make([]Example, len(examples))
+	rejected := make([]Example, len(examples))
+	for ii, example := range examples {
+		chosen[ii] = Example{Prompt: example.Prompt, Completion: example.Chosen}
+		rejected[ii] = Example{Prompt: example.Prompt, Completion: example.Rejected}
+	}
+	return &PreferenceDataset{
+		Dataset:  NewDataset(name, vocab, chosen, batchSize, maxLength),
+		rejected: rejected,
+	}
+}
+
+// Infinite sets the dataset to loop over the examples indefinitely. See Dataset.Infinite.
+func (ds *PreferenceDataset) Infinite(infinite bool) *PreferenceDataset {
+	ds.Dataset.Infinite(infinite)
+	return ds
+}
+
+// Shuffle the examples at every epoch, using the given seed.
+func (ds *PreferenceDataset) Shuffle(seed uint64) *PreferenceDataset {
+	ds.Dataset.Shuffle(seed)
+	return ds
+}
+
+// Yield implements train.Dataset.
+func (ds *PreferenceDataset) Yield() (spec any, inputs []*tensors.Tensor, labels []*tensors.Tensor, err error) {
+	batchIndices, err := ds.nextBatch()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	batchSize := len(batchIndices)
+	batch := make([]*Example, 2*batchSize)
+	for ii, exampleIdx := range batchIndices {
+		if exampleIdx >= 0 {
+			batch[ii] = &ds.examples[exampleIdx]
+			batch[batchSize+ii] = &ds.rejected[exampleIdx]
+		}
+	}
+	tokens, positions, targets, mask := tokenizeBatch(ds.vocab, batch, ds.maxLength)
+	return nil, []*tensors.Tensor{tokens, positions, targets, mask}, []*tensors.Tensor{targets, mask}, nil
+}
+
+// NewDPO creates a Trainer for Direct Preference Optimization (DPO, https://arxiv.org/abs/2305.18290) of the
+// Gemma model with the weights in ctx (under ModelScope), trained with a PreferenceDataset.
+//
+// DPO requires a frozen reference model, usually the model before training:
+//
+//   - If lora is nil, all the weights are trained, and a frozen copy of them is created under ReferenceScope to
+//     serve as the reference model. This doubles the memory used by the weights. The copy is not saved in the
+//     checkpoints (see Trainer.WithCheckpoints): when resuming, it is rebuilt from the model weights loaded from
+//     their original files, before the checkpoint is restored.
+//   - If lora is given, only the LoRA adapters are trained (see NewLoRA), and the reference model is the base model
+//     without the adapters, so no copy is needed.
+//
+// The beta parameter controls how far the trained model can deviate from the reference model: typical values are
+// 0.1 to 0.5. See New for the other arguments.
+func NewDPO(backend backends.Backend, ctx *context.Context, lora *transformers.LoRAConfig, beta float64,
+	optimizer optimizers.Interface, gradientAccumulationSteps int) (*Trainer, error) {
+	config, err := transformers.NewConfigFromContext(ctx.In(ModelScope))
+	if err != nil {
+		return nil, err
+	}
+	if beta <= 0 {
+		return nil, errors.Errorf("NewDPO() requires beta > 0, got %g", beta)
+	}
+	referenceScope := ModelScope
+	if lora != nil {
+		if lora.Rank <= 0 || len(lora.Targets) == 0 {
+			return nil, errors.New("NewDPO() requires a LoRA configuration with Rank > 0 and at least one target")
+		}
+		config.LoRA = lora
+		transformers.FreezeBaseWeights(ctx.In(ModelScope))
+	} else {
+		referenceScope = ReferenceScope
+		copyReferenceWeights(ctx)
+	}
+	return newTrainer(backend, ctx, config, DPOModelFn(config, referenceScope), DPOLoss(beta),
+		optimizer, gradientAccumulationSteps)
+}
+
+// copyReferenceWeights copies the model weights (under ModelScope) to ReferenceScope, as non-trainable variables.
+// Weights already under ReferenceScope (e.g.: loaded by the caller) are kept.
+func copyReferenceWeights(ctx *context.Context) {
+	modelScope := ctx.In(ModelScope).Scope()
+	referenceCtx := ctx.In(ReferenceScope).Checked(false)
+	var variables []*context.Variable
+	for v := range ctx.In(ModelScope).IterVariablesInScope() {
+		variables = append(variables, v)
+	}
+	for _, v := range variables {
+		scopedCtx := referenceCtx.InAbsPath(referenceCtx.Scope() + v.Scope()[len(modelScope):])
+		if scopedCtx.GetVariable(v.Name()) != nil {
+			continue
+		}
+		scopedCtx.VariableWithValue(v.Name(), v.Value().LocalClone()).SetTrainable(false)
+	}
+}
+
+// DPOModelFn returns the train.ModelFn for Direct Preference Optimization: it takes as inputs the tokens,
+// positions, targets and mask (as yielded by PreferenceDataset), and returns the sequence log-probabilities
+// (see SequenceLogProbs) of the completions under the trained model and under the reference model, both
+// shaped [2*batchSize].
+//
+// The reference model uses the weights under referenceScope, without LoRA adapters, and no gradients flow
+// through it. If referenceScope is ModelScope, the reference model is the base model of the LoRA adapters.
+func DPOModelFn(config *transformers.Config, referenceScope string) train.ModelFn {
+	referenceConfig := *config
+	referenceConfig.LoRA = nil
+	return func(ctx *context.Context, _ any, inputs []*Node) []*Node {
+		tokens, positions, targets, mask := inputs[0], inputs[1], inputs[2], inputs[3]
+		logits := transformers.Gemma(ctx.In(ModelScope).Reuse(), config, tokens, positions, nil)
+		policy := SequenceLogProbs(logits, targets, mask)
+		referenceLogits := transformers.Gemma(ctx.In(referenceScope).Reuse(), &referenceConfig, tokens, positions, nil)
+		reference := StopGradient(SequenceLogProbs(referenceLogits, targets, mask))
+		return []*Node{policy, reference}
+	}
+}
+
+// SequenceLogProbs returns the log-probability (in float32) of each sequence: the sum of the log-probabilities of
+// its targets tokens selected by the mask (see TokenLogProbs).
+//
+// The targets and the mask are shaped [batchSize, sequenceLength], and it returns a value per sequence,
+// shaped [batchSize].
+func SequenceLogProbs(logits, targets, mask *Node) *Node {
+	logProbs := TokenLogProbs(logits, targets)
+	return ReduceSum(Where(mask, logProbs, ZerosLike(logProbs)), -1)
+}
+
+// DPOLoss returns the Direct Preference Optimization loss function with the given beta:
+//
+//	-log(sigmoid(beta * ((policyChosen - referenceChosen) - (policyRejected - referenceRejected))))
+//
+// averaged over the preference examples, where each term is a sequence log-probability returned by DPOModelFn.
+// The labels are the targets and mask yielded by PreferenceDataset, used to ignore the padding examples.
+func DPOLoss(beta float64) train.LossFn {
+	return func(labels, predictions []*Node) *Node {
+		mask := labels[1]
+		policy, reference := predictions[0], predictions[1]
+		batchSize := policy.Shape().Dim(0) / 2
+		chosen, rejected := AxisRange(0, batchSize), AxisRange(batchSize, 2*batchSize)
+		logRatios := Sub(policy, reference)
+		logits := MulScalar(Sub(Slice(logRatios, chosen), Slice(logRatios, rejected)), beta)
+		losses := Neg(logSigmoid(logits))
+		isValid := LogicalAny(Slice(mask, chosen), -1)
+		return MaskedReduceMean(losses, isValid)
+	}
+}
+
+// logSigmoid returns log(sigmoid(x)) in a numerically stable way.
+func logSigmoid(x *Node) *Node {
+	return Sub(Min(x, ZerosLike(x)), Log1p(Exp(Neg(Abs(x)))))
+}
@@ -0,0 +1,69 @@
+package finetune
+
+import (
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestPreferenceDataset(t *testing.T) {
+	examples := []PreferenceExample{
+		{Prompt: "a", Chosen: "bb", Rejected: "ccc"},
+		{Prompt: "a bb", Chosen: "dddd", Rejected: "eeeee"},
+		{Prompt: "a", Chosen: "bb ccc", Rejected: "ccc"},
+	}
+	ds := NewPreferenceDataset("test", fakeVocab{}, examples, 2, 4)
+
+	_, inputs, labels, err := ds.Yield()
+	require.NoError(t, err)
+	require.Len(t, inputs, 4)
+	require.Equal(t, [][]int32{{2, 11, 12, 0}, {2, 11, 12, 14}, {2, 11, 13, 0}, {2, 11, 12, 15}}, inputs[0].Value())
+	require.Equal(t, [][]int32{{0, 1, 2, -1}, {0, 1, 2, 3}, {0, 1, 2, -1}, {0, 1, 2, 3}}, inputs[1].Value())
+	require.Equal(t, [][]int32{{11, 12, 1, 0}, {11, 12, 14, 1}, {11, 13, 1, 0}, {11, 12, 15, 1}}, inputs[2].Value())
+	require.Equal(t, inputs[2], labels[0])
+	require.Equal(t, inputs[3], labels[1])
+
+	// Last batch is padded with empty examples, for both chosen and rejected.
+	_, inputs, _, err = ds.Yield()
+	require.NoError(t, err)
+	require.Equal(t, [][]int32{{2, 11, 12, 13}, {0, 0, 0, 0}, {2, 11, 13, 0}, {0, 0, 0, 0}}, inputs[0].Value())
+	require.Equal(t, [][]bool{{false, true, true, true}, {false, false, false, false},
+		{false, true, true, false}, {false, false, false, false}}, inputs[3].Value())
+
+	_, _, _, err = ds.Yield()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Shuffled: chosen and rejected completions are kept paired.
+	ds.Infinite(true).Shuffle(7)
+	for range 4 {
+		_, inputs, _, err = ds.Yield()
+		require.NoError(t, err)
+		tokens := inputs[0].Value().([][]int32)
+		for ii := range 2 {
+			require.Equal(t, tokens[ii][1], tokens[2+ii][1])
+		}
+	}
+}
+
+func TestCopyReferenceWeights(t *testing.T) {
+	ctx := context.New()
+	ctx.In(ModelScope).In("layer_0").In("attn").VariableWithValue("w", []float32{1, 2})
+	ctx.In(ModelScope).VariableWithValue("embedding", []float32{3})
+	copyReferenceWeights(ctx)
+
+	v := ctx.InAbsPath("/reference/layer_0/attn").GetVariable("w")
+	require.NotNil(t, v)
+	require.False(t, v.Trainable)
+	require.Equal(t, []float32{1, 2}, tensors.CopyFlatData[float32](v.Value()))
+	v = ctx.In(ReferenceScope).GetVariable("embedding")
+	require.NotNil(t, v)
+	require.Equal(t, []float32{3}, tensors.CopyFlatData[float32](v.Value()))
+
+	// Changing the model weights doesn't change the reference, and copying again keeps the existing reference.
+	ctx.In(ModelScope).In("layer_0").In("attn").GetVariable("w").SetValue(tensors.FromValue([]float32{5, 6}))
+	copyReferenceWeights(ctx)
+	v = ctx.InAbsPath("/reference/layer_0/attn").GetVariable("w")
+	require.Equal(t, []float32{1, 2}, tensors.CopyFlatData[float32](v.Value()))
+}
@@ -0,0 +1,195 @@
+// Package finetune implements supervised fine-tuning, preference optimization (DPO) and knowledge distillation of
+// Gemma models, using GoMLX training loop and optimizers.
+//
+// The model weights are expected to be loaded in the context under the "model" scope, as done by the
+// download packages (e.g.: kaggle.ReadConvertedWeights), and after training they can be saved back with
+// kaggle.WriteConvertedWeights (see Trainer.SaveWeights).
+package finetune
+
+import (
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gemma/download/kaggle"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/context/checkpoints"
+	"github.com/gomlx/gomlx/ml/train"
+	"github.com/gomlx/gomlx/ml/train/optimizers"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+)
+
+// ModelScope is the scope of the model weights in the context.
+const ModelScope = "model"
+
+// Trainer fine-tunes a Gemma model.
+type Trainer struct {
+	Backend backends.Backend
+
+	// Context with the model weights (under ModelScope), the optimizer state and the training hyperparameters.
+	Context *context.Context
+
+	// Config of the Gemma model, created from the weights.
+	Config *transformers.Config
+
+	// Trainer and Loop used for training: they can be used to further configure the training, for instance to
+	// attach progress bars or plots to the loop.
+	Trainer *train.Trainer
+	Loop    *train.Loop
+
+	// Checkpoint handler, if configured with Trainer.WithCheckpoints.
+	Checkpoint *checkpoints.Handler
+
+	// frozenVars are the non-trainable weights (e.g.: the base weights of LoRA, or the teacher model), which are
+	// not saved in the checkpoints.
+	frozenVars []*context.Variable
+}
+
+// New creates a Trainer for supervised fine-tuning (see Dataset) of the Gemma model with the weights in ctx
+// (under ModelScope). The loss is the causal language model loss (see CausalLMLoss).
+//
+//   - optimizer: for instance optimizers.Adam().LearningRate(1e-5).Done().
+//   - gradientAccumulationSteps: if > 1, the gradients of that many training steps (micro-batches) are accumulated
+//     before being applied by the optimizer, for an effective batch size of gradientAccumulationSteps times
+//     the batch size of the dataset.
+func New(backend backends.Backend, ctx *context.Context, optimizer optimizers.Interface, gradientAccumulationSteps int) (*Trainer, error) {
+	config, err := transformers.NewConfigFromContext(ctx.In(ModelScope))
+	if err != nil {
+		return nil, err
+	}
+	return newTrainer(backend, ctx, config, ModelFn(config), CausalLMLoss, optimizer, gradientAccumulationSteps)
+}
+
+// newTrainer creates a Trainer with the given model and loss functions.
+func newTrainer(backend backends.Backend, ctx *context.Context, config *transformers.Config,
+	modelFn train.ModelFn, lossFn train.LossFn,
+	optimizer optimizers.Interface, gradientAccumulationSteps int) (*Trainer, error) {
+	if gradientAccumulationSteps < 1 {
+		return nil, errors.Errorf("gradientAccumulationSteps must be >= 1, got %d", gradientAccumulationSteps)
+	}
+	if gradientAccumulationSteps > 1 {
+		optimizer = &gradientAccumulation{optimizer: optimizer, numSteps: gradientAccumulationSteps}
+	}
+	t := &Trainer{
+		Backend:    backend,
+		Context:    ctx,
+		Config:     config,
+		frozenVars: frozenVariables(ctx, ModelScope, TeacherScope, ReferenceScope),
+	}
+	t.Trainer = train.NewTrainer(backend, ctx, modelFn, lossFn, optimizer, nil, nil)
+	t.Loop = train.NewLoop(t.Trainer)
+	return t, nil
+}
+
+// WithCheckpoints configures the Trainer to save checkpoints of the training (the model weights and the
+// optimizer state) to dir, every everyNSteps training steps and at the end of the training, keeping only
+// the last keep checkpoints.
+//
+// If dir already has checkpoints, the training state is restored from the latest one, so the training resumes
+// where it stopped.
+//
+// The frozen weights (the base weights of NewLoRA, the teacher model of NewDistillation, or the reference model of
+// NewDPO) are not saved, since they don't change: they must be loaded from their original files before resuming the
+// training.
+func (t *Trainer) WithCheckpoints(dir string, keep, everyNSteps int) error {
+	var err error
+	t.Checkpoint, err = t.newCheckpointHandler(dir, keep)
+	if err != nil {
+		return err
+	}
+	if everyNSteps > 0 {
+		train.EveryNSteps(t.Loop, everyNSteps, "checkpointing", 100, t.Checkpoint.OnStepFn)
+	}
+	t.Loop.OnEnd("checkpointing", 100, func(_ *train.Loop, _ []*tensors.Tensor) error {
+		return t.Checkpoint.Save()
+	})
+	return nil
+}
+
+// newCheckpointHandler creates the checkpoint handler for WithCheckpoints, excluding the frozen weights.
+func (t *Trainer) newCheckpointHandler(dir string, keep int) (*checkpoints.Handler, error) {
+	handler, err := checkpoints.Build(t.Context).Dir(dir).Keep(keep).ExcludeVars(t.frozenVars...).Done()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to configure checkpoints in %q", dir)
+	}
+	return handler, nil
+}
+
+// frozenVariables returns the non-trainable variables under the given scopes of ctx.
+func frozenVariables(ctx *context.Context, scopes ...string) []*context.Variable {
+	var variables []*context.Variable
+	for _, scope := range scopes {
+		for v := range ctx.In(scope).IterVariablesInScope() {
+			if !v.Trainable {
+				variables = append(variables, v)
+			}
+		}
+	}
+	return variables
+}
+
+// Train runs numSteps training steps, reading batches from the dataset ds -- it should be infinite, or have enough
+// batches for the steps (see Dataset.Infinite).
+//
+// It can be called multiple times, and it continues the training from where it stopped.
+func (t *Trainer) Train(ds train.Dataset, numSteps int) error {
+	_, err := t.Loop.RunSteps(ds, numSteps)
+	return err
+}
+
+// Evaluate returns the mean loss of the model over the (finite) dataset ds.
+func (t *Trainer) Evaluate(ds train.Dataset) (loss float64, err error) {
+	err = exceptions.TryCatch[error](func() {
+		metrics := t.Trainer.Eval(ds)
+		loss = shapes.ConvertTo[float64](metrics[0].Value())
+	})
+	return
+}
+
+// SaveWeights writes the model weights to checkpointDir, in the format read by kaggle.ReadConvertedWeights.
+func (t *Trainer) SaveWeights(checkpointDir string) error {
+	return kaggle.WriteConvertedWeights(t.Context, checkpointDir)
+}
+
+// ModelFn returns the train.ModelFn for causal language modeling: it takes as inputs the tokens and their
+// positions (as yielded by Dataset), and returns the logits of the next token at every position, shaped
+// [batchSize, sequenceLength, vocabularySize].
+//
+// The model weights are expected to be already loaded in the context, under ModelScope.
+func ModelFn(config *transformers.Config) train.ModelFn {
+	return func(ctx *context.Context, _ any, inputs []*Node) []*Node {
+		tokens, positions := inputs[0], inputs[1]
+		logits := transformers.Gemma(ctx.In(ModelScope).Reuse(), config, tokens, positions, nil)
+		return []*Node{logits}
+	}
+}
+
+// CausalLMLoss is the causal language model loss: the mean negative log-likelihood of the target (next)
+// tokens, over the targets selected by the mask.
+//
+// The labels are the target tokens (int32[batchSize, sequenceLength]) and the mask (bool[batchSize, sequenceLength]),
+// and the predictions are the logits shaped [batchSize, sequenceLength, vocabularySize], as returned by ModelFn.
+func CausalLMLoss(labels, predictions []*Node) *Node {
+	targets, mask := labels[0], labels[1]
+	logits := predictions[0]
+	return Neg(MaskedReduceMean(TokenLogProbs(logits, targets), mask))
+}
+
+// TokenLogProbs returns the log-probabilities (in float32) of the targets tokens (int[batchSize, sequenceLength]),
+// given the logits shaped [batchSize, sequenceLength, vocabularySize].
+//
+// It returns the log-probabilities shaped [batchSize, sequenceLength].
+func TokenLogProbs(logits, targets *Node) *Node {
+	g := logits.Graph()
+	logProbs := LogSoftmax(ConvertDType(logits, dtypes.Float32), -1)
+	indicesShape := shapes.Make(dtypes.Int32, targets.Shape().Dimensions...)
+	indices := Concatenate([]*Node{
+		ExpandAxes(Iota(g, indicesShape, 0), -1),
+		ExpandAxes(Iota(g, indicesShape, 1), -1),
+		ExpandAxes(ConvertDType(targets, dtypes.Int32), -1),
+	}, -1)
+	return Gather(logProbs, indices)
+}
@@ -0,0 +1,138 @@
+package finetune
+
+import (
+	"encoding/json"
+	"github.com/gomlx/gemma/download/kaggle"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/backends"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/train/optimizers"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"slices"
+)
+
+// NewLoRA creates a Trainer for parameter-efficient supervised fine-tuning of the Gemma model with the weights in
+// ctx (under ModelScope), using LoRA adapters configured by lora (see transformers.LoRAConfig).
+//
+// The base weights of the model are frozen (see transformers.FreezeBaseWeights), and only the adapters are trained:
+// so the base weights are not saved in the checkpoints (see Trainer.WithCheckpoints).
+// The base weights may be quantized (see transformers.QuantizeWeightsInt8 and transformers.QuantizeWeightsQ4), to
+// further cut the memory used.
+//
+// See New for the other arguments. After training, the adapters can be saved with SaveLoRA, or merged into the
+// base weights with transformers.MergeLoRA.
+func NewLoRA(backend backends.Backend, ctx *context.Context, lora *transformers.LoRAConfig,
+	optimizer optimizers.Interface, gradientAccumulationSteps int) (*Trainer, error) {
+	config, err := transformers.NewConfigFromContext(ctx.In(ModelScope))
+	if err != nil {
+		return nil, err
+	}
+	if lora == nil || lora.Rank <= 0 || len(lora.Targets) == 0 {
+		return nil, errors.New("NewLoRA() requires a LoRA configuration with Rank > 0 and at least one target")
+	}
+	config.LoRA = lora
+	transformers.FreezeBaseWeights(ctx.In(ModelScope))
+	return newTrainer(backend, ctx, config, ModelFn(config), CausalLMLoss, optimizer, gradientAccumulationSteps)
+}
+
+// LoRAConfigFileName is the name of the file with the LoRA configuration written by SaveLoRA, next to the
+// adapters weights.
+const LoRAConfigFileName = "lora_config.json"
+
+// loraConfigFile is the LoRA configuration, as stored in LoRAConfigFileName.
+type loraConfigFile struct {
+	Rank        int                       `json:"rank"`
+	Alpha       float64                   `json:"alpha"`
+	Dropout     float64                   `json:"dropout"`
+	Targets     []transformers.LoRATarget `json:"targets"`
+	NumAdapters int                       `json:"num_adapters,omitempty"`
+}
+
+// SaveLoRA writes only the LoRA adapters weights of the model in ctx (under ModelScope) to checkpointDir, in the
+// same format as kaggle.WriteConvertedWeights, along with their configuration lora in LoRAConfigFileName. They can
+// be loaded back with LoadLoRA.
+func SaveLoRA(ctx *context.Context, lora *transformers.LoRAConfig, checkpointDir string) error {
+	if lora == nil {
+		return errors.New("SaveLoRA() requires the LoRA configuration of the adapters")
+	}
+	adaptersCtx := context.New()
+	for v := range ctx.In(ModelScope).IterVariablesInScope() {
+		if transformers.IsLoRAVariable(v) {
+			adaptersCtx.InAbsPath(v.Scope()).VariableWithValue(v.Name(), v.Value())
+		}
+	}
+	err := kaggle.WriteConvertedWeights(adaptersCtx, checkpointDir)
+	if err != nil {
+		return errors.WithMessage(err, "SaveLoRA() failed")
+	}
+	contents, err := json.MarshalIndent(&loraConfigFile{
+		Rank:        lora.Rank,
+		Alpha:       lora.Alpha,
+		Dropout:     lora.Dropout,
+		Targets:     lora.Targets,
+		NumAdapters: lora.NumAdapters,
+	}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path.Join(checkpointDir, LoRAConfigFileName), append(contents, '\n'), 0644)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "SaveLoRA() failed to write %q", LoRAConfigFileName)
+	}
+	return nil
+}
+
+// LoadLoRA loads the LoRA adapters weights saved with SaveLoRA from checkpointDir into ctx (under ModelScope),
+// overwriting the adapters already there, and returns their configuration.
+//
+// The model must then be built with the returned transformers.LoRAConfig, the one used when the adapters were
+// trained.
+func LoadLoRA(ctx *context.Context, checkpointDir string) (*transformers.LoRAConfig, error) {
+	configPath := path.Join(checkpointDir, LoRAConfigFileName)
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "LoadLoRA() failed to read the LoRA configuration %q", configPath)
+	}
+	var configFile loraConfigFile
+	if err = json.Unmarshal(contents, &configFile); err != nil {
+		return nil, errors.Wrapf(err, "LoadLoRA() failed to parse the LoRA configuration %q", configPath)
+	}
+	if configFile.Rank <= 0 || len(configFile.Targets) == 0 {
+		return nil, errors.Errorf("LoadLoRA(%q): invalid LoRA configuration with rank %d and targets %v",
+			checkpointDir, configFile.Rank, configFile.Targets)
+	}
+	lora := &transformers.LoRAConfig{
+		Rank:        configFile.Rank,
+		Alpha:       configFile.Alpha,
+		Dropout:     configFile.Dropout,
+		Targets:     configFile.Targets,
+		NumAdapters: configFile.NumAdapters,
+	}
+
+	weights, err := kaggle.ReadConvertedWeightsToTree(checkpointDir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "LoadLoRA() failed")
+	}
+	modelCtx := ctx.In(ModelScope).Checked(false)
+	for treePath, tensor := range weights.Leaves() {
+		if len(treePath) < 2 || treePath[0] != "transformer" || !slices.Contains(treePath, transformers.LoRAScope) {
+			return nil, errors.Errorf("LoadLoRA(%q): %q is not a LoRA adapter weight", checkpointDir, treePath)
+		}
+		scopedCtx := modelCtx
+		for _, p := range treePath[1 : len(treePath)-1] {
+			scopedCtx = scopedCtx.In(p)
+		}
+		name := treePath[len(treePath)-1]
+		if v := scopedCtx.GetVariable(name); v != nil {
+			if !v.Shape().Equal(tensor.Shape()) {
+				return nil, errors.Errorf("LoadLoRA(%q): variable %q in scope %q is shaped %s, but loaded value is shaped %s",
+					checkpointDir, name, scopedCtx.Scope(), v.Shape(), tensor.Shape())
+			}
+			v.SetValue(tensor)
+			continue
+		}
+		scopedCtx.VariableWithValue(name, tensor)
+	}
+	return lora, nil
+}
@@ -0,0 +1,63 @@
+package finetune
+
+import (
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSaveLoadLoRA(t *testing.T) {
+	ctx := context.New()
+	layerCtx := ctx.In(ModelScope).In("layer_0").In("attn")
+	layerCtx.In("hf").VariableWithValue("q_proj", [][]float32{{1, 1}, {1, 1}})
+	loraCtx := layerCtx.In(transformers.LoRAScope).In(string(transformers.LoRATargetQuery))
+	loraCtx.VariableWithValue("a", [][]float32{{1}, {2}})
+	loraCtx.VariableWithValue("b", [][]float32{{3, 4}})
+
+	lora := transformers.NewLoRAConfig().WithRank(1)
+	lora.Dropout = 0.1
+	dir := t.TempDir()
+	require.NoError(t, SaveLoRA(ctx, lora, dir))
+
+	// Loading into a new context only creates the adapters, and returns their configuration.
+	newCtx := context.New()
+	loadedLoRA, err := LoadLoRA(newCtx, dir)
+	require.NoError(t, err)
+	require.Equal(t, lora, loadedLoRA)
+	newLayerCtx := newCtx.In(ModelScope).In("layer_0").In("attn")
+	require.Nil(t, newLayerCtx.In("hf").GetVariable("q_proj"))
+	newLoRACtx := newLayerCtx.In(transformers.LoRAScope).In(string(transformers.LoRATargetQuery))
+	require.Equal(t, [][]float32{{1}, {2}}, newLoRACtx.GetVariable("a").Value().Value())
+
+	// Loading into an existing context overwrites the adapters.
+	loraCtx.GetVariable("b").SetValue(tensors.FromValue([][]float32{{0, 0}}))
+	_, err = LoadLoRA(ctx, dir)
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{3, 4}}, loraCtx.GetVariable("b").Value().Value())
+
+	// Saving without adapters or without the configuration fails.
+	require.Error(t, SaveLoRA(context.New(), lora, t.TempDir()))
+	require.Error(t, SaveLoRA(ctx, nil, t.TempDir()))
+
+	// Loading adapters saved without their configuration fails.
+	require.NoError(t, os.Remove(path.Join(dir, LoRAConfigFileName)))
+	_, err = LoadLoRA(context.New(), dir)
+	require.ErrorContains(t, err, LoRAConfigFileName)
+}
+
+func TestLoRAFrozenWeights(t *testing.T) {
+	ctx := context.New()
+	layerCtx := ctx.In(ModelScope).In("layer_0").In("attn")
+	layerCtx.In("hf").VariableWithValue("q_proj", [][]float32{{1, 1}, {1, 1}})
+	layerCtx.In(transformers.LoRAScope).In(string(transformers.LoRATargetQuery)).VariableWithValue("a", [][]float32{{1}, {2}})
+	transformers.FreezeBaseWeights(ctx.In(ModelScope))
+
+	// Only the base weights are excluded from the checkpoints.
+	frozen := frozenVariables(ctx, ModelScope, TeacherScope)
+	require.Len(t, frozen, 1)
+	require.Equal(t, "q_proj", frozen[0].Name())
+}
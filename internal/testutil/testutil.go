@@ -0,0 +1,21 @@
+// Package testutil holds the helpers shared by the tests of the other packages.
+package testutil
+
+import (
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gomlx/backends"
+	"github.com/gomlx/gomlx/graph/graphtest"
+	"testing"
+)
+
+// Backend returns the backend to execute graphs in the tests, or skips the test if none is available.
+//
+// The XLA backend is linked in, except when built with the "noxla" tag, for the machines where it isn't installed.
+func Backend(t testing.TB) backends.Backend {
+	var backend backends.Backend
+	err := exceptions.TryCatch[error](func() { backend = graphtest.BuildTestBackend() })
+	if err != nil || backend == nil {
+		t.Skipf("no backend available to execute graphs: %v", err)
+	}
+	return backend
+}
@@ -0,0 +1,7 @@
+//go:build !noxla
+
+package testutil
+
+// The tests that execute graphs use the XLA backend: build with the "noxla" tag to skip them where it isn't
+// installed.
+import _ "github.com/gomlx/gomlx/backends/xla"
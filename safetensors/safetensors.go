@@ -0,0 +1,246 @@
+// Package safetensors reads and writes tensors stored in the HuggingFace ".safetensors" format.
+//
+// The format is an 8 bytes little-endian header length, followed by a JSON header describing each tensor (dtype,
+// shape and data offsets), followed by the raw data of the tensors. See https://github.com/huggingface/safetensors.
+package safetensors
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"slices"
+)
+
+// MetadataKey is the key in the JSON header that holds the free-form (string to string) metadata of the file.
+const MetadataKey = "__metadata__"
+
+// maxHeaderSize is a sanity limit to the size of the header: corrupted files could otherwise trigger
+// very large allocations.
+const maxHeaderSize = 100 << 20
+
+// DTypeNames maps the dtypes supported by the format to their names used in the header.
+var DTypeNames = map[dtypes.DType]string{
+	dtypes.Bool:     "BOOL",
+	dtypes.Uint8:    "U8",
+	dtypes.Int8:     "I8",
+	dtypes.Uint16:   "U16",
+	dtypes.Int16:    "I16",
+	dtypes.Float16:  "F16",
+	dtypes.BFloat16: "BF16",
+	dtypes.Uint32:   "U32",
+	dtypes.Int32:    "I32",
+	dtypes.Float32:  "F32",
+	dtypes.Uint64:   "U64",
+	dtypes.Int64:    "I64",
+	dtypes.Float64:  "F64",
+}
+
+// TensorInfo describes one tensor stored in a ".safetensors" file.
+type TensorInfo struct {
+	Name  string
+	Shape shapes.Shape
+
+	// Offset of the tensor data, relative to the start of the data section (see Header.DataOffset), and its
+	// size in bytes.
+	Offset, Size int64
+}
+
+// Header of a ".safetensors" file.
+type Header struct {
+	// Metadata is the free-form metadata of the file. It may be nil.
+	Metadata map[string]string
+
+	// Tensors sorted by their offsets.
+	Tensors []*TensorInfo
+
+	// DataOffset is the position in the file where the data section starts.
+	DataOffset int64
+}
+
+// jsonTensorInfo is the JSON representation of a tensor in the header.
+type jsonTensorInfo struct {
+	DType   string  `json:"dtype"`
+	Shape   []int   `json:"shape"`
+	Offsets []int64 `json:"data_offsets"`
+}
+
+// ReadHeader reads and parses the header of a ".safetensors" file from r, positioned at its start.
+// After it returns, r is positioned at the start of the data section.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var headerLen uint64
+	if err := binary.Read(r, binary.LittleEndian, &headerLen); err != nil {
+		return nil, errors.Wrap(err, "failed to read safetensors header length")
+	}
+	if headerLen > maxHeaderSize {
+		return nil, errors.Errorf("safetensors header length %d is too large, file is likely corrupted", headerLen)
+	}
+	headerBytes := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, headerBytes); err != nil {
+		return nil, errors.Wrap(err, "failed to read safetensors header")
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(headerBytes, &entries); err != nil {
+		return nil, errors.Wrap(err, "failed to parse safetensors header")
+	}
+
+	header := &Header{DataOffset: 8 + int64(headerLen)}
+	for name, entry := range entries {
+		if name == MetadataKey {
+			if err := json.Unmarshal(entry, &header.Metadata); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse safetensors %q", MetadataKey)
+			}
+			continue
+		}
+		var info jsonTensorInfo
+		if err := json.Unmarshal(entry, &info); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse safetensors header entry for tensor %q", name)
+		}
+		dtype := dtypeFromName(info.DType)
+		if dtype == dtypes.InvalidDType {
+			return nil, errors.Errorf("tensor %q has unsupported safetensors dtype %q", name, info.DType)
+		}
+		if len(info.Offsets) != 2 || info.Offsets[1] < info.Offsets[0] || info.Offsets[0] < 0 {
+			return nil, errors.Errorf("tensor %q has invalid data_offsets %v", name, info.Offsets)
+		}
+		tensorInfo := &TensorInfo{
+			Name:   name,
+			Shape:  shapes.Make(dtype, info.Shape...),
+			Offset: info.Offsets[0],
+			Size:   info.Offsets[1] - info.Offsets[0],
+		}
+		if tensorInfo.Size != int64(tensorInfo.Shape.Memory()) {
+			return nil, errors.Errorf("tensor %q shaped %s requires %d bytes, but data_offsets %v holds %d bytes",
+				name, tensorInfo.Shape, tensorInfo.Shape.Memory(), info.Offsets, tensorInfo.Size)
+		}
+		header.Tensors = append(header.Tensors, tensorInfo)
+	}
+	slices.SortFunc(header.Tensors, func(a, b *TensorInfo) int {
+		return cmp.Or(cmp.Compare(a.Offset, b.Offset), cmp.Compare(a.Name, b.Name))
+	})
+	return header, nil
+}
+
+// dtypeFromName returns the dtype of the given safetensors name, or dtypes.InvalidDType if not supported.
+func dtypeFromName(name string) dtypes.DType {
+	for dtype, dtypeName := range DTypeNames {
+		if dtypeName == name {
+			return dtype
+		}
+	}
+	return dtypes.InvalidDType
+}
+
+// ReadTensor reads the tensor described by info from r, which must hold the whole file.
+func ReadTensor(r io.ReaderAt, header *Header, info *TensorInfo) (*tensors.Tensor, error) {
+	t := tensors.FromShape(info.Shape)
+	var err error
+	t.MutableBytes(func(data []byte) {
+		_, err = r.ReadAt(data, header.DataOffset+info.Offset)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read data of tensor %q", info.Name)
+	}
+	return t, nil
+}
+
+// ReadFile reads all the tensors of the ".safetensors" file in filePath.
+// It returns the header of the file and the tensors indexed by their names.
+func ReadFile(filePath string) (header *Header, tensorsByName map[string]*tensors.Tensor, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to open %q", filePath)
+	}
+	defer func() { _ = f.Close() }()
+	header, err = ReadHeader(f)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "reading %q", filePath)
+	}
+	tensorsByName = make(map[string]*tensors.Tensor, len(header.Tensors))
+	for _, info := range header.Tensors {
+		tensorsByName[info.Name], err = ReadTensor(f, header, info)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "reading %q", filePath)
+		}
+	}
+	return header, tensorsByName, nil
+}
+
+// NamedTensor is a tensor along with its name, used to write ".safetensors" files.
+type NamedTensor struct {
+	Name   string
+	Tensor *tensors.Tensor
+}
+
+// WriteFile writes the tensors to the ".safetensors" file in filePath, in the given order, along with the
+// optional (it can be nil) metadata.
+func WriteFile(filePath string, namedTensors []NamedTensor, metadata map[string]string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", filePath)
+	}
+	err = Write(f, namedTensors, metadata)
+	if err != nil {
+		_ = f.Close()
+		return errors.WithMessagef(err, "writing %q", filePath)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %q", filePath)
+	}
+	return nil
+}
+
+// Write the tensors in the ".safetensors" format to w, in the given order, along with the optional (it can be nil)
+// metadata.
+func Write(w io.Writer, namedTensors []NamedTensor, metadata map[string]string) error {
+	entries := make(map[string]any, len(namedTensors)+1)
+	if len(metadata) > 0 {
+		entries[MetadataKey] = metadata
+	}
+	var offset int64
+	for _, namedTensor := range namedTensors {
+		shape := namedTensor.Tensor.Shape()
+		dtypeName, found := DTypeNames[shape.DType]
+		if !found {
+			return errors.Errorf("tensor %q has dtype %s, not supported by the safetensors format", namedTensor.Name, shape.DType)
+		}
+		if _, found = entries[namedTensor.Name]; found {
+			return errors.Errorf("tensor name %q used more than once", namedTensor.Name)
+		}
+		size := int64(shape.Memory())
+		dimensions := shape.Dimensions
+		if dimensions == nil {
+			dimensions = []int{} // Scalars are encoded with an empty list.
+		}
+		entries[namedTensor.Name] = jsonTensorInfo{DType: dtypeName, Shape: dimensions, Offsets: []int64{offset, offset + size}}
+		offset += size
+	}
+	headerBytes, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode safetensors header")
+	}
+	// Header is padded with spaces to a multiple of 8 bytes, so the data is aligned.
+	for len(headerBytes)%8 != 0 {
+		headerBytes = append(headerBytes, ' ')
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint64(len(headerBytes))); err != nil {
+		return errors.Wrap(err, "failed to write safetensors header length")
+	}
+	if _, err = w.Write(headerBytes); err != nil {
+		return errors.Wrap(err, "failed to write safetensors header")
+	}
+	for _, namedTensor := range namedTensors {
+		namedTensor.Tensor.ConstBytes(func(data []byte) {
+			_, err = w.Write(data)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to write data of tensor %q", namedTensor.Name)
+		}
+	}
+	return nil
+}
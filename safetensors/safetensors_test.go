@@ -0,0 +1,64 @@
+package safetensors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"path"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	header := `{"__metadata__":{"format":"pt"},"b":{"dtype":"I32","shape":[2],"data_offsets":[4,12]},` +
+		`"a":{"dtype":"F32","shape":[],"data_offsets":[0,4]}}`
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(len(header))))
+	buf.WriteString(header)
+	got, err := ReadHeader(&buf)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"format": "pt"}, got.Metadata)
+	require.Equal(t, int64(8+len(header)), got.DataOffset)
+	require.Len(t, got.Tensors, 2)
+	require.Equal(t, "a", got.Tensors[0].Name)
+	require.Equal(t, dtypes.Float32, got.Tensors[0].Shape.DType)
+	require.Equal(t, 0, got.Tensors[0].Shape.Rank())
+	require.Equal(t, "b", got.Tensors[1].Name)
+	require.Equal(t, []int{2}, got.Tensors[1].Shape.Dimensions)
+	require.Equal(t, int64(4), got.Tensors[1].Offset)
+
+	// Invalid dtype and sizes.
+	for _, invalid := range []string{
+		`{"a":{"dtype":"X3","shape":[],"data_offsets":[0,4]}}`,
+		`{"a":{"dtype":"F32","shape":[2],"data_offsets":[0,4]}}`,
+		`{"a":{"dtype":"F32","shape":[1],"data_offsets":[4]}}`,
+	} {
+		buf.Reset()
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(len(invalid))))
+		buf.WriteString(invalid)
+		_, err = ReadHeader(&buf)
+		require.Error(t, err, "header %s", invalid)
+	}
+}
+
+func TestWriteAndReadFile(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "test.safetensors")
+	namedTensors := []NamedTensor{
+		{"x", tensors.FromValue([][]float32{{1, 2, 3}, {4, 5, 6}})},
+		{"y", tensors.FromValue([]uint8{255, 1})},
+		{"z", tensors.FromValue(int64(7))},
+	}
+	require.NoError(t, WriteFile(filePath, namedTensors, map[string]string{"format": "pt"}))
+	header, tensorsByName, err := ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, "pt", header.Metadata["format"])
+	require.Zero(t, header.DataOffset%8)
+	require.Len(t, tensorsByName, 3)
+	require.Equal(t, [][]float32{{1, 2, 3}, {4, 5, 6}}, tensorsByName["x"].Value())
+	require.Equal(t, []uint8{255, 1}, tensorsByName["y"].Value())
+	require.Equal(t, int64(7), tensorsByName["z"].Value())
+
+	// Duplicate names.
+	require.Error(t, WriteFile(filePath, []NamedTensor{namedTensors[0], namedTensors[0]}, nil))
+}
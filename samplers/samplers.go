@@ -13,6 +13,7 @@ import (
 	"github.com/gomlx/gomlx/types/tensors"
 	"github.com/gomlx/gomlx/types/xslices"
 	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
 	klog "k8s.io/klog/v2"
 	"slices"
 	"time"
@@ -51,6 +52,9 @@ type Sampler struct {
 	// CacheTreeStructure holds the structure of the tree used for caching: the tree structure (paths) is stable
 	// across different calls to Sample.
 	CacheTreeStructure *trees.Tree[struct{}]
+
+	// loraAdapters set with SetLoRAAdapters, selected by name in SampleWithAdapters.
+	loraAdapters []*transformers.LoRAAdapter
 }
 
 // New creates a new sampler with the registered vocabulary and model.
@@ -71,6 +75,62 @@ func New(backend backends.Backend, ctx *context.Context, vocab Vocabulary, maxGe
 	return s, nil
 }
 
+// SetCacheLength sets the length of the attention cache (Config.MaxCacheLength) used by the sampler. It limits
+// the number of tokens of each sequence sampled: the prompt plus the generated tokens.
+//
+// It must be > 0 and at most the maximum sequence length the model was trained with (Config.MaxSequenceLength).
+// The default is transformers.DefaultMaxCacheLength.
+func (s *Sampler) SetCacheLength(cacheLength int) error {
+	return s.Config.SetMaxCacheLength(cacheLength)
+}
+
+// SetCacheDType sets the dtype used to store the attention cache (Config.CacheDType) by the sampler.
+//
+// It must be either the model dtype (Config.DType, the default), or dtypes.Int8 to quantize the cache, using ~half
+// the memory of a BFloat16 cache.
+func (s *Sampler) SetCacheDType(dtype dtypes.DType) error {
+	previous := s.Config.CacheDType
+	if err := s.Config.SetCacheDType(dtype); err != nil {
+		return err
+	}
+	if s.Config.CacheDType != previous {
+		// The quantized cache has the extra scale leaves: both the cache tree structure and the graph change.
+		s.CacheTreeStructure = nil
+		s.SampleStep = context.NewExec(s.Backend, s.Context, s.sampleStepGraphFn())
+	}
+	return nil
+}
+
+// SetLoRAAdapters sets the LoRA adapters that can be selected (by name) for each prompt in SampleWithAdapters,
+// replacing the previous ones. See transformers.SetLoRAAdapters for details, and huggingface.LoadPEFTAdapter to
+// load adapters trained with HuggingFace's PEFT library.
+//
+// Adapters can be hot-swapped: if the new adapters have the same largest rank and the union of their targets is the
+// same as the previous ones, the sampling graph already compiled is reused.
+//
+// If no adapters are given, the adapters are removed.
+func (s *Sampler) SetLoRAAdapters(adapters ...*transformers.LoRAAdapter) error {
+	for ii, adapter := range adapters {
+		for _, other := range adapters[:ii] {
+			if adapter.Name == other.Name {
+				return errors.Errorf("Sampler.SetLoRAAdapters(): more than one adapter named %q", adapter.Name)
+			}
+		}
+	}
+	previous := s.Config.LoRA
+	if err := transformers.SetLoRAAdapters(s.Context.In("model"), s.Config, adapters); err != nil {
+		return err
+	}
+	s.loraAdapters = adapters
+	current := s.Config.LoRA
+	if previous == nil || current == nil || previous.NumAdapters != current.NumAdapters ||
+		previous.Rank != current.Rank || !slices.Equal(previous.Targets, current.Targets) {
+		// Graph has to be rebuilt.
+		s.SampleStep = context.NewExec(s.Backend, s.Context, s.sampleStepGraphFn())
+	}
+	return nil
+}
+
 // Sample the continuation from the given prompts.
 func (s *Sampler) Sample(prompts []string) ([]string, error) {
 	return s.SampleMaxTokens(prompts, s.MaxGeneratedTokens)
@@ -78,11 +138,50 @@ func (s *Sampler) Sample(prompts []string) ([]string, error) {
 
 // SampleMaxTokens is like Sample, but instead of using the default MaxGenerateTokens, uses the given maxTokens instead.
 func (s *Sampler) SampleMaxTokens(prompts []string, maxTokens int) ([]string, error) {
+	return s.sample(prompts, nil, maxTokens)
+}
+
+// SampleWithAdapters is like Sample, but each prompt selects the LoRA adapter (by name) to use, among those set
+// with SetLoRAAdapters. An empty name uses the base model, with no adapter.
+//
+// Prompts using different adapters are sampled together in the same batch.
+func (s *Sampler) SampleWithAdapters(prompts, adapterNames []string) ([]string, error) {
+	if len(adapterNames) != len(prompts) {
+		return nil, errors.Errorf("SampleWithAdapters() got %d prompts, but %d adapter names", len(prompts), len(adapterNames))
+	}
+	adapterIndices := make([]int32, len(prompts))
+	for ii, name := range adapterNames {
+		adapterIndices[ii] = -1
+		if name == "" {
+			continue
+		}
+		idx := slices.IndexFunc(s.loraAdapters, func(adapter *transformers.LoRAAdapter) bool { return adapter.Name == name })
+		if idx < 0 {
+			return nil, errors.Errorf("SampleWithAdapters(): unknown LoRA adapter %q, see Sampler.SetLoRAAdapters", name)
+		}
+		adapterIndices[ii] = int32(idx)
+	}
+	return s.sample(prompts, adapterIndices, s.MaxGeneratedTokens)
+}
+
+// usesLoRAAdapters returns whether the model uses a bank of LoRA adapters, selected per example.
+func (s *Sampler) usesLoRAAdapters() bool {
+	return s.Config.LoRA != nil && s.Config.LoRA.NumAdapters > 0
+}
+
+// sample implements Sample, SampleMaxTokens and SampleWithAdapters. If adapterIndices is nil, no adapter is used.
+func (s *Sampler) sample(prompts []string, adapterIndices []int32, maxTokens int) ([]string, error) {
 	promptIds := xslices.Map(prompts, s.Vocab.EncodeAsIDs)
 	state, err := s.initialState(promptIds, maxTokens)
 	if err != nil {
 		return nil, err
 	}
+	if s.usesLoRAAdapters() {
+		if adapterIndices == nil {
+			adapterIndices = xslices.SliceWithValue(len(prompts), int32(-1))
+		}
+		state.AdapterIndices = tensors.FromValue(adapterIndices)
+	}
 	err = exceptions.TryCatch[error](func() {
 		state = s.sampleLoop(state)
 	})
@@ -111,6 +210,9 @@ func (s *Sampler) sampleLoop(state samplingState) samplingState {
 	inputs = append(inputs,
 		state.Positions,
 	)
+	if s.usesLoRAAdapters() {
+		inputs = append(inputs, state.AdapterIndices)
+	}
 	var outputs []*tensors.Tensor
 	var execTime, inputsPrepTime time.Duration
 	var count int
@@ -180,6 +282,10 @@ func (s *Sampler) sampleStepGraphFn() func(*context.Context, []*Node) []*Node {
 
 		// - Constant fields.
 		positions := nextState()
+		if s.usesLoRAAdapters() {
+			// Index of the LoRA adapter of each example, used by the model.
+			ctx.SetGraphParam(g, transformers.LoRAAdapterIndicesGraphParam, nextState())
+		}
 
 		// Take the current step token for all examples of the batch.
 		batchSize := inputBuffer.Shape().Dimensions[0]
@@ -189,14 +295,10 @@ func (s *Sampler) sampleStepGraphFn() func(*context.Context, []*Node) []*Node {
 		currentPositions := DynamicSlice(positions, []*Node{zeroIdx, stepNum}, []int{batchSize, 1})
 		currentPositions.AssertDims(batchSize, 1)
 
-		// Attention to all positions < current step number (stepNum).
-		// Notice that the cache rotates, so once stepNum > Config.MaxCacheLength, the mask will be
-		// true everywhere.
-		cacheAttentionMask := Iota(g, shapes.Make(dtypes.Int32, batchSize, 1, s.Config.MaxCacheLength), -1)
-		cacheAttentionMask = LessOrEqual(cacheAttentionMask, stepNum)
-
+		// The attention masks are derived by the model from the positions stored in the cache: each layer
+		// may have a cache of a different length.
 		logits := transformers.GemmaWithCache(ctx.In("model"), s.Config,
-			currentTokens, currentPositions, cache, cacheAttentionMask)
+			currentTokens, currentPositions, cache)
 		logits.AssertDims(batchSize, 1, s.Config.VocabularySize)
 
 		nextTokenNum := OnePlus(stepNum)
@@ -256,6 +358,10 @@ type samplingState struct {
 	// Done is a vector of the inputs who are done with the generation: shaped bool[batch_size].
 	Done *tensors.Tensor
 
+	// AdapterIndices is the index of the LoRA adapter used by each example (-1 for none): shaped int32[batch_size].
+	// Only used if the Sampler has LoRA adapters set, see Sampler.SetLoRAAdapters.
+	AdapterIndices *tensors.Tensor
+
 	// Cache used during the sampling.
 	Cache *transformers.Cache
 }
@@ -273,8 +379,10 @@ func (s *Sampler) initialState(promptIds [][]int, maxTokens int) (state sampling
 
 	lengths := xslices.Map(promptIds, func(seq []int) int32 { return int32(len(seq)) + 1 }) // +1 for <bos> (beginning-of-sentence) token.
 	state.NumInputTokens = tensors.FromValue(lengths)                                       // Shape [batchSize]
-	maxInputLength := int(slices.Max(lengths))
-	state.TotalLength = maxInputLength + maxTokens + 1 // +1 for <eos>.
+	state.TotalLength, err = sequenceLength(s.Config, int(slices.Max(lengths)), maxTokens)
+	if err != nil {
+		return
+	}
 	totalLength := state.TotalLength
 
 	state.StepNum = tensors.FromScalar(int32(0))
@@ -330,6 +438,22 @@ func (s *Sampler) initialState(promptIds [][]int, maxTokens int) (state sampling
 	return
 }
 
+// sequenceLength returns the length of the sequences sampled: the longest prompt, with maxInputLength tokens
+// (including <bos>), plus maxTokens tokens to generate and <eos>. It returns an error if it doesn't fit the cache.
+func sequenceLength(config *transformers.Config, maxInputLength, maxTokens int) (int, error) {
+	if maxTokens <= 0 {
+		return 0, errors.Errorf("the number of tokens to generate must be > 0, got %d", maxTokens)
+	}
+	totalLength := maxInputLength + maxTokens + 1 // +1 for <eos>.
+	if totalLength > config.MaxCacheLength {
+		return 0, errors.Errorf("the longest prompt has %d tokens (including <bos>), plus %d tokens to generate (and <eos>) "+
+			"requires %d positions, but the cache length is %d: reduce the prompt or the number of tokens to generate, or "+
+			"increase the cache length with Sampler.SetCacheLength (up to the model's maximum sequence length of %d)",
+			maxInputLength, maxTokens, totalLength, config.MaxCacheLength, config.MaxSequenceLength)
+	}
+	return totalLength, nil
+}
+
 // decode converts the state's InputBuffer with the sampled tokens to actual text.
 func (s *Sampler) decode(state samplingState) []string {
 	text := make([]string, state.BatchSize)
@@ -0,0 +1,136 @@
+package samplers
+
+import (
+	"fmt"
+	"github.com/gomlx/gemma/internal/testutil"
+	"github.com/gomlx/gemma/transformers"
+	"github.com/gomlx/gomlx/backends"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gomlx/types/xslices"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestSequenceLength(t *testing.T) {
+	config := &transformers.Config{MaxCacheLength: 100, MaxSequenceLength: 8192}
+	for _, tc := range []struct {
+		name                      string
+		maxInputLength, maxTokens int
+		want                      int
+		err                       string
+	}{
+		{"short", 10, 20, 31, ""},
+		{"exact limit", 10, 89, 100, ""},
+		{"over the limit", 10, 90, 0, "the longest prompt has 10 tokens (including <bos>), plus 90 tokens to generate " +
+			"(and <eos>) requires 101 positions, but the cache length is 100: reduce the prompt or the number of tokens " +
+			"to generate, or increase the cache length with Sampler.SetCacheLength (up to the model's maximum sequence " +
+			"length of 8192)"},
+		{"prompt over the limit", 100, 1, 0, "requires 102 positions"},
+		{"no tokens to generate", 10, 0, 0, "must be > 0"},
+		{"negative tokens to generate", 10, -1, 0, "must be > 0"},
+	} {
+		got, err := sequenceLength(config, tc.maxInputLength, tc.maxTokens)
+		if tc.err != "" {
+			require.ErrorContains(t, err, tc.err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+// testVocab is a vocabulary of the letters "a" to "d", after the special ids <pad>=0, <bos>=1, <eos>=2 and <unk>=3.
+type testVocab struct{}
+
+func (testVocab) EncodeAsIDs(text string) []int {
+	return xslices.Map([]byte(text), func(c byte) int { return int(c-'a') + 4 })
+}
+
+func (testVocab) DecodeIDs(ids []int) string {
+	var text []byte
+	for _, id := range ids {
+		if id >= 4 {
+			text = append(text, byte(id-4)+'a')
+		}
+	}
+	return string(text)
+}
+
+func (testVocab) BeginningOfSentenceID() int { return 1 }
+func (testVocab) EndOfSentenceID() int       { return 2 }
+func (testVocab) UnknownID() int             { return 3 }
+func (testVocab) PadID() int                 { return 0 }
+
+// newTinySampler creates a sampler for a Gemma2 model (26 layers) with tiny dimensions and deterministic weights.
+func newTinySampler(t *testing.T, backend backends.Backend) *Sampler {
+	ctx := context.New()
+	modelCtx := ctx.In("model")
+	seed := 0
+	newVariable := func(scope []string, name string, shape shapes.Shape) {
+		scopedCtx := modelCtx
+		for _, s := range scope {
+			scopedCtx = scopedCtx.In(s)
+		}
+		if scopedCtx.GetVariable(name) != nil {
+			return
+		}
+		value := tensors.FromShape(shape)
+		tensors.MutableFlatData(value, func(flat []bfloat16.BFloat16) {
+			for ii := range flat {
+				flat[ii] = bfloat16.FromFloat32(float32(math.Sin(float64(seed))))
+				seed++
+			}
+		})
+		scopedCtx.VariableWithValue(name, value)
+	}
+
+	// The embedding table and the number of layers are enough for NewConfigFromContext to recognize the model.
+	const vocabSize, embedDim = 8, 4
+	newVariable([]string{"embedder"}, "input_embedding", shapes.Make(dtypes.BFloat16, vocabSize, embedDim))
+	for layerIdx := range 26 {
+		newVariable([]string{fmt.Sprintf("layer_%d", layerIdx), "pre_attention_norm"}, "scale",
+			shapes.Make(dtypes.BFloat16, embedDim))
+	}
+	sampler, err := New(backend, ctx, testVocab{}, 5)
+	require.NoError(t, err)
+	config := sampler.Config
+	require.Equal(t, transformers.Gemma2_2B, config.Type)
+	config.EmbedDim, config.HiddenDim, config.NumHeads, config.HeadDim, config.NumKVHeads = embedDim, 6, 4, 2, 2
+	config.UseQKV, config.UseGroupQueryAttention = false, true
+	require.NoError(t, sampler.SetCacheLength(16))
+	for _, v := range transformers.ExpectedVariables(config) {
+		newVariable(v.Scope, v.Name, v.Shape)
+	}
+	return sampler
+}
+
+func TestSetCacheDType(t *testing.T) {
+	backend := testutil.Backend(t)
+	sampler := newTinySampler(t, backend)
+	prompts := []string{"ab", "c"}
+	want, err := sampler.Sample(prompts)
+	require.NoError(t, err)
+	require.Len(t, want, len(prompts))
+
+	// The quantized cache has extra leaves (the scales): the cache structure and the graph must follow.
+	require.NoError(t, sampler.SetCacheDType(dtypes.Int8))
+	got, err := sampler.Sample(prompts)
+	require.NoError(t, err)
+	require.Len(t, got, len(prompts))
+	require.Len(t, sampler.CacheTreeStructure.Map["layer_0"].Map, 6)
+
+	// And back to the model dtype.
+	require.NoError(t, sampler.SetCacheDType(dtypes.BFloat16))
+	got, err = sampler.Sample(prompts)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Len(t, sampler.CacheTreeStructure.Map["layer_0"].Map, 4)
+
+	require.Error(t, sampler.SetCacheDType(dtypes.Float32))
+	require.Equal(t, dtypes.BFloat16, sampler.Config.CacheDType)
+}
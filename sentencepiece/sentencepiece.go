@@ -4,25 +4,41 @@
 package sentencepiece
 
 import (
+	"bytes"
 	esentencepiece "github.com/eliben/go-sentencepiece"
 	"github.com/gomlx/gomlx/types/xslices"
 	"github.com/pkg/errors"
+	"os"
 )
 
 // Tokenizer is able to encode/decode tokens from/to text.
 type Tokenizer struct {
 	*esentencepiece.Processor
 	Info *esentencepiece.ModelInfo
+
+	// ModelProto is the serialized sentencepiece model proto the Tokenizer was created from.
+	ModelProto []byte
 }
 
 func NewFromPath(vocabPath string) (*Tokenizer, error) {
-	proc, err := esentencepiece.NewProcessorFromPath(vocabPath)
+	modelProto, err := os.ReadFile(vocabPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't create sentencepiece")
+	}
+	return NewFromBytes(modelProto)
+}
+
+// NewFromBytes creates a Tokenizer from the serialized sentencepiece model proto (the contents of a
+// "tokenizer.model" file).
+func NewFromBytes(modelProto []byte) (*Tokenizer, error) {
+	proc, err := esentencepiece.NewProcessor(bytes.NewReader(modelProto))
 	if err != nil {
 		return nil, errors.Wrapf(err, "can't create sentencepiece")
 	}
 	return &Tokenizer{
-		Processor: proc,
-		Info:      proc.ModelInfo(),
+		Processor:  proc,
+		Info:       proc.ModelInfo(),
+		ModelProto: modelProto,
 	}, nil
 }
 
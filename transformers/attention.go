@@ -12,8 +12,20 @@ import (
 )
 
 // createAttentionCache creates the attention cache for the attention layer under treePath.
+//
+// If dtype is quantized (see Config.CacheDType), it also creates the scales for the keys and values.
 func createAttentionCache(data *trees.Tree[*tensors.Tensor], treePath trees.Path, dtype dtypes.DType,
 	batchSize, maxCacheLength, numHeads, headDim int) error {
+	if isQuantizedCacheDType(dtype) {
+		for _, name := range []string{"k_scale", "v_scale"} {
+			err := data.Set(append(treePath, name),
+				tensors.FromShape(shapes.Make(cacheScaleDType, batchSize, maxCacheLength, numHeads)))
+			if err != nil {
+				return errors.WithMessage(err, "in createAttentionCache()")
+			}
+		}
+	}
+
 	// Value cache:
 	err := data.Set(append(treePath, "v"),
 		tensors.FromShape(shapes.Make(dtype, batchSize, maxCacheLength, numHeads, headDim)))
@@ -33,9 +45,70 @@ func createAttentionCache(data *trees.Tree[*tensors.Tensor], treePath trees.Path
 	if err != nil {
 		return errors.WithMessage(err, "in createAttentionCache()")
 	}
+
+	// Absolute positions of the tokens stored in each slot of the cache: -1 for empty slots.
+	err = data.Set(append(treePath, "positions"),
+		tensors.FromScalarAndDimensions(int32(-1), batchSize, maxCacheLength))
+	if err != nil {
+		return errors.WithMessage(err, "in createAttentionCache()")
+	}
 	return nil
 }
 
+// updateAttentionCache inserts the key and value projections of the current tokens (shaped [batchSize, sequenceLength, numKVHeads, headDim])
+// in the rotating cache, along with their positions (shaped [batchSize, sequenceLength]).
+//
+// It returns the keys and values of the whole cache (shaped [batchSize, cacheLength, numKVHeads, headDim]) and their
+// positions (shaped [batchSize, cacheLength]), -1 for empty slots.
+//
+// If the cache is quantized, the keys and values are returned still quantized (converted to the dtype of the
+// projections), along with their scales (shaped [batchSize, cacheLength, numKVHeads]) to be applied with
+// scaleByCache. Otherwise, the scales are nil.
+func updateAttentionCache(cache *trees.Tree[*Node], keyProjection, valueProjection, positions *Node) (
+	keys, values, keyScales, valueScales, keyPositions *Node) {
+	g := keyProjection.Graph()
+	dtype := keyProjection.DType()
+
+	// Insert calculated projections in cache: cached projections are shaped [batchSize, cacheLength, numHeads, headDim]
+	endIndex := Must1(cache.Get("end_index"))
+	zeroIdx := ScalarZero(g, dtypes.Int32)
+	cacheLength := Must1(cache.Get("k")).Shape().Dim(1) // It may be different for each layer.
+	cacheSequencePosition := Mod(endIndex, Scalar(g, endIndex.DType(), cacheLength))
+	updateSliceIndices := []*Node{zeroIdx, cacheSequencePosition, zeroIdx, zeroIdx}
+
+	if _, found := cache.Map["k_scale"]; found {
+		// Quantized cache: values and their scales are updated separately.
+		scaleUpdateIndices := updateSliceIndices[:3]
+		var quantizedKeys, quantizedValues *Node
+		quantizedKeys, keyScales = quantizeCacheValues(keyProjection, Must1(cache.Get("k")).DType())
+		quantizedValues, valueScales = quantizeCacheValues(valueProjection, Must1(cache.Get("v")).DType())
+		quantizedKeys = DynamicUpdateSlice(Must1(cache.Get("k")), quantizedKeys, updateSliceIndices)
+		keyScales = DynamicUpdateSlice(Must1(cache.Get("k_scale")), keyScales, scaleUpdateIndices)
+		quantizedValues = DynamicUpdateSlice(Must1(cache.Get("v")), quantizedValues, updateSliceIndices)
+		valueScales = DynamicUpdateSlice(Must1(cache.Get("v_scale")), valueScales, scaleUpdateIndices)
+		Must(cache.Set(trees.Path{"k"}, quantizedKeys))
+		Must(cache.Set(trees.Path{"k_scale"}, keyScales))
+		Must(cache.Set(trees.Path{"v"}, quantizedValues))
+		Must(cache.Set(trees.Path{"v_scale"}, valueScales))
+		keys = ConvertDType(quantizedKeys, dtype)
+		values = ConvertDType(quantizedValues, dtype)
+	} else {
+		values = DynamicUpdateSlice(Must1(cache.Get("v")), valueProjection, updateSliceIndices)
+		keys = DynamicUpdateSlice(Must1(cache.Get("k")), keyProjection, updateSliceIndices)
+		Must(cache.Set(trees.Path{"v"}, values))
+		Must(cache.Set(trees.Path{"k"}, keys))
+	}
+
+	keyPositions = DynamicUpdateSlice(Must1(cache.Get("positions")), ConvertDType(positions, dtypes.Int32),
+		[]*Node{zeroIdx, cacheSequencePosition})
+	Must(cache.Set(trees.Path{"positions"}, keyPositions))
+
+	// Bump end_index the length of tokens provided at this step: typically, this will be only 1. Attention only
+	// accepts more than one if the cache never wraps around (it is Config.MaxCacheLength long).
+	Must(cache.Set(trees.Path{"end_index"}, AddScalar(endIndex, positions.Shape().Dim(-1))))
+	return
+}
+
 // Must panics if the error is not nil.
 func Must(err error) {
 	if err != nil {
@@ -57,9 +130,17 @@ func Must1[T any](v T, err error) T {
 //   - x is the operand shaped [batchSize, sequenceLength, embedDim]. If using cache, typically the sequenceLength will be 1.
 //   - positions are the positions of the sequence in x, shaped int32[batchSize, sequenceLength].
 //   - cache: if set, x is only used for the current token (so sequenceLength will be 1), and the x's key and value projections
-//     are set in the cache. After that, cache is used instead of x for the attention.
-//   - attentionMask: shaped bool[batchSize, sequenceLength, sequenceLength] (if cache is nil) or bool[batchSize, sequenceLength==1, config.MaxCacheLength] if
-//     cache is being used.
+//     are set in the cache. After that, cache is used instead of x for the attention. More than one token per step
+//     is only accepted if the cache is Config.MaxCacheLength long (see Config.CacheLength), since the tokens could
+//     otherwise overwrite the keys and values attended to by the previous ones when the cache wraps around.
+//     It can also be the cache of one layer of a PagedCache (see GemmaWithPagedCache).
+//   - attentionMask: shaped bool[batchSize, sequenceLength, sequenceLength], only used if cache is nil. If cache
+//     is being used, it must be nil: the mask is derived from the positions stored in the cache, since each layer
+//     may have a different cache length (see Config.CacheLength). If both cache and attentionMask are nil,
+//     a causal mask is derived from the positions (see CausalMask).
+//
+// If config.LoRA is set, LoRA adapters are added to the configured projections (see LoRAConfig).
+// Its attention weights can be captured, see StartCapture.
 func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positions *Node, cache *trees.Tree[*Node], attentionMask *Node) *Node {
 	g := x.Graph()
 	dtype := x.DType()
@@ -76,21 +157,18 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 	// K = config.NumKVHeads
 	if config.HuggingFaceVersion {
 		// HuggingFace version has separate variables per projection.
-		keyProjectionWeights := ctx.In("hf").
-			VariableWithShape("k_proj", shapes.Make(dtype, config.NumKVHeads*config.HeadDim, config.EmbedDim)).
-			ValueGraph(g)
+		keyProjectionWeights := weightsValue(ctx.In("hf"), g,
+			"k_proj", shapes.Make(dtype, config.NumKVHeads*config.HeadDim, config.EmbedDim))
 		keyProjectionWeights = Reshape(keyProjectionWeights, config.NumKVHeads, config.HeadDim, config.EmbedDim)
 		keyProjection = Einsum("BSD,KHD->BSKH", x, keyProjectionWeights)
 
-		valueProjectionWeights := ctx.In("hf").
-			VariableWithShape("v_proj", shapes.Make(dtype, config.NumKVHeads*config.HeadDim, config.EmbedDim)).
-			ValueGraph(g)
+		valueProjectionWeights := weightsValue(ctx.In("hf"), g,
+			"v_proj", shapes.Make(dtype, config.NumKVHeads*config.HeadDim, config.EmbedDim))
 		valueProjectionWeights = Reshape(valueProjectionWeights, config.NumKVHeads, config.HeadDim, config.EmbedDim)
 		valueProjection = Einsum("BSD,KHD->BSKH", x, valueProjectionWeights)
 
-		queryProjectionWeights := ctx.In("hf").
-			VariableWithShape("q_proj", shapes.Make(dtype, config.NumHeads*config.HeadDim, config.EmbedDim)).
-			ValueGraph(g)
+		queryProjectionWeights := weightsValue(ctx.In("hf"), g,
+			"q_proj", shapes.Make(dtype, config.NumHeads*config.HeadDim, config.EmbedDim))
 		queryProjectionWeights = Reshape(queryProjectionWeights, config.NumHeads, config.HeadDim, config.EmbedDim)
 		queryProjection = Einsum("BSD,NHD->BSNH", x, queryProjectionWeights)
 
@@ -111,29 +189,45 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 		valueProjection = Squeeze(Slice(kvProjections, AxisElem(1)), 0)
 	}
 
+	// LoRA adapters, if configured, are applied to the projections of all versions.
+	queryProjection = applyLoRA(ctx, config.LoRA, LoRATargetQuery, x, 1, queryProjection)
+	keyProjection = applyLoRA(ctx, config.LoRA, LoRATargetKey, x, 1, keyProjection)
+	valueProjection = applyLoRA(ctx, config.LoRA, LoRATargetValue, x, 1, valueProjection)
+
 	queryProjection = ApplyRotaryPositionEncoding(queryProjection, positions, RoPEDefaultMaxWaveLength)
 	queryScaled := MulScalar(queryProjection, config.QueryPreAttentionScalar())
 	keyProjection = ApplyRotaryPositionEncoding(keyProjection, positions, RoPEDefaultMaxWaveLength)
 
 	// If cache is set, update it with the projections of the slice of the sequence given, and then take the
 	// projections of the whole cache.
+	keyPositions := positions        // Absolute positions of the keys/values attended to.
+	var keyScales, valueScales *Node // Scales of the keys/values of a quantized cache, see scaleByCache.
 	if cache != nil {
-		// Insert calculated projections in cache: cached projections are shaped [batchSize, maxCacheLength, numHeads, headDim]
-		endIndex, err := cache.Get("end_index")
-		if err != nil {
-			panic(err)
+		if attentionMask != nil {
+			exceptions.Panicf("Attention() with cache requires attentionMask to be nil, since it is derived from the positions stored in the cache")
 		}
-		zeroIdx := ScalarZero(g, dtypes.Int32)
-		cacheSequencePosition := Mod(endIndex, Scalar(g, endIndex.DType(), config.MaxCacheLength))
-		updateSliceIndices := []*Node{zeroIdx, cacheSequencePosition, zeroIdx, zeroIdx}
-
-		valueProjection = DynamicUpdateSlice(Must1(cache.Get("v")), valueProjection, updateSliceIndices)
-		keyProjection = DynamicUpdateSlice(Must1(cache.Get("k")), keyProjection, updateSliceIndices)
-		Must(cache.Set(trees.Path{"v"}, valueProjection))
-		Must(cache.Set(trees.Path{"k"}, keyProjection))
-		// Bump end_index the length of tokens provided at this step: typically, this will be only 1. If > 1
-		// this will probably not work if the cache wraps around.
-		Must(cache.Set(trees.Path{"end_index"}, AddScalar(endIndex, positions.Shape().Dim(-1))))
+		if _, isPaged := cache.Map[pagedBlockTablesKey]; isPaged {
+			var windowSize int // Local sliding layers only gather the blocks of the window.
+			if config.AttentionTypes[attentionIdx] == AttentionTypeLocalSliding {
+				windowSize = config.SlidingWindowSize
+			}
+			keyProjection, valueProjection, keyScales, valueScales, keyPositions = updatePagedAttentionCache(cache,
+				keyProjection, valueProjection, positions, windowSize)
+		} else {
+			numTokens, cacheLength := positions.Shape().Dim(1), Must1(cache.Get("k")).Shape().Dim(1)
+			if numTokens > 1 && cacheLength < config.MaxCacheLength {
+				exceptions.Panicf("GemmaWithCache() got %d tokens per step, but the cache of layer %d (local sliding "+
+					"window attention) is a ring buffer of %d slots, shorter than Config.MaxCacheLength=%d: when it "+
+					"wraps around, the tokens of the step would overwrite keys and values still attended to by the "+
+					"previous tokens of the same step -- feed one token per step, or set Config.MaxCacheLength <= "+
+					"Config.SlidingWindowSize", numTokens, attentionIdx, cacheLength, config.MaxCacheLength)
+			}
+			keyProjection, valueProjection, keyScales, valueScales, keyPositions = updateAttentionCache(cache,
+				keyProjection, valueProjection, positions)
+		}
+		attentionMask = CausalMask(positions, keyPositions)
+	} else if attentionMask == nil {
+		attentionMask = CausalMask(positions, positions)
 	}
 
 	batchSize := queryScaled.Shape().Dim(0)               // B
@@ -141,7 +235,7 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 	numQueryHeads := queryScaled.Shape().Dim(2)           // N
 	headDim := queryScaled.Shape().Dim(3)                 // H
 	numKVHeads := config.NumKVHeads                       // K
-	attentionTargetLength := keyProjection.Shape().Dim(1) // S = config.MaxCacheLength if cache != nil, or seqLength.
+	attentionTargetLength := keyProjection.Shape().Dim(1) // S = config.CacheLength(attentionIdx) if cache != nil, or seqLength.
 
 	var logits *Node
 	if config.UseGroupQueryAttention {
@@ -150,27 +244,25 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 		queryPerKVHeads := numQueryHeads / numKVHeads // G
 		queryScaled = Reshape(queryScaled, batchSize, seqLength, numKVHeads, queryPerKVHeads, headDim)
 		logits = Einsum("BTKGH,BSKH->BTKGS", queryScaled, keyProjection)
+		logits = scaleByCache(logits, keyScales)
 		logits = Reshape(logits, batchSize, seqLength, numQueryHeads, attentionTargetLength)
 	} else {
 		// Same number of query/key projections.
 		// N = numQueryHeads == numKVHeads.
 		logits = Einsum("BTNH,BSNH->BTNS", queryScaled, keyProjection)
+		logits = scaleByCache(logits, keyScales)
 	}
-	logits.AssertDims(batchSize, seqLength, numQueryHeads, config.MaxCacheLength)
+	logits.AssertDims(batchSize, seqLength, numQueryHeads, attentionTargetLength)
 	logits = SoftCap(logits, config.AttentionLogitsSoftCap) // No-op if config.AttentionLogitsSoftCap is 0.
 
 	if config.AttentionTypes[attentionIdx] == AttentionTypeLocalSliding {
-		// Create a sliding mask: a mask that has a band (2*config.SlidingWindowSize) around the diagonal.
-		// Issue: this will not work when using cache, and the cache loops around its config.MaxCacheLength, since
-		//        the sliding mask "band" won't wrap around.
+		// Create a sliding mask: a band of width (2*config.SlidingWindowSize-1) around the query positions.
+		// It uses the absolute positions of the tokens (and not their slots in the cache), so it works even after
+		// the cache wraps around (see Config.CacheLength).
 		if config.SlidingWindowSize <= 0 {
 			exceptions.Panicf("Config.SlidingWindowSize must be set for AttentionTypeLocalSliding")
 		}
-		allOnes := OnesLike(attentionMask)
-		slidingMask := And(
-			TakeUpperTriangular(allOnes, 1-config.SlidingWindowSize),
-			TakeLowerTriangular(allOnes, config.SlidingWindowSize-1),
-		)
+		slidingMask := SlidingWindowMask(positions, keyPositions, config.SlidingWindowSize)
 		attentionMask = And(attentionMask, slidingMask)
 	}
 
@@ -182,6 +274,7 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 		Scalar(g, logits.DType(), logitsMask),
 	)
 	attentionWeights := Softmax(paddedLogits, -1)
+	capture(ctx, CaptureAttentionWeights, attentionIdx, attentionWeights)
 
 	// Weighted sum of the values:
 	var encoded *Node
@@ -189,20 +282,19 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 		// Reshape matrices to enable Einsums over groups of queries.
 		queryPerKVHeads := numQueryHeads / numKVHeads // G
 		attentionWeights = Reshape(attentionWeights, batchSize, seqLength, numKVHeads, queryPerKVHeads, attentionTargetLength)
-		encoded = Einsum("BTKGS,BSKH->BTKGH", attentionWeights, valueProjection)
+		encoded = Einsum("BTKGS,BSKH->BTKGH", scaleByCache(attentionWeights, valueScales), valueProjection)
 		encoded = Reshape(encoded, batchSize, seqLength, numQueryHeads, headDim)
 	} else {
 		// Plain attention: same number of query, keys and values projections.
-		encoded = Einsum("BTNS,BSNH->BTNH", attentionWeights, valueProjection)
+		encoded = Einsum("BTNS,BSNH->BTNH", scaleByCache(attentionWeights, valueScales), valueProjection)
 		encoded.AssertDims(batchSize, seqLength, numQueryHeads, headDim)
 	}
 
 	// Finally, a linear transformation on the result, merging all the heads.
 	var output *Node
 	if config.HuggingFaceVersion {
-		outputProjectionWeights := ctx.In("hf").
-			VariableWithShape("o_proj", shapes.Make(dtype, config.EmbedDim, config.NumHeads*config.HeadDim)).
-			ValueGraph(g)
+		outputProjectionWeights := weightsValue(ctx.In("hf"), g,
+			"o_proj", shapes.Make(dtype, config.EmbedDim, config.NumHeads*config.HeadDim))
 		outputProjectionWeights = Reshape(outputProjectionWeights, config.EmbedDim, numQueryHeads, config.HeadDim)
 		output = Einsum("BTNH,DNH->BTD", encoded, outputProjectionWeights)
 
@@ -211,5 +303,43 @@ func Attention(ctx *context.Context, config *Config, attentionIdx int, x, positi
 			encoded,
 			shapes.Make(encoded.DType(), numQueryHeads, config.HeadDim, config.EmbedDim))
 	}
+	output = applyLoRA(ctx, config.LoRA, LoRATargetOutput, encoded, 2, output)
 	return output
 }
+
+// CausalMask returns a mask that is true where the key position is <= than the query position, that is, each query
+// can only attend to itself and to the past. Key positions < 0 (empty cache slots) are always masked out.
+//
+//   - queryPositions: absolute positions of the queries, shaped [batchSize, sequenceLength].
+//   - keyPositions: absolute positions of the keys/values attended to, shaped [batchSize, attentionTargetLength].
+//     If using cache, these are the positions stored along with the cache.
+//
+// It returns a bool mask shaped [batchSize, sequenceLength, attentionTargetLength].
+func CausalMask(queryPositions, keyPositions *Node) *Node {
+	queryPositions = ConvertDType(queryPositions, dtypes.Int32)
+	keyPositions = ConvertDType(keyPositions, dtypes.Int32)
+	isPast := LessOrEqual(ExpandAxes(keyPositions, -2), ExpandAxes(queryPositions, -1))
+	return And(isPast, validKeysMask(keyPositions, isPast.Shape()))
+}
+
+// validKeysMask returns a mask that is false for the empty cache slots (key positions < 0), broadcast to the given shape.
+func validKeysMask(keyPositions *Node, shape shapes.Shape) *Node {
+	isValidKey := GreaterOrEqual(keyPositions, ScalarZero(keyPositions.Graph(), keyPositions.DType()))
+	return BroadcastToShape(ExpandAxes(isValidKey, -2), shape)
+}
+
+// SlidingWindowMask returns a mask that is true where the key position is within windowSize of the query position,
+// that is |queryPosition - keyPosition| < windowSize. Key positions < 0 (empty cache slots) are always masked out.
+//
+//   - queryPositions: absolute positions of the queries, shaped [batchSize, sequenceLength].
+//   - keyPositions: absolute positions of the keys/values attended to, shaped [batchSize, attentionTargetLength].
+//     If using cache, these are the positions stored along with the cache.
+//
+// It returns a bool mask shaped [batchSize, sequenceLength, attentionTargetLength].
+func SlidingWindowMask(queryPositions, keyPositions *Node, windowSize int) *Node {
+	queryPositions = ConvertDType(queryPositions, dtypes.Int32)
+	keyPositions = ConvertDType(keyPositions, dtypes.Int32)
+	distance := Abs(Sub(ExpandAxes(queryPositions, -1), ExpandAxes(keyPositions, -2)))
+	withinWindow := LessThan(distance, Scalar(distance.Graph(), dtypes.Int32, windowSize))
+	return And(withinWindow, validKeysMask(keyPositions, withinWindow.Shape()))
+}
@@ -0,0 +1,131 @@
+package transformers
+
+import (
+	"github.com/gomlx/gemma/internal/testutil"
+	"github.com/gomlx/gemma/trees"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"slices"
+	"testing"
+)
+
+func TestCreateAttentionCache(t *testing.T) {
+	for _, dtype := range []dtypes.DType{dtypes.Float32, dtypes.Int8} {
+		data := trees.New[*tensors.Tensor]()
+		require.NoError(t, createAttentionCache(data, trees.Path{"layer_0"}, dtype, 2, 3, 4, 5))
+		layerData := data.Map["layer_0"]
+		for _, name := range []string{"k", "v"} {
+			require.Equal(t, dtype, layerData.Map[name].Value.DType())
+			require.Equal(t, []int{2, 3, 4, 5}, layerData.Map[name].Value.Shape().Dimensions)
+		}
+		require.Equal(t, int32(0), layerData.Map["end_index"].Value.Value())
+		// All slots start empty.
+		require.Equal(t, [][]int32{{-1, -1, -1}, {-1, -1, -1}}, layerData.Map["positions"].Value.Value())
+
+		_, hasScales := layerData.Map["k_scale"]
+		require.Equal(t, dtype == dtypes.Int8, hasScales)
+		if hasScales {
+			require.Equal(t, []int{2, 3, 4}, layerData.Map["v_scale"].Value.Shape().Dimensions)
+		}
+	}
+}
+
+func TestAttentionMasks(t *testing.T) {
+	backend := testutil.Backend(t)
+	// One query per example, against the positions of a cache of length 4: the first example wrapped around after
+	// storing positions 0 to 5, the second only holds positions 0 and 1, and the other slots are empty (-1).
+	queryPositions := [][]int32{{5}, {1}}
+	keyPositions := [][]int32{{4, 5, 2, 3}, {0, 1, -1, -1}}
+	require.Equal(t, [][][]bool{{{true, true, true, true}}, {{true, true, false, false}}},
+		ExecOnce(backend, CausalMask, queryPositions, keyPositions).Value())
+	for _, tc := range []struct {
+		windowSize int
+		want       [][][]bool
+	}{
+		{3, [][][]bool{{{true, true, false, true}}, {{true, true, false, false}}}},
+		{1, [][][]bool{{{false, true, false, false}}, {{false, true, false, false}}}},
+	} {
+		got := ExecOnce(backend, func(queryPositions, keyPositions *Node) *Node {
+			return SlidingWindowMask(queryPositions, keyPositions, tc.windowSize)
+		}, queryPositions, keyPositions)
+		require.Equal(t, tc.want, got.Value(), "windowSize=%d", tc.windowSize)
+	}
+
+	// Without cache: the queries attend to themselves.
+	positions := [][]int32{{0, 1, 2}}
+	require.Equal(t, [][][]bool{{{true, false, false}, {true, true, false}, {true, true, true}}},
+		ExecOnce(backend, CausalMask, positions, positions).Value())
+	require.Equal(t, [][][]bool{{{true, true, false}, {true, true, true}, {false, true, true}}},
+		ExecOnce(backend, func(queryPositions, keyPositions *Node) *Node {
+			return SlidingWindowMask(queryPositions, keyPositions, 2)
+		}, positions, positions).Value())
+}
+
+// attentionCacheStep feeds one step of tokens with the given positions to the attention cache of "layer_0" in data,
+// with batchSize=numKVHeads=headDim=1, using the positions as the keys and values. It returns the keys (dequantized,
+// if the cache is quantized) and their positions, in the order of the slots of the cache.
+func attentionCacheStep(t *testing.T, backend backends.Backend, data *trees.Tree[*tensors.Tensor], positions []int32) (
+	keys []float32, keyPositions []int32) {
+	layerData := data.Map["layer_0"]
+	var names []string
+	for name := range layerData.Map {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	exec := NewExec(backend, func(inputs []*Node) []*Node {
+		layerCache := trees.New[*Node]()
+		for ii, name := range names {
+			Must(layerCache.Set(trees.Path{name}, inputs[ii]))
+		}
+		tokenPositions := inputs[len(names)]
+		projections := Reshape(ConvertDType(tokenPositions, dtypes.Float32), 1, tokenPositions.Shape().Dim(1), 1, 1)
+		keys, _, keyScales, _, keyPositions := updateAttentionCache(layerCache, projections, projections, tokenPositions)
+		if keyScales != nil {
+			keys = Mul(keys, ExpandAxes(keyScales, -1))
+		}
+		outputs := []*Node{Reshape(keys, keyPositions.Shape().Dim(1)), Reshape(keyPositions, keyPositions.Shape().Dim(1))}
+		for _, name := range names {
+			outputs = append(outputs, Must1(layerCache.Get(name)))
+		}
+		return outputs
+	})
+	var args []any
+	for _, name := range names {
+		args = append(args, layerData.Map[name].Value)
+	}
+	results := exec.Call(append(args, [][]int32{positions})...)
+	for ii, name := range names {
+		layerData.Map[name].Value = results[2+ii]
+	}
+	return tensors.CopyFlatData[float32](results[0]), results[1].Value().([]int32)
+}
+
+func TestUpdateAttentionCache(t *testing.T) {
+	backend := testutil.Backend(t)
+	for _, dtype := range []dtypes.DType{dtypes.Float32, dtypes.Int8} {
+		data := trees.New[*tensors.Tensor]()
+		require.NoError(t, createAttentionCache(data, trees.Path{"layer_0"}, dtype, 1, 4, 1, 1))
+
+		// Prompt of 3 tokens: the last slot is still empty.
+		keys, keyPositions := attentionCacheStep(t, backend, data, []int32{0, 1, 2})
+		require.Equal(t, []int32{0, 1, 2, -1}, keyPositions, "dtype %s", dtype)
+		require.InDeltaSlice(t, []float32{0, 1, 2, 0}, keys, 1e-4, "dtype %s", dtype)
+		require.Equal(t, int32(3), data.Map["layer_0"].Map["end_index"].Value.Value())
+
+		// One token at a time: the cache wraps around, overwriting the oldest slots, and the positions follow.
+		for _, want := range [][]int32{{0, 1, 2, 3}, {4, 1, 2, 3}, {4, 5, 2, 3}} {
+			position := slices.Max(want)
+			keys, keyPositions = attentionCacheStep(t, backend, data, []int32{position})
+			require.Equal(t, want, keyPositions, "dtype %s, position %d", dtype, position)
+			wantKeys := make([]float32, len(want))
+			for ii, p := range want {
+				wantKeys[ii] = float32(p)
+			}
+			require.InDeltaSlice(t, wantKeys, keys, 1e-4, "dtype %s, position %d", dtype, position)
+		}
+		require.Equal(t, int32(6), data.Map["layer_0"].Map["end_index"].Value.Value())
+	}
+}
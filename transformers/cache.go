@@ -3,7 +3,10 @@ package transformers
 import (
 	"fmt"
 	"github.com/gomlx/gemma/trees"
+	. "github.com/gomlx/gomlx/graph"
 	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
 )
 
 // Cache is a state cache of a (batch of) sequence being encoded/decoded.
@@ -14,7 +17,12 @@ import (
 // It's stored as a trees.Tree[*tensor.Tensor].
 //
 // For the Gemma2 model, the first level of the tree being the layer names,
-// and the second level hold the "keys" and "values" embedding caches for each transformer layer.
+// and the second level hold the "keys" and "values" embedding caches for each transformer layer, along with
+// the absolute "positions" of the tokens stored in each slot of the cache (-1 for empty slots), used to build
+// the attention masks, even after the cache wraps around.
+//
+// If Config.CacheDType is set to dtypes.Int8, the keys and values are stored quantized, and the tree also holds
+// their scales ("k_scale" and "v_scale"), one per token and head.
 type Cache struct {
 	// Config of the model.
 	Config *Config
@@ -24,13 +32,22 @@ type Cache struct {
 
 	// Length (in number of steps) of the cache. The cache itself is rotating on this size.
 	// It comes from config.MaxCacheLength.
+	//
+	// Layers using AttentionTypeLocalSliding use a smaller rotating cache, see Config.CacheLength.
 	Length int
 
 	// Data holds the cached data, organized as a trees.Tree[*tensors.Tensor].
 	Data *trees.Tree[*tensors.Tensor]
 }
 
+// NewCache creates a new Cache for the given model configuration and batch size.
+//
+// The cache is stored in Config.CacheDType, or Config.DType if the former is not set.
 func NewCache(config *Config, batchSize int) (*Cache, error) {
+	cacheDType, err := cacheDTypeFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
 	c := &Cache{
 		Config:    config,
 		BatchSize: batchSize,
@@ -40,7 +57,7 @@ func NewCache(config *Config, batchSize int) (*Cache, error) {
 
 	for layerIdx := range config.NumLayers {
 		treePath := []string{fmt.Sprintf("layer_%d", layerIdx)}
-		err := createAttentionCache(c.Data, treePath, config.DType, batchSize, config.MaxCacheLength,
+		err = createAttentionCache(c.Data, treePath, cacheDType, batchSize, config.CacheLength(layerIdx),
 			config.NumKVHeads, config.HeadDim)
 		if err != nil {
 			return nil, err
@@ -48,3 +65,60 @@ func NewCache(config *Config, batchSize int) (*Cache, error) {
 	}
 	return c, nil
 }
+
+// cacheDTypeFromConfig returns the dtype used to store the cache: Config.CacheDType, or Config.DType if the former
+// is not set.
+func cacheDTypeFromConfig(config *Config) (dtypes.DType, error) {
+	cacheDType := config.CacheDType
+	if cacheDType == dtypes.InvalidDType {
+		cacheDType = config.DType
+	}
+	if !cacheDType.IsFloat() && !isQuantizedCacheDType(cacheDType) {
+		return dtypes.InvalidDType, errors.Errorf("Config.CacheDType=%s not supported: only float dtypes, or %s for a "+
+			"quantized cache (fp8 dtypes are not yet supported by GoMLX tensors)", cacheDType, dtypes.Int8)
+	}
+	return cacheDType, nil
+}
+
+// cacheScaleDType is the dtype used for the scales of a quantized cache.
+const cacheScaleDType = dtypes.Float32
+
+// isQuantizedCacheDType returns whether the dtype used to store the cache requires quantization.
+func isQuantizedCacheDType(dtype dtypes.DType) bool {
+	return dtype == dtypes.Int8
+}
+
+// quantizeCacheValues quantizes x, shaped [batchSize, sequenceLength, numHeads, headDim], to the cacheDType, with a
+// symmetric scale per head, calculated from the maximum absolute value of each head.
+//
+// It returns the quantized values and the scales, shaped [batchSize, sequenceLength, numHeads].
+func quantizeCacheValues(x *Node, cacheDType dtypes.DType) (quantized, scales *Node) {
+	maxQuantized := 127.0 // dtypes.Int8
+	x = ConvertDType(x, cacheScaleDType)
+	scales = DivScalar(ReduceMax(Abs(x), -1), maxQuantized)
+	safeScales := MaxScalar(scales, 1e-12) // Avoid division by 0 for all-zero heads.
+	quantized = Round(Div(x, ExpandAxes(safeScales, -1)))
+	quantized = ClipScalar(quantized, -maxQuantized, maxQuantized)
+	quantized = ConvertDType(quantized, cacheDType)
+	return
+}
+
+// scaleByCache multiplies x, the attention logits or weights shaped [batchSize, sequenceLength, numKVHeads,
+// (queriesPerKVHead,) cacheLength], by the scales of the quantized keys or values of the cache (see
+// quantizeCacheValues), shaped [batchSize, cacheLength, numKVHeads]. It is a no-op if scales is nil.
+//
+// Since there is one scale per token and head, scaling the einsum over the quantized keys (or the attention weights
+// before the einsum over the quantized values) is equivalent to dequantizing the cache, but it only multiplies
+// [batchSize, sequenceLength, numHeads, cacheLength] values, instead of the whole cache, headDim times larger.
+func scaleByCache(x, scales *Node) *Node {
+	if scales == nil {
+		return x
+	}
+	scalesDims := make([]int, x.Rank())
+	for axis := range scalesDims {
+		scalesDims[axis] = 1
+	}
+	scalesDims[0], scalesDims[2], scalesDims[x.Rank()-1] = x.Shape().Dim(0), x.Shape().Dim(2), x.Shape().Dim(-1)
+	scales = Reshape(TransposeAllDims(ConvertDType(scales, x.DType()), 0, 2, 1), scalesDims...)
+	return Mul(x, BroadcastToShape(scales, x.Shape()))
+}
@@ -0,0 +1,76 @@
+package transformers
+
+import (
+	"fmt"
+	"github.com/gomlx/gemma/internal/testutil"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewCache(t *testing.T) {
+	config := &Config{Type: Gemma2_2B}
+	config.setGemma2_2B()
+	config.DType, config.NumKVHeads, config.HeadDim = dtypes.Float32, 1, 2
+	require.NoError(t, config.SetMaxCacheLength(8192))
+	cache, err := NewCache(config, 3)
+	require.NoError(t, err)
+	require.Equal(t, 8192, cache.Length)
+	for layerIdx := range config.NumLayers {
+		layerCache := cache.Data.Map[fmt.Sprintf("layer_%d", layerIdx)]
+		cacheLength := config.CacheLength(layerIdx) // 4096 for the local sliding (even) layers, 8192 for the global ones.
+		require.Equal(t, []int{3, cacheLength, 1, 2}, layerCache.Map["k"].Value.Shape().Dimensions, "layer %d", layerIdx)
+		require.Equal(t, []int{3, cacheLength, 1, 2}, layerCache.Map["v"].Value.Shape().Dimensions, "layer %d", layerIdx)
+		require.Equal(t, []int{3, cacheLength}, layerCache.Map["positions"].Value.Shape().Dimensions, "layer %d", layerIdx)
+	}
+	require.Equal(t, 4096, cache.Data.Map["layer_0"].Map["k"].Value.Shape().Dim(1))
+	require.Equal(t, 8192, cache.Data.Map["layer_1"].Map["k"].Value.Shape().Dim(1))
+}
+
+func TestScaleByCache(t *testing.T) {
+	backend := testutil.Backend(t)
+	// Query shaped [B=1, T=2, K=2, G=2, H=3], and cache with S=4 slots.
+	query := make([]float32, 2*2*2*3)
+	for ii := range query {
+		query[ii] = float32(ii%7) - 3
+	}
+	cached := make([]float32, 4*2*3)
+	for ii := range cached {
+		cached[ii] = float32(ii%5)*0.7 - 1.2
+	}
+	outputs := NewExec(backend, func(inputs []*Node) []*Node {
+		query := Reshape(inputs[0], 1, 2, 2, 2, 3)
+		cached := Reshape(inputs[1], 1, 4, 2, 3)
+		quantized, scales := quantizeCacheValues(cached, dtypes.Int8)
+		dequantized := Mul(ConvertDType(quantized, dtypes.Float32), ExpandAxes(scales, -1))
+		quantized = ConvertDType(quantized, dtypes.Float32)
+
+		// Logits: the scales of the keys applied after the einsum.
+		logits := Einsum("BTKGH,BSKH->BTKGS", query, dequantized)
+		scaledLogits := scaleByCache(Einsum("BTKGH,BSKH->BTKGS", query, quantized), scales)
+
+		// Weighted sum of the values: the scales of the values applied to the weights.
+		weights := Softmax(logits, -1)
+		encoded := Einsum("BTKGS,BSKH->BTKGH", weights, dequantized)
+		scaledEncoded := Einsum("BTKGS,BSKH->BTKGH", scaleByCache(weights, scales), quantized)
+
+		// Plain attention (G=1) is shaped [B, T, N, S].
+		plainQuery := Slice(query, AxisRange(), AxisRange(), AxisRange(), AxisElem(0))
+		plainQuery = Reshape(plainQuery, 1, 2, 2, 3)
+		plainLogits := Einsum("BTNH,BSNH->BTNS", plainQuery, dequantized)
+		scaledPlainLogits := scaleByCache(Einsum("BTNH,BSNH->BTNS", plainQuery, quantized), scales)
+		return []*Node{logits, scaledLogits, encoded, scaledEncoded, plainLogits, scaledPlainLogits}
+	}).Call(query, cached)
+	for ii := 0; ii < len(outputs); ii += 2 {
+		require.Equal(t, outputs[ii].Shape(), outputs[ii+1].Shape())
+		require.InDeltaSlice(t, tensors.CopyFlatData[float32](outputs[ii]), tensors.CopyFlatData[float32](outputs[ii+1]),
+			1e-4, "output #%d", ii/2)
+	}
+
+	// No scales: a no-op.
+	require.Equal(t, []float32{1, 2}, ExecOnce(backend, func(x *Node) *Node {
+		return scaleByCache(x, nil)
+	}, []float32{1, 2}).Value())
+}
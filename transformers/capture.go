@@ -0,0 +1,100 @@
+package transformers
+
+import (
+	"fmt"
+	"github.com/gomlx/gemma/trees"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"slices"
+)
+
+// CaptureGraphParam is the graph parameter (see context.Context.SetGraphParam) used by StartCapture to request
+// intermediary values of the model to be captured.
+const CaptureGraphParam = "transformers_capture"
+
+// Names of the captured values, see CaptureOptions.
+const (
+	CaptureEmbeddings       = "embeddings"
+	CaptureResidual         = "residual"
+	CaptureAttentionWeights = "attention_weights"
+	CaptureLogits           = "pre_softcap_logits"
+)
+
+// CaptureOptions selects which intermediary values of the model are captured, see StartCapture.
+type CaptureOptions struct {
+	// Residuals captures the embeddings of the tokens (under CaptureEmbeddings) and the output of each transformer
+	// block (the residual stream, under "layer_<idx>/residual"), all shaped [batchSize, sequenceLength, embedDim].
+	Residuals bool
+
+	// AttentionWeights captures the attention weights of each layer (under "layer_<idx>/attention_weights"), shaped
+	// [batchSize, sequenceLength, numHeads, attentionTargetLength], after masking and softmax.
+	// attentionTargetLength is the sequenceLength, or the cache length if using a cache.
+	AttentionWeights bool
+
+	// Logits captures the logits before the final soft-capping (under CaptureLogits),
+	// shaped [batchSize, sequenceLength, vocabularySize].
+	Logits bool
+
+	// Layers restricts the per-layer values captured to the given layers. If empty, all layers are captured.
+	Layers []int
+}
+
+// captureState is the value of the CaptureGraphParam.
+type captureState struct {
+	options  CaptureOptions
+	captured *trees.Tree[*Node]
+}
+
+// StartCapture configures the forward passes of the model (Gemma, GemmaWithCache or GemmaWithPagedCache) built in
+// the graph g with ctx (or any of its sub-scopes) to capture the intermediary values selected by options.
+//
+// It returns the tree where the captured values are stored as the model is built: it is empty until then. The
+// per-layer values are stored under "layer_<idx>". If the model is built more than once in the same graph, the
+// values of the last one are kept.
+//
+// Typically, the captured values are returned by the graph function along with the logits, for interpretability
+// tools (e.g.: the "logit lens") or debugging. See also GemmaWithCapture.
+func StartCapture(ctx *context.Context, g *Graph, options CaptureOptions) *trees.Tree[*Node] {
+	state := &captureState{options: options, captured: trees.New[*Node]()}
+	ctx.SetGraphParam(g, CaptureGraphParam, state)
+	return state.captured
+}
+
+// GemmaWithCapture is like Gemma, but it also returns the intermediary values selected by options. See StartCapture
+// for details.
+func GemmaWithCapture(ctx *context.Context, config *Config, tokens, positions, attentionMask *Node,
+	options CaptureOptions) (logits *Node, captured *trees.Tree[*Node]) {
+	captured = StartCapture(ctx, tokens.Graph(), options)
+	logits = Gemma(ctx, config, tokens, positions, attentionMask)
+	return
+}
+
+// capture stores the value x under the name, if it was selected by the options set with StartCapture.
+// layerIdx is the index of the layer for per-layer values, or -1 for the model values.
+func capture(ctx *context.Context, name string, layerIdx int, x *Node) {
+	stateValue, found := ctx.GetGraphParam(x.Graph(), CaptureGraphParam)
+	if !found {
+		return
+	}
+	state := stateValue.(*captureState)
+	var selected bool
+	switch name {
+	case CaptureEmbeddings, CaptureResidual:
+		selected = state.options.Residuals
+	case CaptureAttentionWeights:
+		selected = state.options.AttentionWeights
+	case CaptureLogits:
+		selected = state.options.Logits
+	}
+	if !selected {
+		return
+	}
+	treePath := trees.Path{name}
+	if layerIdx >= 0 {
+		if len(state.options.Layers) > 0 && !slices.Contains(state.options.Layers, layerIdx) {
+			return
+		}
+		treePath = trees.Path{fmt.Sprintf("layer_%d", layerIdx), name}
+	}
+	Must(state.captured.Set(treePath, x))
+}
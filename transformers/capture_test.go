@@ -0,0 +1,58 @@
+package transformers
+
+import (
+	"github.com/gomlx/gemma/internal/testutil"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestGemmaWithCapture(t *testing.T) {
+	backend := testutil.Backend(t)
+	config := tinyModelConfig()
+	ctx := newTinyModel(config)
+	tokens := [][]int32{{1, 4, 2, 3}}
+	positions := [][]int32{{0, 1, 2, 3}}
+	for _, tc := range []struct {
+		options CaptureOptions
+		paths   []string
+	}{
+		{CaptureOptions{Residuals: true}, []string{"embeddings", "layer_0/residual", "layer_1/residual"}},
+		{CaptureOptions{AttentionWeights: true}, []string{"layer_0/attention_weights", "layer_1/attention_weights"}},
+		{CaptureOptions{Logits: true}, []string{"pre_softcap_logits"}},
+		{CaptureOptions{Residuals: true, AttentionWeights: true, Logits: true, Layers: []int{1}},
+			[]string{"embeddings", "layer_1/attention_weights", "layer_1/residual", "pre_softcap_logits"}},
+	} {
+		// The captured values are returned after the logits, in the order of their paths.
+		var paths []string
+		outputs := context.NewExec(backend, ctx, func(ctx *context.Context, tokens, positions *Node) []*Node {
+			logits, captured := GemmaWithCapture(ctx, config, tokens, positions, nil, tc.options)
+			outputs := []*Node{logits}
+			for treePath, x := range captured.OrderedLeaves() {
+				paths = append(paths, strings.Join(treePath, "/"))
+				if treePath[len(treePath)-1] == CaptureLogits {
+					x = SoftCap(x, config.FinalLogitSoftCap)
+				}
+				outputs = append(outputs, x)
+			}
+			return outputs
+		}).Call(tokens, positions)
+		require.Equal(t, tc.paths, paths, "options %+v", tc.options)
+
+		for ii, treePath := range paths {
+			output := outputs[1+ii]
+			switch name := treePath[strings.LastIndex(treePath, "/")+1:]; name {
+			case CaptureEmbeddings, CaptureResidual:
+				require.Equal(t, []int{1, 4, config.EmbedDim}, output.Shape().Dimensions, treePath)
+			case CaptureAttentionWeights:
+				require.Equal(t, []int{1, 4, config.NumHeads, 4}, output.Shape().Dimensions, treePath)
+			case CaptureLogits:
+				// Soft-capping the captured logits gives the logits returned by the model.
+				require.Equal(t, []int{1, 4, config.VocabularySize}, output.Shape().Dimensions, treePath)
+				require.Equal(t, outputs[0].Value(), output.Value())
+			}
+		}
+	}
+}
@@ -55,6 +55,9 @@ const (
 	QueryNormTypeByOneOverSqrtEmbedDimDivNumHeads
 )
 
+// DefaultMaxCacheLength is the default value for Config.MaxCacheLength. It can be changed up to Config.MaxSequenceLength.
+const DefaultMaxCacheLength = 1024
+
 // Config Gemma transformer model.
 type Config struct {
 	Type                GemmaType
@@ -74,8 +77,22 @@ type Config struct {
 	UseQKV, UseGroupQueryAttention       bool
 	UsePostAttentionNorm, UsePostFFWNorm bool
 
-	AttentionTypes        []AttentionType
-	MaxCacheLength        int
+	AttentionTypes []AttentionType
+
+	// MaxCacheLength is the length of the attention cache used when sampling, and it limits the number of tokens
+	// (prompt plus generated) of a sequence. It defaults to DefaultMaxCacheLength, and it can be at most MaxSequenceLength.
+	MaxCacheLength int
+
+	// MaxSequenceLength is the maximum sequence length (context) the model was trained with.
+	MaxSequenceLength int
+
+	// CacheDType is the dtype used to store the attention cache. If not set (dtypes.InvalidDType) it uses DType.
+	//
+	// If set to dtypes.Int8, keys and values are quantized to int8 when inserted in the cache, with one scale per
+	// token and head. The scales are applied to the attention logits and weights, so the cache is never dequantized
+	// as a whole. It uses ~half the memory of a BFloat16 cache. See SetCacheDType.
+	CacheDType dtypes.DType
+
 	QueryPreAttentionNorm QueryPreAttentionNormalisationType
 
 	// AttentionLogitsSoftCap limits the attention logits (logits = AttentionLogitsSoftCap * tanh(logits/AttentionLogitsSoftCap)).
@@ -83,24 +100,34 @@ type Config struct {
 	AttentionLogitsSoftCap float64
 	SlidingWindowSize      int
 	TransposeGatingEinsum  bool
+
+	// LoRA configures LoRA adapters added to the linear projections of the attention and feed-forward layers.
+	// If nil (the default), no adapters are used. See LoRAConfig.
+	LoRA *LoRAConfig
 }
 
 // NewConfigFromContext creates a transformers config model, based on the structure of the variables in the given context -- the scope
 // has to be set directly to the model variables.
 func NewConfigFromContext(ctx *context.Context) (*Config, error) {
 	c := &Config{
-		MaxCacheLength:        1024,
+		MaxCacheLength:        DefaultMaxCacheLength,
 		QueryPreAttentionNorm: QueryNormTypeByOneOverSqrtHeadDim,
 	}
 
 	embedTable := ctx.In("embedder").GetVariable("input_embedding")
+	isQuantized := false
+	if embedTable == nil {
+		// Check whether it was quantized.
+		embedTable = ctx.In("embedder").GetVariable("input_embedding" + int8WeightsSuffix)
+		isQuantized = true
+	}
 	if embedTable == nil {
 		return nil, errors.New("context given doesn't have an embedding table defined in \"embedder/input_embedding\"")
 	}
 
 	c.DType = embedTable.Shape().DType
 	c.VocabularySize = embedTable.Shape().Dim(0)
-	c.HuggingFaceVersion = c.VocabularySize == 256000 // Kaggle version is 256128.
+	c.HuggingFaceVersion = c.VocabularySize == HuggingFaceVocabularySize // Kaggle version is padded to KaggleVocabularySize.
 
 	// Find number of layers.
 	for {
@@ -110,6 +137,10 @@ func NewConfigFromContext(ctx *context.Context) (*Config, error) {
 		}
 		c.NumLayers++
 	}
+	if isQuantized && c.NumLayers > 0 {
+		// The model dtype is taken from the (never quantized) normalization scales instead.
+		c.DType = ctx.In("layer_0").In("pre_attention_norm").GetVariable("scale").Shape().DType
+	}
 	if t, found := numLayersToGemmaClass[c.NumLayers]; found {
 		c.Type = t
 	}
@@ -121,6 +152,7 @@ func NewConfigFromContext(ctx *context.Context) (*Config, error) {
 		return nil, errors.Errorf("unknown or not implemented for Gemma model type %q", c.Type)
 	}
 
+	c.MaxCacheLength = min(c.MaxCacheLength, c.MaxSequenceLength)
 	c.UseQKV = c.NumKVHeads == c.NumHeads
 	c.UseGroupQueryAttention = (c.NumKVHeads != c.NumHeads) && c.NumKVHeads > 1
 	return c, nil
@@ -144,6 +176,43 @@ func (c *Config) setGemma2_2B() {
 	c.QueryPreAttentionNorm = QueryNormTypeByOneOverSqrtHeadDim
 	c.AttentionLogitsSoftCap = 50.0
 	c.SlidingWindowSize = 4096
+	c.MaxSequenceLength = 8192
+}
+
+// SetMaxCacheLength sets MaxCacheLength, after checking that it is > 0 and <= MaxSequenceLength.
+func (c *Config) SetMaxCacheLength(length int) error {
+	if length <= 0 {
+		return errors.Errorf("invalid cache length %d, it must be > 0", length)
+	}
+	if length > c.MaxSequenceLength {
+		return errors.Errorf("cache length %d is larger than the maximum sequence length (%d) the model %s was trained with",
+			length, c.MaxSequenceLength, c.Type)
+	}
+	c.MaxCacheLength = length
+	return nil
+}
+
+// SetCacheDType sets CacheDType, after checking that it is either DType or dtypes.Int8 (a quantized cache).
+func (c *Config) SetCacheDType(dtype dtypes.DType) error {
+	if dtype != c.DType && dtype != dtypes.Int8 {
+		return errors.Errorf("cache dtype %s not supported for model %s: it must be the model dtype %s, or %s for a "+
+			"quantized cache", dtype, c.Type, c.DType, dtypes.Int8)
+	}
+	c.CacheDType = dtype
+	return nil
+}
+
+// CacheLength returns the length of the rotating attention cache for the layer layerIdx.
+//
+// Layers using AttentionTypeLocalSliding only attend to the last SlidingWindowSize tokens, so they use a
+// ring buffer of that size, if it is smaller than MaxCacheLength. In that case GemmaWithCache only accepts one
+// token per step.
+func (c *Config) CacheLength(layerIdx int) int {
+	if c.AttentionTypes[layerIdx] == AttentionTypeLocalSliding &&
+		c.SlidingWindowSize > 0 && c.SlidingWindowSize < c.MaxCacheLength {
+		return c.SlidingWindowSize
+	}
+	return c.MaxCacheLength
 }
 
 // QueryPreAttentionScalar is a multiplier to the query projections.
@@ -0,0 +1,85 @@
+package transformers
+
+import (
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSetMaxCacheLength(t *testing.T) {
+	for _, tc := range []struct {
+		length int
+		err    string
+	}{
+		{-1, "invalid cache length -1, it must be > 0"},
+		{0, "invalid cache length 0, it must be > 0"},
+		{1, ""},
+		{2048, ""},
+		{8192, ""}, // Exactly MaxSequenceLength.
+		{8193, "cache length 8193 is larger than the maximum sequence length (8192) the model gemma2_2b was trained with"},
+	} {
+		config := &Config{Type: Gemma2_2B}
+		config.setGemma2_2B()
+		config.MaxCacheLength = DefaultMaxCacheLength
+		err := config.SetMaxCacheLength(tc.length)
+		if tc.err != "" {
+			require.EqualError(t, err, tc.err, "length %d", tc.length)
+			require.Equal(t, DefaultMaxCacheLength, config.MaxCacheLength, "length %d", tc.length)
+			continue
+		}
+		require.NoError(t, err, "length %d", tc.length)
+		require.Equal(t, tc.length, config.MaxCacheLength)
+	}
+}
+
+func TestSetCacheDType(t *testing.T) {
+	for _, tc := range []struct {
+		dtype dtypes.DType
+		err   string
+	}{
+		{dtypes.BFloat16, ""},
+		{dtypes.Int8, ""},
+		{dtypes.Float32, "it must be the model dtype BFloat16, or Int8"},
+		{dtypes.Int16, "cache dtype Int16 not supported"},
+		{dtypes.InvalidDType, "not supported"},
+	} {
+		config := &Config{Type: Gemma_2B, DType: dtypes.BFloat16}
+		err := config.SetCacheDType(tc.dtype)
+		if tc.err != "" {
+			require.ErrorContains(t, err, tc.err, "dtype %s", tc.dtype)
+			require.Equal(t, dtypes.InvalidDType, config.CacheDType)
+			continue
+		}
+		require.NoError(t, err, "dtype %s", tc.dtype)
+		require.Equal(t, tc.dtype, config.CacheDType)
+	}
+}
+
+func TestCacheLength(t *testing.T) {
+	// Gemma2 alternates local sliding (even layers) and global (odd layers) attention, with a window of 4096.
+	for _, tc := range []struct {
+		maxCacheLength, slidingWindowSize int
+		local, global                     int
+	}{
+		{1024, 4096, 1024, 1024}, // Window larger than the cache.
+		{4096, 4096, 4096, 4096}, // Window equal to the cache.
+		{4097, 4096, 4096, 4097},
+		{8192, 4096, 4096, 8192},
+		{8192, 0, 8192, 8192}, // No sliding window.
+	} {
+		config := &Config{Type: Gemma2_2B}
+		config.setGemma2_2B()
+		config.MaxCacheLength, config.SlidingWindowSize = tc.maxCacheLength, tc.slidingWindowSize
+		for layerIdx := range config.NumLayers {
+			want := tc.global
+			if layerIdx%2 == 0 {
+				require.Equal(t, AttentionTypeLocalSliding, config.AttentionTypes[layerIdx])
+				want = tc.local
+			} else {
+				require.Equal(t, AttentionTypeGlobal, config.AttentionTypes[layerIdx])
+			}
+			require.Equal(t, want, config.CacheLength(layerIdx), "MaxCacheLength=%d, SlidingWindowSize=%d, layer %d",
+				tc.maxCacheLength, tc.slidingWindowSize, layerIdx)
+		}
+	}
+}
@@ -20,19 +20,22 @@ func SoftCap(x *Node, cap float64) *Node {
 }
 
 // KernelEinsum multiplies the input by a kernel of the given shape, using the given graph.EinSum equation.
+//
+// If the kernel was quantized (see QuantizeWeightsInt8 and QuantizeWeightsQ4), it is dequantized on the fly.
 func KernelEinsum(ctx *context.Context, equation string, x *Node, kernelShape shapes.Shape) *Node {
 	g := x.Graph()
-	kernelVar := ctx.VariableWithShape("w", kernelShape)
-	kernel := kernelVar.ValueGraph(g)
+	kernel := weightsValue(ctx, g, "w", kernelShape)
 	return Einsum(equation, x, kernel)
 }
 
+// RMSNormEpsilon is the epsilon used by RMSNorm, for numerical stability.
+const RMSNormEpsilon = 1e-6
+
 // RMSNorm normalizes by its root-mean-square x = x / √(mean(sqrt(x), axis=-1) + epsilon) and applies a learned scale.
 func RMSNorm(ctx *context.Context, x *Node) *Node {
 	g := x.Graph()
 	variance := ReduceAndKeep(Square(x), ReduceMean, -1)
-	const epsilon = 1e-6
-	normalizedX := Mul(x, Rsqrt(AddScalar(variance, epsilon)))
+	normalizedX := Mul(x, Rsqrt(AddScalar(variance, RMSNormEpsilon)))
 
 	// Now apply a learned scale.
 	scaleVar := ctx.WithInitializer(initializers.Zero).
@@ -101,36 +104,38 @@ func ApplyRotaryPositionEncoding(operand, positions *Node, maxWaveLength int) *N
 // - hiddenDim: one intermediary layer.
 // - transposeGatingEinsum: for some versions of Gemma, the gating (hidden) weights have the axes transposed.
 // - It uses Gelu as activation function for the gating signal (multiplied by the up-projected values).
-func GatedFeedForward(ctx *context.Context, x *Node, hiddenDim int, transposeGatingEinsum bool) *Node {
+// - Quantized weights (see QuantizeWeightsInt8 and QuantizeWeightsQ4) are dequantized on the fly.
+// - lora: if not nil, LoRA adapters are added to the configured projections (see LoRAConfig).
+func GatedFeedForward(ctx *context.Context, x *Node, hiddenDim int, transposeGatingEinsum bool, lora *LoRAConfig) *Node {
 	g := x.Graph()
 	featuresDim := x.Shape().Dim(-1)
 
 	var gatingWeights *Node
 	if transposeGatingEinsum {
 		// Some versions of Gemma use an alternate parameter ordering that transposes hiddenDim and outputDim.
-		gatingVar := ctx.WithInitializer(initializers.Zero).
-			VariableWithShape("gating_einsum", shapes.Make(x.DType(), 2, hiddenDim, featuresDim))
-		gatingWeights = gatingVar.ValueGraph(g)
+		gatingWeights = weightsValue(ctx.WithInitializer(initializers.Zero), g,
+			"gating_einsum", shapes.Make(x.DType(), 2, hiddenDim, featuresDim))
 		gatingWeights = Transpose(gatingWeights, 1, 2)
 	} else {
 		// Standard shape of the gating weights.
-		gatingVar := ctx.WithInitializer(initializers.Zero).
-			VariableWithShape("gating_einsum", shapes.Make(x.DType(), 2, featuresDim, hiddenDim))
-		gatingWeights = gatingVar.ValueGraph(g)
+		gatingWeights = weightsValue(ctx.WithInitializer(initializers.Zero), g,
+			"gating_einsum", shapes.Make(x.DType(), 2, featuresDim, hiddenDim))
 	}
 	gatingWeights0 := Squeeze(Slice(gatingWeights, AxisElem(0)), 0)
 	gatingWeights1 := Squeeze(Slice(gatingWeights, AxisElem(1)), 0)
 
 	gateValue := DotGeneral(x, []int{-1}, nil, gatingWeights0, []int{0}, nil)
+	gateValue = applyLoRA(ctx, lora, LoRATargetGate, x, 1, gateValue)
 	gateValue = activations.Gelu(gateValue)
 
 	upProjection := DotGeneral(x, []int{-1}, nil, gatingWeights1, []int{0}, nil)
+	upProjection = applyLoRA(ctx, lora, LoRATargetUp, x, 1, upProjection)
 	upProjection = Mul(gateValue, upProjection) // Gate upProjection.
 
-	downProjectionVar := ctx.WithInitializer(initializers.Zero).
-		VariableWithShape("linear", shapes.Make(x.DType(), hiddenDim, featuresDim))
-	downProjectionWeights := downProjectionVar.ValueGraph(g)
+	downProjectionWeights := weightsValue(ctx.WithInitializer(initializers.Zero), g,
+		"linear", shapes.Make(x.DType(), hiddenDim, featuresDim))
 	output := DotGeneral(upProjection, []int{-1}, nil, downProjectionWeights, []int{0}, nil)
+	output = applyLoRA(ctx, lora, LoRATargetDown, upProjection, 1, output)
 	return output
 }
 
@@ -138,27 +143,30 @@ func GatedFeedForward(ctx *context.Context, x *Node, hiddenDim int, transposeGat
 // - hiddenDim: one intermediary layer.
 // - transposeGatingEinsum: for some versions of Gemma, the gating (hidden) weights have the axes transposed.
 // - It uses Gelu as activation function for the gating signal (multiplied by the up-projected values).
-func HuggingFaceGatedFeedForward(ctx *context.Context, x *Node, hiddenDim int, transposeGatingEinsum bool) *Node {
+// - Quantized weights (see QuantizeWeightsInt8 and QuantizeWeightsQ4) are dequantized on the fly.
+// - lora: if not nil, LoRA adapters are added to the configured projections (see LoRAConfig).
+func HuggingFaceGatedFeedForward(ctx *context.Context, x *Node, hiddenDim int, transposeGatingEinsum bool, lora *LoRAConfig) *Node {
+	loraCtx := ctx
 	ctx = ctx.In("hf") // extra-scope for HuggingFace version.
 	g := x.Graph()
 	featuresDim := x.Shape().Dim(-1)
 
-	gatingProjVar := ctx.WithInitializer(initializers.Zero).
-		VariableWithShape("gating_proj", shapes.Make(x.DType(), hiddenDim, featuresDim))
-	gatingWeights := gatingProjVar.ValueGraph(g)
-	upProjectionVar := ctx.WithInitializer(initializers.Zero).
-		VariableWithShape("up_proj", shapes.Make(x.DType(), hiddenDim, featuresDim))
-	upProjectionWeights := upProjectionVar.ValueGraph(g)
+	gatingWeights := weightsValue(ctx.WithInitializer(initializers.Zero), g,
+		"gating_proj", shapes.Make(x.DType(), hiddenDim, featuresDim))
+	upProjectionWeights := weightsValue(ctx.WithInitializer(initializers.Zero), g,
+		"up_proj", shapes.Make(x.DType(), hiddenDim, featuresDim))
 
 	gateValue := DotGeneral(x, []int{-1}, nil, gatingWeights, []int{1}, nil)
+	gateValue = applyLoRA(loraCtx, lora, LoRATargetGate, x, 1, gateValue)
 	gateValue = activations.Gelu(gateValue)
 
 	upProjection := DotGeneral(x, []int{-1}, nil, upProjectionWeights, []int{1}, nil)
+	upProjection = applyLoRA(loraCtx, lora, LoRATargetUp, x, 1, upProjection)
 	upProjection = Mul(gateValue, upProjection) // Gate upProjection.
 
-	downProjectionVar := ctx.WithInitializer(initializers.Zero).
-		VariableWithShape("down_proj", shapes.Make(x.DType(), featuresDim, hiddenDim))
-	downProjectionWeights := downProjectionVar.ValueGraph(g)
+	downProjectionWeights := weightsValue(ctx.WithInitializer(initializers.Zero), g,
+		"down_proj", shapes.Make(x.DType(), featuresDim, hiddenDim))
 	output := DotGeneral(upProjection, []int{-1}, nil, downProjectionWeights, []int{1}, nil)
+	output = applyLoRA(loraCtx, lora, LoRATargetDown, upProjection, 1, output)
 	return output
 }
@@ -0,0 +1,377 @@
+package transformers
+
+import (
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/pkg/errors"
+	"slices"
+)
+
+// The Kaggle checkpoints pad the embedding table (the vocabulary) to a multiple of 128 rows, while the
+// HuggingFace checkpoints only include the rows of the tokens in the vocabulary.
+const (
+	KaggleVocabularySize      = 256128
+	HuggingFaceVocabularySize = 256000
+)
+
+// ConvertToHuggingFaceLayout rewrites the model variables in ctx (the scope has to be set directly to the model
+// variables, see NewConfigFromContext) from the Kaggle layout (the "*_einsum" variables) to the HuggingFace layout
+// (the "hf/*_proj" variables), and updates config accordingly. The embedding table is truncated to the
+// HuggingFace vocabulary size.
+//
+// The conversion is done in the host, one layer at a time, and it preserves the dtype and whether the variables
+// are trainable. LoRA adapters are not affected, since they are the same in both layouts.
+//
+// The weights must not be quantized: convert the layout first, and then quantize (see QuantizeWeightsInt8 and
+// QuantizeWeightsQ4).
+func ConvertToHuggingFaceLayout(ctx *context.Context, config *Config) error {
+	if config.HuggingFaceVersion {
+		return errors.New("ConvertToHuggingFaceLayout(): model is already in the HuggingFace layout")
+	}
+	if err := checkLayoutVariables(ctx, config); err != nil {
+		return errors.WithMessage(err, "ConvertToHuggingFaceLayout()")
+	}
+	for layerIdx := range config.NumLayers {
+		if err := convertLayerToHuggingFaceLayout(ctx.Inf("layer_%d", layerIdx).Checked(false), config); err != nil {
+			return errors.WithMessagef(err, "ConvertToHuggingFaceLayout(): layer #%d", layerIdx)
+		}
+	}
+	if err := resizeEmbeddingTable(ctx, config, HuggingFaceVocabularySize); err != nil {
+		return errors.WithMessage(err, "ConvertToHuggingFaceLayout()")
+	}
+	config.HuggingFaceVersion = true
+	return nil
+}
+
+// ConvertToKaggleLayout rewrites the model variables in ctx (the scope has to be set directly to the model
+// variables, see NewConfigFromContext) from the HuggingFace layout (the "hf/*_proj" variables) to the Kaggle layout
+// (the "*_einsum" variables), and updates config accordingly. The embedding table is padded with zeros to the
+// Kaggle vocabulary size.
+//
+// It is the inverse of ConvertToHuggingFaceLayout, and the same observations apply.
+func ConvertToKaggleLayout(ctx *context.Context, config *Config) error {
+	if !config.HuggingFaceVersion {
+		return errors.New("ConvertToKaggleLayout(): model is already in the Kaggle layout")
+	}
+	if err := checkLayoutVariables(ctx, config); err != nil {
+		return errors.WithMessage(err, "ConvertToKaggleLayout()")
+	}
+	for layerIdx := range config.NumLayers {
+		if err := convertLayerToKaggleLayout(ctx.Inf("layer_%d", layerIdx).Checked(false), config); err != nil {
+			return errors.WithMessagef(err, "ConvertToKaggleLayout(): layer #%d", layerIdx)
+		}
+	}
+	if err := resizeEmbeddingTable(ctx, config, KaggleVocabularySize); err != nil {
+		return errors.WithMessage(err, "ConvertToKaggleLayout()")
+	}
+	config.HuggingFaceVersion = false
+	return nil
+}
+
+// checkLayoutVariables checks that all the variables that depend on the layout exist and are not quantized,
+// before any of them is changed.
+func checkLayoutVariables(ctx *context.Context, config *Config) error {
+	for _, weights := range listQuantizableWeights(config) {
+		scopedCtx := ctx
+		for _, p := range weights.scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		if scopedCtx.GetVariable(weights.name) != nil {
+			continue
+		}
+		if scopedCtx.GetVariable(weights.name+int8WeightsSuffix) != nil ||
+			scopedCtx.GetVariable(weights.name+q4WeightsSuffix) != nil {
+			return errors.Errorf("variable %q in scope %q is quantized, the layout must be converted before quantization",
+				weights.name, scopedCtx.Scope())
+		}
+		return errors.Errorf("variable %q not found in scope %q", weights.name, scopedCtx.Scope())
+	}
+	return nil
+}
+
+// convertLayerToHuggingFaceLayout converts the variables of one layer, see ConvertToHuggingFaceLayout.
+func convertLayerToHuggingFaceLayout(layerCtx *context.Context, config *Config) error {
+	attnCtx, mlpCtx := layerCtx.In("attn"), layerCtx.In("mlp")
+	hfAttnCtx, hfMLPCtx := attnCtx.In("hf"), mlpCtx.In("hf")
+
+	// Query, key and value projections: from [N, D, H] to [N*H, D].
+	var projections []*tensors.Tensor
+	var trainable bool
+	if config.UseQKV {
+		qkv := takeVariable(attnCtx.In("qkv_einsum"), "w", &trainable) // [3, N, D, H]
+		for ii := range 3 {
+			projections = append(projections, sliceFirstAxis(qkv, ii))
+		}
+	} else {
+		projections = append(projections, takeVariable(attnCtx.In("q_einsum"), "w", &trainable)) // [N, D, H]
+		kv := takeVariable(attnCtx.In("kv_einsum"), "w", &trainable)                             // [2, K, D, H]
+		projections = append(projections, sliceFirstAxis(kv, 0), sliceFirstAxis(kv, 1))
+	}
+	for ii, name := range []string{"q_proj", "k_proj", "v_proj"} {
+		if projections[ii].Shape().Rank() != 3 {
+			return errors.Errorf("%s weights shaped %s, expected rank 3", name, projections[ii].Shape())
+		}
+		projection, err := TransposeTensor(projections[ii], []int{0, 2, 1})
+		if err != nil {
+			return err
+		}
+		dims := projection.Shape().Dimensions
+		setLayoutVariable(hfAttnCtx, name, reshapeTensor(projection, dims[0]*dims[1], dims[2]), trainable)
+	}
+
+	// Output projection: from [N, H, D] to [D, N*H].
+	output, err := TransposeTensor(takeVariable(attnCtx.In("attn_vec_einsum"), "w", &trainable), []int{2, 0, 1})
+	if err != nil {
+		return errors.WithMessage(err, "attn_vec_einsum weights")
+	}
+	dims := output.Shape().Dimensions
+	setLayoutVariable(hfAttnCtx, "o_proj", reshapeTensor(output, dims[0], dims[1]*dims[2]), trainable)
+
+	// Gating and up projections: from [2, D, F] (or [2, F, D] if transposed) to [F, D].
+	gating := takeVariable(mlpCtx, "gating_einsum", &trainable)
+	if gating.Shape().Rank() != 3 || gating.Shape().Dim(0) != 2 {
+		return errors.Errorf("gating_einsum weights shaped %s, expected [2, D, F] or [2, F, D]", gating.Shape())
+	}
+	for ii, name := range []string{"gating_proj", "up_proj"} {
+		projection := sliceFirstAxis(gating, ii)
+		if !config.TransposeGatingEinsum {
+			projection, err = TransposeTensor(projection, []int{1, 0})
+			if err != nil {
+				return err
+			}
+		}
+		setLayoutVariable(hfMLPCtx, name, projection, trainable)
+	}
+
+	// Down projection: from [F, D] to [D, F].
+	down, err := TransposeTensor(takeVariable(mlpCtx, "linear", &trainable), []int{1, 0})
+	if err != nil {
+		return errors.WithMessage(err, "linear weights")
+	}
+	setLayoutVariable(hfMLPCtx, "down_proj", down, trainable)
+	return nil
+}
+
+// convertLayerToKaggleLayout converts the variables of one layer, see ConvertToKaggleLayout.
+func convertLayerToKaggleLayout(layerCtx *context.Context, config *Config) error {
+	attnCtx, mlpCtx := layerCtx.In("attn"), layerCtx.In("mlp")
+	hfAttnCtx, hfMLPCtx := attnCtx.In("hf"), mlpCtx.In("hf")
+
+	// Query, key and value projections: from [N*H, D] to [N, D, H].
+	var projections []*tensors.Tensor
+	var trainable bool
+	for _, name := range []string{"q_proj", "k_proj", "v_proj"} {
+		projection := takeVariable(hfAttnCtx, name, &trainable)
+		dims := projection.Shape().Dimensions
+		if len(dims) != 2 || dims[0]%config.HeadDim != 0 {
+			return errors.Errorf("%s weights shaped %s, expected [N*H, D] with H=%d", name, projection.Shape(), config.HeadDim)
+		}
+		projection, err := TransposeTensor(
+			reshapeTensor(projection, dims[0]/config.HeadDim, config.HeadDim, dims[1]), []int{0, 2, 1})
+		if err != nil {
+			return err
+		}
+		projections = append(projections, projection)
+	}
+	if config.UseQKV {
+		qkv, err := stackTensors(projections...)
+		if err != nil {
+			return errors.WithMessage(err, "qkv_einsum weights")
+		}
+		setLayoutVariable(attnCtx.In("qkv_einsum"), "w", qkv, trainable)
+	} else {
+		setLayoutVariable(attnCtx.In("q_einsum"), "w", projections[0], trainable)
+		kv, err := stackTensors(projections[1:]...)
+		if err != nil {
+			return errors.WithMessage(err, "kv_einsum weights")
+		}
+		setLayoutVariable(attnCtx.In("kv_einsum"), "w", kv, trainable)
+	}
+
+	// Output projection: from [D, N*H] to [N, H, D].
+	output := takeVariable(hfAttnCtx, "o_proj", &trainable)
+	dims := output.Shape().Dimensions
+	if len(dims) != 2 || dims[1]%config.HeadDim != 0 {
+		return errors.Errorf("o_proj weights shaped %s, expected [D, N*H] with H=%d", output.Shape(), config.HeadDim)
+	}
+	output, err := TransposeTensor(reshapeTensor(output, dims[0], dims[1]/config.HeadDim, config.HeadDim), []int{1, 2, 0})
+	if err != nil {
+		return err
+	}
+	setLayoutVariable(attnCtx.In("attn_vec_einsum"), "w", output, trainable)
+
+	// Gating and up projections: from [F, D] to [2, D, F] (or [2, F, D] if transposed).
+	var gating []*tensors.Tensor
+	for _, name := range []string{"gating_proj", "up_proj"} {
+		projection := takeVariable(hfMLPCtx, name, &trainable)
+		if !config.TransposeGatingEinsum {
+			projection, err = TransposeTensor(projection, []int{1, 0})
+			if err != nil {
+				return errors.WithMessagef(err, "%s weights", name)
+			}
+		}
+		gating = append(gating, projection)
+	}
+	gatingEinsum, err := stackTensors(gating...)
+	if err != nil {
+		return errors.WithMessage(err, "gating_einsum weights")
+	}
+	setLayoutVariable(mlpCtx, "gating_einsum", gatingEinsum, trainable)
+
+	// Down projection: from [D, F] to [F, D].
+	down, err := TransposeTensor(takeVariable(hfMLPCtx, "down_proj", &trainable), []int{1, 0})
+	if err != nil {
+		return errors.WithMessage(err, "down_proj weights")
+	}
+	setLayoutVariable(mlpCtx, "linear", down, trainable)
+	return nil
+}
+
+// takeVariable returns the value of the variable with the given name in ctx, and deletes the variable. It sets
+// trainable to whether the variable was trainable.
+//
+// The variable must exist, see checkLayoutVariables.
+func takeVariable(ctx *context.Context, name string, trainable *bool) *tensors.Tensor {
+	v := ctx.GetVariable(name)
+	value := v.Value()
+	*trainable = v.Trainable
+	ctx.DeleteVariable(ctx.Scope(), name)
+	return value
+}
+
+// setLayoutVariable creates the variable with the given name and value in ctx.
+func setLayoutVariable(ctx *context.Context, name string, value *tensors.Tensor, trainable bool) {
+	ctx.VariableWithValue(name, value).SetTrainable(trainable)
+}
+
+// resizeEmbeddingTable truncates or pads (with zeros) the embedding table to vocabularySize rows, and updates
+// config.VocabularySize.
+func resizeEmbeddingTable(ctx *context.Context, config *Config, vocabularySize int) error {
+	embedderCtx := ctx.In("embedder").Checked(false)
+	v := embedderCtx.GetVariable("input_embedding")
+	if v.Shape().Rank() != 2 {
+		return errors.Errorf("embedding table shaped %s, expected rank 2", v.Shape())
+	}
+	if v.Shape().Dim(0) != vocabularySize {
+		var trainable bool
+		table := takeVariable(embedderCtx, "input_embedding", &trainable)
+		setLayoutVariable(embedderCtx, "input_embedding", resizeFirstAxis(table, vocabularySize), trainable)
+	}
+	config.VocabularySize = vocabularySize
+	return nil
+}
+
+// TransposeTensor returns a new tensor with the axes of t permuted: axis i of the result is the axis permutation[i]
+// of t. It is done in the host, on the raw bytes of the tensor, so it works with any dtype.
+func TransposeTensor(t *tensors.Tensor, permutation []int) (*tensors.Tensor, error) {
+	dims := t.Shape().Dimensions
+	if len(permutation) != len(dims) {
+		return nil, errors.Errorf("permutation %v has %d axes, but tensor shaped %s has rank %d",
+			permutation, len(permutation), t.Shape(), len(dims))
+	}
+	for axis, fromAxis := range slices.Sorted(slices.Values(permutation)) {
+		if fromAxis != axis {
+			return nil, errors.Errorf("invalid permutation %v for tensor shaped %s", permutation, t.Shape())
+		}
+	}
+
+	elementSize := t.DType().Size()
+	inputStrides := make([]int, len(dims))
+	stride := elementSize
+	for axis := len(dims) - 1; axis >= 0; axis-- {
+		inputStrides[axis] = stride
+		stride *= dims[axis]
+	}
+	outputDims := make([]int, len(dims))
+	strides := make([]int, len(dims)) // Input strides of the output axes.
+	for axis, fromAxis := range permutation {
+		outputDims[axis] = dims[fromAxis]
+		strides[axis] = inputStrides[fromAxis]
+	}
+	output := tensors.FromShape(shapes.Make(t.DType(), outputDims...))
+	t.ConstBytes(func(input []byte) {
+		output.MutableBytes(func(outputBytes []byte) {
+			if slices.IsSorted(permutation) {
+				copy(outputBytes, input)
+				return
+			}
+			position := make([]int, len(dims))
+			inputOffset := 0
+			for outputOffset := 0; outputOffset < len(outputBytes); outputOffset += elementSize {
+				copy(outputBytes[outputOffset:outputOffset+elementSize], input[inputOffset:inputOffset+elementSize])
+				// Increment position, starting from the last axis.
+				for axis := len(dims) - 1; axis >= 0; axis-- {
+					position[axis]++
+					inputOffset += strides[axis]
+					if position[axis] < outputDims[axis] {
+						break
+					}
+					inputOffset -= position[axis] * strides[axis]
+					position[axis] = 0
+				}
+			}
+		})
+	})
+	return output, nil
+}
+
+// sliceFirstAxis returns a new tensor with the element idx of the first axis of t.
+func sliceFirstAxis(t *tensors.Tensor, idx int) *tensors.Tensor {
+	output := tensors.FromShape(shapes.Make(t.DType(), t.Shape().Dimensions[1:]...))
+	size := int(output.Shape().Memory())
+	t.ConstBytes(func(input []byte) {
+		output.MutableBytes(func(outputBytes []byte) {
+			copy(outputBytes, input[idx*size:(idx+1)*size])
+		})
+	})
+	return output
+}
+
+// stackTensors returns a new tensor with the given tensors, all with the same shape, stacked on a new first axis.
+func stackTensors(ts ...*tensors.Tensor) (*tensors.Tensor, error) {
+	shape := ts[0].Shape()
+	for _, t := range ts[1:] {
+		if !t.Shape().Equal(shape) {
+			return nil, errors.Errorf("cannot stack tensors shaped %s and %s", shape, t.Shape())
+		}
+	}
+	output := tensors.FromShape(shapes.Make(shape.DType, append([]int{len(ts)}, shape.Dimensions...)...))
+	size := int(shape.Memory())
+	output.MutableBytes(func(outputBytes []byte) {
+		for ii, t := range ts {
+			t.ConstBytes(func(input []byte) {
+				copy(outputBytes[ii*size:(ii+1)*size], input)
+			})
+		}
+	})
+	return output, nil
+}
+
+// reshapeTensor returns a new tensor with the values of t and the given dimensions, which must have the same size.
+func reshapeTensor(t *tensors.Tensor, dims ...int) *tensors.Tensor {
+	output := tensors.FromShape(shapes.Make(t.DType(), dims...))
+	if output.Shape().Size() != t.Shape().Size() {
+		exceptions.Panicf("cannot reshape tensor shaped %s to dimensions %v", t.Shape(), dims)
+	}
+	t.ConstBytes(func(input []byte) {
+		output.MutableBytes(func(outputBytes []byte) {
+			copy(outputBytes, input)
+		})
+	})
+	return output
+}
+
+// resizeFirstAxis returns a new tensor with the first axis of t truncated or padded with zeros to size.
+func resizeFirstAxis(t *tensors.Tensor, size int) *tensors.Tensor {
+	dims := slices.Clone(t.Shape().Dimensions)
+	dims[0] = size
+	output := tensors.FromShape(shapes.Make(t.DType(), dims...))
+	t.ConstBytes(func(input []byte) {
+		output.MutableBytes(func(outputBytes []byte) {
+			copy(outputBytes, input) // Copies the smaller of the two, the rest of the output is left with zeros.
+		})
+	})
+	return output
+}
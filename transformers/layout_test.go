@@ -0,0 +1,110 @@
+package transformers
+
+import (
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// iotaTensor returns a float32 tensor with the given dimensions and values 0, 1, 2, ...
+func iotaTensor(dims ...int) *tensors.Tensor {
+	t := tensors.FromShape(shapes.Make(dtypes.Float32, dims...))
+	tensors.MutableFlatData(t, func(flat []float32) {
+		for ii := range flat {
+			flat[ii] = float32(ii)
+		}
+	})
+	return t
+}
+
+func TestTransposeTensor(t *testing.T) {
+	transposed, err := TransposeTensor(iotaTensor(2, 3), []int{1, 0})
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{0, 3}, {1, 4}, {2, 5}}, transposed.Value())
+
+	transposed, err = TransposeTensor(iotaTensor(2, 1, 3), []int{2, 0, 1})
+	require.NoError(t, err)
+	require.Equal(t, [][][]float32{{{0}, {3}}, {{1}, {4}}, {{2}, {5}}}, transposed.Value())
+
+	_, err = TransposeTensor(iotaTensor(2, 3), []int{0, 0})
+	require.Error(t, err)
+	_, err = TransposeTensor(iotaTensor(2, 3), []int{0})
+	require.Error(t, err)
+}
+
+func TestConvertLayout(t *testing.T) {
+	const (
+		numHeads, numKVHeads, headDim = 2, 1, 2
+		embedDim, hiddenDim           = 3, 4
+	)
+	for _, useQKV := range []bool{false, true} {
+		config := &Config{
+			NumLayers: 1, NumHeads: numHeads, NumKVHeads: numKVHeads, HeadDim: headDim,
+			EmbedDim: embedDim, HiddenDim: hiddenDim, VocabularySize: KaggleVocabularySize, UseQKV: useQKV,
+		}
+		if useQKV {
+			config.NumKVHeads = numHeads
+		}
+		ctx := context.New()
+		embedding := resizeFirstAxis(iotaTensor(HuggingFaceVocabularySize, embedDim), KaggleVocabularySize)
+		ctx.In("embedder").VariableWithValue("input_embedding", embedding)
+		attnCtx, mlpCtx := ctx.In("layer_0").In("attn"), ctx.In("layer_0").In("mlp")
+		kaggleValues := map[string]*tensors.Tensor{
+			"attn_vec_einsum": iotaTensor(numHeads, headDim, embedDim),
+			"gating_einsum":   iotaTensor(2, embedDim, hiddenDim),
+			"linear":          iotaTensor(hiddenDim, embedDim),
+		}
+		if useQKV {
+			kaggleValues["qkv_einsum"] = iotaTensor(3, numHeads, embedDim, headDim)
+			attnCtx.In("qkv_einsum").VariableWithValue("w", kaggleValues["qkv_einsum"])
+		} else {
+			kaggleValues["q_einsum"] = iotaTensor(numHeads, embedDim, headDim)
+			kaggleValues["kv_einsum"] = iotaTensor(2, numKVHeads, embedDim, headDim)
+			attnCtx.In("q_einsum").VariableWithValue("w", kaggleValues["q_einsum"])
+			attnCtx.In("kv_einsum").VariableWithValue("w", kaggleValues["kv_einsum"]).SetTrainable(false)
+		}
+		attnCtx.In("attn_vec_einsum").VariableWithValue("w", kaggleValues["attn_vec_einsum"])
+		mlpCtx.VariableWithValue("gating_einsum", kaggleValues["gating_einsum"])
+		mlpCtx.VariableWithValue("linear", kaggleValues["linear"])
+
+		require.NoError(t, ConvertToHuggingFaceLayout(ctx, config))
+		require.True(t, config.HuggingFaceVersion)
+		require.Equal(t, HuggingFaceVocabularySize, config.VocabularySize)
+		require.Equal(t, []int{HuggingFaceVocabularySize, embedDim},
+			ctx.In("embedder").GetVariable("input_embedding").Shape().Dimensions)
+		require.Nil(t, mlpCtx.GetVariable("linear"))
+		hfAttnCtx := attnCtx.In("hf")
+		qProj := hfAttnCtx.GetVariable("q_proj").Value()
+		require.Equal(t, []int{numHeads * headDim, embedDim}, qProj.Shape().Dimensions)
+		// q_proj[n*H+h, d] = q_einsum[n, d, h]: for n=1, h=0, d=2 it is 1*D*H + 2*H + 0 = 10.
+		require.Equal(t, float32(10), qProj.Value().([][]float32)[1*headDim+0][2])
+		require.Equal(t, []int{embedDim, numHeads * headDim}, hfAttnCtx.GetVariable("o_proj").Shape().Dimensions)
+		require.Equal(t, []int{hiddenDim, embedDim}, mlpCtx.In("hf").GetVariable("up_proj").Shape().Dimensions)
+		require.Equal(t, useQKV, hfAttnCtx.GetVariable("k_proj").Trainable)
+		require.Error(t, ConvertToHuggingFaceLayout(ctx, config))
+
+		// Back to the Kaggle layout: the original values, with the padding of the embedding table zeroed.
+		require.NoError(t, ConvertToKaggleLayout(ctx, config))
+		require.False(t, config.HuggingFaceVersion)
+		require.Equal(t, KaggleVocabularySize, config.VocabularySize)
+		require.True(t, embedding.Equal(ctx.In("embedder").GetVariable("input_embedding").Value()))
+		require.Nil(t, hfAttnCtx.GetVariable("q_proj"))
+		for name, want := range kaggleValues {
+			v := mlpCtx.GetVariable(name)
+			if v == nil {
+				v = attnCtx.In(name).GetVariable("w")
+			}
+			require.NotNilf(t, v, "variable %q missing", name)
+			require.Truef(t, want.Equal(v.Value()), "variable %q changed after converting back and forth", name)
+		}
+	}
+
+	// Quantized weights.
+	config := &Config{NumLayers: 1, HeadDim: headDim, VocabularySize: HuggingFaceVocabularySize, HuggingFaceVersion: true}
+	ctx := context.New()
+	ctx.In("embedder").VariableWithValue("input_embedding"+int8WeightsSuffix, [][]int8{{1}})
+	require.ErrorContains(t, ConvertToKaggleLayout(ctx, config), "quantized")
+}
@@ -0,0 +1,384 @@
+package transformers
+
+import (
+	"fmt"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/context/initializers"
+	"github.com/gomlx/gomlx/ml/layers"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/pkg/errors"
+	"math"
+	"slices"
+	"strings"
+)
+
+// LoRATarget is a linear projection of the model to which a LoRA adapter can be applied.
+//
+// The names match the ones used by HuggingFace's PEFT library.
+type LoRATarget string
+
+const (
+	LoRATargetQuery  LoRATarget = "q_proj"
+	LoRATargetKey    LoRATarget = "k_proj"
+	LoRATargetValue  LoRATarget = "v_proj"
+	LoRATargetOutput LoRATarget = "o_proj"
+	LoRATargetGate   LoRATarget = "gate_proj"
+	LoRATargetUp     LoRATarget = "up_proj"
+	LoRATargetDown   LoRATarget = "down_proj"
+)
+
+// LoRAScope is the sub-scope where the LoRA adapters weights are stored, see LoRAConfig.
+const LoRAScope = "lora"
+
+const (
+	loraAName        = "a"
+	loraBName        = "b"
+	loraDefaultRank  = 8
+	loraDefaultAlpha = 16.0
+)
+
+// LoRAAllTargets lists all the projections to which LoRA adapters can be applied.
+var LoRAAllTargets = []LoRATarget{
+	LoRATargetQuery, LoRATargetKey, LoRATargetValue, LoRATargetOutput,
+	LoRATargetGate, LoRATargetUp, LoRATargetDown,
+}
+
+// loraDType is the dtype of the LoRA adapter weights and of its computation.
+const loraDType = dtypes.Float32
+
+// LoRAConfig configures the LoRA (Low-Rank Adaptation) adapters added to the linear projections of the
+// model, see Config.LoRA.
+//
+// Each adapted projection W gets an additional low-rank term: y = x·W + (Alpha/Rank)·(Dropout(x)·A·B),
+// where A is shaped [inputDim, Rank] and B is shaped [Rank, outputDim]. B is initialized with zeros,
+// so the adapted model starts exactly as the base model.
+//
+// The adapter weights are stored (in float32) under the LoRAScope ("lora") sub-scope of the attention
+// ("attn") and feed-forward ("mlp") scopes of each layer, e.g.: "layer_0/attn/lora/q_proj/a".
+//
+// Reference: https://arxiv.org/abs/2106.09685
+type LoRAConfig struct {
+	// Rank of the adapters.
+	Rank int
+
+	// Alpha scales the adapters output by Alpha/Rank.
+	Alpha float64
+
+	// Dropout rate applied to the input of the adapters, only during training. Disabled if 0.
+	Dropout float64
+
+	// Targets are the projections to which the adapters are applied.
+	Targets []LoRATarget
+
+	// NumAdapters, if > 0, indicates that a bank of NumAdapters adapters is used, each example of the batch
+	// selecting its own adapter -- used to serve multiple adapters on top of the same base model.
+	// It is set by SetLoRAAdapters, see details there.
+	NumAdapters int
+}
+
+// NewLoRAConfig creates a LoRAConfig with rank 8, alpha 16, no dropout, applied to the query and value projections
+// of the attention layers.
+func NewLoRAConfig() *LoRAConfig {
+	return &LoRAConfig{
+		Rank:    loraDefaultRank,
+		Alpha:   loraDefaultAlpha,
+		Targets: []LoRATarget{LoRATargetQuery, LoRATargetValue},
+	}
+}
+
+// WithRank sets the rank of the adapters, and returns the updated LoRAConfig.
+func (c *LoRAConfig) WithRank(rank int) *LoRAConfig {
+	c.Rank = rank
+	return c
+}
+
+// WithAlpha sets the scaling factor alpha of the adapters, and returns the updated LoRAConfig.
+func (c *LoRAConfig) WithAlpha(alpha float64) *LoRAConfig {
+	c.Alpha = alpha
+	return c
+}
+
+// WithDropout sets the dropout rate of the input of the adapters, and returns the updated LoRAConfig.
+func (c *LoRAConfig) WithDropout(rate float64) *LoRAConfig {
+	c.Dropout = rate
+	return c
+}
+
+// WithTargets sets the projections to which the adapters are applied (see LoRAAllTargets), and returns the
+// updated LoRAConfig.
+func (c *LoRAConfig) WithTargets(targets ...LoRATarget) *LoRAConfig {
+	c.Targets = targets
+	return c
+}
+
+// Scale applied to the output of the adapters: Alpha/Rank.
+func (c *LoRAConfig) Scale() float64 {
+	return c.Alpha / float64(c.Rank)
+}
+
+// hasTarget returns whether the adapters are applied to the given target. It returns false if c is nil.
+func (c *LoRAConfig) hasTarget(target LoRATarget) bool {
+	return c != nil && slices.Contains(c.Targets, target)
+}
+
+// applyLoRA adds the output of the LoRA adapter of the target projection to its output, if the target is
+// configured in lora (which may be nil). Otherwise, it returns output unchanged.
+//
+//   - ctx: scope of the projection's layer ("attn" or "mlp"), the adapter weights are stored under LoRAScope.
+//   - x: input of the projection, its last numInputAxes axes are contracted by the projection.
+//   - output: output of the base projection. It must be shaped as x's non-contracted (batch) axes followed by the
+//     output axes of the projection.
+func applyLoRA(ctx *context.Context, lora *LoRAConfig, target LoRATarget, x *Node, numInputAxes int, output *Node) *Node {
+	if !lora.hasTarget(target) {
+		return output
+	}
+	ctx = ctx.In(LoRAScope).In(string(target)).Checked(false)
+	g := x.Graph()
+	batchDims := x.Shape().Dimensions[:x.Rank()-numInputAxes]
+	inputDim := x.Shape().Size() / shapes.Make(x.DType(), batchDims...).Size()
+	outputDim := output.Shape().Size() / shapes.Make(x.DType(), batchDims...).Size()
+	if lora.NumAdapters > 0 {
+		return applyLoRABank(ctx, lora, x, inputDim, outputDim, output)
+	}
+
+	loraA := ctx.WithInitializer(initializers.RandomUniformFn(ctx, -1/math.Sqrt(float64(inputDim)), 1/math.Sqrt(float64(inputDim)))).
+		VariableWithShape(loraAName, shapes.Make(loraDType, inputDim, lora.Rank)).ValueGraph(g)
+	loraB := ctx.WithInitializer(initializers.Zero).
+		VariableWithShape(loraBName, shapes.Make(loraDType, lora.Rank, outputDim)).ValueGraph(g)
+
+	x = Reshape(ConvertDType(x, loraDType), append(slices.Clone(batchDims), inputDim)...)
+	x = layers.DropoutStatic(ctx, x, lora.Dropout) // No-op if not training.
+	delta := DotGeneral(x, []int{-1}, nil, loraA, []int{0}, nil)
+	delta = DotGeneral(delta, []int{-1}, nil, loraB, []int{0}, nil)
+	delta = MulScalar(delta, lora.Scale())
+	delta = Reshape(ConvertDType(delta, output.DType()), output.Shape().Dimensions...)
+	return Add(output, delta)
+}
+
+// IsLoRAVariable returns whether the variable holds the weights of a LoRA adapter.
+func IsLoRAVariable(v *context.Variable) bool {
+	return slices.Contains(strings.Split(v.Scope(), context.ScopeSeparator), LoRAScope)
+}
+
+// FreezeBaseWeights marks all variables in ctx that are not LoRA adapter weights (see IsLoRAVariable) as
+// not trainable, so only the adapters are trained.
+func FreezeBaseWeights(ctx *context.Context) {
+	for v := range ctx.IterVariablesInScope() {
+		if !IsLoRAVariable(v) {
+			v.SetTrainable(false)
+		}
+	}
+}
+
+// loraBaseWeights describes the base weights variable of a LoRA target.
+type loraBaseWeights struct {
+	// scope relative to the layer scope, and name of the variable.
+	scope []string
+	name  string
+
+	// slice is the index on the first axis of the variable to which the adapter applies, for variables that
+	// combine more than one projection. It is -1 if the variable holds only one projection.
+	slice int
+
+	// axes holds, for each axis of the weights (after slicing), whether it is an input axis ('i') or an output axis ('o').
+	axes string
+}
+
+// listLoRABaseWeights returns the base weights of each LoRA target, for the model described by config.
+func listLoRABaseWeights(config *Config) map[LoRATarget]loraBaseWeights {
+	if config.HuggingFaceVersion {
+		// Projections are shaped [outputDim, inputDim].
+		return map[LoRATarget]loraBaseWeights{
+			LoRATargetQuery:  {[]string{"attn", "hf"}, "q_proj", -1, "oi"},
+			LoRATargetKey:    {[]string{"attn", "hf"}, "k_proj", -1, "oi"},
+			LoRATargetValue:  {[]string{"attn", "hf"}, "v_proj", -1, "oi"},
+			LoRATargetOutput: {[]string{"attn", "hf"}, "o_proj", -1, "oi"},
+			LoRATargetGate:   {[]string{"mlp", "hf"}, "gating_proj", -1, "oi"},
+			LoRATargetUp:     {[]string{"mlp", "hf"}, "up_proj", -1, "oi"},
+			LoRATargetDown:   {[]string{"mlp", "hf"}, "down_proj", -1, "oi"},
+		}
+	}
+	weights := map[LoRATarget]loraBaseWeights{
+		LoRATargetOutput: {[]string{"attn", "attn_vec_einsum"}, "w", -1, "iio"}, // [N, H, D]
+		LoRATargetDown:   {[]string{"mlp"}, "linear", -1, "io"},                 // [F, D]
+	}
+	if config.UseQKV {
+		// [3, N, D, H]
+		weights[LoRATargetQuery] = loraBaseWeights{[]string{"attn", "qkv_einsum"}, "w", 0, "oio"}
+		weights[LoRATargetKey] = loraBaseWeights{[]string{"attn", "qkv_einsum"}, "w", 1, "oio"}
+		weights[LoRATargetValue] = loraBaseWeights{[]string{"attn", "qkv_einsum"}, "w", 2, "oio"}
+	} else {
+		weights[LoRATargetQuery] = loraBaseWeights{[]string{"attn", "q_einsum"}, "w", -1, "oio"} // [N, D, H]
+		weights[LoRATargetKey] = loraBaseWeights{[]string{"attn", "kv_einsum"}, "w", 0, "oio"}   // [2, K, D, H]
+		weights[LoRATargetValue] = loraBaseWeights{[]string{"attn", "kv_einsum"}, "w", 1, "oio"}
+	}
+	gatingAxes := "io" // [2, D, F]
+	if config.TransposeGatingEinsum {
+		gatingAxes = "oi" // [2, F, D]
+	}
+	weights[LoRATargetGate] = loraBaseWeights{[]string{"mlp"}, "gating_einsum", 0, gatingAxes}
+	weights[LoRATargetUp] = loraBaseWeights{[]string{"mlp"}, "gating_einsum", 1, gatingAxes}
+	return weights
+}
+
+// loraLayerScope returns the scope of the layer (relative to the model scope) where the adapter of the target is
+// stored: "attn" or "mlp".
+func loraLayerScope(target LoRATarget) string {
+	switch target {
+	case LoRATargetGate, LoRATargetUp, LoRATargetDown:
+		return "mlp"
+	default:
+		return "attn"
+	}
+}
+
+// MergeLoRA merges the LoRA adapters configured in config.LoRA into the base weights of the model in ctx
+// (the scope has to be set directly to the model variables), and deletes the adapters weights.
+//
+// After merging, the model can be used (and saved) without LoRA (config.LoRA = nil), with no extra cost at inference.
+// Adapters that were not created (e.g.: the model was never built with LoRA) are ignored.
+//
+// The base weights must not be quantized, since the merged weights would have to be quantized again: merge first,
+// and then quantize (see QuantizeWeightsInt8 and QuantizeWeightsQ4).
+func MergeLoRA(ctx *context.Context, config *Config) error {
+	if config.LoRA == nil {
+		return errors.New("MergeLoRA(): config.LoRA is not set")
+	}
+	if config.LoRA.NumAdapters > 0 {
+		return errors.New("MergeLoRA(): cannot merge a bank of LoRA adapters, see SetLoRAAdapters")
+	}
+	baseWeights := listLoRABaseWeights(config)
+	for layerIdx := range config.NumLayers {
+		layerCtx := ctx.In(fmt.Sprintf("layer_%d", layerIdx))
+		for _, target := range config.LoRA.Targets {
+			base, found := baseWeights[target]
+			if !found {
+				return errors.Errorf("MergeLoRA(): unknown LoRA target %q", target)
+			}
+			loraCtx := layerCtx.In(loraLayerScope(target)).In(LoRAScope).In(string(target))
+			aVar, bVar := loraCtx.GetVariable(loraAName), loraCtx.GetVariable(loraBName)
+			if aVar == nil && bVar == nil {
+				continue
+			}
+			if aVar == nil || bVar == nil {
+				return errors.Errorf("MergeLoRA(): LoRA adapter in scope %q is missing one of its weights", loraCtx.Scope())
+			}
+			baseCtx := layerCtx
+			for _, p := range base.scope {
+				baseCtx = baseCtx.In(p)
+			}
+			baseVar := baseCtx.GetVariable(base.name)
+			if baseVar == nil {
+				return errors.Errorf("MergeLoRA(): base weights %q not found in scope %q -- were they quantized ? "+
+					"LoRA must be merged before quantization", base.name, baseCtx.Scope())
+			}
+			merged, err := mergeLoRAWeights(baseVar.Value(), aVar.Value(), bVar.Value(), config.LoRA.Scale(), base.slice, base.axes)
+			if err != nil {
+				return errors.WithMessagef(err, "MergeLoRA(): merging adapter %q into %q of scope %q",
+					target, base.name, baseCtx.Scope())
+			}
+			baseVar.SetValue(merged)
+			loraCtx.DeleteVariable(loraCtx.Scope(), loraAName)
+			loraCtx.DeleteVariable(loraCtx.Scope(), loraBName)
+		}
+	}
+	return nil
+}
+
+// mergeLoRAWeights returns the base weights plus scale*A·B, with the same shape and dtype as base.
+// See loraBaseWeights for the meaning of slice and axes.
+func mergeLoRAWeights(base, loraA, loraB *tensors.Tensor, scale float64, slice int, axes string) (*tensors.Tensor, error) {
+	values, err := tensorToFloat32(base)
+	if err != nil {
+		return nil, err
+	}
+	a, err := tensorToFloat32(loraA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := tensorToFloat32(loraB)
+	if err != nil {
+		return nil, err
+	}
+	dims := base.Shape().Dimensions
+	offset := 0
+	if slice >= 0 {
+		offset = slice * shapes.Make(base.DType(), dims[1:]...).Size()
+		dims = dims[1:]
+	}
+	if len(dims) != len(axes) {
+		return nil, errors.Errorf("base weights shaped %s, expected rank %d (after slicing)", base.Shape(), len(axes))
+	}
+	inputDim, outputDim := 1, 1
+	for axis, dim := range dims {
+		if axes[axis] == 'i' {
+			inputDim *= dim
+		} else {
+			outputDim *= dim
+		}
+	}
+	rank := loraA.Shape().Dim(-1)
+	if !slices.Equal(loraA.Shape().Dimensions, []int{inputDim, rank}) ||
+		!slices.Equal(loraB.Shape().Dimensions, []int{rank, outputDim}) {
+		return nil, errors.Errorf("LoRA weights shaped A=%s and B=%s are incompatible with base weights shaped %s",
+			loraA.Shape(), loraB.Shape(), base.Shape())
+	}
+
+	// Iterate over the elements of the (sliced) base weights, tracking their input and output indices.
+	indices := make([]int, len(dims))
+	for flatIdx := range shapes.Make(base.DType(), dims...).Size() {
+		inputIdx, outputIdx := 0, 0
+		for axis, idx := range indices {
+			if axes[axis] == 'i' {
+				inputIdx = inputIdx*dims[axis] + idx
+			} else {
+				outputIdx = outputIdx*dims[axis] + idx
+			}
+		}
+		var delta float32
+		for r := range rank {
+			delta += a[inputIdx*rank+r] * b[r*outputDim+outputIdx]
+		}
+		values[offset+flatIdx] += float32(scale) * delta
+
+		// Increment indices, row-major.
+		for axis := len(indices) - 1; axis >= 0; axis-- {
+			indices[axis]++
+			if indices[axis] < dims[axis] {
+				break
+			}
+			indices[axis] = 0
+		}
+	}
+	return float32ToTensor(values, base.Shape())
+}
+
+// float32ToTensor converts the values to a tensor of the given shape and (float) dtype.
+func float32ToTensor(values []float32, shape shapes.Shape) (*tensors.Tensor, error) {
+	t := tensors.FromShape(shape)
+	switch shape.DType {
+	case dtypes.Float32:
+		tensors.MutableFlatData(t, func(flat []float32) {
+			copy(flat, values)
+		})
+	case dtypes.Float64:
+		tensors.MutableFlatData(t, func(flat []float64) {
+			for ii, v := range values {
+				flat[ii] = float64(v)
+			}
+		})
+	case dtypes.BFloat16:
+		tensors.MutableFlatData(t, func(flat []bfloat16.BFloat16) {
+			for ii, v := range values {
+				flat[ii] = bfloat16.FromFloat32(v)
+			}
+		})
+	default:
+		return nil, errors.Errorf("dtype %s not supported, only float32, float64 and bfloat16", shape.DType)
+	}
+	return t, nil
+}
@@ -0,0 +1,256 @@
+package transformers
+
+import (
+	"fmt"
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gemma/trees"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/ml/context/initializers"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"slices"
+	"strings"
+)
+
+// LoRAAdapterIndicesGraphParam is the graph parameter (see context.Context.SetGraphParam) with the index of the
+// adapter used by each example of the batch, when using a bank of LoRA adapters (see SetLoRAAdapters).
+//
+// Its value must be a *Node shaped int32[batchSize], and -1 selects no adapter (the base model).
+const LoRAAdapterIndicesGraphParam = "lora_adapter_indices"
+
+// LoRAAdapter holds the weights of one trained LoRA adapter, so it can be served along with other adapters on
+// top of the same base model, see SetLoRAAdapters.
+type LoRAAdapter struct {
+	// Name of the adapter, used to select it.
+	Name string
+
+	// Config of the adapter: the rank, alpha and targets it was trained with.
+	Config *LoRAConfig
+
+	// Weights of the adapter, with the same paths and shapes as the variables created for the adapter (relative
+	// to the model scope), e.g.: "layer_0/attn/lora/q_proj/a" shaped [inputDim, rank] and
+	// "layer_0/attn/lora/q_proj/b" shaped [rank, outputDim].
+	Weights *trees.Tree[*tensors.Tensor]
+}
+
+// LoRAAdapterFromContext creates a LoRAAdapter with the weights of the adapter trained in ctx (the scope has to be
+// set directly to the model variables), with the given LoRA configuration.
+func LoRAAdapterFromContext(ctx *context.Context, name string, lora *LoRAConfig) (*LoRAAdapter, error) {
+	adapter := &LoRAAdapter{Name: name, Config: lora, Weights: trees.New[*tensors.Tensor]()}
+	baseScope := ctx.Scope() + context.ScopeSeparator
+	if ctx.Scope() == context.RootScope {
+		baseScope = context.RootScope
+	}
+	count := 0
+	for v := range ctx.IterVariablesInScope() {
+		if !IsLoRAVariable(v) {
+			continue
+		}
+		if v.Shape().Rank() != 2 {
+			return nil, errors.Errorf("LoRAAdapterFromContext(): variable %q in scope %q shaped %s is not from a "+
+				"single adapter", v.Name(), v.Scope(), v.Shape())
+		}
+		treePath := append(strings.Split(strings.TrimPrefix(v.Scope(), baseScope), context.ScopeSeparator), v.Name())
+		if err := adapter.Weights.Set(treePath, v.Value()); err != nil {
+			return nil, errors.WithMessage(err, "LoRAAdapterFromContext()")
+		}
+		count++
+	}
+	if count == 0 {
+		return nil, errors.Errorf("LoRAAdapterFromContext(): no LoRA adapter variables found in scope %q", ctx.Scope())
+	}
+	return adapter, nil
+}
+
+// SetLoRAAdapters creates a bank with the given adapters in ctx (the scope has to be set directly to the model
+// variables), replacing any previous LoRA adapters there, and configures config.LoRA to use it.
+//
+// The adapters may have different ranks and targets: their weights are padded with zeros to the largest rank, and
+// the union of their targets is used. The scaling of each adapter (LoRAConfig.Scale) is folded into its weights.
+//
+// The model then requires the graph parameter LoRAAdapterIndicesGraphParam to be set with the index of the adapter
+// to use for each example of the batch (the order of the adapters given here), or -1 for the base model. So examples
+// using different adapters can be batched together.
+//
+// Calling it again with a new set of adapters hot-swaps them: if the new bank has the same shapes (same number of
+// adapters, largest rank and targets), the variables are updated in place and a model already compiled can be reused.
+//
+// If adapters is empty, the LoRA adapters are removed and config.LoRA is set to nil.
+func SetLoRAAdapters(ctx *context.Context, config *Config, adapters []*LoRAAdapter) error {
+	// Union of the targets and largest rank.
+	var bankConfig *LoRAConfig
+	if len(adapters) > 0 {
+		bankConfig = &LoRAConfig{NumAdapters: len(adapters)}
+		for _, adapter := range adapters {
+			if adapter.Config == nil || adapter.Config.Rank <= 0 {
+				return errors.Errorf("SetLoRAAdapters(): adapter %q has no valid LoRA configuration", adapter.Name)
+			}
+			bankConfig.Rank = max(bankConfig.Rank, adapter.Config.Rank)
+			for _, target := range adapter.Config.Targets {
+				if !slices.Contains(bankConfig.Targets, target) {
+					bankConfig.Targets = append(bankConfig.Targets, target)
+				}
+			}
+		}
+		bankConfig.Alpha = float64(bankConfig.Rank) // Scale of 1, since the scales are folded into the weights.
+	}
+
+	// Build the bank for each adapted projection, indexed by the scope of the variables.
+	bank := make(map[string][2]*tensors.Tensor)
+	for layerIdx := range config.NumLayers {
+		if bankConfig == nil {
+			break
+		}
+		layerName := fmt.Sprintf("layer_%d", layerIdx)
+		for _, target := range bankConfig.Targets {
+			treePath := []string{layerName, loraLayerScope(target), LoRAScope, string(target)}
+			bankA, bankB, err := buildLoRABank(adapters, bankConfig.Rank, treePath)
+			if err != nil {
+				return errors.WithMessage(err, "SetLoRAAdapters()")
+			}
+			if bankA == nil {
+				continue // No adapter for this projection in this layer.
+			}
+			scopedCtx := ctx
+			for _, p := range treePath {
+				scopedCtx = scopedCtx.In(p)
+			}
+			bank[scopedCtx.Scope()] = [2]*tensors.Tensor{bankA, bankB}
+		}
+	}
+
+	// Update the previous adapters variables in place if they have the same shape (so a model already compiled
+	// can be reused), and remove the others.
+	var previous []*context.Variable
+	for v := range ctx.IterVariablesInScope() {
+		if IsLoRAVariable(v) {
+			previous = append(previous, v)
+		}
+	}
+	updated := make(map[string]bool)
+	for _, v := range previous {
+		weights, found := bank[v.Scope()]
+		if found && (v.Name() == loraAName || v.Name() == loraBName) {
+			value := weights[0]
+			if v.Name() == loraBName {
+				value = weights[1]
+			}
+			if v.Shape().Equal(value.Shape()) {
+				v.SetValue(value)
+				updated[v.Scope()+context.ScopeSeparator+v.Name()] = true
+				continue
+			}
+		}
+		ctx.DeleteVariable(v.Scope(), v.Name())
+	}
+	for scope, weights := range bank {
+		scopedCtx := ctx.InAbsPath(scope).Checked(false)
+		for ii, name := range []string{loraAName, loraBName} {
+			if !updated[scope+context.ScopeSeparator+name] {
+				scopedCtx.VariableWithValue(name, weights[ii]).SetTrainable(false)
+			}
+		}
+	}
+	config.LoRA = bankConfig
+	return nil
+}
+
+// buildLoRABank returns the weights A and B of the given adapters for the projection in treePath, stacked and padded
+// to the given rank: shaped [numAdapters, inputDim, rank] and [numAdapters, rank, outputDim] respectively.
+// The scale of each adapter is folded into its B weights.
+//
+// It returns nil weights if none of the adapters has the projection.
+func buildLoRABank(adapters []*LoRAAdapter, rank int, treePath []string) (bankA, bankB *tensors.Tensor, err error) {
+	inputDim, outputDim := -1, -1
+	valuesA := make([][]float32, len(adapters))
+	valuesB := make([][]float32, len(adapters))
+	for adapterIdx, adapter := range adapters {
+		a, errA := adapter.Weights.Get(append(slices.Clone(treePath), loraAName)...)
+		b, errB := adapter.Weights.Get(append(slices.Clone(treePath), loraBName)...)
+		if errA != nil && errB != nil {
+			continue
+		}
+		if errA != nil || errB != nil {
+			return nil, nil, errors.Errorf("adapter %q is missing one of the weights in %q", adapter.Name, treePath)
+		}
+		adapterRank := adapter.Config.Rank
+		if a.Shape().Rank() != 2 || b.Shape().Rank() != 2 || a.Shape().Dim(1) != adapterRank || b.Shape().Dim(0) != adapterRank {
+			return nil, nil, errors.Errorf("adapter %q weights in %q shaped A=%s and B=%s don't match its rank %d",
+				adapter.Name, treePath, a.Shape(), b.Shape(), adapterRank)
+		}
+		if inputDim == -1 {
+			inputDim, outputDim = a.Shape().Dim(0), b.Shape().Dim(1)
+		} else if a.Shape().Dim(0) != inputDim || b.Shape().Dim(1) != outputDim {
+			return nil, nil, errors.Errorf("adapter %q weights in %q shaped A=%s and B=%s, don't match other adapters "+
+				"with inputDim=%d and outputDim=%d", adapter.Name, treePath, a.Shape(), b.Shape(), inputDim, outputDim)
+		}
+		valuesA[adapterIdx], err = tensorToFloat32(a)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "adapter %q weights in %q", adapter.Name, treePath)
+		}
+		valuesB[adapterIdx], err = tensorToFloat32(b)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "adapter %q weights in %q", adapter.Name, treePath)
+		}
+		scale := float32(adapter.Config.Scale())
+		for ii := range valuesB[adapterIdx] {
+			valuesB[adapterIdx][ii] *= scale
+		}
+	}
+	if inputDim == -1 {
+		return nil, nil, nil
+	}
+
+	bankA = tensors.FromShape(shapes.Make(loraDType, len(adapters), inputDim, rank))
+	bankB = tensors.FromShape(shapes.Make(loraDType, len(adapters), rank, outputDim))
+	tensors.MutableFlatData(bankA, func(flat []float32) {
+		for adapterIdx, values := range valuesA {
+			adapterRank := adapters[adapterIdx].Config.Rank
+			for ii, v := range values { // values shaped [inputDim, adapterRank].
+				flat[(adapterIdx*inputDim+ii/adapterRank)*rank+ii%adapterRank] = v
+			}
+		}
+	})
+	tensors.MutableFlatData(bankB, func(flat []float32) {
+		for adapterIdx, values := range valuesB {
+			// values shaped [adapterRank, outputDim], padding rows are left as zero.
+			copy(flat[adapterIdx*rank*outputDim:], values)
+		}
+	})
+	return bankA, bankB, nil
+}
+
+// applyLoRABank implements applyLoRA for a bank of adapters, where each example selects its adapter with
+// the graph parameter LoRAAdapterIndicesGraphParam.
+func applyLoRABank(ctx *context.Context, lora *LoRAConfig, x *Node, inputDim, outputDim int, output *Node) *Node {
+	g := x.Graph()
+	indicesValue, found := ctx.GetGraphParam(g, LoRAAdapterIndicesGraphParam)
+	indices, ok := indicesValue.(*Node)
+	if !found || !ok {
+		exceptions.Panicf("using a bank of LoRA adapters requires the graph parameter %q to be set with the "+
+			"adapter indices of each example (int32[batchSize]), see SetLoRAAdapters", LoRAAdapterIndicesGraphParam)
+	}
+	batchSize := x.Shape().Dim(0)
+	indices.AssertDims(batchSize)
+
+	bankCtx := ctx.WithInitializer(initializers.Zero)
+	bankA := bankCtx.VariableWithShape(loraAName, shapes.Make(loraDType, lora.NumAdapters, inputDim, lora.Rank)).ValueGraph(g)
+	bankB := bankCtx.VariableWithShape(loraBName, shapes.Make(loraDType, lora.NumAdapters, lora.Rank, outputDim)).ValueGraph(g)
+
+	// Select the adapters of each example: -1 (no adapter) uses adapter 0 and is masked out below.
+	indices = ConvertDType(indices, dtypes.Int32)
+	isAdapted := GreaterOrEqual(indices, ScalarZero(g, dtypes.Int32))
+	gatherIndices := ExpandAxes(Max(indices, ScalarZero(g, dtypes.Int32)), -1)
+	loraA := Gather(bankA, gatherIndices) // [batchSize, inputDim, rank]
+	loraB := Gather(bankB, gatherIndices) // [batchSize, rank, outputDim]
+
+	x = Reshape(ConvertDType(x, loraDType), batchSize, -1, inputDim)
+	delta := Einsum("bmi,bir->bmr", x, loraA)
+	delta = Einsum("bmr,bro->bmo", delta, loraB)
+	delta = Where(isAdapted, delta, ZerosLike(delta))
+	delta = Reshape(ConvertDType(delta, output.DType()), output.Shape().Dimensions...)
+	return Add(output, delta)
+}
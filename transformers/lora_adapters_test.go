@@ -0,0 +1,81 @@
+package transformers
+
+import (
+	"github.com/gomlx/gemma/trees"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// newTestLoRAAdapter creates an adapter for the query projection of layer 0, with inputDim=2 and outputDim=3.
+func newTestLoRAAdapter(t *testing.T, name string, rank int, alpha float64, a, b any) *LoRAAdapter {
+	adapter := &LoRAAdapter{
+		Name:    name,
+		Config:  &LoRAConfig{Rank: rank, Alpha: alpha, Targets: []LoRATarget{LoRATargetQuery}},
+		Weights: trees.New[*tensors.Tensor](),
+	}
+	require.NoError(t, adapter.Weights.Set(trees.Path{"layer_0", "attn", LoRAScope, "q_proj", loraAName}, tensors.FromAnyValue(a)))
+	require.NoError(t, adapter.Weights.Set(trees.Path{"layer_0", "attn", LoRAScope, "q_proj", loraBName}, tensors.FromAnyValue(b)))
+	return adapter
+}
+
+func TestSetLoRAAdapters(t *testing.T) {
+	config := &Config{NumLayers: 1}
+	ctx := context.New()
+	loraCtx := ctx.In("layer_0").In("attn").In(LoRAScope).In(string(LoRATargetQuery))
+
+	adapter1 := newTestLoRAAdapter(t, "one", 1, 2, [][]float32{{1}, {2}}, [][]float32{{1, 2, 3}})
+	adapter2 := newTestLoRAAdapter(t, "two", 2, 2, [][]float32{{1, 2}, {3, 4}}, [][]float32{{1, 1, 1}, {2, 2, 2}})
+	require.NoError(t, SetLoRAAdapters(ctx, config, []*LoRAAdapter{adapter1, adapter2}))
+	require.Equal(t, 2, config.LoRA.NumAdapters)
+	require.Equal(t, 2, config.LoRA.Rank)
+	require.Equal(t, []LoRATarget{LoRATargetQuery}, config.LoRA.Targets)
+
+	// A is padded to the largest rank, B is scaled by each adapter's alpha/rank (2 and 1) and padded.
+	bankA := loraCtx.GetVariable(loraAName)
+	require.False(t, bankA.Trainable)
+	require.Equal(t, [][][]float32{{{1, 0}, {2, 0}}, {{1, 2}, {3, 4}}}, bankA.Value().Value())
+	bankB := loraCtx.GetVariable(loraBName)
+	require.Equal(t, [][][]float32{{{2, 4, 6}, {0, 0, 0}}, {{1, 1, 1}, {2, 2, 2}}}, bankB.Value().Value())
+
+	// Hot-swap with same shapes: variables are updated in place.
+	require.NoError(t, SetLoRAAdapters(ctx, config, []*LoRAAdapter{adapter2, adapter1}))
+	require.Same(t, bankA, loraCtx.GetVariable(loraAName))
+	require.Equal(t, [][][]float32{{{1, 2}, {3, 4}}, {{1, 0}, {2, 0}}}, bankA.Value().Value())
+
+	// Different number of adapters: variables are recreated.
+	require.NoError(t, SetLoRAAdapters(ctx, config, []*LoRAAdapter{adapter1}))
+	require.Equal(t, 1, config.LoRA.Rank)
+	require.NotSame(t, bankA, loraCtx.GetVariable(loraAName))
+	require.Equal(t, [][][]float32{{{1}, {2}}}, loraCtx.GetVariable(loraAName).Value().Value())
+
+	// Removing adapters.
+	require.NoError(t, SetLoRAAdapters(ctx, config, nil))
+	require.Nil(t, config.LoRA)
+	require.Nil(t, loraCtx.GetVariable(loraAName))
+
+	// Incompatible adapters.
+	adapter3 := newTestLoRAAdapter(t, "three", 1, 1, [][]float32{{1}, {2}, {3}}, [][]float32{{1, 2, 3}})
+	require.Error(t, SetLoRAAdapters(ctx, config, []*LoRAAdapter{adapter1, adapter3}))
+}
+
+func TestLoRAAdapterFromContext(t *testing.T) {
+	ctx := context.New()
+	modelCtx := ctx.In("model")
+	modelCtx.In("layer_0").In("attn").In("hf").VariableWithValue("q_proj", [][]float32{{1, 1}, {1, 1}})
+	loraCtx := modelCtx.In("layer_0").In("attn").In(LoRAScope).In(string(LoRATargetQuery))
+	loraCtx.VariableWithValue(loraAName, [][]float32{{1}, {2}})
+	loraCtx.VariableWithValue(loraBName, [][]float32{{1, 2}})
+
+	lora := NewLoRAConfig().WithRank(1).WithTargets(LoRATargetQuery)
+	adapter, err := LoRAAdapterFromContext(modelCtx, "test", lora)
+	require.NoError(t, err)
+	require.Equal(t, 2, adapter.Weights.NumLeaves())
+	a, err := adapter.Weights.Get("layer_0", "attn", LoRAScope, "q_proj", loraAName)
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1}, {2}}, a.Value())
+
+	_, err = LoRAAdapterFromContext(ctx.In("other"), "test", lora)
+	require.Error(t, err)
+}
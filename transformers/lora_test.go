@@ -0,0 +1,67 @@
+package transformers
+
+import (
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMergeLoRAWeights(t *testing.T) {
+	// A·B = [[1, 2, 3], [2, 4, 6]], for inputDim=2, outputDim=3.
+	loraA := tensors.FromValue([][]float32{{1}, {2}})
+	loraB := tensors.FromValue([][]float32{{1, 2, 3}})
+
+	// Weights shaped [inputDim, outputDim].
+	merged, err := mergeLoRAWeights(tensors.FromValue([][]float32{{0, 0, 0}, {1, 1, 1}}), loraA, loraB, 0.5, -1, "io")
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{0.5, 1, 1.5}, {2, 3, 4}}, merged.Value())
+
+	// Weights shaped [outputDim, inputDim].
+	merged, err = mergeLoRAWeights(tensors.FromValue([][]float64{{0, 0}, {0, 0}, {0, 0}}), loraA, loraB, 1, -1, "oi")
+	require.NoError(t, err)
+	require.Equal(t, [][]float64{{1, 2}, {2, 4}, {3, 6}}, merged.Value())
+
+	// Sliced weights shaped [2, outputDim, inputDim]: only the second slice is changed.
+	merged, err = mergeLoRAWeights(tensors.FromValue([][][]float32{
+		{{0, 0}, {0, 0}, {0, 0}},
+		{{0, 0}, {0, 0}, {0, 0}}}), loraA, loraB, 1, 1, "oi")
+	require.NoError(t, err)
+	require.Equal(t, [][][]float32{
+		{{0, 0}, {0, 0}, {0, 0}},
+		{{1, 2}, {2, 4}, {3, 6}}}, merged.Value())
+
+	// Output axes split around the input axis: [N=3, D=2, H=1].
+	merged, err = mergeLoRAWeights(tensors.FromValue([][][]float32{{{0}, {0}}, {{0}, {0}}, {{0}, {0}}}), loraA, loraB, 1, -1, "oio")
+	require.NoError(t, err)
+	require.Equal(t, [][][]float32{{{1}, {2}}, {{2}, {4}}, {{3}, {6}}}, merged.Value())
+
+	// Incompatible shapes.
+	_, err = mergeLoRAWeights(tensors.FromValue([][]float32{{0, 0}, {0, 0}}), loraA, loraB, 1, -1, "io")
+	require.Error(t, err)
+}
+
+func TestMergeLoRA(t *testing.T) {
+	config := &Config{NumLayers: 1, HuggingFaceVersion: true,
+		LoRA: NewLoRAConfig().WithRank(1).WithTargets(LoRATargetQuery, LoRATargetDown)}
+	ctx := context.New()
+	layerCtx := ctx.In("layer_0")
+	layerCtx.In("attn").In("hf").VariableWithValue("q_proj", [][]float32{{1, 1}, {1, 1}})
+	layerCtx.In("attn").In(LoRAScope).In(string(LoRATargetQuery)).VariableWithValue(loraAName, [][]float32{{1}, {0}})
+	layerCtx.In("attn").In(LoRAScope).In(string(LoRATargetQuery)).VariableWithValue(loraBName, [][]float32{{1, 2}})
+	layerCtx.In("mlp").In("hf").VariableWithValue("down_proj", [][]float32{{1, 1}, {1, 1}})
+
+	FreezeBaseWeights(ctx)
+	require.False(t, layerCtx.In("attn").In("hf").GetVariable("q_proj").Trainable)
+	require.True(t, layerCtx.In("attn").In(LoRAScope).In(string(LoRATargetQuery)).GetVariable(loraAName).Trainable)
+
+	// The adapter of the down projection was never created, so it is ignored.
+	require.NoError(t, MergeLoRA(ctx, config))
+	require.Equal(t, [][]float32{{1 + 16, 1}, {1 + 32, 1}}, layerCtx.In("attn").In("hf").GetVariable("q_proj").Value().Value())
+	require.Equal(t, [][]float32{{1, 1}, {1, 1}}, layerCtx.In("mlp").In("hf").GetVariable("down_proj").Value().Value())
+	require.Nil(t, layerCtx.In("attn").In(LoRAScope).In(string(LoRATargetQuery)).GetVariable(loraAName))
+
+	// Without LoRA configuration.
+	config.LoRA = nil
+	require.Error(t, MergeLoRA(ctx, config))
+}
@@ -0,0 +1,381 @@
+package transformers
+
+import (
+	"fmt"
+	"github.com/gomlx/gemma/trees"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gomlx/types/xslices"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"maps"
+)
+
+// PagedCache is a key/value cache organized in fixed-size blocks taken from a pool shared by all sequences,
+// each sequence addressing its blocks through a block table -- as opposed to Cache, which allocates
+// [BatchSize, Length] slots upfront.
+//
+// This allows sequences of very different lengths to share the memory without over-allocating, and sequences
+// with a common prefix (e.g.: the same system prompt) to share the blocks of the prefix (see ForkSequence).
+//
+// The block management is done in the host (in Go): for each step, StepInputs allocates the blocks needed for
+// the new tokens, and returns the block tables and write indices to be fed to GemmaWithPagedCache.
+//
+// Data is stored as a trees.Tree[*tensors.Tensor], with the first level being the layer names, and
+// the second level holding the pools of "k" and "v" (shaped [NumBlocks, BlockSize, numKVHeads, headDim]) and
+// the absolute "positions" of the tokens stored in each slot (shaped [NumBlocks, BlockSize]).
+// If Config.CacheDType is dtypes.Int8, it also holds the pools of scales "k_scale" and "v_scale".
+//
+// The block 0 is never allocated: it is used to pad the block tables.
+//
+// Unlike Cache, the local sliding attention layers don't use a rotating cache, and the total length of a
+// sequence is limited to Config.MaxCacheLength. But at each step they only gather the blocks that overlap their
+// window, while the global attention layers gather all the blocks in use (see StepInputs).
+//
+// As with the rotating cache of Cache, the local sliding attention layers assume the tokens of a sequence have
+// consecutive positions.
+//
+// PagedCache is not safe for concurrent use.
+type PagedCache struct {
+	// Config of the model.
+	Config *Config
+
+	// BlockSize is the number of tokens stored in each block.
+	BlockSize int
+
+	// NumBlocks is the total number of blocks in the pool, including the reserved padding block 0.
+	NumBlocks int
+
+	// MaxBlocksPerSequence is the number of blocks needed to hold Config.MaxCacheLength tokens, and
+	// the maximum size of the block tables returned by StepInputs.
+	MaxBlocksPerSequence int
+
+	// Data holds the pools of cached data, organized as a trees.Tree[*tensors.Tensor].
+	Data *trees.Tree[*tensors.Tensor]
+
+	sequences      map[int]*pagedSequence
+	nextSequenceID int
+	freeBlocks     []int
+	refCounts      []int
+}
+
+// pagedSequence holds the blocks used by a sequence, and its current length (number of tokens stored).
+type pagedSequence struct {
+	blocks []int
+	length int
+}
+
+// Keys in the per-layer cache tree fed to the graph, with the block tables and write indices.
+const (
+	pagedBlockTablesKey  = "block_tables"
+	pagedWriteIndicesKey = "write_indices"
+)
+
+// NewPagedCache creates a new PagedCache for the given model configuration, with a pool of numBlocks blocks
+// (one of which is reserved) of blockSize tokens each.
+//
+// The cache is stored in Config.CacheDType, or Config.DType if the former is not set.
+func NewPagedCache(config *Config, numBlocks, blockSize int) (*PagedCache, error) {
+	if blockSize <= 0 {
+		return nil, errors.Errorf("NewPagedCache(): blockSize must be > 0, got %d", blockSize)
+	}
+	if numBlocks < 2 {
+		return nil, errors.Errorf("NewPagedCache(): numBlocks must be >= 2 (block 0 is reserved), got %d", numBlocks)
+	}
+	cacheDType, err := cacheDTypeFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	c := &PagedCache{
+		Config:               config,
+		BlockSize:            blockSize,
+		NumBlocks:            numBlocks,
+		MaxBlocksPerSequence: (config.MaxCacheLength + blockSize - 1) / blockSize,
+		Data:                 trees.New[*tensors.Tensor](),
+		sequences:            make(map[int]*pagedSequence),
+		refCounts:            make([]int, numBlocks),
+	}
+	// Free blocks is used as a stack, lower blocks are allocated first.
+	c.freeBlocks = make([]int, 0, numBlocks-1)
+	for block := numBlocks - 1; block > 0; block-- {
+		c.freeBlocks = append(c.freeBlocks, block)
+	}
+
+	for layerIdx := range config.NumLayers {
+		treePath := []string{fmt.Sprintf("layer_%d", layerIdx)}
+		// The pool has the same layout as a dense cache, with the blocks in place of the batch.
+		err = createAttentionCache(c.Data, treePath, cacheDType, numBlocks, blockSize, config.NumKVHeads, config.HeadDim)
+		if err != nil {
+			return nil, err
+		}
+		// There is no rotating index in a paged cache.
+		delete(c.Data.Map[treePath[0]].Map, "end_index")
+	}
+	return c, nil
+}
+
+// NumFreeBlocks returns the number of blocks available for allocation.
+func (c *PagedCache) NumFreeBlocks() int {
+	return len(c.freeBlocks)
+}
+
+// NewSequence registers a new empty sequence in the cache, and returns its id.
+func (c *PagedCache) NewSequence() int {
+	id := c.nextSequenceID
+	c.nextSequenceID++
+	c.sequences[id] = &pagedSequence{}
+	return id
+}
+
+// ForkSequence creates a new sequence sharing the blocks of the first prefixLength tokens of the sequence srcID.
+//
+// Only full blocks are shared, so the number of tokens actually shared (sharedLength) is prefixLength rounded down
+// to a multiple of BlockSize: the remaining tokens of the prefix must be fed to the new sequence as usual.
+// Since sequences only append to the cache, shared blocks are never written to again.
+func (c *PagedCache) ForkSequence(srcID, prefixLength int) (id, sharedLength int, err error) {
+	src, found := c.sequences[srcID]
+	if !found {
+		return 0, 0, errors.Errorf("PagedCache.ForkSequence(): unknown sequence id %d", srcID)
+	}
+	if prefixLength < 0 || prefixLength > src.length {
+		return 0, 0, errors.Errorf("PagedCache.ForkSequence(): prefixLength=%d out of range for sequence %d of length %d",
+			prefixLength, srcID, src.length)
+	}
+	numShared := prefixLength / c.BlockSize
+	id = c.NewSequence()
+	seq := c.sequences[id]
+	seq.blocks = append(seq.blocks, src.blocks[:numShared]...)
+	seq.length = numShared * c.BlockSize
+	for _, block := range seq.blocks {
+		c.refCounts[block]++
+	}
+	return id, seq.length, nil
+}
+
+// FreeSequence removes the sequence from the cache, and returns its blocks to the pool, once they are no longer
+// shared with other sequences.
+func (c *PagedCache) FreeSequence(id int) error {
+	seq, found := c.sequences[id]
+	if !found {
+		return errors.Errorf("PagedCache.FreeSequence(): unknown sequence id %d", id)
+	}
+	for _, block := range seq.blocks {
+		c.refCounts[block]--
+		if c.refCounts[block] == 0 {
+			c.freeBlocks = append(c.freeBlocks, block)
+		}
+	}
+	delete(c.sequences, id)
+	return nil
+}
+
+// SequenceLength returns the number of tokens stored for the sequence.
+func (c *PagedCache) SequenceLength(id int) (int, error) {
+	seq, found := c.sequences[id]
+	if !found {
+		return 0, errors.Errorf("PagedCache.SequenceLength(): unknown sequence id %d", id)
+	}
+	return seq.length, nil
+}
+
+// StepInputs reserves space for numTokens new tokens in each of the given sequences, and returns the inputs
+// for GemmaWithPagedCache for this step:
+//
+//   - blockTables: the blocks of each sequence, shaped int32[len(ids), numTableBlocks], padded with block 0.
+//     numTableBlocks is the number of blocks used by the longest of the sequences, rounded up to a power of 2 (and
+//     at most MaxBlocksPerSequence): so the attention only gathers the blocks in use, while the number of distinct
+//     shapes -- and so of graphs compiled -- is kept small.
+//   - writeIndices: the current length of each sequence, that is, where the new tokens are to be written,
+//     shaped int32[len(ids)].
+//
+// The sequences lengths are advanced by numTokens. If there are not enough free blocks, or a sequence would
+// grow beyond Config.MaxCacheLength, it returns an error, and the cache is left unchanged.
+func (c *PagedCache) StepInputs(ids []int, numTokens int) (blockTables, writeIndices *tensors.Tensor, err error) {
+	if len(ids) == 0 || numTokens <= 0 {
+		return nil, nil, errors.Errorf("PagedCache.StepInputs(): requires at least one sequence and numTokens > 0, "+
+			"got %d sequences and numTokens=%d", len(ids), numTokens)
+	}
+	seqs := make([]*pagedSequence, len(ids))
+	requiredBlocks, numUsedBlocks := 0, 0
+	for ii, id := range ids {
+		seq, found := c.sequences[id]
+		if !found {
+			return nil, nil, errors.Errorf("PagedCache.StepInputs(): unknown sequence id %d", id)
+		}
+		for _, previous := range seqs[:ii] {
+			if previous == seq {
+				return nil, nil, errors.Errorf("PagedCache.StepInputs(): sequence id %d given more than once", id)
+			}
+		}
+		seqs[ii] = seq
+		newLength := seq.length + numTokens
+		if newLength > c.Config.MaxCacheLength {
+			return nil, nil, errors.Errorf("PagedCache.StepInputs(): sequence %d would grow to %d tokens, beyond "+
+				"Config.MaxCacheLength=%d", id, newLength, c.Config.MaxCacheLength)
+		}
+		requiredBlocks += (newLength+c.BlockSize-1)/c.BlockSize - len(seq.blocks)
+		numUsedBlocks = max(numUsedBlocks, (newLength+c.BlockSize-1)/c.BlockSize)
+	}
+	if requiredBlocks > len(c.freeBlocks) {
+		return nil, nil, errors.Errorf("PagedCache.StepInputs(): %d new blocks required, but only %d are free",
+			requiredBlocks, len(c.freeBlocks))
+	}
+
+	numTableBlocks := 1
+	for numTableBlocks < numUsedBlocks {
+		numTableBlocks *= 2
+	}
+	numTableBlocks = min(numTableBlocks, c.MaxBlocksPerSequence)
+	blockTables = tensors.FromShape(shapes.Make(dtypes.Int32, len(ids), numTableBlocks))
+	writeIndices = tensors.FromShape(shapes.Make(dtypes.Int32, len(ids)))
+	tensors.MutableFlatData(blockTables, func(flatTables []int32) {
+		tensors.MutableFlatData(writeIndices, func(flatIndices []int32) {
+			for ii, seq := range seqs {
+				flatIndices[ii] = int32(seq.length)
+				seq.length += numTokens
+				for len(seq.blocks)*c.BlockSize < seq.length {
+					block := c.freeBlocks[len(c.freeBlocks)-1]
+					c.freeBlocks = c.freeBlocks[:len(c.freeBlocks)-1]
+					c.refCounts[block] = 1
+					seq.blocks = append(seq.blocks, block)
+				}
+				for blockIdx, block := range seq.blocks {
+					flatTables[ii*numTableBlocks+blockIdx] = int32(block)
+				}
+			}
+		})
+	})
+	return blockTables, writeIndices, nil
+}
+
+// GemmaWithPagedCache creates a forward path on a Gemma model for one decoding step, using a PagedCache.
+//
+// It takes as input the current tokens to decode currentTokens (shape [batchSize, sequenceLength]) along with
+// their currentPositions (shape [batchSize, sequenceLength]), the pools of the PagedCache (PagedCache.Data), and the
+// blockTables and writeIndices for the step, as returned by PagedCache.StepInputs.
+//
+// It updates the pools in cache in-place, and returns the logits (shape [batchSize, sequenceLength, <num_tokens>])
+// of the prediction of the next token.
+func GemmaWithPagedCache(ctx *context.Context, config *Config,
+	currentTokens, currentPositions *Node, cache *trees.Tree[*Node], blockTables, writeIndices *Node) *Node {
+	// Each layer sees its pools along with the block tables and write indices: the pools are shared with cache, so
+	// updates reflect back to it.
+	layersCache := trees.New[*Node]()
+	for layerName, layerPools := range cache.Map {
+		layerCache := trees.New[*Node]()
+		maps.Copy(layerCache.Map, layerPools.Map)
+		Must(layerCache.Set(trees.Path{pagedBlockTablesKey}, blockTables))
+		Must(layerCache.Set(trees.Path{pagedWriteIndicesKey}, writeIndices))
+		layersCache.Map[layerName] = layerCache
+	}
+	logits := GemmaWithCache(ctx, config, currentTokens, currentPositions, layersCache)
+	for layerName, layerPools := range cache.Map {
+		for name := range layerPools.Map {
+			layerPools.Map[name] = layersCache.Map[layerName].Map[name]
+		}
+	}
+	return logits
+}
+
+// updatePagedAttentionCache inserts the key and value projections of the current tokens (shaped
+// [batchSize, sequenceLength, numKVHeads, headDim]) in the blocks of the paged cache, along with their positions
+// (shaped [batchSize, sequenceLength]). See PagedCache.
+//
+// It returns the keys and values of the blocks of each sequence in its block table (shaped
+// [batchSize, numBlocks*BlockSize, numKVHeads, headDim]) and their positions (shaped [batchSize, numBlocks*BlockSize]),
+// -1 for the slots not used by the sequence. As in updateAttentionCache, the keys and values of a quantized cache are
+// returned with their scales, to be applied with scaleByCache.
+//
+// If windowSize > 0 (for the local sliding attention layers), only the blocks that may hold the last windowSize-1
+// tokens before the new ones, and the new ones, are returned, instead of all the blocks of the block table.
+func updatePagedAttentionCache(cache *trees.Tree[*Node], keyProjection, valueProjection, positions *Node,
+	windowSize int) (keys, values, keyScales, valueScales, keyPositions *Node) {
+	g := keyProjection.Graph()
+	dtype := keyProjection.DType()
+	blockTables := ConvertDType(Must1(cache.Get(pagedBlockTablesKey)), dtypes.Int32)   // [B, MB]
+	writeIndices := ConvertDType(Must1(cache.Get(pagedWriteIndicesKey)), dtypes.Int32) // [B]
+	batchSize := blockTables.Shape().Dim(0)
+	maxBlocks := blockTables.Shape().Dim(1)
+	seqLength := keyProjection.Shape().Dim(1)
+	blockSize := Must1(cache.Get("k")).Shape().Dim(1)
+
+	// Find the slot (block, offset) in the pool where each new token is to be written.
+	tokensShape := shapes.Make(dtypes.Int32, batchSize, seqLength)
+	sequenceIndices := Add(ExpandAxes(writeIndices, -1), Iota(g, tokensShape, 1))
+	blockIndices := DivScalar(sequenceIndices, blockSize)
+	offsets := ModScalar(sequenceIndices, blockSize)
+	batchIndices := Iota(g, tokensShape, 0)
+	blocks := Gather(blockTables, Concatenate([]*Node{ExpandAxes(batchIndices, -1), ExpandAxes(blockIndices, -1)}, -1))
+	slots := Reshape(Concatenate([]*Node{ExpandAxes(blocks, -1), ExpandAxes(offsets, -1)}, -1), batchSize*seqLength, 2)
+
+	// Select the blocks to attend to: by default all the blocks of the block tables.
+	numBlocks := maxBlocks
+	tableIndices := Iota(g, shapes.Make(dtypes.Int32, batchSize, maxBlocks), 1) // [B, numBlocks]
+	attendedBlocks := blockTables
+	if windowSize > 0 {
+		// Blocks from the one holding the token windowSize-1 before the first new token: the extra block accounts
+		// for the window not being aligned to the blocks.
+		numWindowBlocks := (windowSize-1+seqLength+blockSize-1)/blockSize + 1
+		if numWindowBlocks < maxBlocks {
+			numBlocks = numWindowBlocks
+			firstIndex := DivScalar(MaxScalar(AddScalar(writeIndices, -(windowSize-1)), 0), blockSize)
+			// Keep the blocks within the block table: starting earlier still covers the window.
+			firstIndex = MinScalar(firstIndex, maxBlocks-numBlocks)
+			tableIndices = Add(ExpandAxes(firstIndex, -1), Iota(g, shapes.Make(dtypes.Int32, batchSize, numBlocks), 1))
+			windowBatchIndices := Iota(g, tableIndices.Shape(), 0)
+			attendedBlocks = Gather(blockTables,
+				Concatenate([]*Node{ExpandAxes(windowBatchIndices, -1), ExpandAxes(tableIndices, -1)}, -1))
+		}
+	}
+
+	// update scatters the new values (flattening batch and sequence axes) into the pool, and returns
+	// the values of the attended blocks of each sequence, shaped [batchSize, numBlocks*BlockSize, ...].
+	update := func(name string, newValues *Node) *Node {
+		pool := Must1(cache.Get(name))
+		innerDims := newValues.Shape().Dimensions[2:]
+		pool = scatterUpdate(pool, slots, Reshape(newValues, append([]int{batchSize * seqLength}, innerDims...)...))
+		Must(cache.Set(trees.Path{name}, pool))
+		sequenceValues := Gather(pool, ExpandAxes(attendedBlocks, -1))
+		return Reshape(sequenceValues, append([]int{batchSize, numBlocks * blockSize}, innerDims...)...)
+	}
+
+	if _, found := cache.Map["k_scale"]; found {
+		quantizedKeys, newKeyScales := quantizeCacheValues(keyProjection, Must1(cache.Get("k")).DType())
+		quantizedValues, newValueScales := quantizeCacheValues(valueProjection, Must1(cache.Get("v")).DType())
+		keys, keyScales = ConvertDType(update("k", quantizedKeys), dtype), update("k_scale", newKeyScales)
+		values, valueScales = ConvertDType(update("v", quantizedValues), dtype), update("v_scale", newValueScales)
+	} else {
+		keys = update("k", keyProjection)
+		values = update("v", valueProjection)
+	}
+	keyPositions = update("positions", ConvertDType(positions, dtypes.Int32))
+
+	// Slots beyond the length of the sequence may hold stale values (from padding or blocks previously used by
+	// other sequences): they are marked as empty.
+	sequenceLengths := AddScalar(writeIndices, seqLength)
+	slotIndices := Add(MulScalar(ExpandAxes(tableIndices, -1), blockSize),
+		Iota(g, shapes.Make(dtypes.Int32, batchSize, numBlocks, blockSize), 2)) // Index of each slot in its sequence.
+	slotIndices = Reshape(slotIndices, batchSize, numBlocks*blockSize)
+	isUsed := LessThan(slotIndices, ExpandAxes(sequenceLengths, -1))
+	keyPositions = Where(isUsed, keyPositions, Scalar(g, dtypes.Int32, -1))
+	return
+}
+
+// scatterUpdate sets the slices of operand pointed by indices (shaped [numUpdates, indexedRank]) to the
+// updates (shaped [numUpdates, <operand dimensions not indexed>...]). Indices must be unique.
+//
+// It is implemented as a ScatterMin with the lowest value of the dtype (which sets the slices to it), followed by a
+// ScatterMax with the updates.
+func scatterUpdate(operand, indices, updates *Node) *Node {
+	g := operand.Graph()
+	dtype := operand.DType()
+	indexVectorAxis := indices.Rank() - 1
+	indexedAxes := xslices.Iota(0, indices.Shape().Dim(-1))
+	updateWindowAxes := xslices.Iota(1, updates.Rank()-1)
+	lowest := ConvertDType(Const(g, dtype.LowestValue()), dtype) // Int8.LowestValue() is not returned as an int8.
+	lowest = BroadcastToShape(lowest, updates.Shape())
+	operand = ScatterMin(operand, indices, lowest, indexVectorAxis, updateWindowAxes, indexedAxes, indexedAxes, false, true)
+	return ScatterMax(operand, indices, updates, indexVectorAxis, updateWindowAxes, indexedAxes, indexedAxes, false, true)
+}
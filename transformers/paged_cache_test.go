@@ -0,0 +1,175 @@
+package transformers
+
+import (
+	"github.com/gomlx/gemma/internal/testutil"
+	"github.com/gomlx/gemma/trees"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func createTestPagedCache(t *testing.T, numBlocks int) *PagedCache {
+	config := &Config{
+		DType:          dtypes.Float32,
+		NumLayers:      2,
+		NumKVHeads:     1,
+		HeadDim:        4,
+		MaxCacheLength: 16,
+	}
+	cache, err := NewPagedCache(config, numBlocks, 4)
+	require.NoError(t, err)
+	return cache
+}
+
+func TestPagedCache(t *testing.T) {
+	cache := createTestPagedCache(t, 8)
+	require.Equal(t, 4, cache.MaxBlocksPerSequence)
+	require.Equal(t, 7, cache.NumFreeBlocks())
+	keys, err := cache.Data.Get("layer_1", "k")
+	require.NoError(t, err)
+	require.Equal(t, []int{8, 4, 1, 4}, keys.Shape().Dimensions)
+	require.NotContains(t, cache.Data.Map["layer_1"].Map, "end_index")
+
+	seq0 := cache.NewSequence()
+	seq1 := cache.NewSequence()
+
+	// Prompts of different lengths.
+	_, _, err = cache.StepInputs([]int{seq0}, 6)
+	require.NoError(t, err)
+	blockTables, writeIndices, err := cache.StepInputs([]int{seq0, seq1}, 1)
+	require.NoError(t, err)
+	require.Equal(t, [][]int32{{1, 2}, {3, 0}}, blockTables.Value()) // Only the blocks in use.
+	require.Equal(t, []int32{6, 0}, writeIndices.Value())
+	require.Equal(t, 4, cache.NumFreeBlocks())
+
+	// Share the first (full) block of seq0.
+	seq2, sharedLength, err := cache.ForkSequence(seq0, 6)
+	require.NoError(t, err)
+	require.Equal(t, 4, sharedLength)
+	blockTables, writeIndices, err = cache.StepInputs([]int{seq2}, 3)
+	require.NoError(t, err)
+	require.Equal(t, [][]int32{{1, 4}}, blockTables.Value())
+	require.Equal(t, []int32{4}, writeIndices.Value())
+
+	// Shared block is only released once no sequence uses it.
+	require.NoError(t, cache.FreeSequence(seq0))
+	require.Equal(t, 4, cache.NumFreeBlocks())
+	require.NoError(t, cache.FreeSequence(seq2))
+	require.Equal(t, 6, cache.NumFreeBlocks())
+	require.Error(t, cache.FreeSequence(seq2))
+	length, err := cache.SequenceLength(seq1)
+	require.NoError(t, err)
+	require.Equal(t, 1, length)
+}
+
+func TestPagedCacheErrors(t *testing.T) {
+	cache := createTestPagedCache(t, 4)
+	seq0 := cache.NewSequence()
+	seq1 := cache.NewSequence()
+
+	// Beyond Config.MaxCacheLength.
+	_, _, err := cache.StepInputs([]int{seq0}, 17)
+	require.Error(t, err)
+
+	// Not enough blocks: cache must be left unchanged.
+	_, _, err = cache.StepInputs([]int{seq0, seq1}, 8)
+	require.Error(t, err)
+	require.Equal(t, 3, cache.NumFreeBlocks())
+	length, err := cache.SequenceLength(seq0)
+	require.NoError(t, err)
+	require.Equal(t, 0, length)
+
+	// Repeated and unknown sequences.
+	_, _, err = cache.StepInputs([]int{seq0, seq0}, 1)
+	require.Error(t, err)
+	_, _, err = cache.StepInputs([]int{seq0, 10}, 1)
+	require.Error(t, err)
+	_, _, err = cache.ForkSequence(seq0, 1)
+	require.Error(t, err)
+
+	var blockTables *tensors.Tensor
+	blockTables, _, err = cache.StepInputs([]int{seq0}, 12)
+	require.NoError(t, err)
+	require.Equal(t, [][]int32{{1, 2, 3, 0}}, blockTables.Value())
+}
+
+func TestPagedCacheBlockTablesBuckets(t *testing.T) {
+	cache := createTestPagedCache(t, 8) // BlockSize=4, MaxBlocksPerSequence=4.
+	seq := cache.NewSequence()
+	for _, tc := range []struct{ numTokens, wantTableBlocks int }{
+		{1, 1}, {4, 2}, {4, 4}, {6, 4}, // 1, 5 (2 blocks), 9 (3 blocks, rounded up to 4) and 15 tokens.
+	} {
+		blockTables, _, err := cache.StepInputs([]int{seq}, tc.numTokens)
+		require.NoError(t, err)
+		require.Equal(t, []int{1, tc.wantTableBlocks}, blockTables.Shape().Dimensions)
+	}
+}
+
+// pagedAttentionStep feeds one step of tokens with the given positions (one row per sequence) to the cache of
+// "layer_0" of a PagedCache with numKVHeads=headDim=1, using the positions as the keys and values. It returns the
+// keys and their positions attended to by each sequence.
+func pagedAttentionStep(t *testing.T, backend backends.Backend, cache *PagedCache, ids []int, positions [][]int32,
+	windowSize int) (keys [][]float32, keyPositions [][]int32) {
+	blockTables, writeIndices, err := cache.StepInputs(ids, len(positions[0]))
+	require.NoError(t, err)
+	poolNames := []string{"k", "v", "positions"}
+	layerData := cache.Data.Map["layer_0"]
+	exec := NewExec(backend, func(inputs []*Node) []*Node {
+		layerCache := trees.New[*Node]()
+		for ii, name := range poolNames {
+			Must(layerCache.Set(trees.Path{name}, inputs[ii]))
+		}
+		Must(layerCache.Set(trees.Path{pagedBlockTablesKey}, inputs[3]))
+		Must(layerCache.Set(trees.Path{pagedWriteIndicesKey}, inputs[4]))
+		tokenPositions := inputs[5]
+		projections := Reshape(ConvertDType(tokenPositions, dtypes.Float32),
+			tokenPositions.Shape().Dim(0), tokenPositions.Shape().Dim(1), 1, 1)
+		keys, _, _, _, keyPositions := updatePagedAttentionCache(layerCache, projections, projections, tokenPositions, windowSize)
+		outputs := []*Node{Reshape(keys, keyPositions.Shape().Dimensions...), keyPositions}
+		for _, name := range poolNames {
+			outputs = append(outputs, Must1(layerCache.Get(name)))
+		}
+		return outputs
+	})
+	var args []any
+	for _, name := range poolNames {
+		args = append(args, layerData.Map[name].Value)
+	}
+	outputs := exec.Call(append(args, blockTables, writeIndices, positions)...)
+	for ii, name := range poolNames {
+		layerData.Map[name].Value = outputs[2+ii]
+	}
+	return outputs[0].Value().([][]float32), outputs[1].Value().([][]int32)
+}
+
+func TestUpdatePagedAttentionCache(t *testing.T) {
+	backend := testutil.Backend(t)
+	config := &Config{DType: dtypes.Float32, NumLayers: 1, NumKVHeads: 1, HeadDim: 1, MaxCacheLength: 16}
+	cache, err := NewPagedCache(config, 10, 2) // MaxBlocksPerSequence=8.
+	require.NoError(t, err)
+	seq0, seq1 := cache.NewSequence(), cache.NewSequence()
+
+	// Prompt of seq0: 5 tokens in 3 blocks, table padded to 4 blocks, so 3 unused slots (position -1).
+	keys, keyPositions := pagedAttentionStep(t, backend, cache, []int{seq0}, [][]int32{{0, 1, 2, 3, 4}}, 0)
+	require.Equal(t, [][]int32{{0, 1, 2, 3, 4, -1, -1, -1}}, keyPositions)
+	require.Equal(t, []float32{0, 1, 2, 3, 4}, keys[0][:5])
+
+	// Prompt of seq1, then one token for both: the slots of seq1 beyond its length are not attended to.
+	pagedAttentionStep(t, backend, cache, []int{seq1}, [][]int32{{0, 1, 2}}, 0)
+	_, keyPositions = pagedAttentionStep(t, backend, cache, []int{seq0, seq1}, [][]int32{{5}, {3}}, 0)
+	require.Equal(t, [][]int32{{0, 1, 2, 3, 4, 5, -1, -1}, {0, 1, 2, 3, -1, -1, -1, -1}}, keyPositions)
+
+	// Local sliding layers only gather the blocks that may hold the window: with window 3 and new tokens at
+	// positions 6 and 7, 3 blocks from the one holding the position 4. They are clamped to the end of the block
+	// table (of 4 blocks), so the blocks gathered hold the positions 2 to 7.
+	keys, keyPositions = pagedAttentionStep(t, backend, cache, []int{seq0}, [][]int32{{6, 7}}, 3)
+	require.Equal(t, [][]int32{{2, 3, 4, 5, 6, 7}}, keyPositions)
+	require.Equal(t, []float32{2, 3, 4, 5, 6, 7}, keys[0])
+
+	// With a block table of 8 blocks, the blocks gathered hold the positions 6 to 11, the last 3 not used yet.
+	_, keyPositions = pagedAttentionStep(t, backend, cache, []int{seq0}, [][]int32{{8}}, 3)
+	require.Equal(t, [][]int32{{6, 7, 8, -1, -1, -1}}, keyPositions)
+}
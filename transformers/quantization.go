@@ -0,0 +1,624 @@
+package transformers
+
+import (
+	"fmt"
+	"github.com/gomlx/exceptions"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/pkg/errors"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Weights quantized with QuantizeWeightsInt8 are stored in two variables, replacing the original variable "X":
+//
+//   - "X_int8": the int8 quantized values, with the same shape as the original weights.
+//   - "X_int8_scale": float32 scales, one per output channel, shaped like the original weights, but with
+//     the contracting (input) axes set to 1, so the original weights are approximated by "X_int8" * "X_int8_scale".
+//
+// Weights quantized with QuantizeWeightsQ4 are stored in two or three variables, replacing the original variable "X":
+//
+//   - "X_q4": uint8 with the 4-bit quantized values (0 to 15) packed in pairs (the first in the lower bits), along
+//     the last axis, so the last dimension is half of the original one.
+//   - "X_q4_scale": float32 scales, one per group of consecutive values along the group axis (a contracting axis
+//     of the weights), shaped like the original weights, but with the dimension of the group axis divided by the
+//     group size. The group axis is the only axis where the dimensions of the scales and the weights differ.
+//   - "X_q4_zero": optional uint8 zero-points, one per group, shaped like the scales. If not present, the zero-point
+//     is 8, and the quantization is symmetric.
+//
+// The original weights are approximated by ("X_q4" - "X_q4_zero") * "X_q4_scale", for each group.
+const (
+	int8WeightsSuffix = "_int8"
+	int8ScaleSuffix   = "_int8_scale"
+	q4WeightsSuffix   = "_q4"
+	q4ScaleSuffix     = "_q4_scale"
+	q4ZeroSuffix      = "_q4_zero"
+)
+
+// weightsScaleDType is the dtype used for the scales of quantized weights.
+const weightsScaleDType = dtypes.Float32
+
+// quantizableWeights describes one weights variable that can be quantized.
+type quantizableWeights struct {
+	// scope relative to the model scope, and name of the variable.
+	scope []string
+	name  string
+
+	// contractingAxes are the axes of the weights contracted with the input, so there is one scale per
+	// element of the other (output) axes.
+	contractingAxes []int
+}
+
+// listQuantizableWeights returns the weights used by the model that can be quantized: all the linear projections
+// of the attention and feed-forward layers, and the embedding table.
+func listQuantizableWeights(config *Config) []quantizableWeights {
+	weights := []quantizableWeights{
+		// One scale per token embedding, used both to embed and to decode tokens.
+		{[]string{"embedder"}, "input_embedding", []int{1}},
+	}
+	for layerIdx := range config.NumLayers {
+		layerName := fmt.Sprintf("layer_%d", layerIdx)
+		attn := []string{layerName, "attn"}
+		mlp := []string{layerName, "mlp"}
+		if config.HuggingFaceVersion {
+			// Projections are shaped [outputDim, inputDim].
+			for _, name := range []string{"q_proj", "k_proj", "v_proj", "o_proj"} {
+				weights = append(weights, quantizableWeights{append(attn, "hf"), name, []int{1}})
+			}
+			for _, name := range []string{"gating_proj", "up_proj", "down_proj"} {
+				weights = append(weights, quantizableWeights{append(mlp, "hf"), name, []int{1}})
+			}
+			continue
+		}
+		if config.UseQKV {
+			weights = append(weights, quantizableWeights{append(attn, "qkv_einsum"), "w", []int{2}}) // [3, N, D, H]
+		} else {
+			weights = append(weights,
+				quantizableWeights{append(attn, "q_einsum"), "w", []int{1}},  // [N, D, H]
+				quantizableWeights{append(attn, "kv_einsum"), "w", []int{2}}) // [2, K, D, H]
+		}
+		weights = append(weights, quantizableWeights{append(attn, "attn_vec_einsum"), "w", []int{0, 1}}) // [N, H, D]
+		if config.TransposeGatingEinsum {
+			weights = append(weights, quantizableWeights{mlp, "gating_einsum", []int{2}}) // [2, F, D]
+		} else {
+			weights = append(weights, quantizableWeights{mlp, "gating_einsum", []int{1}}) // [2, D, F]
+		}
+		weights = append(weights, quantizableWeights{mlp, "linear", []int{0}}) // [F, D]
+	}
+	return weights
+}
+
+// QuantizeWeightsInt8 quantizes the weights of the model to int8, with symmetric per-channel scales (one per output
+// channel). It replaces the variables of the linear projections of the attention and feed-forward layers, and the
+// embedding table, by their quantized values and scales: the quantized variables are no longer trainable.
+//
+// The weights are dequantized on the fly by the model, so this cuts the memory used by the weights to about half
+// (from bfloat16), at the cost of some precision.
+//
+// The ctx scope has to be set to the model variables (see NewConfigFromContext), and the quantization is done
+// in the host. Weights already quantized (with any method) are left untouched.
+func QuantizeWeightsInt8(ctx *context.Context, config *Config) error {
+	err := forEachQuantizableWeights(ctx, config, true,
+		func(scopedCtx *context.Context, weights quantizableWeights, values []float32, dims []int) error {
+			quantized, scales, scalesDims := quantizeInt8(values, dims, weights.contractingAxes)
+			scopedCtx.VariableWithValue(weights.name+int8WeightsSuffix, tensors.FromFlatDataAndDimensions(quantized, dims...)).
+				SetTrainable(false)
+			scopedCtx.VariableWithValue(weights.name+int8ScaleSuffix, tensors.FromFlatDataAndDimensions(scales, scalesDims...)).
+				SetTrainable(false)
+			return nil
+		})
+	return errors.WithMessage(err, "QuantizeWeightsInt8()")
+}
+
+// QuantizeWeightsQ4 quantizes the weights of the linear projections of the attention and feed-forward layers
+// to 4 bits, with one scale (and optionally one zero-point) per group of groupSize consecutive values along the
+// contracting (input) axis of the weights -- the last one, if there is more than one, as in the Kaggle
+// "attn_vec_einsum". So, as with QuantizeWeightsInt8, each output channel has its own scales.
+// The quantized variables are no longer trainable.
+//
+// The embedding table is not quantized by QuantizeWeightsQ4, since it is too sensitive to 4-bit quantization,
+// but it can be quantized to int8 by calling QuantizeWeightsInt8 afterwards.
+//
+// If useZeroPoint is false, quantization is symmetric (around 0), otherwise the range of each group is
+// quantized independently, using a zero-point, at the cost of slightly more memory.
+//
+// groupSize must be even and divide the dimension of the contracting axis of the weights: typical values are 32, 64
+// or 128. The last dimension of the weights must be even, since the quantized values are packed in pairs along it.
+//
+// The weights are dequantized on the fly by the model, so this cuts the memory used by the weights to a bit more
+// than a quarter (from bfloat16), at the cost of some precision.
+//
+// The ctx scope has to be set to the model variables (see NewConfigFromContext), and the quantization is done
+// in the host. Weights already quantized (with any method) are left untouched.
+func QuantizeWeightsQ4(ctx *context.Context, config *Config, groupSize int, useZeroPoint bool) error {
+	if groupSize <= 0 || groupSize%2 != 0 {
+		return errors.Errorf("QuantizeWeightsQ4(): groupSize must be even and > 0, got %d", groupSize)
+	}
+	err := forEachQuantizableWeights(ctx, config, false,
+		func(scopedCtx *context.Context, weights quantizableWeights, values []float32, dims []int) error {
+			groupAxis := slices.Max(weights.contractingAxes)
+			if dims[groupAxis]%groupSize != 0 {
+				return errors.Errorf("variable %q in scope %q has contracting axis %d of dimension %d, not "+
+					"divisible by groupSize=%d", weights.name, scopedCtx.Scope(), groupAxis, dims[groupAxis], groupSize)
+			}
+			if dims[len(dims)-1]%2 != 0 {
+				return errors.Errorf("variable %q in scope %q has an odd last dimension %d, the quantized values "+
+					"can't be packed in pairs", weights.name, scopedCtx.Scope(), dims[len(dims)-1])
+			}
+			packed, scales, zeros, scalesDims := quantizeQ4(values, dims, groupAxis, groupSize, useZeroPoint)
+			packedDims := slices.Clone(dims)
+			packedDims[len(dims)-1] /= 2
+			scopedCtx.VariableWithValue(weights.name+q4WeightsSuffix, tensors.FromFlatDataAndDimensions(packed, packedDims...)).
+				SetTrainable(false)
+			scopedCtx.VariableWithValue(weights.name+q4ScaleSuffix, tensors.FromFlatDataAndDimensions(scales, scalesDims...)).
+				SetTrainable(false)
+			if useZeroPoint {
+				scopedCtx.VariableWithValue(weights.name+q4ZeroSuffix, tensors.FromFlatDataAndDimensions(zeros, scalesDims...)).
+					SetTrainable(false)
+			}
+			return nil
+		})
+	return errors.WithMessage(err, "QuantizeWeightsQ4()")
+}
+
+// SetQuantizedWeightsQ4 creates the variables of the weights with the given name and dimensions in ctx, quantized
+// to 4 bits elsewhere, in the same format used by QuantizeWeightsQ4: it can be used to load weights already
+// quantized (e.g.: from a GGUF file) without dequantizing them.
+//
+// The quantized values (from 0 to 15) are given one per element, and they are packed by SetQuantizedWeightsQ4.
+// There is one scale (and optionally one zero-point) per group of consecutive values along the last axis, which
+// must be the contracting axis of the weights, as in the HuggingFace layout: the group size is inferred from the
+// number of scales. If zeros is nil, the zero-point is 8.
+func SetQuantizedWeightsQ4(ctx *context.Context, name string, dims []int, quantized []uint8, scales []float32, zeros []uint8) error {
+	size := 1
+	for _, dim := range dims {
+		size *= dim
+	}
+	if len(dims) == 0 || len(quantized) != size || dims[len(dims)-1]%2 != 0 {
+		return errors.Errorf("SetQuantizedWeightsQ4(%q): %d quantized values for dimensions %v, the last of which "+
+			"must be even", name, len(quantized), dims)
+	}
+	lastDim := dims[len(dims)-1]
+	if len(scales) == 0 || size%len(scales) != 0 || lastDim%(size/len(scales)) != 0 {
+		return errors.Errorf("SetQuantizedWeightsQ4(%q): %d scales don't divide the last dimension of %v in groups",
+			name, len(scales), dims)
+	}
+	if zeros != nil && len(zeros) != len(scales) {
+		return errors.Errorf("SetQuantizedWeightsQ4(%q): %d zero-points, but %d scales", name, len(zeros), len(scales))
+	}
+	groupSize := size / len(scales)
+	packed := make([]uint8, size/2)
+	for ii, q := range quantized {
+		packed[ii/2] |= (q & 0xF) << (4 * (ii % 2))
+	}
+	packedDims := slices.Clone(dims)
+	packedDims[len(dims)-1] = lastDim / 2
+	scalesDims := slices.Clone(dims)
+	scalesDims[len(dims)-1] = lastDim / groupSize
+	ctx = ctx.Checked(false)
+	ctx.VariableWithValue(name+q4WeightsSuffix, tensors.FromFlatDataAndDimensions(packed, packedDims...)).
+		SetTrainable(false)
+	ctx.VariableWithValue(name+q4ScaleSuffix, tensors.FromFlatDataAndDimensions(scales, scalesDims...)).
+		SetTrainable(false)
+	if zeros != nil {
+		ctx.VariableWithValue(name+q4ZeroSuffix, tensors.FromFlatDataAndDimensions(zeros, scalesDims...)).
+			SetTrainable(false)
+	}
+	return nil
+}
+
+// forEachQuantizableWeights calls quantizeFn for each of the model weights that can be quantized, and that are not
+// quantized yet, with a context set to the scope of the weights and their values converted to float32.
+// The original variable is deleted after quantizeFn succeeds.
+//
+// The embedding table is only included if includeEmbedding is true.
+func forEachQuantizableWeights(ctx *context.Context, config *Config, includeEmbedding bool,
+	quantizeFn func(scopedCtx *context.Context, weights quantizableWeights, values []float32, dims []int) error) error {
+	for _, weights := range listQuantizableWeights(config) {
+		if !includeEmbedding && weights.name == "input_embedding" {
+			continue
+		}
+		scopedCtx := ctx
+		for _, p := range weights.scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		v := scopedCtx.GetVariable(weights.name)
+		if v == nil {
+			if scopedCtx.GetVariable(weights.name+int8WeightsSuffix) != nil ||
+				scopedCtx.GetVariable(weights.name+q4WeightsSuffix) != nil {
+				continue // Already quantized.
+			}
+			return errors.Errorf("variable %q not found in scope %q", weights.name, scopedCtx.Scope())
+		}
+		values, err := tensorToFloat32(v.Value())
+		if err != nil {
+			return errors.WithMessagef(err, "variable %q in scope %q", weights.name, scopedCtx.Scope())
+		}
+		dims := v.Shape().Dimensions
+		if slices.Max(weights.contractingAxes) >= len(dims) {
+			return errors.Errorf("variable %q in scope %q shaped %s, expected rank > %d",
+				weights.name, scopedCtx.Scope(), v.Shape(), slices.Max(weights.contractingAxes))
+		}
+		err = quantizeFn(scopedCtx.Checked(false), weights, values, dims)
+		if err != nil {
+			return err
+		}
+		scopedCtx.DeleteVariable(scopedCtx.Scope(), weights.name)
+	}
+	return nil
+}
+
+// tensorToFloat32 returns the values of a float tensor converted to float32.
+func tensorToFloat32(t *tensors.Tensor) (values []float32, err error) {
+	switch t.DType() {
+	case dtypes.Float32:
+		tensors.ConstFlatData(t, func(flat []float32) {
+			values = slices.Clone(flat)
+		})
+	case dtypes.Float64:
+		tensors.ConstFlatData(t, func(flat []float64) {
+			values = make([]float32, len(flat))
+			for ii, v := range flat {
+				values[ii] = float32(v)
+			}
+		})
+	case dtypes.BFloat16:
+		tensors.ConstFlatData(t, func(flat []bfloat16.BFloat16) {
+			values = make([]float32, len(flat))
+			for ii, v := range flat {
+				values[ii] = v.Float32()
+			}
+		})
+	default:
+		err = errors.Errorf("dtype %s not supported for quantization, only float32, float64 and bfloat16", t.DType())
+	}
+	return
+}
+
+// channelIndices returns for each element of a tensor with the given dimensions, the flat index of its channel,
+// where a channel is identified by its indices in all axes except the contractingAxes. It also returns the
+// dimensions of the channels: the same as dims, with the contractingAxes set to 1.
+func channelIndices(dims []int, contractingAxes []int) (indices []int, channelDims []int) {
+	channelDims = slices.Clone(dims)
+	for _, axis := range contractingAxes {
+		channelDims[axis] = 1
+	}
+	channelStrides := make([]int, len(dims))
+	stride := 1
+	for axis := len(dims) - 1; axis >= 0; axis-- {
+		if channelDims[axis] != 1 {
+			channelStrides[axis] = stride
+		}
+		stride *= channelDims[axis]
+	}
+
+	size := 1
+	for _, dim := range dims {
+		size *= dim
+	}
+	indices = make([]int, size)
+	position := make([]int, len(dims))
+	channelIdx := 0
+	for ii := range indices {
+		indices[ii] = channelIdx
+		// Increment position, starting from the last axis.
+		for axis := len(dims) - 1; axis >= 0; axis-- {
+			position[axis]++
+			channelIdx += channelStrides[axis]
+			if position[axis] < dims[axis] {
+				break
+			}
+			channelIdx -= position[axis] * channelStrides[axis]
+			position[axis] = 0
+		}
+	}
+	return
+}
+
+// q4GroupIndices returns for each element of a tensor with the given dimensions, the flat index of its group of
+// groupSize consecutive values along groupAxis. It also returns the dimensions of the groups: the same as dims, with
+// the dimension of groupAxis divided by groupSize.
+func q4GroupIndices(dims []int, groupAxis, groupSize int) (indices []int, groupsDims []int) {
+	groupsDims = slices.Clone(dims)
+	groupsDims[groupAxis] /= groupSize
+	innerSize := 1 // Number of elements of the axes after groupAxis.
+	for _, dim := range dims[groupAxis+1:] {
+		innerSize *= dim
+	}
+	size := innerSize
+	for _, dim := range dims[:groupAxis+1] {
+		size *= dim
+	}
+	indices = make([]int, size)
+	for ii := range indices {
+		outerIdx, axisIdx, innerIdx := ii/(innerSize*dims[groupAxis]), (ii/innerSize)%dims[groupAxis], ii%innerSize
+		indices[ii] = (outerIdx*groupsDims[groupAxis]+axisIdx/groupSize)*innerSize + innerIdx
+	}
+	return
+}
+
+// q4GroupAxis returns the group axis of Q4 quantized weights with the given (unpacked) dimensions, and the dimensions
+// of their scales: the only axis where they differ.
+func q4GroupAxis(dims, scalesDims []int) (int, error) {
+	groupAxis := -1
+	if len(dims) == len(scalesDims) {
+		for axis, dim := range dims {
+			if dim == scalesDims[axis] {
+				continue
+			}
+			if groupAxis != -1 || scalesDims[axis] <= 0 || dim%scalesDims[axis] != 0 {
+				groupAxis = -1
+				break
+			}
+			groupAxis = axis
+		}
+	}
+	if groupAxis == -1 {
+		return -1, errors.Errorf("Q4 scales with dimensions %v don't match groups of weights with dimensions %v",
+			scalesDims, dims)
+	}
+	return groupAxis, nil
+}
+
+// quantizeInt8 quantizes values with the given dimensions to int8, with one symmetric scale per channel
+// (see channelIndices).
+func quantizeInt8(values []float32, dims []int, contractingAxes []int) (quantized []int8, scales []float32, scalesDims []int) {
+	const maxQuantized = 127
+	indices, scalesDims := channelIndices(dims, contractingAxes)
+	numChannels := 1
+	for _, dim := range scalesDims {
+		numChannels *= dim
+	}
+	scales = make([]float32, numChannels)
+	for ii, v := range values {
+		scales[indices[ii]] = max(scales[indices[ii]], float32(math.Abs(float64(v))))
+	}
+	for ii := range scales {
+		scales[ii] /= maxQuantized
+	}
+	quantized = make([]int8, len(values))
+	for ii, v := range values {
+		scale := scales[indices[ii]]
+		if scale == 0 {
+			continue
+		}
+		quantized[ii] = int8(max(-maxQuantized, min(maxQuantized, math.Round(float64(v/scale)))))
+	}
+	return
+}
+
+// quantizeQ4 quantizes values with the given dimensions to 4 bits, with one scale (and optionally one zero-point)
+// per group of groupSize consecutive values along groupAxis (see q4GroupIndices). The quantized values are packed in
+// pairs in each byte, in the order of values, the first in the lower 4 bits.
+//
+// If useZeroPoint is false, zeros is nil, and an implicit zero-point of 8 is used.
+func quantizeQ4(values []float32, dims []int, groupAxis, groupSize int, useZeroPoint bool) (
+	packed []uint8, scales []float32, zeros []uint8, scalesDims []int) {
+	indices, scalesDims := q4GroupIndices(dims, groupAxis, groupSize)
+	numGroups := len(values) / groupSize
+	// Range of each group, always including 0, so it is exactly represented.
+	minValues, maxValues := make([]float64, numGroups), make([]float64, numGroups)
+	for ii, v := range values {
+		groupIdx := indices[ii]
+		minValues[groupIdx] = min(minValues[groupIdx], float64(v))
+		maxValues[groupIdx] = max(maxValues[groupIdx], float64(v))
+	}
+	scales = make([]float32, numGroups)
+	zeroPoints := make([]float64, numGroups)
+	if useZeroPoint {
+		zeros = make([]uint8, numGroups)
+	}
+	for groupIdx := range numGroups {
+		var scale, zero float64
+		if useZeroPoint {
+			scale = (maxValues[groupIdx] - minValues[groupIdx]) / 15
+			if scale > 0 {
+				zero = max(0, min(15, math.Round(-minValues[groupIdx]/scale)))
+			}
+			zeros[groupIdx] = uint8(zero)
+		} else {
+			scale = max(-minValues[groupIdx], maxValues[groupIdx]) / 7
+			zero = 8
+		}
+		scales[groupIdx] = float32(scale)
+		zeroPoints[groupIdx] = zero
+	}
+	packed = make([]uint8, len(values)/2)
+	for ii, v := range values {
+		scale, zero := float64(scales[indices[ii]]), zeroPoints[indices[ii]]
+		q := zero
+		if scale > 0 {
+			q = max(0, min(15, math.Round(float64(v)/scale)+zero))
+		}
+		packed[ii/2] |= uint8(q) << (4 * (ii % 2))
+	}
+	return
+}
+
+// QuantizedVariableBaseName returns the name of the original weights variable, if the variable with the given name
+// was created by QuantizeWeightsInt8 or QuantizeWeightsQ4, and whether it holds the quantized values (as opposed to
+// their scales or zero-points). It returns an empty baseName for any other variable.
+func QuantizedVariableBaseName(name string) (baseName string, isValues bool) {
+	for _, suffix := range []string{int8ScaleSuffix, q4ScaleSuffix, q4ZeroSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), false
+		}
+	}
+	for _, suffix := range []string{int8WeightsSuffix, q4WeightsSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+// DequantizeWeights returns the value of the weights variable with the given name in ctx, converted to dtype.
+// If the weights were quantized (see QuantizeWeightsInt8 and QuantizeWeightsQ4) they are dequantized in the host,
+// so the quantization error is preserved, but the returned tensor takes the memory of the unquantized weights.
+//
+// It returns nil (and no error) if the weights are not found in ctx.
+func DequantizeWeights(ctx *context.Context, name string, dtype dtypes.DType) (*tensors.Tensor, error) {
+	var values []float32
+	var dims []int
+	if packedVar := ctx.GetVariable(name + q4WeightsSuffix); packedVar != nil {
+		scalesVar := ctx.GetVariable(name + q4ScaleSuffix)
+		if scalesVar == nil {
+			return nil, errors.Errorf("missing scales %q for quantized weights in scope %q", name+q4ScaleSuffix, ctx.Scope())
+		}
+		packed := tensors.CopyFlatData[uint8](packedVar.Value())
+		scales, err := tensorToFloat32(scalesVar.Value())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "scales of quantized weights %q in scope %q", name, ctx.Scope())
+		}
+		var zeros []uint8
+		if zerosVar := ctx.GetVariable(name + q4ZeroSuffix); zerosVar != nil {
+			zeros = tensors.CopyFlatData[uint8](zerosVar.Value())
+		}
+		dims = slices.Clone(packedVar.Shape().Dimensions)
+		dims[len(dims)-1] *= 2
+		scalesDims := scalesVar.Shape().Dimensions
+		groupAxis, err := q4GroupAxis(dims, scalesDims)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "quantized weights %q in scope %q", name, ctx.Scope())
+		}
+		indices, _ := q4GroupIndices(dims, groupAxis, dims[groupAxis]/scalesDims[groupAxis])
+		values = make([]float32, 2*len(packed))
+		for ii := range values {
+			q := (packed[ii/2] >> (4 * (ii % 2))) & 0xF
+			zero := float32(8)
+			if zeros != nil {
+				zero = float32(zeros[indices[ii]])
+			}
+			values[ii] = (float32(q) - zero) * scales[indices[ii]]
+		}
+
+	} else if quantizedVar := ctx.GetVariable(name + int8WeightsSuffix); quantizedVar != nil {
+		scalesVar := ctx.GetVariable(name + int8ScaleSuffix)
+		if scalesVar == nil {
+			return nil, errors.Errorf("missing scales %q for quantized weights in scope %q", name+int8ScaleSuffix, ctx.Scope())
+		}
+		scales, err := tensorToFloat32(scalesVar.Value())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "scales of quantized weights %q in scope %q", name, ctx.Scope())
+		}
+		dims = quantizedVar.Shape().Dimensions
+		scalesDims := scalesVar.Shape().Dimensions
+		if len(scalesDims) != len(dims) {
+			return nil, errors.Errorf("quantized weights %q in scope %q shaped %s, but scales shaped %s",
+				name, ctx.Scope(), quantizedVar.Shape(), scalesVar.Shape())
+		}
+		var contractingAxes []int
+		for axis, dim := range scalesDims {
+			if dim == 1 {
+				contractingAxes = append(contractingAxes, axis)
+			}
+		}
+		indices, _ := channelIndices(dims, contractingAxes)
+		quantized := tensors.CopyFlatData[int8](quantizedVar.Value())
+		values = make([]float32, len(quantized))
+		for ii, q := range quantized {
+			values[ii] = float32(q) * scales[indices[ii]]
+		}
+
+	} else if v := ctx.GetVariable(name); v != nil {
+		if v.Shape().DType == dtype {
+			return v.Value(), nil
+		}
+		var err error
+		values, err = tensorToFloat32(v.Value())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "variable %q in scope %q", name, ctx.Scope())
+		}
+		dims = v.Shape().Dimensions
+
+	} else {
+		return nil, nil
+	}
+	return float32ToTensor(values, shapes.Make(dtype, dims...))
+}
+
+// weightsValue returns the value of the weights variable with the given name and shape in ctx.
+//
+// If the weights were quantized (see QuantizeWeightsInt8 and QuantizeWeightsQ4), it dequantizes them on the fly
+// to shape.DType. Otherwise, it creates or reuses the variable with ctx.VariableWithShape.
+func weightsValue(ctx *context.Context, g *Graph, name string, shape shapes.Shape) *Node {
+	if packedVar := ctx.GetVariable(name + q4WeightsSuffix); packedVar != nil {
+		packedDims := slices.Clone(shape.Dimensions)
+		packedDims[len(packedDims)-1] /= 2
+		if !slices.Equal(packedVar.Shape().Dimensions, packedDims) {
+			exceptions.Panicf("Q4 quantized weights %q in scope %q shaped %s, but expected dimensions %v (packed)",
+				packedVar.Name(), ctx.Scope(), packedVar.Shape(), packedDims)
+		}
+		scales := quantizedScales(ctx, g, name+q4ScaleSuffix)
+		var zeros *Node
+		if zerosVar := ctx.GetVariable(name + q4ZeroSuffix); zerosVar != nil {
+			zeros = zerosVar.ValueGraph(g)
+		}
+		return dequantizeQ4(packedVar.ValueGraph(g), scales, zeros, shape.DType)
+	}
+	if quantizedVar := ctx.GetVariable(name + int8WeightsSuffix); quantizedVar != nil {
+		if !slices.Equal(quantizedVar.Shape().Dimensions, shape.Dimensions) {
+			exceptions.Panicf("quantized weights %q in scope %q shaped %s, but expected dimensions %v",
+				quantizedVar.Name(), ctx.Scope(), quantizedVar.Shape(), shape.Dimensions)
+		}
+		scales := quantizedScales(ctx, g, name+int8ScaleSuffix)
+		return dequantizeInt8(quantizedVar.ValueGraph(g), scales, shape.DType)
+	}
+	return ctx.VariableWithShape(name, shape).ValueGraph(g)
+}
+
+// quantizedScales returns the value of the variable with the scales of quantized weights, or panics if it is missing.
+func quantizedScales(ctx *context.Context, g *Graph, scalesName string) *Node {
+	scalesVar := ctx.GetVariable(scalesName)
+	if scalesVar == nil {
+		exceptions.Panicf("missing scales %q for quantized weights in scope %q", scalesName, ctx.Scope())
+	}
+	return scalesVar.ValueGraph(g)
+}
+
+// dequantizeInt8 reverts quantizeInt8: scales must have the same rank as quantized, and it is broadcast over
+// the contracting axes.
+func dequantizeInt8(quantized, scales *Node, dtype dtypes.DType) *Node {
+	values := Mul(ConvertDType(quantized, weightsScaleDType), ConvertDType(scales, weightsScaleDType))
+	return ConvertDType(values, dtype)
+}
+
+// dequantizeQ4 reverts quantizeQ4: packed is shaped [..., lastDim/2], and scales and zeros (optional)
+// are shaped like the unpacked values, with the dimension of the group axis divided by the group size.
+//
+// The 4-bit values are unpacked with integer arithmetic, and it returns the values shaped [..., lastDim].
+func dequantizeQ4(packed, scales, zeros *Node, dtype dtypes.DType) *Node {
+	g := packed.Graph()
+	packedInt := ConvertDType(packed, dtypes.Int32)
+	low := ModScalar(packedInt, 16)
+	high := DivScalar(packedInt, 16)
+	quantized := Concatenate([]*Node{ExpandAxes(low, -1), ExpandAxes(high, -1)}, -1) // [..., lastDim/2, 2]
+	quantized = ConvertDType(quantized, weightsScaleDType)
+
+	// Split the group axis in groups: [..., numGroups, groupSize, ...].
+	dims := slices.Clone(packed.Shape().Dimensions)
+	dims[len(dims)-1] *= 2
+	groupAxis, err := q4GroupAxis(dims, scales.Shape().Dimensions)
+	if err != nil {
+		exceptions.Panicf("dequantizeQ4(): %v", err)
+	}
+	numGroups := scales.Shape().Dim(groupAxis)
+	groupedDims := append(slices.Clone(dims[:groupAxis]), numGroups, dims[groupAxis]/numGroups)
+	groupedDims = append(groupedDims, dims[groupAxis+1:]...)
+	quantized = Reshape(quantized, groupedDims...)
+
+	var zeroPoint *Node
+	if zeros != nil {
+		zeroPoint = ExpandAxes(ConvertDType(zeros, weightsScaleDType), groupAxis+1)
+	} else {
+		zeroPoint = Scalar(g, weightsScaleDType, 8)
+	}
+	values := Mul(Sub(quantized, zeroPoint), ExpandAxes(ConvertDType(scales, weightsScaleDType), groupAxis+1))
+	values = Reshape(values, dims...)
+	return ConvertDType(values, dtype)
+}
@@ -0,0 +1,286 @@
+package transformers
+
+import (
+	"github.com/gomlx/gemma/internal/testutil"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"slices"
+	"testing"
+)
+
+func TestChannelIndices(t *testing.T) {
+	indices, channelDims := channelIndices([]int{2, 3, 2}, []int{1})
+	require.Equal(t, []int{2, 1, 2}, channelDims)
+	require.Equal(t, []int{0, 1, 0, 1, 0, 1, 2, 3, 2, 3, 2, 3}, indices)
+
+	indices, channelDims = channelIndices([]int{2, 2, 3}, []int{0, 1})
+	require.Equal(t, []int{1, 1, 3}, channelDims)
+	require.Equal(t, []int{0, 1, 2, 0, 1, 2, 0, 1, 2, 0, 1, 2}, indices)
+}
+
+func TestQuantizeInt8(t *testing.T) {
+	values := []float32{
+		1, -0.5, 0,
+		-2, 1, 0.5,
+		0, 0, 0}
+	quantized, scales, scalesDims := quantizeInt8(values, []int{3, 3}, []int{1})
+	require.Equal(t, []int{3, 1}, scalesDims)
+	require.InDeltaSlice(t, []float32{1.0 / 127, 2.0 / 127, 0}, scales, 1e-6)
+	require.Equal(t, []int8{127, -64, 0, -127, 64, 32, 0, 0, 0}, quantized)
+}
+
+func TestQuantizeWeightsInt8(t *testing.T) {
+	config := &Config{NumLayers: 1, UseQKV: true}
+	ctx := context.New()
+	for _, weights := range listQuantizableWeights(config) {
+		scopedCtx := ctx
+		for _, p := range weights.scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		if weights.name == "linear" {
+			scopedCtx.VariableWithValue(weights.name, [][]float32{{1, 2}, {-4, 3}})
+			continue
+		}
+		dims := make([]int, slices.Max(weights.contractingAxes)+2)
+		for ii := range dims {
+			dims[ii] = 2
+		}
+		scopedCtx.VariableWithValue(weights.name, tensors.FromShape(shapes.Make(dtypes.BFloat16, dims...)))
+	}
+	require.NoError(t, QuantizeWeightsInt8(ctx, config))
+	linearCtx := ctx.In("layer_0").In("mlp")
+	require.Nil(t, linearCtx.GetVariable("linear"))
+	quantizedVar := linearCtx.GetVariable("linear" + int8WeightsSuffix)
+	require.NotNil(t, quantizedVar)
+	require.False(t, quantizedVar.Trainable)
+	require.Equal(t, [][]int8{{32, 85}, {-127, 127}}, quantizedVar.Value().Value())
+	scales := linearCtx.GetVariable("linear" + int8ScaleSuffix).Value()
+	require.Equal(t, []int{1, 2}, scales.Shape().Dimensions)
+	require.InDeltaSlice(t, []float32{4.0 / 127, 3.0 / 127}, tensors.CopyFlatData[float32](scales), 1e-6)
+
+	// Quantizing again is a no-op.
+	require.NoError(t, QuantizeWeightsInt8(ctx, config))
+
+	// Wrongly shaped weights.
+	embedderCtx := ctx.In("embedder")
+	embedderCtx.DeleteVariable(embedderCtx.Scope(), "input_embedding"+int8WeightsSuffix)
+	embedderCtx.VariableWithValue("input_embedding", []float32{1, 2})
+	require.Error(t, QuantizeWeightsInt8(ctx, config))
+}
+
+func TestQ4GroupIndices(t *testing.T) {
+	indices, groupsDims := q4GroupIndices([]int{3, 4}, 1, 2)
+	require.Equal(t, []int{3, 2}, groupsDims)
+	require.Equal(t, []int{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5}, indices)
+
+	indices, groupsDims = q4GroupIndices([]int{4, 3}, 0, 2)
+	require.Equal(t, []int{2, 3}, groupsDims)
+	require.Equal(t, []int{0, 1, 2, 0, 1, 2, 3, 4, 5, 3, 4, 5}, indices)
+
+	indices, groupsDims = q4GroupIndices([]int{2, 4, 2}, 1, 4)
+	require.Equal(t, []int{2, 1, 2}, groupsDims)
+	require.Equal(t, []int{0, 1, 0, 1, 0, 1, 0, 1, 2, 3, 2, 3, 2, 3, 2, 3}, indices)
+
+	groupAxis, err := q4GroupAxis([]int{2, 4, 2}, groupsDims)
+	require.NoError(t, err)
+	require.Equal(t, 1, groupAxis)
+	_, err = q4GroupAxis([]int{2, 4, 2}, []int{2, 4, 2})
+	require.Error(t, err)
+	_, err = q4GroupAxis([]int{2, 4, 2}, []int{1, 1, 2})
+	require.Error(t, err)
+	_, err = q4GroupAxis([]int{2, 4, 2}, []int{2, 3, 2})
+	require.Error(t, err)
+}
+
+// dequantizeQ4Values reverts quantizeQ4 in the host, for testing.
+func dequantizeQ4Values(packed []uint8, scales []float32, zeros []uint8, dims []int, groupAxis, groupSize int) []float32 {
+	indices, _ := q4GroupIndices(dims, groupAxis, groupSize)
+	values := make([]float32, 2*len(packed))
+	for ii := range values {
+		q := (packed[ii/2] >> (4 * (ii % 2))) & 0xF
+		zero := float32(8)
+		if zeros != nil {
+			zero = float32(zeros[indices[ii]])
+		}
+		values[ii] = (float32(q) - zero) * scales[indices[ii]]
+	}
+	return values
+}
+
+func TestQuantizeQ4(t *testing.T) {
+	values := []float32{
+		0.7, -0.3, 0, 0.1,
+		1, 2, 3, 1.5,
+		0, 0, 0, 0}
+	for _, useZeroPoint := range []bool{false, true} {
+		// Groups along the last axis ([3, 4]), or along the first axis ([4, 3], groups of values ii, ii+3, ...).
+		for _, dims := range [][]int{{3, 4}, {4, 3}} {
+			groupAxis := len(dims) - 1
+			if dims[0] == 4 {
+				groupAxis = 0
+			}
+			packed, scales, zeros, scalesDims := quantizeQ4(values, dims, groupAxis, 4, useZeroPoint)
+			require.Len(t, packed, 6)
+			require.Len(t, scales, 3)
+			scalesDims[groupAxis] = 4
+			require.Equal(t, dims, scalesDims)
+			got := dequantizeQ4Values(packed, scales, zeros, dims, groupAxis, 4)
+			indices, _ := q4GroupIndices(dims, groupAxis, 4)
+			for ii, want := range values {
+				require.InDeltaf(t, want, got[ii], float64(scales[indices[ii]])/2+1e-6,
+					"useZeroPoint=%v, dims=%v, value #%d", useZeroPoint, dims, ii)
+			}
+		}
+	}
+
+	// Symmetric: 0.7 is the max absolute value of the first group, so it is quantized to 7+8.
+	packed, scales, zeros, _ := quantizeQ4(values[:4], []int{1, 4}, 1, 4, false)
+	require.Nil(t, zeros)
+	require.InDelta(t, 0.1, scales[0], 1e-6)
+	require.Equal(t, []uint8{15 | (5 << 4), 8 | (9 << 4)}, packed)
+
+	// With zero-point: the range of the second group is [0, 3], the zero-point is 0.
+	_, scales, zeros, _ = quantizeQ4(values[4:8], []int{1, 4}, 1, 4, true)
+	require.Equal(t, []uint8{0}, zeros)
+	require.InDelta(t, 0.2, scales[0], 1e-6)
+
+	// Groups along the first axis of [4, 3]: the first group is {0.7, 0.1, 3, 0}.
+	_, scales, _, _ = quantizeQ4(values, []int{4, 3}, 0, 4, false)
+	require.InDeltaSlice(t, []float32{3.0 / 7, 1.5 / 7, 2.0 / 7}, scales, 1e-6)
+}
+
+func TestQuantizeWeightsQ4(t *testing.T) {
+	config := &Config{NumLayers: 1, HuggingFaceVersion: true}
+	ctx := context.New()
+	for _, weights := range listQuantizableWeights(config) {
+		scopedCtx := ctx
+		for _, p := range weights.scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		scopedCtx.VariableWithValue(weights.name, tensors.FromShape(shapes.Make(dtypes.BFloat16, 3, 8)))
+	}
+	require.Error(t, QuantizeWeightsQ4(ctx, config, 3, false))
+	require.Error(t, QuantizeWeightsQ4(ctx, config, 16, false))
+	require.NoError(t, QuantizeWeightsQ4(ctx, config, 4, true))
+	hfCtx := ctx.In("layer_0").In("attn").In("hf")
+	require.Nil(t, hfCtx.GetVariable("q_proj"))
+	require.Equal(t, []int{3, 4}, hfCtx.GetVariable("q_proj"+q4WeightsSuffix).Shape().Dimensions)
+	require.Equal(t, []int{3, 2}, hfCtx.GetVariable("q_proj"+q4ScaleSuffix).Shape().Dimensions)
+	require.Equal(t, []int{3, 2}, hfCtx.GetVariable("q_proj"+q4ZeroSuffix).Shape().Dimensions)
+
+	// Embedding is not quantized to Q4, but can be quantized to int8 afterwards.
+	embedderCtx := ctx.In("embedder")
+	require.NotNil(t, embedderCtx.GetVariable("input_embedding"))
+	require.NoError(t, QuantizeWeightsInt8(ctx, config))
+	require.NotNil(t, embedderCtx.GetVariable("input_embedding"+int8WeightsSuffix))
+	require.Nil(t, hfCtx.GetVariable("q_proj"+int8WeightsSuffix))
+
+	// Kaggle layout: the groups are along the contracting axes, which are not always the last one.
+	config = &Config{NumLayers: 1}
+	ctx = context.New()
+	for _, weights := range listQuantizableWeights(config) {
+		scopedCtx := ctx
+		for _, p := range weights.scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		dims := make([]int, slices.Max(weights.contractingAxes)+2)
+		for ii := range dims {
+			dims[ii] = 4
+		}
+		scopedCtx.VariableWithValue(weights.name, tensors.FromShape(shapes.Make(dtypes.BFloat16, dims...)))
+	}
+	require.NoError(t, QuantizeWeightsQ4(ctx, config, 2, false))
+	attnCtx := ctx.In("layer_0").In("attn")
+	for _, tc := range []struct {
+		scope      *context.Context
+		name       string
+		scalesDims []int
+		packedDims []int
+	}{
+		{ctx.In("layer_0").In("mlp"), "linear", []int{2, 4}, []int{4, 2}},              // [F, D]
+		{ctx.In("layer_0").In("mlp"), "gating_einsum", []int{4, 2, 4}, []int{4, 4, 2}}, // [2, D, F]
+		{attnCtx.In("q_einsum"), "w", []int{4, 2, 4}, []int{4, 4, 2}},                  // [N, D, H]
+		{attnCtx.In("attn_vec_einsum"), "w", []int{4, 2, 4}, []int{4, 4, 2}},           // [N, H, D]
+	} {
+		require.Equal(t, tc.packedDims, tc.scope.GetVariable(tc.name+q4WeightsSuffix).Shape().Dimensions, tc.name)
+		require.Equal(t, tc.scalesDims, tc.scope.GetVariable(tc.name+q4ScaleSuffix).Shape().Dimensions, tc.name)
+	}
+}
+
+func TestDequantizeQ4(t *testing.T) {
+	backend := testutil.Backend(t)
+	// Weights shaped [F=4, D=2], quantized with groups along the first (contracting) axis.
+	flat := []float32{1, -0.5, 0, 0.25, -2, 1, 0.5, 2}
+	ctx := context.New()
+	packed, scales, zeros, scalesDims := quantizeQ4(flat, []int{4, 2}, 0, 2, true)
+	ctx.VariableWithValue("w"+q4WeightsSuffix, tensors.FromFlatDataAndDimensions(packed, 4, 1))
+	ctx.VariableWithValue("w"+q4ScaleSuffix, tensors.FromFlatDataAndDimensions(scales, scalesDims...))
+	ctx.VariableWithValue("w"+q4ZeroSuffix, tensors.FromFlatDataAndDimensions(zeros, scalesDims...))
+	want, err := DequantizeWeights(ctx, "w", dtypes.Float32)
+	require.NoError(t, err)
+	got := context.ExecOnce(backend, ctx, func(ctx *context.Context, g *Graph) *Node {
+		return weightsValue(ctx, g, "w", shapes.Make(dtypes.Float32, 4, 2))
+	})
+	require.Equal(t, want.Value(), got.Value())
+}
+
+func TestDequantizeWeights(t *testing.T) {
+	ctx := context.New()
+	values := [][]float32{{1, -0.5, 0, 0.25}, {-2, 1, 0.5, 2}}
+	ctx.In("float").VariableWithValue("w", values)
+
+	// Quantized weights: "int8/w" and "q4/w".
+	flat := []float32{1, -0.5, 0, 0.25, -2, 1, 0.5, 2}
+	quantized, scales, scalesDims := quantizeInt8(flat, []int{2, 4}, []int{1})
+	int8Ctx := ctx.In("int8")
+	int8Ctx.VariableWithValue("w"+int8WeightsSuffix, tensors.FromFlatDataAndDimensions(quantized, 2, 4))
+	int8Ctx.VariableWithValue("w"+int8ScaleSuffix, tensors.FromFlatDataAndDimensions(scales, scalesDims...))
+	// Q4 with groups along the last axis ("q4"), and along the first axis ("q4_axis0").
+	for groupAxis, scope := range []string{"q4_axis0", "q4"} {
+		packed, q4Scales, zeros, q4ScalesDims := quantizeQ4(flat, []int{2, 4}, groupAxis, 2, true)
+		q4Ctx := ctx.In(scope)
+		q4Ctx.VariableWithValue("w"+q4WeightsSuffix, tensors.FromFlatDataAndDimensions(packed, 2, 2))
+		q4Ctx.VariableWithValue("w"+q4ScaleSuffix, tensors.FromFlatDataAndDimensions(q4Scales, q4ScalesDims...))
+		q4Ctx.VariableWithValue("w"+q4ZeroSuffix, tensors.FromFlatDataAndDimensions(zeros, q4ScalesDims...))
+	}
+
+	for _, scope := range []string{"int8", "q4", "q4_axis0", "float"} {
+		tensor, err := DequantizeWeights(ctx.In(scope), "w", dtypes.Float32)
+		require.NoError(t, err)
+		require.Equal(t, []int{2, 4}, tensor.Shape().Dimensions)
+		require.InDeltaSlicef(t, flat, tensors.CopyFlatData[float32](tensor), 0.15, "scope %q", scope)
+	}
+	tensor, err := DequantizeWeights(ctx.In("float"), "w", dtypes.BFloat16)
+	require.NoError(t, err)
+	require.Equal(t, dtypes.BFloat16, tensor.DType())
+	tensor, err = DequantizeWeights(ctx.In("float"), "missing", dtypes.Float32)
+	require.NoError(t, err)
+	require.Nil(t, tensor)
+
+	baseName, isValues := QuantizedVariableBaseName("w" + int8ScaleSuffix)
+	require.Equal(t, "w", baseName)
+	require.False(t, isValues)
+	baseName, isValues = QuantizedVariableBaseName("w" + q4WeightsSuffix)
+	require.Equal(t, "w", baseName)
+	require.True(t, isValues)
+	baseName, _ = QuantizedVariableBaseName("w")
+	require.Empty(t, baseName)
+}
+
+func TestSetQuantizedWeightsQ4(t *testing.T) {
+	ctx := context.New()
+	quantized := []uint8{0, 15, 8, 9, 1, 2, 3, 4}
+	require.Error(t, SetQuantizedWeightsQ4(ctx, "w", []int{2, 3}, quantized, []float32{1, 1}, nil))
+	require.Error(t, SetQuantizedWeightsQ4(ctx, "w", []int{2, 4}, quantized, []float32{1, 1, 1}, nil))
+	require.NoError(t, SetQuantizedWeightsQ4(ctx, "w", []int{2, 4}, quantized, []float32{1, 2}, nil))
+	packedVar := ctx.GetVariable("w" + q4WeightsSuffix)
+	require.Equal(t, [][]uint8{{15 << 4, 8 | 9<<4}, {1 | 2<<4, 3 | 4<<4}}, packedVar.Value().Value())
+	require.False(t, packedVar.Trainable)
+	values, err := DequantizeWeights(ctx, "w", dtypes.Float32)
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{-8, 7, 0, 1}, {-14, -12, -10, -8}}, values.Value())
+}
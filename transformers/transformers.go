@@ -16,30 +16,66 @@ import (
 //
 // It takes as input the current token to decode currentTokens (shape [batchSize, 1] in a sequence along
 // with currentPosition (shape [batchSize, 1]) and the current cache of the key/values for each transformer
-// layer (see Cache), whose elements are generally shaped [batchSize, MaxCacheLength,...].
+// layer (see Cache), whose elements are generally shaped [batchSize, Config.CacheLength(layerIdx),...].
+//
+// More than one token per step (e.g.: to process a prompt at once) is only accepted if no layer has a cache
+// shorter than Config.MaxCacheLength (see Config.CacheLength), otherwise it panics.
+//
+// The attention masks are derived from the positions stored in the cache: each token attends to the tokens
+// in the cache with positions <= its own position (and within the sliding window, for local attention layers).
 //
 // It updates the Cache with the new step in-place, and returns the logits (shape [batchSize, <num_tokens>])
 // of the prediction of the next token.
 func GemmaWithCache(ctx *context.Context, config *Config,
-	currentTokens, currentPositions *Node, cache *trees.Tree[*Node], cacheAttentionMask *Node) *Node {
-	batchSize := currentTokens.Shape().Dim(0)
-	seqLength := currentTokens.Shape().Dim(1)
+	currentTokens, currentPositions *Node, cache *trees.Tree[*Node]) *Node {
+	return gemma(ctx, config, currentTokens, currentPositions, cache, nil)
+}
+
+// Gemma creates a forward path on a Gemma model over full sequences, without a cache, as used for
+// training, scoring or extracting embeddings.
+//
+// It takes as input the tokens (shape [batchSize, sequenceLength]), their positions (shape
+// [batchSize, sequenceLength]) and an optional attentionMask (shape bool[batchSize, sequenceLength, sequenceLength]),
+// true where a token (second axis) can attend to another token (third axis).
+//
+// If attentionMask is nil, a causal mask is derived from the positions (see CausalMask): tokens with negative
+// positions (e.g.: padding) are never attended to. For local attention layers, the sliding window mask
+// is also applied, in either case.
+//
+// It returns the logits (shape [batchSize, sequenceLength, <num_tokens>]) of the prediction of the next token,
+// for every position of the sequence.
+func Gemma(ctx *context.Context, config *Config, tokens, positions, attentionMask *Node) *Node {
+	if attentionMask == nil {
+		attentionMask = CausalMask(positions, positions)
+	}
+	return gemma(ctx, config, tokens, positions, nil, attentionMask)
+}
+
+// gemma implements Gemma and GemmaWithCache: either cache or attentionMask must be nil.
+func gemma(ctx *context.Context, config *Config, tokens, positions *Node, cache *trees.Tree[*Node], attentionMask *Node) *Node {
+	batchSize := tokens.Shape().Dim(0)
+	seqLength := tokens.Shape().Dim(1)
 
 	// Embed.
-	x := EmbedTokens(ctx.In("embedder"), config, currentTokens)
+	x := EmbedTokens(ctx.In("embedder"), config, tokens)
+	capture(ctx, CaptureEmbeddings, -1, x)
 
 	// Run through numLayers blocks.
 	for blockIdx := range config.NumLayers {
 		blockName := fmt.Sprintf("layer_%d", blockIdx)
 		blockCtx := ctx.In(blockName)
-		blockCache := cache.Map[blockName]
-		x = Block(blockCtx, config, blockIdx, x, currentPositions, blockCache, cacheAttentionMask)
+		var blockCache *trees.Tree[*Node]
+		if cache != nil {
+			blockCache = cache.Map[blockName]
+		}
+		x = Block(blockCtx, config, blockIdx, x, positions, blockCache, attentionMask)
 		//x.SetLogged(fmt.Sprintf("GemmaWithCache::x(%s)", blockName))
 		x = Identity(x)
 	}
 
 	x = RMSNorm(ctx.In("final_norm"), x)
 	logits := DecodeTokens(ctx.Reuse().In("embedder"), config, x)
+	capture(ctx, CaptureLogits, -1, logits)
 	logits = SoftCap(logits, config.FinalLogitSoftCap)
 	logits.AssertDims(batchSize, seqLength, config.VocabularySize)
 	return logits
@@ -48,10 +84,20 @@ func GemmaWithCache(ctx *context.Context, config *Config,
 // EmbedTokens using weights in Config.
 // Input: currentTokens: [batchSize, sequenceLength]
 // Output: embeddings: [batchSize, sequenceLength, config.EmbedDim]
+//
+// If the embedding table was quantized (see QuantizeWeightsInt8), only the rows of the tokens used are dequantized.
 func EmbedTokens(ctx *context.Context, config *Config, currentTokens *Node) *Node {
 	g := currentTokens.Graph()
-	embedTableVar := ctx.VariableWithShape("input_embedding", shapes.Make(dtypes.BFloat16, config.VocabularySize, config.EmbedDim))
-	embeddings := Gather(embedTableVar.ValueGraph(g), ExpandAxes(currentTokens, -1))
+	tokenIndices := ExpandAxes(currentTokens, -1)
+	var embeddings *Node
+	if quantizedVar := ctx.GetVariable("input_embedding" + int8WeightsSuffix); quantizedVar != nil {
+		scales := quantizedScales(ctx, g, "input_embedding"+int8ScaleSuffix)
+		embeddings = dequantizeInt8(
+			Gather(quantizedVar.ValueGraph(g), tokenIndices), Gather(scales, tokenIndices), config.DType)
+	} else {
+		embedTableVar := ctx.VariableWithShape("input_embedding", shapes.Make(dtypes.BFloat16, config.VocabularySize, config.EmbedDim))
+		embeddings = Gather(embedTableVar.ValueGraph(g), tokenIndices)
+	}
 	embeddings = Mul(embeddings, Sqrt(Scalar(g, embeddings.DType(), config.EmbedDim)))
 	return embeddings
 }
@@ -59,8 +105,17 @@ func EmbedTokens(ctx *context.Context, config *Config, currentTokens *Node) *Nod
 // DecodeTokens use the same table as EmbedTokens to convert embedding back to the tokens -- or to token logits.
 // Input: current embeddings: [batchSize, sequenceLength, embedDim]
 // Output: logits for each token: [batchSize, sequenceLength, vocabularySize]
+//
+// If the embedding table was quantized (see QuantizeWeightsInt8), the scales are applied to the logits.
 func DecodeTokens(ctx *context.Context, config *Config, x *Node) *Node {
 	g := x.Graph()
+	if quantizedVar := ctx.GetVariable("input_embedding" + int8WeightsSuffix); quantizedVar != nil {
+		scales := quantizedScales(ctx, g, "input_embedding"+int8ScaleSuffix) // [vocabularySize, 1]
+		quantizedTable := ConvertDType(quantizedVar.ValueGraph(g), x.DType())
+		logits := DotGeneral(x, []int{-1}, nil, quantizedTable, []int{-1}, nil)
+		scales = ExpandLeftToRank(Reshape(ConvertDType(scales, x.DType()), config.VocabularySize), logits.Rank())
+		return Mul(logits, scales)
+	}
 	embedTableVar := ctx.VariableWithShape("input_embedding", shapes.Make(dtypes.BFloat16, config.VocabularySize, config.EmbedDim))
 	embedTable := embedTableVar.ValueGraph(g)
 	return DotGeneral(x, []int{-1}, nil, embedTable, []int{-1}, nil)
@@ -71,7 +126,10 @@ func DecodeTokens(ctx *context.Context, config *Config, x *Node) *Node {
 //
 // The attentionIdx indexes attention configuration (in config) parameters, like config.AttentionTypes.
 //
-// If cache is given, attentionMask is relative to the cache. Otherwise, attentionMask is relative to the operand x.
+// If cache is given, attentionMask must be nil, and the mask is derived from the positions stored in the cache.
+// Otherwise, attentionMask is relative to the operand x, and if nil, a causal mask is used.
+//
+// Its output (the residual stream) can be captured, see StartCapture.
 func Block(ctx *context.Context, config *Config, attentionIdx int, x, positions *Node, cache *trees.Tree[*Node], attentionMask *Node) *Node {
 	normalizedX := RMSNorm(ctx.In("pre_attention_norm"), x)
 
@@ -87,9 +145,9 @@ func Block(ctx *context.Context, config *Config, attentionIdx int, x, positions
 	// GatedFeedForward ("ffw") layer: 2 layers, with a gate.
 	output := RMSNorm(ctx.In("pre_ffw_norm"), attentionOut)
 	if config.HuggingFaceVersion {
-		output = HuggingFaceGatedFeedForward(ctx.In("mlp"), output, config.HiddenDim, config.TransposeGatingEinsum)
+		output = HuggingFaceGatedFeedForward(ctx.In("mlp"), output, config.HiddenDim, config.TransposeGatingEinsum, config.LoRA)
 	} else {
-		output = GatedFeedForward(ctx.In("mlp"), output, config.HiddenDim, config.TransposeGatingEinsum)
+		output = GatedFeedForward(ctx.In("mlp"), output, config.HiddenDim, config.TransposeGatingEinsum, config.LoRA)
 	}
 	if config.UsePostFFWNorm {
 		output = RMSNorm(ctx.In("post_ffw_norm"), output)
@@ -97,5 +155,6 @@ func Block(ctx *context.Context, config *Config, attentionIdx int, x, positions
 
 	// Residual to attentionOut.
 	output = Add(output, attentionOut)
+	capture(ctx, CaptureResidual, attentionIdx, output)
 	return output
 }
@@ -0,0 +1,99 @@
+package transformers
+
+import (
+	"github.com/gomlx/exceptions"
+	"github.com/gomlx/gemma/internal/testutil"
+	"github.com/gomlx/gemma/trees"
+	"github.com/gomlx/gomlx/backends"
+	. "github.com/gomlx/gomlx/graph"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gomlx/types/xslices"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// gemmaLogits returns the logits of Gemma, converted to float32, shaped [batchSize, sequenceLength, vocabularySize].
+func gemmaLogits(backend backends.Backend, ctx *context.Context, config *Config, tokens, positions [][]int32) []float32 {
+	logits := context.ExecOnce(backend, ctx, func(ctx *context.Context, tokens, positions *Node) *Node {
+		return ConvertDType(Gemma(ctx, config, tokens, positions, nil), dtypes.Float32)
+	}, tokens, positions)
+	return tensors.CopyFlatData[float32](logits)
+}
+
+// gemmaWithCacheLogits feeds the tokens of a single example to GemmaWithCache, stepLength tokens at a time, and
+// returns the logits of all the steps, converted to float32, shaped [1, sequenceLength, vocabularySize].
+func gemmaWithCacheLogits(t *testing.T, backend backends.Backend, ctx *context.Context, config *Config,
+	tokens []int32, stepLength int) []float32 {
+	cache, err := NewCache(config, 1)
+	require.NoError(t, err)
+	cacheValues := trees.ValuesAsList(cache.Data)
+	numCacheValues := len(cacheValues)
+	exec := context.NewExec(backend, ctx, func(ctx *context.Context, inputs []*Node) []*Node {
+		cacheTree := trees.FromValuesAndTree(inputs[:numCacheValues], cache.Data)
+		tokens, positions := inputs[numCacheValues], inputs[numCacheValues+1]
+		logits := ConvertDType(GemmaWithCache(ctx, config, tokens, positions, cacheTree), dtypes.Float32)
+		return append([]*Node{logits}, trees.ValuesAsList(cacheTree)...)
+	})
+	var logits []float32
+	for start := 0; start < len(tokens); start += stepLength {
+		stepTokens := tokens[start:min(start+stepLength, len(tokens))]
+		stepPositions := make([]int32, len(stepTokens))
+		for ii := range stepPositions {
+			stepPositions[ii] = int32(start + ii)
+		}
+		args := xslices.Map(cacheValues, func(value *tensors.Tensor) any { return value })
+		outputs := exec.Call(append(args, [][]int32{stepTokens}, [][]int32{stepPositions})...)
+		logits = append(logits, tensors.CopyFlatData[float32](outputs[0])...)
+		cacheValues = outputs[1:]
+	}
+	return logits
+}
+
+func TestGemma(t *testing.T) {
+	backend := testutil.Backend(t)
+	config := tinyModelConfig()
+	ctx := newTinyModel(config)
+
+	// The logits over the whole sequence match the ones decoded step by step with the cache: the sequence is longer
+	// than the sliding window of the local attention layer. The model is in BFloat16, hence the tolerance.
+	tokens := []int32{1, 4, 2, 3, 4}
+	want := gemmaWithCacheLogits(t, backend, ctx, config, tokens, 1)
+	got := gemmaLogits(backend, ctx, config, [][]int32{tokens}, [][]int32{{0, 1, 2, 3, 4}})
+	require.Len(t, got, len(tokens)*config.VocabularySize)
+	require.InDeltaSlice(t, want, got, 0.05)
+
+	// A padded example (negative positions) doesn't change the logits of the other examples of the batch.
+	batchLogits := gemmaLogits(backend, ctx, config, [][]int32{tokens, {1, 3, 0, 0, 0}},
+		[][]int32{{0, 1, 2, 3, 4}, {0, 1, -1, -1, -1}})
+	exampleSize := len(tokens) * config.VocabularySize
+	require.InDeltaSlice(t, got, batchLogits[:exampleSize], 0.01)
+	padded := gemmaLogits(backend, ctx, config, [][]int32{{1, 3}}, [][]int32{{0, 1}})
+	require.InDeltaSlice(t, padded, batchLogits[exampleSize:exampleSize+len(padded)], 0.01)
+}
+
+func TestGemmaWithCacheSteps(t *testing.T) {
+	backend := testutil.Backend(t)
+	config := tinyModelConfig()
+	ctx := newTinyModel(config)
+	tokens := []int32{1, 4, 2, 3, 4}
+	positions := [][]int32{{0, 1, 2, 3, 4}}
+
+	// The local attention layer has a ring buffer cache of 2 slots (the sliding window), shorter than
+	// MaxCacheLength: a step with more than one token could overwrite keys still attended to, so it is rejected.
+	require.Equal(t, 2, config.CacheLength(0))
+	err := exceptions.TryCatch[error](func() { gemmaWithCacheLogits(t, backend, ctx, config, tokens, 2) })
+	require.ErrorContains(t, err, "GemmaWithCache() got 2 tokens per step, but the cache of layer 0")
+
+	// With the cache of all layers as long as MaxCacheLength, it never wraps around, and the tokens can be given
+	// in steps of any length.
+	config.MaxCacheLength = len(tokens)
+	config.SlidingWindowSize = len(tokens)
+	require.Equal(t, len(tokens), config.CacheLength(0))
+	want := gemmaLogits(backend, ctx, config, [][]int32{tokens}, positions)
+	for _, stepLength := range []int{1, 2, 5} {
+		require.InDeltaSlice(t, want, gemmaWithCacheLogits(t, backend, ctx, config, tokens, stepLength), 0.05,
+			"stepLength=%d", stepLength)
+	}
+}
@@ -0,0 +1,289 @@
+package transformers
+
+import (
+	"fmt"
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/pkg/errors"
+	"slices"
+	"strings"
+)
+
+// ModelVariable identifies a variable of the model, with its scope relative to the model scope.
+type ModelVariable struct {
+	// Scope relative to the model scope, e.g.: ["layer_3", "attn", "hf"].
+	Scope []string
+	Name  string
+
+	// Shape of the variable. It is not set (shapes.Shape.Ok() is false) if it is not fully known, e.g.: the scales
+	// of Q4 quantized weights, whose dimensions depend on the group size.
+	Shape shapes.Shape
+}
+
+// Path returns the scope and name of the variable joined by "/", e.g.: "layer_3/attn/hf/q_proj".
+func (v ModelVariable) Path() string {
+	return strings.Join(append(slices.Clone(v.Scope), v.Name), context.ScopeSeparator)
+}
+
+// String implements fmt.Stringer.
+func (v ModelVariable) String() string {
+	if !v.Shape.Ok() {
+		return v.Path()
+	}
+	return fmt.Sprintf("%s %s", v.Path(), v.Shape)
+}
+
+// ExpectedVariables returns the weights variables the model (see Gemma and GemmaWithCache) requests for the given
+// config, with their exact names and shapes, in the order they are used.
+//
+// It doesn't include the LoRA adapters (see LoRAConfig), and it lists the weights not quantized: see
+// DiffVariables for the quantized alternatives accepted.
+func ExpectedVariables(config *Config) []ModelVariable {
+	dtype := config.DType
+	D, F := config.EmbedDim, config.HiddenDim
+	N, K, H := config.NumHeads, config.NumKVHeads, config.HeadDim
+	variables := []ModelVariable{
+		// The embedding table is always requested as BFloat16, see EmbedTokens.
+		{[]string{"embedder"}, "input_embedding", shapes.Make(dtypes.BFloat16, config.VocabularySize, D)},
+	}
+	add := func(scope []string, name string, dims ...int) {
+		variables = append(variables, ModelVariable{scope, name, shapes.Make(dtype, dims...)})
+	}
+	for layerIdx := range config.NumLayers {
+		layerName := fmt.Sprintf("layer_%d", layerIdx)
+		attn, mlp := []string{layerName, "attn"}, []string{layerName, "mlp"}
+		add([]string{layerName, "pre_attention_norm"}, "scale", D)
+		if config.HuggingFaceVersion {
+			hf := append(attn, "hf")
+			add(hf, "k_proj", K*H, D)
+			add(hf, "v_proj", K*H, D)
+			add(hf, "q_proj", N*H, D)
+			add(hf, "o_proj", D, N*H)
+		} else {
+			if config.UseQKV {
+				add(append(attn, "qkv_einsum"), "w", 3, N, D, H)
+			} else {
+				add(append(attn, "q_einsum"), "w", N, D, H)
+				add(append(attn, "kv_einsum"), "w", 2, K, D, H)
+			}
+			add(append(attn, "attn_vec_einsum"), "w", N, H, D)
+		}
+		if config.UsePostAttentionNorm {
+			add([]string{layerName, "post_attention_norm"}, "scale", D)
+		}
+		add([]string{layerName, "pre_ffw_norm"}, "scale", D)
+		switch {
+		case config.HuggingFaceVersion:
+			hf := append(mlp, "hf")
+			add(hf, "gating_proj", F, D)
+			add(hf, "up_proj", F, D)
+			add(hf, "down_proj", D, F)
+		case config.TransposeGatingEinsum:
+			add(mlp, "gating_einsum", 2, F, D)
+			add(mlp, "linear", F, D)
+		default:
+			add(mlp, "gating_einsum", 2, D, F)
+			add(mlp, "linear", F, D)
+		}
+		if config.UsePostFFWNorm {
+			add([]string{layerName, "post_ffw_norm"}, "scale", D)
+		}
+	}
+	add([]string{"final_norm"}, "scale", D)
+	return variables
+}
+
+// MisShapedVariable is a variable found with a shape different from the expected one, see VariablesDiff.
+type MisShapedVariable struct {
+	// Expected variable, with its expected shape.
+	Expected ModelVariable
+
+	// Found is the shape of the variable in the context.
+	Found shapes.Shape
+}
+
+// String implements fmt.Stringer.
+func (v MisShapedVariable) String() string {
+	return fmt.Sprintf("%s: found %s", v.Expected, v.Found)
+}
+
+// VariablesDiff lists the differences between the variables in a context and those expected by the model, see
+// DiffVariables.
+type VariablesDiff struct {
+	// Missing variables: the model would create them initialized with zeros.
+	Missing []ModelVariable
+
+	// Unexpected variables, not used by the model, sorted by path: usually the result of a tensor mapped to the
+	// wrong name.
+	Unexpected []ModelVariable
+
+	// MisShaped variables: the model would fail when requesting them.
+	MisShaped []MisShapedVariable
+}
+
+// Empty returns whether there are no differences.
+func (d *VariablesDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Unexpected) == 0 && len(d.MisShaped) == 0
+}
+
+// String implements fmt.Stringer, listing all the differences, one per line.
+func (d *VariablesDiff) String() string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "%d missing, %d unexpected and %d mis-shaped variables",
+		len(d.Missing), len(d.Unexpected), len(d.MisShaped))
+	for _, v := range d.Missing {
+		_, _ = fmt.Fprintf(&sb, "\n  missing: %s", v)
+	}
+	for _, v := range d.Unexpected {
+		_, _ = fmt.Fprintf(&sb, "\n  unexpected: %s", v)
+	}
+	for _, v := range d.MisShaped {
+		_, _ = fmt.Fprintf(&sb, "\n  mis-shaped: %s", v)
+	}
+	return sb.String()
+}
+
+// DiffVariables compares the variables in ctx (the scope has to be set directly to the model variables, see
+// NewConfigFromContext) against the variables the model requests for config, see ExpectedVariables.
+//
+// Quantized weights (see QuantizeWeightsInt8 and QuantizeWeightsQ4) are accepted in place of the weights they
+// quantize, along with their scales and zero points. If config.LoRA is set, the variables of the LoRA adapters are
+// not checked, otherwise they are reported as unexpected.
+func DiffVariables(ctx *context.Context, config *Config) *VariablesDiff {
+	diff := &VariablesDiff{}
+	found := make(map[string]bool) // Paths of the variables accounted for.
+	check := func(expected ModelVariable) (ok bool) {
+		v := ctx.GetVariableByScopeAndName(scopeIn(ctx, expected.Scope), expected.Name)
+		if v == nil {
+			return false
+		}
+		found[expected.Path()] = true
+		if expected.Shape.Ok() && !expected.Shape.Equal(v.Shape()) {
+			diff.MisShaped = append(diff.MisShaped, MisShapedVariable{expected, v.Shape()})
+		}
+		return true
+	}
+	checkCompanion := func(expected ModelVariable, required bool) {
+		if !check(expected) && required {
+			diff.Missing = append(diff.Missing, expected)
+		}
+	}
+
+	contractingAxes := make(map[string][]int)
+	for _, weights := range listQuantizableWeights(config) {
+		contractingAxes[ModelVariable{Scope: weights.scope, Name: weights.name}.Path()] = weights.contractingAxes
+	}
+	for _, expected := range ExpectedVariables(config) {
+		if check(expected) {
+			continue
+		}
+		axes, quantizable := contractingAxes[expected.Path()]
+		dims := expected.Shape.Dimensions
+		int8Weights := ModelVariable{expected.Scope, expected.Name + int8WeightsSuffix, shapes.Make(dtypes.Int8, dims...)}
+		if quantizable && check(int8Weights) {
+			scalesDims := slices.Clone(dims) // One scale per channel, see channelIndices.
+			for _, axis := range axes {
+				scalesDims[axis] = 1
+			}
+			checkCompanion(ModelVariable{expected.Scope, expected.Name + int8ScaleSuffix,
+				shapes.Make(weightsScaleDType, scalesDims...)}, true)
+			continue
+		}
+		packedDims := slices.Clone(dims)
+		packedDims[len(packedDims)-1] /= 2
+		q4Weights := ModelVariable{expected.Scope, expected.Name + q4WeightsSuffix, shapes.Make(dtypes.Uint8, packedDims...)}
+		if quantizable && expected.Name != "input_embedding" && check(q4Weights) {
+			// The dimensions of the scales and zero points depend on the group size, so only their presence
+			// is checked.
+			checkCompanion(ModelVariable{Scope: expected.Scope, Name: expected.Name + q4ScaleSuffix}, true)
+			checkCompanion(ModelVariable{Scope: expected.Scope, Name: expected.Name + q4ZeroSuffix}, false)
+			continue
+		}
+		diff.Missing = append(diff.Missing, expected)
+	}
+
+	for v := range ctx.IterVariablesInScope() {
+		scope := relativeScope(ctx, v)
+		modelVar := ModelVariable{scope, v.Name(), v.Shape()}
+		if found[modelVar.Path()] || (config.LoRA != nil && slices.Contains(scope, LoRAScope)) {
+			continue
+		}
+		diff.Unexpected = append(diff.Unexpected, modelVar)
+	}
+	slices.SortFunc(diff.Unexpected, func(a, b ModelVariable) int { return strings.Compare(a.Path(), b.Path()) })
+	return diff
+}
+
+// ValidateVariables returns an error with the detailed differences (see DiffVariables) if the variables in ctx
+// don't match exactly those the model requests for config.
+//
+// It is meant to be called right after loading the weights: missing variables would otherwise be silently
+// initialized with zeros, and mis-shaped variables would only fail when building the model graph.
+func ValidateVariables(ctx *context.Context, config *Config) error {
+	diff := DiffVariables(ctx, config)
+	if diff.Empty() {
+		return nil
+	}
+	return errors.Errorf("variables in scope %q don't match the model %s: %s", ctx.Scope(), config.Type, diff)
+}
+
+// ValidateModel is like ValidateVariables, but for the config inferred from the variables themselves, see
+// NewConfigFromContext. It is used by the loaders of the weights to validate the model loaded.
+func ValidateModel(ctx *context.Context) error {
+	config, err := NewConfigFromContext(ctx)
+	if err != nil {
+		return errors.WithMessage(err, "failed to validate the model variables")
+	}
+	return ValidateVariables(ctx, config)
+}
+
+// ListModelVariables lists the weights variables in ctx (the scope has to be set directly to the model variables,
+// see NewConfigFromContext), sorted by path. The variables of quantized weights (see QuantizeWeightsInt8 and
+// QuantizeWeightsQ4) are merged into the weights they quantize, so their shapes are not set: see DequantizeWeights
+// to read their values.
+//
+// It is used to export the model: it returns an error if there are LoRA adapters, they must be merged first with
+// MergeLoRA.
+func ListModelVariables(ctx *context.Context) ([]ModelVariable, error) {
+	var variables []ModelVariable
+	found := make(map[string]bool)
+	for v := range ctx.IterVariablesInScope() {
+		if IsLoRAVariable(v) {
+			return nil, errors.Errorf("variable %q in scope %q is a LoRA adapter weight, merge the adapters with "+
+				"transformers.MergeLoRA first", v.Name(), v.Scope())
+		}
+		modelVar := ModelVariable{Scope: relativeScope(ctx, v), Name: v.Name(), Shape: v.Shape()}
+		if baseName, _ := QuantizedVariableBaseName(modelVar.Name); baseName != "" {
+			modelVar.Name, modelVar.Shape = baseName, shapes.Shape{}
+		}
+		if path := modelVar.Path(); !found[path] {
+			found[path] = true
+			variables = append(variables, modelVar)
+		}
+	}
+	slices.SortFunc(variables, func(a, b ModelVariable) int { return strings.Compare(a.Path(), b.Path()) })
+	return variables, nil
+}
+
+// relativeScope returns the scope of the variable v relative to the scope of ctx, split in its parts.
+func relativeScope(ctx *context.Context, v *context.Variable) []string {
+	baseScope := ctx.Scope()
+	if !strings.HasSuffix(baseScope, context.ScopeSeparator) {
+		baseScope += context.ScopeSeparator
+	}
+	scope := strings.TrimPrefix(v.Scope()+context.ScopeSeparator, baseScope)
+	parts := strings.Split(strings.TrimSuffix(scope, context.ScopeSeparator), context.ScopeSeparator)
+	if parts[0] == "" {
+		return nil
+	}
+	return parts
+}
+
+// scopeIn returns the absolute scope of the relative scope in ctx.
+func scopeIn(ctx *context.Context, scope []string) string {
+	for _, p := range scope {
+		ctx = ctx.In(p)
+	}
+	return ctx.Scope()
+}
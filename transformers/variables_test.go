@@ -0,0 +1,177 @@
+package transformers
+
+import (
+	"github.com/gomlx/gomlx/ml/context"
+	"github.com/gomlx/gomlx/types/shapes"
+	"github.com/gomlx/gomlx/types/tensors"
+	"github.com/gomlx/gomlx/types/xslices"
+	"github.com/gomlx/gopjrt/dtypes"
+	"github.com/gomlx/gopjrt/dtypes/bfloat16"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+// tinyConfig returns the config of a tiny model, with 2 layers.
+func tinyConfig(huggingFaceVersion bool) *Config {
+	return &Config{
+		DType: dtypes.BFloat16, NumLayers: 2, VocabularySize: 5, EmbedDim: 4, HiddenDim: 6,
+		NumHeads: 2, NumKVHeads: 1, HeadDim: 2, UsePostAttentionNorm: true, UsePostFFWNorm: true,
+		HuggingFaceVersion: huggingFaceVersion,
+	}
+}
+
+// tinyModelConfig returns the config of a tiny model that can be executed: like tinyConfig, but with grouped query
+// attention, and with a local sliding window attention layer (of 2 tokens) followed by a global attention layer,
+// as in Gemma2.
+func tinyModelConfig() *Config {
+	config := tinyConfig(false)
+	config.NumHeads, config.NumKVHeads, config.UseGroupQueryAttention = 4, 2, true
+	config.AttentionTypes = []AttentionType{AttentionTypeLocalSliding, AttentionTypeGlobal}
+	config.SlidingWindowSize = 2
+	config.AttentionLogitsSoftCap = 50
+	config.FinalLogitSoftCap = 1 // Small, so it changes the logits significantly.
+	config.MaxCacheLength, config.MaxSequenceLength = 8, 8
+	return config
+}
+
+// newTinyModel returns a context (set to reuse the variables) with the weights of the model described by config,
+// set to deterministic pseudo-random values.
+func newTinyModel(config *Config) *context.Context {
+	ctx := context.New().In("model")
+	seed := 0
+	for _, v := range ExpectedVariables(config) {
+		scopedCtx := ctx
+		for _, p := range v.Scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		value := tensors.FromShape(v.Shape)
+		tensors.MutableFlatData(value, func(flat []bfloat16.BFloat16) {
+			for ii := range flat {
+				flat[ii] = bfloat16.FromFloat32(float32(math.Sin(float64(seed))))
+				seed++
+			}
+		})
+		scopedCtx.VariableWithValue(v.Name, value)
+	}
+	return ctx.Reuse()
+}
+
+func TestExpectedVariables(t *testing.T) {
+	var paths []string
+	for _, v := range ExpectedVariables(tinyConfig(true)) {
+		if v.Scope[0] != "layer_1" {
+			paths = append(paths, v.String())
+		}
+	}
+	require.Equal(t, []string{
+		"embedder/input_embedding (BFloat16)[5 4]",
+		"layer_0/pre_attention_norm/scale (BFloat16)[4]",
+		"layer_0/attn/hf/k_proj (BFloat16)[2 4]",
+		"layer_0/attn/hf/v_proj (BFloat16)[2 4]",
+		"layer_0/attn/hf/q_proj (BFloat16)[4 4]",
+		"layer_0/attn/hf/o_proj (BFloat16)[4 4]",
+		"layer_0/post_attention_norm/scale (BFloat16)[4]",
+		"layer_0/pre_ffw_norm/scale (BFloat16)[4]",
+		"layer_0/mlp/hf/gating_proj (BFloat16)[6 4]",
+		"layer_0/mlp/hf/up_proj (BFloat16)[6 4]",
+		"layer_0/mlp/hf/down_proj (BFloat16)[4 6]",
+		"layer_0/post_ffw_norm/scale (BFloat16)[4]",
+		"final_norm/scale (BFloat16)[4]",
+	}, paths)
+
+	config := tinyConfig(false)
+	config.UsePostAttentionNorm = false
+	expected := ExpectedVariables(config)
+	require.Len(t, expected, 1+2*8+1)
+	require.Equal(t, "layer_0/attn/kv_einsum/w (BFloat16)[2 1 4 2]", expected[3].String())
+}
+
+func TestDiffVariables(t *testing.T) {
+	for _, huggingFaceVersion := range []bool{false, true} {
+		config := tinyConfig(huggingFaceVersion)
+		ctx := context.New().In("model")
+		for _, v := range ExpectedVariables(config) {
+			scopedCtx := ctx
+			for _, p := range v.Scope {
+				scopedCtx = scopedCtx.In(p)
+			}
+			scopedCtx.VariableWithValue(v.Name, tensors.FromShape(v.Shape))
+		}
+		require.NoError(t, ValidateVariables(ctx, config))
+
+		// Quantized weights are accepted.
+		require.NoError(t, QuantizeWeightsInt8(ctx, config))
+		require.NoError(t, ValidateVariables(ctx, config))
+	}
+
+	config := tinyConfig(true)
+	ctx := context.New().In("model")
+	for _, v := range ExpectedVariables(config) {
+		scopedCtx := ctx
+		for _, p := range v.Scope {
+			scopedCtx = scopedCtx.In(p)
+		}
+		scopedCtx.VariableWithValue(v.Name, tensors.FromShape(v.Shape))
+	}
+	require.NoError(t, QuantizeWeightsQ4(ctx, config, 2, true))
+	require.NoError(t, ValidateVariables(ctx, config))
+
+	// Missing, unexpected and mis-shaped variables.
+	layerCtx := ctx.In("layer_1")
+	layerCtx.In("post_ffw_norm").DeleteVariable(layerCtx.In("post_ffw_norm").Scope(), "scale")
+	layerCtx.In("mlp").In("hf").DeleteVariable(layerCtx.In("mlp").In("hf").Scope(), "up_proj_q4_scale")
+	ctx.In("lm_head").VariableWithValue("weight", []float32{1})
+	ctx.In("final_norm").DeleteVariable(ctx.In("final_norm").Scope(), "scale")
+	ctx.In("final_norm").VariableWithValue("scale", tensors.FromShape(shapes.Make(dtypes.BFloat16, 3)))
+	layerCtx.In("attn").In(LoRAScope).In("q_proj").VariableWithValue("a", [][]float32{{1}})
+	diff := DiffVariables(ctx, config)
+	require.Equal(t, []string{"layer_1/mlp/hf/up_proj_q4_scale", "layer_1/post_ffw_norm/scale"},
+		[]string{diff.Missing[0].Path(), diff.Missing[1].Path()})
+	require.Len(t, diff.Missing, 2)
+	require.Len(t, diff.Unexpected, 2)
+	require.Equal(t, "layer_1/attn/lora/q_proj/a", diff.Unexpected[0].Path())
+	require.Equal(t, "lm_head/weight", diff.Unexpected[1].Path())
+	require.Len(t, diff.MisShaped, 1)
+	require.Equal(t, "final_norm/scale (BFloat16)[4]: found (BFloat16)[3]", diff.MisShaped[0].String())
+	err := ValidateVariables(ctx, config)
+	require.ErrorContains(t, err, "2 missing, 2 unexpected and 1 mis-shaped variables")
+	require.ErrorContains(t, err, "\n  missing: layer_1/post_ffw_norm/scale (BFloat16)[4]")
+
+	// LoRA adapters are accepted if configured.
+	config.LoRA = &LoRAConfig{}
+	require.Len(t, DiffVariables(ctx, config).Unexpected, 1)
+}
+
+func TestValidateModel(t *testing.T) {
+	require.ErrorContains(t, ValidateModel(context.New()), "embedding table")
+
+	// Variables of Gemma2-2B with the wrong shapes.
+	ctx := context.New().In("model")
+	ctx.In("embedder").VariableWithValue("input_embedding", tensors.FromShape(shapes.Make(dtypes.BFloat16, 3, 2)))
+	for layerIdx := range 26 {
+		ctx.Inf("layer_%d", layerIdx).In("pre_attention_norm").VariableWithValue("scale",
+			tensors.FromShape(shapes.Make(dtypes.BFloat16, 2)))
+	}
+	require.ErrorContains(t, ValidateModel(ctx), "don't match the model gemma2_2b")
+}
+
+func TestListModelVariables(t *testing.T) {
+	ctx := context.New().In("model")
+	ctx.In("final_norm").VariableWithValue("scale", []float32{1, 2})
+	ctx.In("layer_0").In("attn").In("hf").VariableWithValue("q_proj"+int8WeightsSuffix, [][]int8{{1, 2}})
+	ctx.In("layer_0").In("attn").In("hf").VariableWithValue("q_proj"+int8ScaleSuffix, [][]float32{{1}})
+	ctx.In("embedder").VariableWithValue("input_embedding", [][]float32{{1, 2}})
+	variables, err := ListModelVariables(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"embedder/input_embedding (Float32)[1 2]",
+		"final_norm/scale (Float32)[2]",
+		"layer_0/attn/hf/q_proj", // Quantized: the shape is not set.
+	}, xslices.Map(variables, ModelVariable.String))
+
+	// LoRA adapters must be merged first.
+	ctx.In("layer_0").In("attn").In(LoRAScope).In("q_proj").VariableWithValue("a", [][]float32{{1}})
+	_, err = ListModelVariables(ctx)
+	require.ErrorContains(t, err, "MergeLoRA")
+}